@@ -0,0 +1,122 @@
+package admin
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestLoopback(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1:7373": true,
+		"127.0.0.2:7373": true,
+		"[::1]:7373":     true,
+		"localhost:7373": true,
+		":7373":          false,
+		"0.0.0.0:7373":   false,
+		"[::]:7373":      false,
+		"10.0.0.1:7373":  false,
+		"admin:7373":     false,
+		"127.0.0.1":      false,
+	}
+	for addr, want := range tests {
+		if got := Loopback(addr); got != want {
+			t.Fatalf("%s expected loopback %v, got %v", addr, want, got)
+		}
+	}
+}
+
+func newTestServer(t *testing.T, addr string, token string) (*Server, error) {
+	logger := zerolog.Nop()
+	s := NewServer(addr, mqtt.New(&mqtt.Options{Logger: &logger}), nil)
+	s.SetToken(token)
+	err := s.Start()
+	if err == nil {
+		t.Cleanup(s.Stop)
+	}
+	return s, err
+}
+
+func TestStartOpenAddr(t *testing.T) {
+	tests := []struct {
+		name  string
+		addr  string
+		token string
+		ok    bool
+	}{
+		{"loopback without token", "127.0.0.1:0", "", true},
+		{"every interface without token", ":0", "", false},
+		{"every interface with token", ":0", "secret", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newTestServer(t, tt.addr, tt.token); (err == nil) != tt.ok {
+				t.Fatalf("expected started %v, got %v", tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestToken(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	if _, err := newTestServer(t, addr, "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		code  codes.Code
+	}{
+		{"without token", "", codes.Unauthenticated},
+		{"wrong token", "wrong", codes.Unauthenticated},
+		// the bridge is not enabled, the rpc passes the authentication and fails in its handler
+		{"token", "secret", codes.FailedPrecondition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+			if tt.token != "" {
+				opts = append(opts, grpc.WithPerRPCCredentials(TokenCredentials(tt.token)))
+			}
+			conn, err := grpc.Dial(addr, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			c := NewAdminClient(conn)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if _, err := c.Members(ctx, &Empty{}); status.Code(err) != tt.code {
+				t.Fatalf("unary rpc expected %s, got %v", tt.code, err)
+			}
+			stream, err := c.Replay(ctx, &ReplayRequest{})
+			if err == nil {
+				_, err = stream.Recv()
+			}
+			if tt.code == codes.Unauthenticated && status.Code(err) != codes.Unauthenticated {
+				t.Fatalf("stream rpc expected %s, got %v", tt.code, err)
+			}
+			if tt.code != codes.Unauthenticated && (status.Code(err) == codes.Unauthenticated || err == io.EOF) {
+				t.Fatalf("stream rpc expected to pass the authentication, got %v", err)
+			}
+		})
+	}
+}
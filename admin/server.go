@@ -0,0 +1,456 @@
+package admin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/werbenhu/bridgemq"
+	"github.com/werbenhu/bridgemq/agent"
+	"github.com/werbenhu/bridgemq/discovery"
+	"github.com/werbenhu/bridgemq/replay"
+	"github.com/werbenhu/bridgemq/topics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	TapHookId = "admintap"
+
+	// subscriberQueueSize is the number of messages buffered for a slow subscriber before dropping
+	subscriberQueueSize = 256
+)
+
+var (
+	errBridgeDisabled = status.Error(codes.FailedPrecondition, "bridge mode is not enabled")
+	errReplayDisabled = status.Error(codes.FailedPrecondition, "replay log is not enabled")
+)
+
+// Reloader re-reads the configuration and applies the changes which can be applied live
+type Reloader interface {
+	// Reload returns the config keys applied, the config keys which need a restart to
+	// take effect and the config keys failed to apply with their errors
+	Reload() (applied []string, restart []string, failed []string, err error)
+}
+
+// Server is a grpc server which allows the cli to operate a running agent
+type Server struct {
+	UnimplementedAdminServer
+
+	addr     string
+	broker   *mqtt.Server
+	bridge   *bridgemq.Bridge
+	server   *grpc.Server
+	reloader Reloader
+	replay   *replay.Log
+
+	// token is checked against the bearer token of every rpc, the rpcs are not authenticated if it is empty
+	token string
+
+	subscribers sync.Map
+}
+
+type subscriber struct {
+	filter string
+	msgs   chan *Message
+}
+
+// NewServer creates an admin server listening on addr,
+// bridge can be nil if the broker is not running in bridge mode
+func NewServer(addr string, broker *mqtt.Server, bridge *bridgemq.Bridge) *Server {
+	return &Server{
+		addr:   addr,
+		broker: broker,
+		bridge: bridge,
+	}
+}
+
+// SetReloader sets the reloader used by the Reload rpc
+func (s *Server) SetReloader(r Reloader) {
+	s.reloader = r
+}
+
+// SetReplay sets the log read by the Replay rpc
+func (s *Server) SetReplay(log *replay.Log) {
+	s.replay = log
+}
+
+// SetToken sets the token the clients send with TokenCredentials, a server without token
+// only listens on a loopback address
+func (s *Server) SetToken(token string) {
+	s.token = token
+}
+
+// Start binds the admin listener and serves it in the background, it fails if the listener is
+// not bound to a loopback address and the server has no token
+func (s *Server) Start() error {
+	if s.token == "" && !Loopback(s.addr) {
+		return fmt.Errorf("admin rpc addr %s is not a loopback address, a token is required", s.addr)
+	}
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	if err = s.broker.AddHook(&tapHook{server: s}, nil); err != nil {
+		listener.Close()
+		return err
+	}
+
+	s.server = grpc.NewServer(grpc.UnaryInterceptor(s.unaryAuth), grpc.StreamInterceptor(s.streamAuth))
+	RegisterAdminServer(s.server, s)
+	go func() {
+		if err := s.server.Serve(listener); err != nil {
+			s.broker.Log.Error().Err(err).Str("addr", s.addr).Msg("admin server serve failed")
+		}
+	}()
+	s.broker.Log.Info().Str("addr", s.addr).Msg("admin server started")
+	return nil
+}
+
+func (s *Server) Stop() {
+	if s.server != nil {
+		s.server.Stop()
+	}
+}
+
+// Members returns all the agents known by the cluster
+func (s *Server) Members(ctx context.Context, req *Empty) (*MembersResponse, error) {
+	if s.bridge == nil {
+		return nil, errBridgeDisabled
+	}
+	agents, err := s.bridge.Members()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &MembersResponse{}
+	states := s.bridge.PeerStates()
+	for _, a := range agents {
+		m := &Member{
+			Name:   a.Id,
+			Addr:   a.Addr,
+			Port:   int32(a.Port),
+			Status: a.Status,
+			Tags:   a.Tags,
+			Pipe:   string(states[a.Id]),
+		}
+		if rtt, ok := s.bridge.RTT(a.Id); ok && a.Status == agent.StatusAlive {
+			m.Rtt = rtt.Microseconds()
+		}
+		resp.Members = append(resp.Members, m)
+	}
+	return resp, nil
+}
+
+// Join joins the cluster by contacting the given agent addresses
+func (s *Server) Join(ctx context.Context, req *JoinRequest) (*JoinResponse, error) {
+	if s.bridge == nil {
+		return nil, errBridgeDisabled
+	}
+	n, err := s.bridge.Join(req.Addrs)
+	if err != nil {
+		return nil, err
+	}
+	return &JoinResponse{Joined: int32(n)}, nil
+}
+
+// Leave gracefully leaves the cluster
+func (s *Server) Leave(ctx context.Context, req *Empty) (*Empty, error) {
+	if s.bridge == nil {
+		return nil, errBridgeDisabled
+	}
+	return &Empty{}, s.bridge.Leave()
+}
+
+// ForceLeave forces a failed agent to transition into the left state
+func (s *Server) ForceLeave(ctx context.Context, req *ForceLeaveRequest) (*Empty, error) {
+	if s.bridge == nil {
+		return nil, errBridgeDisabled
+	}
+	return &Empty{}, s.bridge.ForceLeave(req.Name)
+}
+
+// Clients returns the clients connected to the cluster or to the given node
+func (s *Server) Clients(ctx context.Context, req *ClientsRequest) (*ClientsResponse, error) {
+	resp := &ClientsResponse{}
+	if s.bridge == nil {
+		for _, cl := range s.broker.Clients.GetAll() {
+			if cl.Net.Inline || cl.Closed() {
+				continue
+			}
+			resp.Clients = append(resp.Clients, &Client{
+				Id:              cl.ID,
+				Remote:          cl.Net.Remote,
+				Listener:        cl.Net.Listener,
+				Username:        string(cl.Properties.Username),
+				ProtocolVersion: int32(cl.Properties.ProtocolVersion),
+			})
+		}
+		return resp, nil
+	}
+
+	for _, cl := range s.bridge.Clients(req.Node) {
+		resp.Clients = append(resp.Clients, &Client{
+			Id:              cl.Id,
+			Node:            cl.Agent,
+			Remote:          cl.Remote,
+			Listener:        cl.Listener,
+			Username:        cl.Username,
+			ProtocolVersion: int32(cl.ProtocolVersion),
+		})
+	}
+	return resp, nil
+}
+
+// Kick disconnects a client connected to this agent
+func (s *Server) Kick(ctx context.Context, req *KickRequest) (*Empty, error) {
+	if s.bridge != nil {
+		return &Empty{}, s.bridge.Kick(req.ClientId)
+	}
+
+	cl, ok := s.broker.Clients.Get(req.ClientId)
+	if !ok || cl.Closed() {
+		return nil, bridgemq.ErrClientNotFound
+	}
+	s.broker.DisconnectClient(cl, packets.ErrAdministrativeAction)
+	return &Empty{}, nil
+}
+
+// Publish publishes a message to the broker, it will be bridged to the other agents in bridge mode
+func (s *Server) Publish(ctx context.Context, req *PublishRequest) (*Empty, error) {
+	if req.Qos < 0 || req.Qos > 2 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid qos:%d", req.Qos)
+	}
+	return &Empty{}, s.broker.Publish(req.Topic, req.Payload, req.Retain, byte(req.Qos))
+}
+
+// Subscribe streams the messages matching the filter until the caller cancels
+func (s *Server) Subscribe(req *SubscribeRequest, stream Admin_SubscribeServer) error {
+	if !mqtt.IsValidFilter(req.Filter, false) {
+		return status.Errorf(codes.InvalidArgument, "invalid filter:%s", req.Filter)
+	}
+
+	sub := &subscriber{
+		filter: req.Filter,
+		msgs:   make(chan *Message, subscriberQueueSize),
+	}
+	s.subscribers.Store(sub, struct{}{})
+	defer s.subscribers.Delete(sub)
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case msg := <-sub.msgs:
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// InstallKey installs a new gossip encryption key on all the agents
+func (s *Server) InstallKey(ctx context.Context, req *KeyRequest) (*Empty, error) {
+	keyring, err := s.keyring()
+	if err != nil {
+		return nil, err
+	}
+	return &Empty{}, keyring.InstallKey(req.Key)
+}
+
+// UseKey changes the primary gossip encryption key on all the agents
+func (s *Server) UseKey(ctx context.Context, req *KeyRequest) (*Empty, error) {
+	keyring, err := s.keyring()
+	if err != nil {
+		return nil, err
+	}
+	return &Empty{}, keyring.UseKey(req.Key)
+}
+
+// RemoveKey removes a gossip encryption key from all the agents
+func (s *Server) RemoveKey(ctx context.Context, req *KeyRequest) (*Empty, error) {
+	keyring, err := s.keyring()
+	if err != nil {
+		return nil, err
+	}
+	return &Empty{}, keyring.RemoveKey(req.Key)
+}
+
+// ListKeys returns the installed gossip encryption keys
+func (s *Server) ListKeys(ctx context.Context, req *Empty) (*KeysResponse, error) {
+	keyring, err := s.keyring()
+	if err != nil {
+		return nil, err
+	}
+	keys, num, err := keyring.ListKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &KeysResponse{
+		Keys:     make(map[string]int32),
+		NumNodes: int32(num),
+	}
+	for k, v := range keys {
+		resp.Keys[k] = int32(v)
+	}
+	return resp, nil
+}
+
+// Version returns the version and the agent name of the server
+func (s *Server) Version(ctx context.Context, req *Empty) (*VersionResponse, error) {
+	resp := &VersionResponse{Version: bridgemq.Version}
+	if s.bridge != nil {
+		if local := s.bridge.LocalAgent(); local != nil {
+			resp.Agent = local.Id
+		}
+	}
+	return resp, nil
+}
+
+// Reload re-reads the configuration and applies the changes which can be applied live
+func (s *Server) Reload(ctx context.Context, req *Empty) (*ReloadResponse, error) {
+	if s.reloader == nil {
+		return nil, status.Error(codes.Unimplemented, "reload is not supported by this agent")
+	}
+	applied, restart, failed, err := s.reloader.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return &ReloadResponse{
+		Applied:         applied,
+		RestartRequired: restart,
+		Failed:          failed,
+	}, nil
+}
+
+// Drain moves the clients to the other agents and leaves the cluster, the clients
+// left are disconnected at once after the timeout of the request
+func (s *Server) Drain(ctx context.Context, req *DrainRequest) (*Empty, error) {
+	if s.bridge == nil {
+		return nil, errBridgeDisabled
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(req.Timeout)*time.Millisecond)
+	defer cancel()
+	return &Empty{}, s.bridge.Drain(ctx)
+}
+
+// RateLimits returns the rate limits of the pipe with their counters
+func (s *Server) RateLimits(ctx context.Context, req *Empty) (*RateLimitsResponse, error) {
+	if s.bridge == nil {
+		return nil, errBridgeDisabled
+	}
+	resp := &RateLimitsResponse{}
+	for _, st := range s.bridge.RateLimitStats() {
+		resp.Limits = append(resp.Limits, &RateLimit{
+			Direction: st.Limit.Direction,
+			Agent:     st.Limit.Agent,
+			Filter:    st.Limit.Filter,
+			Messages:  st.Limit.Messages,
+			Bytes:     st.Limit.Bytes,
+			Action:    st.Limit.Action,
+			Passed:    st.Passed,
+			Delayed:   st.Delayed,
+			Dropped:   st.Dropped,
+		})
+	}
+	return resp, nil
+}
+
+// Replay streams the messages of the replay log matching the filter in the order they were published
+func (s *Server) Replay(req *ReplayRequest, stream Admin_ReplayServer) error {
+	if s.replay == nil {
+		return errReplayDisabled
+	}
+	if !mqtt.IsValidFilter(req.Filter, false) {
+		return status.Errorf(codes.InvalidArgument, "invalid filter:%s", req.Filter)
+	}
+
+	q := &replay.Query{
+		Filter: req.Filter,
+		Limit:  int(req.Limit),
+	}
+	if req.Since > 0 {
+		q.Since = time.UnixMilli(req.Since)
+	}
+	if req.Until > 0 {
+		q.Until = time.UnixMilli(req.Until)
+	}
+
+	var err error
+	rerr := s.replay.Read(q, func(r *replay.Record) bool {
+		if stream.Context().Err() != nil {
+			return false
+		}
+		err = stream.Send(&Message{
+			Topic:    r.Topic,
+			Payload:  r.Payload,
+			Qos:      int32(r.Qos),
+			Retain:   r.Retain,
+			ClientId: r.ClientId,
+			Time:     r.Time.UnixMilli(),
+		})
+		return err == nil
+	})
+	if rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (s *Server) keyring() (discovery.Keyring, error) {
+	if s.bridge == nil {
+		return nil, errBridgeDisabled
+	}
+	return s.bridge.Keyring()
+}
+
+// dispatch delivers a published message to the matching subscribers, the message is
+// dropped for a subscriber whose queue is full so a slow cli never blocks the broker
+func (s *Server) dispatch(cl *mqtt.Client, pk packets.Packet) {
+	var msg *Message
+	s.subscribers.Range(func(key any, val any) bool {
+		sub := key.(*subscriber)
+		if !topics.Match(sub.filter, pk.TopicName) {
+			return true
+		}
+		if msg == nil {
+			msg = &Message{
+				Topic:    pk.TopicName,
+				Payload:  pk.Payload,
+				Qos:      int32(pk.FixedHeader.Qos),
+				Retain:   pk.FixedHeader.Retain,
+				ClientId: cl.ID,
+			}
+		}
+		select {
+		case sub.msgs <- msg:
+		default:
+		}
+		return true
+	})
+}
+
+// tapHook feeds the messages published to the broker to the admin subscribers
+type tapHook struct {
+	mqtt.HookBase
+	server *Server
+}
+
+func (h *tapHook) ID() string {
+	return TapHookId
+}
+
+func (h *tapHook) Provides(b byte) bool {
+	return b == mqtt.OnPublished
+}
+
+func (h *tapHook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	h.server.dispatch(cl, pk)
+}
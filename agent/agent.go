@@ -1,10 +1,19 @@
 package agent
 
+const (
+	StatusAlive   = "alive"
+	StatusLeaving = "leaving"
+	StatusLeft    = "left"
+	StatusFailed  = "failed"
+)
+
 type Agent struct {
 	Id       string
 	Addr     string
 	Port     uint16
 	PipePort string
+	Status   string
+	Tags     map[string]string
 }
 
 func New(id string, addr string, port uint16, pipePort string) *Agent {
@@ -13,6 +22,8 @@ func New(id string, addr string, port uint16, pipePort string) *Agent {
 		Addr:     addr,
 		Port:     port,
 		PipePort: pipePort,
+		Status:   StatusAlive,
+		Tags:     make(map[string]string),
 	}
 }
 
@@ -1,70 +1,436 @@
 package bridgemq
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/rs/zerolog"
 	"github.com/werbenhu/bridgemq/agent"
 	"github.com/werbenhu/bridgemq/discovery"
 	"github.com/werbenhu/bridgemq/transport"
+	"github.com/werbenhu/bridgemq/webhook"
 )
 
 type Bridge struct {
 	option    *Option
 	discovery discovery.Discovery
 	transport transport.Transport
+
+	// clients records the clients connected to the remote agents, client id => agent id
+	clients sync.Map
+
+	// rules are the forwarding rules, they can be replaced at runtime by SetRules
+	rules atomic.Value
+
+	// policies are the agent policies by agent name, they can be replaced at runtime by SetAgentPolicies
+	policies atomic.Value
+
+	// limiter applies the rate limits, it is replaced at runtime by SetRateLimits
+	limiter atomic.Pointer[limiter]
+
+	// delays are the queues of the publishes delayed by the inbound rate limits by agent id
+	delays sync.Map
+
+	// priorities are the priority rules, they can be replaced at runtime by SetPriorities
+	priorities atomic.Value
+
+	// interceptors is the interceptor chain, it is replaced under interceptLock when an interceptor is added or removed
+	interceptors  atomic.Pointer[chain]
+	interceptLock sync.Mutex
+
+	// webhook sends the events to the webhook endpoints, it is nil if there is no endpoint
+	webhook *webhook.Sink
+
+	// logger carries the local agent name in the agent field
+	logger *zerolog.Logger
+
+	// draining is set once Drain is called
+	draining atomic.Bool
+
+	// picks counts the peers selected in turn by SelectPeer
+	picks atomic.Uint64
+
+	// sys counts the publishes bridged and keeps the stats of the remote agents for the cluster $SYS topics
+	sys sysStats
+
+	// handlers handle the user events and the queries sent through the gossip
+	handlers handlers
+
+	// joined is set once another agent is seen, the agent is not ready before when seeds are configured
+	joined atomic.Bool
+
+	started  atomic.Bool
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// ClientInfo describes a client connected to the local broker or to a remote agent
+type ClientInfo struct {
+	Id              string
+	Agent           string
+	Remote          string
+	Listener        string
+	Username        string
+	ProtocolVersion byte
 }
 
 func NewBridge(opt *Option) *Bridge {
-	b := &Bridge{option: opt}
-
-	b.discovery = discovery.NewSerf(&discovery.Opt{
-		Addr:      b.option.Addr,
-		Advertise: b.option.Advertise,
-		Name:      b.option.Name,
-		Members:   b.option.Agents,
-		PipePort:  b.option.PipePort,
-	})
-	b.transport = transport.NewRpcTransport(&transport.Opt{
-		Port: b.option.PipePort,
-	})
+	b := &Bridge{
+		option: opt,
+		done:   make(chan struct{}),
+		handlers: handlers{
+			events:  make(map[string]EventHandler),
+			queries: make(map[string]QueryHandler),
+		},
+	}
+	b.rules.Store(opt.Rules)
+	b.SetAgentPolicies(opt.AgentPolicies)
+	b.SetRateLimits(opt.RateLimits, opt.RateLimitMaxDelay)
+	b.SetPriorities(opt.Priorities)
+	b.interceptors.Store(newChain(nil))
+	b.HandleQuery(QueryOwner, b.answerOwner)
+
+	logger := opt.Logger
+	if logger == nil && opt.Broker != nil {
+		logger = opt.Broker.Log
+	}
+	if logger == nil {
+		l := zerolog.New(os.Stderr).With().Timestamp().Logger()
+		logger = &l
+	}
+	agentLogger := logger.With().Str("agent", opt.Name).Logger()
+	b.logger = &agentLogger
+
+	host, _, _ := net.SplitHostPort(b.option.Advertise)
+	switch opt.Discovery {
+	case DiscoveryStatic:
+		b.discovery = discovery.NewStatic(&discovery.StaticOpt{
+			Name:          b.option.Name,
+			Addr:          host,
+			PipePort:      b.option.PipePort,
+			Endpoint:      b.option.Endpoint,
+			Zone:          b.option.Zone,
+			Agents:        b.option.StaticAgents,
+			File:          b.option.StaticFile,
+			CheckInterval: b.option.StaticCheckInterval,
+			TLS:           b.option.PipeTLS,
+			Logger:        b.logger,
+		})
+	case DiscoveryKV:
+		b.discovery = discovery.NewKV(&discovery.KVOpt{
+			Store:    b.option.KVStore,
+			Prefix:   b.option.KVPrefix,
+			TTL:      b.option.KVTTL,
+			Name:     b.option.Name,
+			Addr:     host,
+			PipePort: b.option.PipePort,
+			Endpoint: b.option.Endpoint,
+			Zone:     b.option.Zone,
+			Logger:   b.logger,
+		})
+	default:
+		b.discovery = discovery.NewSerf(&discovery.Opt{
+			Addr:      b.option.Addr,
+			Advertise: b.option.Advertise,
+			Name:      b.option.Name,
+			Members:   b.option.Agents,
+			PipePort:  b.option.PipePort,
+			Endpoint:  b.option.Endpoint,
+			Zone:      b.option.Zone,
+
+			EncryptKey:   b.option.EncryptKey,
+			Logger:       b.logger,
+			SerfLogLevel: b.option.SerfLogLevel,
+			SerfLogFile:  b.option.SerfLogFile,
+
+			JoinRetries:    b.option.JoinRetries,
+			JoinBackoff:    b.option.JoinBackoff,
+			JoinMaxBackoff: b.option.JoinMaxBackoff,
+			ExpectedSize:   b.option.ExpectedSize,
+			RejoinInterval: b.option.RejoinInterval,
+			SnapshotPath:   b.option.SnapshotPath,
+			Resolver:       b.option.Resolver,
+		})
+	}
+	switch opt.Transport {
+	case TransportTcp:
+		b.transport = transport.NewTcpTransport(&transport.TcpOpt{
+			Port:           b.option.PipePort,
+			Name:           b.option.Name,
+			TLS:            b.option.PipeTLS,
+			Token:          b.option.PipeToken,
+			KeepAlive:      b.option.PipeKeepAlive,
+			Backoff:        b.option.PipeBackoff,
+			MaxBackoff:     b.option.PipeMaxBackoff,
+			MaxMsgSize:     b.option.PipeMaxMsgSize,
+			MaxPayloadSize: b.option.PipeMaxPayloadSize,
+			ChunkSize:      b.option.PipeChunkSize,
+			ChunkTimeout:   b.option.PipeChunkTimeout,
+			Weights:        b.option.weights(),
+			Logger:         b.logger,
+		})
+	default:
+		b.transport = transport.NewRpcTransport(&transport.Opt{
+			Port:             b.option.PipePort,
+			Name:             b.option.Name,
+			TLS:              b.option.PipeTLS,
+			Token:            b.option.PipeToken,
+			Members:          b.isMember,
+			KeepAlive:        b.option.PipeKeepAlive,
+			KeepAliveTimeout: b.option.PipeKeepAliveTimeout,
+			Backoff:          b.option.PipeBackoff,
+			MaxBackoff:       b.option.PipeMaxBackoff,
+			BatchSize:        b.option.PipeBatchSize,
+			BatchBytes:       b.option.PipeBatchBytes,
+			BatchLinger:      b.option.PipeBatchLinger,
+			MaxMsgSize:       b.option.PipeMaxMsgSize,
+			MaxPayloadSize:   b.option.PipeMaxPayloadSize,
+			ChunkSize:        b.option.PipeChunkSize,
+			ChunkTimeout:     b.option.PipeChunkTimeout,
+			Weights:          b.option.weights(),
+			Logger:           b.logger,
+		})
+	}
 	b.transport.SetHandler(b)
 	b.discovery.SetHandler(b)
+
+	if opt.Webhook != nil && len(opt.Webhook.Endpoints) > 0 {
+		if opt.Webhook.Logger == nil {
+			opt.Webhook.Logger = b.logger
+		}
+		b.webhook = webhook.New(opt.Webhook)
+	}
 	return b
 }
 
-func (b *Bridge) Serve() error {
-	if b.option.Broker == nil {
-		return ErrInvalidBroker
+// Start validates the options, binds the pipe listener and the discovery listener and joins the
+// seeds, the bridge is stopped when ctx is done. Nothing is left running if it fails, the error is
+// an Err such as ErrInvalidAddr, ErrBind or ErrJoin wrapping the cause.
+func (b *Bridge) Start(ctx context.Context) error {
+	// the options are validated first so that a bridge with invalid options can be started once they are fixed
+	if err := b.option.Validate(); err != nil {
+		return err
+	}
+	if !b.started.CompareAndSwap(false, true) {
+		return ErrStarted
+	}
+
+	if b.webhook != nil {
+		if err := b.webhook.Start(); err != nil {
+			b.Stop()
+			return ErrInvalidOption.Wrap(err)
+		}
+	}
+
+	// the pipe is started first so that the other agents can push to this agent once it joins
+	if err := b.transport.Start(); err != nil {
+		b.Stop()
+		return ErrBind.Wrap(err)
+	}
+	if err := b.discovery.Start(); err != nil {
+		b.Stop()
+		switch {
+		case errors.Is(err, discovery.ErrInvalidAddr):
+			return ErrInvalidAddr.Wrap(err)
+		case errors.Is(err, discovery.ErrBind):
+			return ErrBind.Wrap(err)
+		case errors.Is(err, discovery.ErrJoin):
+			return ErrJoin.Wrap(err)
+		}
+		return err
 	}
-	b.discovery.Start()
-	b.transport.Start()
+	if b.sysEnabled() {
+		go b.publishSysLoop()
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.logger.Info().Msg("bridge context done, stopping")
+			b.Stop()
+		case <-b.done:
+		}
+	}()
 	return nil
 }
 
+// Serve starts the bridge until it is stopped.
+//
+// Deprecated: use Start, which can be stopped by its context.
+func (b *Bridge) Serve() error {
+	return b.Start(context.Background())
+}
+
+// Stop stops the transport and the discovery, it can be called more than once
 func (b *Bridge) Stop() error {
-	b.transport.Stop()
-	b.discovery.Stop()
+	b.stopOnce.Do(func() {
+		close(b.done)
+		b.transport.Stop()
+		b.discovery.Stop()
+		if b.webhook != nil {
+			b.webhook.Stop()
+		}
+	})
 	return nil
 }
 
 func (b *Bridge) LocalAgent() *agent.Agent {
 	if b.discovery != nil {
-		b.discovery.LocalAgent()
+		return b.discovery.LocalAgent()
 	}
 	return nil
 }
 
+// SetRules replaces the forwarding rules, it takes effect on the next published message
+func (b *Bridge) SetRules(rules []Rule) {
+	b.rules.Store(rules)
+}
+
+// Rules returns the current forwarding rules
+func (b *Bridge) Rules() []Rule {
+	return b.rules.Load().([]Rule)
+}
+
+// Members returns all the agents known by the discovery, including the failed and left ones
+func (b *Bridge) Members() ([]*agent.Agent, error) {
+	cluster, ok := b.discovery.(discovery.Cluster)
+	if !ok {
+		return b.discovery.Agents(), nil
+	}
+	return cluster.Members(), nil
+}
+
+// Join joins the cluster by contacting the given agent addresses
+func (b *Bridge) Join(addrs []string) (int, error) {
+	cluster, ok := b.discovery.(discovery.Cluster)
+	if !ok {
+		return 0, ErrNotSupported
+	}
+	n, err := cluster.Join(addrs)
+	if err != nil {
+		return n, ErrJoin.Wrap(err)
+	}
+	return n, nil
+}
+
+// Leave gracefully leaves the cluster
+func (b *Bridge) Leave() error {
+	cluster, ok := b.discovery.(discovery.Cluster)
+	if !ok {
+		return ErrNotSupported
+	}
+	return cluster.Leave()
+}
+
+// ForceLeave forces a failed agent to transition into the left state
+func (b *Bridge) ForceLeave(name string) error {
+	cluster, ok := b.discovery.(discovery.Cluster)
+	if !ok {
+		return ErrNotSupported
+	}
+	return cluster.ForceLeave(name)
+}
+
+// Keyring returns the gossip keyring of the discovery
+func (b *Bridge) Keyring() (discovery.Keyring, error) {
+	keyring, ok := b.discovery.(discovery.Keyring)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return keyring, nil
+}
+
+// Clients returns the clients connected to the cluster,
+// if agentId is not empty, only the clients connected to that agent are returned
+func (b *Bridge) Clients(agentId string) []ClientInfo {
+	clients := make([]ClientInfo, 0)
+	localId := b.option.Name
+	if agentId == "" || agentId == localId {
+		for _, cl := range b.option.Broker.Clients.GetAll() {
+			if cl.Net.Inline || cl.Closed() {
+				continue
+			}
+			clients = append(clients, ClientInfo{
+				Id:              cl.ID,
+				Agent:           localId,
+				Remote:          cl.Net.Remote,
+				Listener:        cl.Net.Listener,
+				Username:        string(cl.Properties.Username),
+				ProtocolVersion: cl.Properties.ProtocolVersion,
+			})
+		}
+	}
+
+	b.clients.Range(func(key any, val any) bool {
+		if agentId == "" || agentId == val.(string) {
+			clients = append(clients, ClientInfo{
+				Id:    key.(string),
+				Agent: val.(string),
+			})
+		}
+		return true
+	})
+	return clients
+}
+
+// Kick disconnects a client connected to the local broker
+func (b *Bridge) Kick(clientId string) error {
+	if cl, ok := b.option.Broker.Clients.Get(clientId); ok && !cl.Closed() {
+		b.option.Broker.DisconnectClient(cl, packets.ErrAdministrativeAction)
+		return nil
+	}
+	if id, ok := b.clients.Load(clientId); ok {
+		return ErrClientNotLocal.Wrap(fmt.Errorf("it is connected to agent:%s", id.(string)))
+	}
+	return ErrClientNotFound
+}
+
+// Publish publishes a message to the local broker, it will be bridged to the other agents
+func (b *Bridge) Publish(topic string, payload []byte, qos byte, retain bool) error {
+	return b.option.Broker.Publish(topic, payload, retain, qos)
+}
+
+// isMember reports whether an agent is a member of the cluster known by the discovery which has not left
+// or failed, the agents pushing to the pipe are checked against it when they are authenticated
+func (b *Bridge) isMember(id string) bool {
+	for _, a := range b.discovery.Agents() {
+		if a.Id == id {
+			return a.Status != agent.StatusLeft && a.Status != agent.StatusFailed
+		}
+	}
+	return false
+}
+
 func (b *Bridge) OnAgentJoin(a *agent.Agent) {
+	b.joined.Store(true)
 	if b.transport != nil {
 		b.transport.Join(a)
 	}
+	b.emit(&webhook.Event{Type: webhook.EventAgentJoined, Peer: a.Id, Addr: a.Addr})
 }
 
 func (b *Bridge) OnAgentLeave(a *agent.Agent) {
 	if b.transport != nil {
 		b.transport.Leave(a)
 	}
+	b.clients.Range(func(key any, val any) bool {
+		if val.(string) == a.Id {
+			b.clients.Delete(key)
+			b.publishPresence(key.(string), a.Id, false)
+		}
+		return true
+	})
+	b.limiter.Load().forget(a.Id)
+	b.delays.Delete(a.Id)
+	b.forgetNode(a.Id)
+	b.emit(&webhook.Event{Type: webhook.EventAgentLeft, Peer: a.Id, Addr: a.Addr})
 }
 
 func (b *Bridge) OnAgentUpdate(a *agent.Agent) {
@@ -87,34 +453,166 @@ func (b *Bridge) PushDisconnect(clientId string) {
 	}
 }
 
+// PushPublish transmit a publish to the remote agents with the priority of its topic
 func (b *Bridge) PushPublish(topic string, payload []byte, qos byte, retain bool) {
-	if b.transport != nil {
-		local := b.discovery.LocalAgent()
-		b.transport.PushPublish(local, topic, payload, qos, retain)
+	b.pushPublish(topic, payload, qos, retain, nil, b.priority(topic, nil))
+}
+
+// pushPublish transmit a publish and its user properties to the remote agents with the priority, through
+// the outbound interceptors run for every agent. The transports which do not route the publishes run the
+// interceptors once with an empty Target and push the publish to every agent without its properties.
+func (b *Bridge) pushPublish(topic string, payload []byte, qos byte, retain bool, properties []packets.UserProperty, priority transport.Priority) {
+	if b.transport == nil || !forwardable(b.Rules(), topic) {
+		return
+	}
+	local := b.discovery.LocalAgent()
+	interceptors := b.interceptors.Load().outbound
+	router, ok := b.transport.(transport.Router)
+	if !ok {
+		msg := &Message{Topic: topic, Payload: payload, Qos: qos, Retain: retain, Properties: properties, Origin: local.Id}
+		if !b.interceptOutbound(interceptors, msg) {
+			return
+		}
+		if t, ok := b.transport.(transport.Prioritizer); ok {
+			t.PushPublishPriority(local, msg.Topic, msg.Payload, msg.Qos, msg.Retain, priority)
+			return
+		}
+		b.transport.PushPublish(local, msg.Topic, msg.Payload, msg.Qos, msg.Retain)
+		return
+	}
+
+	if len(interceptors) == 0 {
+		router.PushPublishTo(local, "", &transport.Publish{
+			Topic:      topic,
+			Payload:    payload,
+			Qos:        int32(qos),
+			Retain:     retain,
+			Properties: toProperties(properties),
+		}, priority)
+		return
+	}
+	for _, a := range b.discovery.Agents() {
+		if local.IsSelf(a.Id) {
+			continue
+		}
+		msg := &Message{
+			Topic:      topic,
+			Payload:    payload,
+			Qos:        qos,
+			Retain:     retain,
+			Properties: append([]packets.UserProperty(nil), properties...),
+			Origin:     local.Id,
+			Target:     a.Id,
+		}
+		if !b.interceptOutbound(interceptors, msg) || local.IsSelf(msg.Target) {
+			continue
+		}
+		router.PushPublishTo(local, msg.Target, &transport.Publish{
+			Topic:      msg.Topic,
+			Payload:    msg.Payload,
+			Qos:        int32(msg.Qos),
+			Retain:     msg.Retain,
+			Properties: toProperties(msg.Properties),
+		}, priority)
 	}
 }
 
 func (b *Bridge) OnConnect(id string, clientId string) {
-	log.Printf("[INFO] client id:%s connected from bridge agent:%s \n", clientId, id)
+	if b.option.LogClients {
+		b.logger.Info().Str("peer", id).Str("client_id", clientId).Msg("client connected to remote agent")
+	}
+	b.clients.Store(clientId, id)
+	b.publishPresence(clientId, id, true)
 	if existing, ok := b.option.Broker.Clients.Get(clientId); ok {
+		if !b.AgentPolicy(id).mayTakeover() {
+			b.logger.Warn().Str("peer", id).Str("client_id", clientId).Msg("client takeover denied by the agent policy")
+			return
+		}
 		b.option.Broker.DisconnectClient(existing, packets.ErrSessionTakenOver)
 	}
 }
 
 func (b *Bridge) OnDisConnect(id string, clientId string) {
-	log.Printf("[INFO] client id:%s disconnected from bridge agent:%s \n", clientId, id)
+	if b.option.LogClients {
+		b.logger.Info().Str("peer", id).Str("client_id", clientId).Msg("client disconnected from remote agent")
+	}
+	if owner, ok := b.clients.Load(clientId); ok && owner.(string) == id {
+		b.clients.Delete(clientId)
+		b.publishPresence(clientId, id, false)
+	}
 }
 
 func (b *Bridge) OnPublish(id string, topic string, payload []byte, qos byte, retain bool) {
+	b.OnPublishMessage(id, &transport.Publish{AgentId: id, Topic: topic, Payload: payload, Qos: int32(qos), Retain: retain})
+}
+
+// OnPublishMessage publishes a message received from a remote agent to the local broker with its user
+// properties, once it passes the agent policy, the inbound rate limits and the inbound interceptors. A
+// publish delayed by the rate limits is published later without blocking the pipe of the agent. The
+// stats pushed by the agent for the cluster $SYS topics are kept instead.
+func (b *Bridge) OnPublishMessage(id string, p *transport.Publish) {
+	if isSysTopic(p.Topic) {
+		b.onNodeStats(id, p)
+		return
+	}
+	if !b.AgentPolicy(id).mayPublish(p.Topic) {
+		b.logger.Warn().Str("peer", id).Str("topic", p.Topic).Msg("publish denied by the agent policy")
+		return
+	}
+	delay, ok := b.limiter.Load().reserve(LimitIn, id, p.Topic, len(p.Topic)+len(p.Payload), byte(p.Qos))
+	if !ok {
+		return
+	}
+	b.delayInbound(id, delay, func() {
+		b.publishInbound(id, p)
+	})
+}
+
+// publishInbound publishes a message received from a remote agent to the local broker once it passes the inbound interceptors
+func (b *Bridge) publishInbound(id string, p *transport.Publish) {
+	msg := &Message{
+		Topic:      p.Topic,
+		Payload:    p.Payload,
+		Qos:        byte(p.Qos),
+		Retain:     p.Retain,
+		Properties: fromProperties(p.Properties),
+		Origin:     id,
+		Target:     b.option.Name,
+	}
+	if !b.interceptInbound(b.interceptors.Load().inbound, msg) {
+		return
+	}
+	b.countIn(id)
 	cl := b.option.Broker.NewClient(nil, "local", HookId, true)
 	b.option.Broker.InjectPacket(cl, packets.Packet{
 		FixedHeader: packets.FixedHeader{
 			Type:   packets.Publish,
-			Qos:    qos,
-			Retain: retain,
+			Qos:    msg.Qos,
+			Retain: msg.Retain,
+		},
+		TopicName: msg.Topic,
+		Payload:   msg.Payload,
+		Properties: packets.Properties{
+			User: msg.Properties,
 		},
-		TopicName: topic,
-		Payload:   payload,
-		PacketID:  uint16(qos),
+		PacketID: uint16(msg.Qos),
 	})
 }
+
+// emit sends an event of the local agent to the webhook endpoints which want it
+func (b *Bridge) emit(e *webhook.Event) {
+	if b.webhook == nil {
+		return
+	}
+	e.Agent = b.option.Name
+	e.Time = time.Now()
+	b.webhook.Emit(e)
+}
+
+// WebhookStats returns the counters of the webhook endpoints
+func (b *Bridge) WebhookStats() []webhook.Stats {
+	if b.webhook == nil {
+		return nil
+	}
+	return b.webhook.Stats()
+}
@@ -0,0 +1,26 @@
+package bridgemq
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestStartInvalidOption(t *testing.T) {
+	logger := zerolog.Nop()
+	opt := DefaultOption()
+	opt.Logger = &logger
+	b := NewBridge(opt)
+
+	// an invalid option does not mark the bridge started, the start fails again with the same error
+	for i := 0; i < 2; i++ {
+		if err := b.Start(context.Background()); !errors.Is(err, ErrInvalidBroker) {
+			t.Fatalf("start %d expected ErrInvalidBroker, got %v", i, err)
+		}
+	}
+	if b.started.Load() {
+		t.Fatal("expected the bridge not started")
+	}
+}
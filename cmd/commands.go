@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/werbenhu/bridgemq"
+	"github.com/werbenhu/bridgemq/admin"
+	"github.com/werbenhu/bridgemq/config"
+	"github.com/werbenhu/bridgemq/replay"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	defaultRpcAddr = "127.0.0.1:7373"
+	rpcTimeout     = 10 * time.Second
+)
+
+// command is a cli subcommand which operates a running agent through the admin rpc
+type command struct {
+	usage string
+	run   func(c admin.AdminClient, fs *flag.FlagSet, args []string) error
+	flags func(fs *flag.FlagSet)
+}
+
+var commands = map[string]*command{
+	"members": {
+		usage: "members                     list the agents of the cluster with their tags and status",
+		run:   runMembers,
+	},
+	"join": {
+		usage: "join <addr> [<addr>...]     join the cluster by contacting the given agents",
+		run:   runJoin,
+	},
+	"leave": {
+		usage: "leave                       gracefully leave the cluster",
+		run:   runLeave,
+	},
+	"force-leave": {
+		usage: "force-leave <name>          force a failed agent into the left state",
+		run:   runForceLeave,
+	},
+	"clients": {
+		usage: "clients [-node <name>]      list the clients connected to the cluster",
+		run:   runClients,
+		flags: func(fs *flag.FlagSet) {
+			fs.String("node", "", "only list the clients connected to this agent")
+		},
+	},
+	"kick": {
+		usage: "kick <client>               disconnect a client connected to the agent",
+		run:   runKick,
+	},
+	"pub": {
+		usage: "pub [-qos n] [-retain] <topic> <payload>   publish a message",
+		run:   runPub,
+		flags: func(fs *flag.FlagSet) {
+			fs.Int("qos", 0, "qos of the message")
+			fs.Bool("retain", false, "retain the message")
+		},
+	},
+	"sub": {
+		usage: "sub <filter>                print the messages matching the filter until interrupted",
+		run:   runSub,
+	},
+	"replay": {
+		usage: "replay [-since t] [-until t] [-limit n] <filter>   print the messages of the replay log matching the filter",
+		run:   runReplay,
+		flags: func(fs *flag.FlagSet) {
+			fs.String("since", "", "only print the messages published since a duration before now such as 1h, a unix time or an rfc3339 time")
+			fs.String("until", "", "only print the messages published until a duration before now, a unix time or an rfc3339 time")
+			fs.Int("limit", 0, "maximum number of messages printed, 0 prints them all")
+		},
+	},
+	"keys": {
+		usage: "keys install|use|remove <key> | keys list   manage the gossip encryption keys",
+		run:   runKeys,
+	},
+	"reload": {
+		usage: "reload                      re-read the config of the agent and apply the live changes",
+		run:   runReload,
+	},
+	"drain": {
+		usage: "drain [-timeout d]          move the clients to the other agents and leave the cluster",
+		run:   runDrain,
+		flags: func(fs *flag.FlagSet) {
+			fs.Duration("timeout", 30*time.Second, "the clients left are disconnected at once after this timeout")
+		},
+	},
+	"limits": {
+		usage: "limits                      list the rate limits of the pipe with the publishes passed, delayed and dropped",
+		run:   runLimits,
+	},
+	"version": {
+		usage: "version                     print the version of the cli and the agent",
+		run:   runVersion,
+	},
+}
+
+// isCommand reports whether the cli is invoked with a subcommand instead of starting a server
+func isCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	_, ok := commands[args[0]]
+	return ok
+}
+
+// runCommand runs the subcommand and returns the process exit code
+func runCommand(args []string) int {
+	cmd := commands[args[0]]
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	rpcAddr := fs.String("rpc-addr", defaultRpcAddr, "admin rpc address of the agent")
+	rpcToken := fs.String("rpc-token", os.Getenv(config.EnvName("admin.rpc_token")), "admin rpc token of the agent, it defaults to the "+config.EnvName("admin.rpc_token")+" environment variable")
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: bridgemq %s\n", cmd.usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	if args[0] == "version" {
+		fmt.Printf("cli version: %s\n", bridgemq.Version)
+	}
+
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	if *rpcToken != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(admin.TokenCredentials(*rpcToken)))
+	}
+	conn, err := grpc.Dial(*rpcAddr, opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "connect to agent rpc addr:%s failed, err:%s\n", *rpcAddr, err.Error())
+		return 1
+	}
+	defer conn.Close()
+
+	if err := cmd.run(admin.NewAdminClient(conn), fs, fs.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed, err:%s\n", args[0], err.Error())
+		return 1
+	}
+	return 0
+}
+
+func printCommands(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "Subcommands (operate a running agent through -rpc-addr, default %s):\n", defaultRpcAddr)
+	for _, name := range names {
+		fmt.Fprintf(w, "  bridgemq %s\n", commands[name].usage)
+	}
+}
+
+func timeout() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), rpcTimeout)
+}
+
+func expectArgs(args []string, n int, usage string) error {
+	if len(args) != n {
+		return fmt.Errorf("expected arguments: %s", usage)
+	}
+	return nil
+}
+
+func runMembers(c admin.AdminClient, fs *flag.FlagSet, args []string) error {
+	ctx, cancel := timeout()
+	defer cancel()
+	resp, err := c.Members(ctx, &admin.Empty{})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tADDRESS\tSTATUS\tPIPE\tRTT\tTAGS")
+	for _, m := range resp.Members {
+		tags := make([]string, 0, len(m.Tags))
+		for k, v := range m.Tags {
+			tags = append(tags, k+"="+v)
+		}
+		sort.Strings(tags)
+		rtt := ""
+		if m.Rtt > 0 {
+			rtt = (time.Duration(m.Rtt) * time.Microsecond).String()
+		}
+		fmt.Fprintf(w, "%s\t%s:%d\t%s\t%s\t%s\t%s\n", m.Name, m.Addr, m.Port, m.Status, m.Pipe, rtt, strings.Join(tags, ","))
+	}
+	return w.Flush()
+}
+
+func runJoin(c admin.AdminClient, fs *flag.FlagSet, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected arguments: <addr> [<addr>...]")
+	}
+	ctx, cancel := timeout()
+	defer cancel()
+	resp, err := c.Join(ctx, &admin.JoinRequest{Addrs: args})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("successfully joined cluster by contacting %d agents\n", resp.Joined)
+	return nil
+}
+
+func runLeave(c admin.AdminClient, fs *flag.FlagSet, args []string) error {
+	ctx, cancel := timeout()
+	defer cancel()
+	if _, err := c.Leave(ctx, &admin.Empty{}); err != nil {
+		return err
+	}
+	fmt.Println("graceful leave complete")
+	return nil
+}
+
+func runForceLeave(c admin.AdminClient, fs *flag.FlagSet, args []string) error {
+	if err := expectArgs(args, 1, "<name>"); err != nil {
+		return err
+	}
+	ctx, cancel := timeout()
+	defer cancel()
+	_, err := c.ForceLeave(ctx, &admin.ForceLeaveRequest{Name: args[0]})
+	return err
+}
+
+func runClients(c admin.AdminClient, fs *flag.FlagSet, args []string) error {
+	ctx, cancel := timeout()
+	defer cancel()
+	resp, err := c.Clients(ctx, &admin.ClientsRequest{Node: fs.Lookup("node").Value.String()})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CLIENT\tNODE\tREMOTE\tLISTENER\tUSERNAME\tPROTOCOL")
+	for _, cl := range resp.Clients {
+		protocol := ""
+		if cl.ProtocolVersion > 0 {
+			protocol = fmt.Sprintf("%d", cl.ProtocolVersion)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", cl.Id, cl.Node, cl.Remote, cl.Listener, cl.Username, protocol)
+	}
+	return w.Flush()
+}
+
+func runKick(c admin.AdminClient, fs *flag.FlagSet, args []string) error {
+	if err := expectArgs(args, 1, "<client>"); err != nil {
+		return err
+	}
+	ctx, cancel := timeout()
+	defer cancel()
+	_, err := c.Kick(ctx, &admin.KickRequest{ClientId: args[0]})
+	return err
+}
+
+func runPub(c admin.AdminClient, fs *flag.FlagSet, args []string) error {
+	if err := expectArgs(args, 2, "<topic> <payload>"); err != nil {
+		return err
+	}
+	qos := fs.Lookup("qos").Value.(flag.Getter).Get().(int)
+	retain := fs.Lookup("retain").Value.(flag.Getter).Get().(bool)
+
+	ctx, cancel := timeout()
+	defer cancel()
+	_, err := c.Publish(ctx, &admin.PublishRequest{
+		Topic:   args[0],
+		Payload: []byte(args[1]),
+		Qos:     int32(qos),
+		Retain:  retain,
+	})
+	return err
+}
+
+func runSub(c admin.AdminClient, fs *flag.FlagSet, args []string) error {
+	if err := expectArgs(args, 1, "<filter>"); err != nil {
+		return err
+	}
+	stream, err := c.Subscribe(context.Background(), &admin.SubscribeRequest{Filter: args[0]})
+	if err != nil {
+		return err
+	}
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s %s\n", msg.Topic, msg.Payload)
+	}
+}
+
+func runReplay(c admin.AdminClient, fs *flag.FlagSet, args []string) error {
+	if err := expectArgs(args, 1, "<filter>"); err != nil {
+		return err
+	}
+	req := &admin.ReplayRequest{
+		Filter: args[0],
+		Limit:  int32(fs.Lookup("limit").Value.(flag.Getter).Get().(int)),
+	}
+	now := time.Now()
+	for name, bound := range map[string]*int64{"since": &req.Since, "until": &req.Until} {
+		value := fs.Lookup(name).Value.String()
+		if value == "" {
+			continue
+		}
+		t, err := replay.ParseSince(value, now)
+		if err != nil {
+			return fmt.Errorf("-%s: %s", name, err.Error())
+		}
+		*bound = t.UnixMilli()
+	}
+
+	stream, err := c.Replay(context.Background(), req)
+	if err != nil {
+		return err
+	}
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s %s %s\n", time.UnixMilli(msg.Time).Format(time.RFC3339Nano), msg.Topic, msg.Payload)
+	}
+}
+
+func runKeys(c admin.AdminClient, fs *flag.FlagSet, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected arguments: install|use|remove <key> or list")
+	}
+
+	ctx, cancel := timeout()
+	defer cancel()
+	switch args[0] {
+	case "list":
+		resp, err := c.ListKeys(ctx, &admin.Empty{})
+		if err != nil {
+			return err
+		}
+		for key, n := range resp.Keys {
+			fmt.Printf("%s [%d/%d]\n", key, n, resp.NumNodes)
+		}
+		return nil
+	case "install", "use", "remove":
+		if err := expectArgs(args, 2, args[0]+" <key>"); err != nil {
+			return err
+		}
+		req := &admin.KeyRequest{Key: args[1]}
+		var err error
+		switch args[0] {
+		case "install":
+			_, err = c.InstallKey(ctx, req)
+		case "use":
+			_, err = c.UseKey(ctx, req)
+		case "remove":
+			_, err = c.RemoveKey(ctx, req)
+		}
+		return err
+	}
+	return fmt.Errorf("unknown keys subcommand:%s", args[0])
+}
+
+func runReload(c admin.AdminClient, fs *flag.FlagSet, args []string) error {
+	ctx, cancel := timeout()
+	defer cancel()
+	resp, err := c.Reload(ctx, &admin.Empty{})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("applied: %s\n", strings.Join(resp.Applied, ", "))
+	if len(resp.RestartRequired) > 0 {
+		fmt.Printf("restart required: %s\n", strings.Join(resp.RestartRequired, ", "))
+	}
+	if len(resp.Failed) > 0 {
+		fmt.Printf("failed: %s\n", strings.Join(resp.Failed, "; "))
+		return fmt.Errorf("%d config keys failed to apply", len(resp.Failed))
+	}
+	return nil
+}
+
+func runDrain(c admin.AdminClient, fs *flag.FlagSet, args []string) error {
+	drainTimeout := fs.Lookup("timeout").Value.(flag.Getter).Get().(time.Duration)
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout+rpcTimeout)
+	defer cancel()
+	if _, err := c.Drain(ctx, &admin.DrainRequest{Timeout: drainTimeout.Milliseconds()}); err != nil {
+		return err
+	}
+	fmt.Println("agent drained, it can be stopped now")
+	return nil
+}
+
+func runLimits(c admin.AdminClient, fs *flag.FlagSet, args []string) error {
+	ctx, cancel := timeout()
+	defer cancel()
+	resp, err := c.RateLimits(ctx, &admin.Empty{})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DIRECTION\tAGENT\tFILTER\tMESSAGES/S\tBYTES/S\tACTION\tPASSED\tDELAYED\tDROPPED")
+	for _, l := range resp.Limits {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%g\t%g\t%s\t%d\t%d\t%d\n", or(l.Direction, bridgemq.LimitBoth), l.Agent, l.Filter,
+			l.Messages, l.Bytes, or(l.Action, bridgemq.LimitDrop), l.Passed, l.Delayed, l.Dropped)
+	}
+	return w.Flush()
+}
+
+// or returns s, or def if s is empty
+func or(s string, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+func runVersion(c admin.AdminClient, fs *flag.FlagSet, args []string) error {
+	ctx, cancel := timeout()
+	defer cancel()
+	resp, err := c.Version(ctx, &admin.Empty{})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("agent version: %s\n", resp.Version)
+	if resp.Agent != "" {
+		fmt.Printf("agent name: %s\n", resp.Agent)
+	}
+	return nil
+}
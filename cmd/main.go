@@ -1,15 +1,17 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"flag"
+	"fmt"
 	"io"
 	"io/fs"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -19,135 +21,370 @@ import (
 	"github.com/mochi-co/mqtt/v2/listeners"
 	"github.com/rs/zerolog"
 	"github.com/werbenhu/bridgemq"
+	"github.com/werbenhu/bridgemq/admin"
+	"github.com/werbenhu/bridgemq/config"
+	"github.com/werbenhu/bridgemq/health"
+	"github.com/werbenhu/bridgemq/replay"
+	"github.com/werbenhu/bridgemq/webhook"
 	"go.etcd.io/bbolt"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-func newTlsConfig(pemFile string, keyFile string, caFile string) *tls.Config {
-	pem, err := tls.LoadX509KeyPair(pemFile, keyFile)
-	if err != nil {
-		log.Fatalf("[ERROR] tls serve LoadX509KeyPair cert file:%s Err:%s\n", pemFile, err.Error())
+// flagKeys maps the command line flags to the config keys they override
+var flagKeys = map[string]string{
+	"tcp":             "listeners.tcp",
+	"tls":             "listeners.tls",
+	"ws":              "listeners.ws",
+	"dashboard":       "listeners.dashboard",
+	"tls-ca":          "tls.ca",
+	"tls-cert":        "tls.cert",
+	"tls-key":         "tls.key",
+	"bridge":          "bridge.enabled",
+	"agents":          "bridge.agents",
+	"agent-name":      "bridge.name",
+	"agent-addr":      "bridge.addr",
+	"agent-advertise": "bridge.advertise",
+	"pipe-port":       "bridge.pipe_port",
+	"agent-key":       "bridge.encrypt_key",
+	"endpoint":        "bridge.endpoint",
+	"zone":            "bridge.zone",
+	"rpc-addr":        "admin.rpc_addr",
+	"health-addr":     "admin.health_addr",
+	"log-level":       "log.level",
+}
+
+// portFlags are the flags which take a port while their config keys take a listening address
+var portFlags = map[string]bool{
+	"tcp":       true,
+	"tls":       true,
+	"ws":        true,
+	"dashboard": true,
+}
+
+// parseFlags parses the command line flags and returns the config file path
+func parseFlags() string {
+	flag.String("tcp", "", "network port for mqtt tcp listener, if both -tcp and -tls are not set, the tcp listener opens on 1883")
+	flag.String("tls", "", "network port for mqtt tls listener, if this parameter is not set, the service will not open, if set this then parameter -tls-ca, -tls-cert and -tls-key must be set")
+	flag.String("ws", "", "network port for mqtt websocket listener, if this parameter is not set, this service will not open")
+	flag.String("tls-ca", "", "ca file path for tls listener")
+	flag.String("tls-cert", "", "certificate file path for tls listener")
+	flag.String("tls-key", "", "key file path for tls listener")
+	flag.String("dashboard", "8080", "http port for web info dashboard listener, if this parameter is not set, this default port is 8080")
+
+	flag.Bool("bridge", false, "optional value for bridge mode")
+	flag.String("agents", "", "seeds list of bridge member agents, such as 192.168.0.1:7933,192.168.0.2:7933, a host name resolving to several addresses such as bridgemq.default.svc:7933, or an srv name such as _bridgemq._tcp.example.com")
+	flag.String("agent-name", "", "the name of current agent, this parameter is not set, a name is randomly generated")
+	flag.String("agent-addr", ":7933", "listening addr for bridge agent, such as 192.168.0.1:7933 or :7933")
+	flag.String("agent-advertise", "", "address to advertise to other agent. used for nat traversal. such as 192.168.0.1:7933 or www.xxx.com:7933")
+	flag.String("pipe-port", "8933", "transmit port (grpc server) to receive msg from other bridge agent. such as 8933")
+	flag.String("agent-key", "", "base64 encoded 16, 24 or 32 bytes key to encrypt the gossip traffic between agents, all the agents must use the same key")
+	flag.String("endpoint", "", "mqtt address advertised to other agents, such as 192.168.0.1:1883, the clients of a draining agent are redirected to it")
+	flag.String("zone", "", "zone of the agent advertised to other agents, such as an availability zone, used by the zone peer policy")
+	flag.String("rpc-addr", defaultRpcAddr, "listening addr for the admin rpc used by the cli subcommands, if this parameter is set to empty, the admin rpc will not open")
+	flag.String("health-addr", ":8081", "listening addr for the http /healthz and /readyz endpoints, if this parameter is set to empty, the endpoints will not open")
+	flag.String("log-level", "info", "log level, one of trace, debug, info, warn, error")
+	configPath := flag.String("config", "", "path of a yaml, toml or json config file, it can also be set by the "+config.EnvConfig+" environment variable. The keys can be overridden by "+config.EnvPrefix+"<KEY> environment variables, which are overridden by the flags")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of bridgemq:\n")
+		flag.PrintDefaults()
+		printCommands(flag.CommandLine.Output())
 	}
+	flag.Parse()
+
+	if *configPath == "" {
+		return os.Getenv(config.EnvConfig)
+	}
+	return *configPath
+}
 
-	ca, err := ioutil.ReadFile(caFile)
+// loadConfig loads the config file, the environment variables and the command line flags,
+// the flags explicitly set override the environment variables which override the file.
+func loadConfig(path string) (*config.Config, error) {
+	cfg, err := config.Load(path)
 	if err != nil {
-		log.Fatalf("[ERROR] tls serve read ca file failed. err:%s", err.Error())
+		return nil, err
 	}
-	caPool := x509.NewCertPool()
-	caPool.AppendCertsFromPEM(ca)
-	if !caPool.AppendCertsFromPEM(ca) {
-		log.Fatalf("[ERROR] tls serve append cert pool failed.\n")
+
+	flag.Visit(func(f *flag.Flag) {
+		key, ok := flagKeys[f.Name]
+		if !ok || err != nil {
+			return
+		}
+		value := f.Value.String()
+		if portFlags[f.Name] && value != "" {
+			value = ":" + value
+		}
+		if e := cfg.Set(key, value); e != nil {
+			err = fmt.Errorf("flag -%s: %s", f.Name, e.Error())
+		}
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return &tls.Config{
-		Certificates:       []tls.Certificate{pem},
-		ClientCAs:          caPool,
-		InsecureSkipVerify: false,
-		ClientAuth:         tls.RequireAndVerifyClientCert,
+	// if both tcp listener and tls listener not set, default open tcp service on 1883
+	if cfg.Listeners.TCP == "" && cfg.Listeners.TLS == "" {
+		cfg.Listeners.TCP = ":1883"
 	}
+	return cfg, cfg.Validate()
 }
 
-func main() {
-	tcpPort := flag.String("tcp", "", "network port for mqtt tcp listener")
-	tlsPort := flag.String("tls", "", "network port for mqtt tls listener, if this parameter is not set, the service will not open, if set this then parameter -tls-ca, -tls-cert and -tls-key must be set")
-	wsPort := flag.String("ws", "", "network port for mqtt websocket listener, if this parameter is not set, this service will not open")
-	tlsCa := flag.String("tls-ca", "", "ca file path for tls listener")
-	tlsCert := flag.String("tls-cert", "", "certificate file path for tls listener")
-	tlsKey := flag.String("tls-key", "", "key file path for tls listener")
-	dashboard := flag.String("dashboard", "8080", "http port for web info dashboard listener, if this parameter is not set, this default port is 8080")
-
-	isBridge := flag.Bool("bridge", false, "optional value for bridge mode")
-	agents := flag.String("agents", "", "seeds list of bridge member agents, such as 192.168.0.1:7933,192.168.0.2:7933")
-	agentName := flag.String("agent-name", "", "the name of current agent, this parameter is not set, a name is randomly generated")
-	agentAddr := flag.String("agent-addr", ":7933", "listening addr for bridge agent, such as 192.168.0.1:7933 or :7933")
-	agentAdvertise := flag.String("agent-advertise", "", "address to advertise to other agent. used for nat traversal. such as 192.168.0.1:7933 or www.xxx.com:7933")
-	pipePort := flag.String("pipe-port", "8933", "transmit port (grpc server) to receive msg from other bridge agent. such as 8933")
-
-	flag.Parse()
-	sigs := make(chan os.Signal, 1)
-	done := make(chan bool, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigs
-		done <- true
-	}()
-
-	writers := io.MultiWriter(&lumberjack.Logger{
-		Filename:   "./log/bridgemq.log",
-		MaxSize:    10,
-		MaxBackups: 3,
-		MaxAge:     28,
-	}, os.Stderr)
+func newLogger(cfg *config.Log) zerolog.Logger {
+	writers := io.Writer(os.Stderr)
+	if cfg.File != "" {
+		writers = io.MultiWriter(&lumberjack.Logger{
+			Filename:   cfg.File,
+			MaxSize:    cfg.MaxSize,
+			MaxBackups: cfg.MaxBackups,
+			MaxAge:     cfg.MaxAge,
+		}, os.Stderr)
+	}
 
-	logger := zerolog.New(writers).With().Timestamp().Logger().Level(zerolog.InfoLevel).Output(zerolog.ConsoleWriter{
+	// the level is controlled by the global level so that it can be changed when the config is reloaded
+	level, _ := zerolog.ParseLevel(cfg.Level)
+	zerolog.SetGlobalLevel(level)
+	return zerolog.New(writers).With().Timestamp().Logger().Level(zerolog.TraceLevel).Output(zerolog.ConsoleWriter{
 		Out:        writers,
 		TimeFormat: "2006-01-02 15:04:05",
 		NoColor:    true,
 	})
+}
 
-	server := mqtt.New(&mqtt.Options{
-		Logger: &logger,
-	})
+// addStorage adds the storage hook to mqtt server and returns the function checking the storage,
+// the function is nil if nothing is persisted
+func addStorage(server *mqtt.Server, cfg *config.Storage) (func() error, error) {
+	if cfg.Type != config.StorageBolt {
+		return nil, nil
+	}
 
-	os.MkdirAll("./data", fs.ModePerm)
-	_ = server.AddHook(new(auth.AllowHook), nil)
-	_ = server.AddHook(new(bolt.Hook), &bolt.Options{
-		Path: "./data/bolt.db",
+	os.MkdirAll(filepath.Dir(cfg.Path), fs.ModePerm)
+	hook := new(bolt.Hook)
+	err := server.AddHook(hook, &bolt.Options{
+		Path: cfg.Path,
 		Options: &bbolt.Options{
-			Timeout: 500 * time.Millisecond,
+			Timeout: time.Duration(cfg.Timeout),
 		},
 	})
+	return func() error {
+		_, err := hook.StoredSysInfo()
+		return err
+	}, err
+}
 
-	// if both tcp port and tsl port not set, default open tcp service on 1883
-	if *tcpPort == "" && *tlsPort == "" {
-		*tcpPort = "1883"
+// addReplay adds the replay hook to mqtt server and returns its log, the log is nil if no topic is recorded.
+// The replay subscriptions are checked against the acl of the auth hook.
+func addReplay(server *mqtt.Server, cfg *config.Replay, acl mqtt.Hook) (*replay.Log, error) {
+	if len(cfg.Filters) == 0 {
+		return nil, nil
 	}
 
-	if *tcpPort != "" {
-		tcp := listeners.NewTCP("t1", ":"+*tcpPort, nil)
-		err := server.AddListener(tcp)
-		if err != nil {
-			log.Fatal(err)
+	hook := new(replay.Hook)
+	err := server.AddHook(hook, &replay.Opt{
+		Filters:     cfg.Filters,
+		Dir:         cfg.Dir,
+		SegmentSize: cfg.SegmentSize,
+		MaxAge:      time.Duration(cfg.MaxAge),
+		MaxBytes:    cfg.MaxBytes,
+		ACL:         acl.OnACLCheck,
+	})
+	return hook.ReplayLog(), err
+}
+
+// addAuth adds the auth hook to mqtt server and returns it with its ledger, the ledger is nil if all the clients are allowed
+func addAuth(server *mqtt.Server, cfg *config.Config) (mqtt.Hook, *auth.Ledger, error) {
+	if cfg.Auth.AllowAll {
+		hook := new(auth.AllowHook)
+		return hook, nil, server.AddHook(hook, nil)
+	}
+
+	ledger, err := cfg.LoadLedger()
+	if err != nil {
+		return nil, nil, err
+	}
+	hook := new(auth.Hook)
+	return hook, ledger, server.AddHook(hook, &auth.Options{
+		Ledger: ledger,
+	})
+}
+
+// addListeners adds the listeners to mqtt server and returns the certificates of the tls listener,
+// the certificates are nil if the tls listener is not open
+func addListeners(server *mqtt.Server, cfg *config.Config) (*certStore, error) {
+	if cfg.Listeners.TCP != "" {
+		if err := server.AddListener(listeners.NewTCP("t1", cfg.Listeners.TCP, nil)); err != nil {
+			return nil, err
 		}
 	}
 
-	if *tlsPort != "" {
-		tlsConfig := newTlsConfig(*tlsCert, *tlsKey, *tlsCa)
-		tlsTcp := listeners.NewTCP("tls1", ":"+*tlsPort, &listeners.Config{
-			TLSConfig: tlsConfig,
+	var certs *certStore
+	if cfg.Listeners.TLS != "" {
+		certs = new(certStore)
+		if _, err := certs.load(&cfg.TLS); err != nil {
+			return nil, err
+		}
+		tlsTcp := listeners.NewTCP("tls1", cfg.Listeners.TLS, &listeners.Config{
+			TLSConfig: certs.listenerConfig(),
 		})
-		err := server.AddListener(tlsTcp)
-		if err != nil {
-			log.Fatal(err)
+		if err := server.AddListener(tlsTcp); err != nil {
+			return nil, err
 		}
 	}
 
+	// if websocket addr not set, do not open the ws service
+	if cfg.Listeners.WS != "" {
+		if err := server.AddListener(listeners.NewWebsocket("ws1", cfg.Listeners.WS, nil)); err != nil {
+			return nil, err
+		}
+	}
+
+	// if http addr not set, do not open the http service
+	if cfg.Listeners.Dashboard != "" {
+		stats := listeners.NewHTTPStats("stats", cfg.Listeners.Dashboard, nil, server.Info)
+		if err := server.AddListener(stats); err != nil {
+			return nil, err
+		}
+	}
+	return certs, nil
+}
+
+// addBridge adds the bridge hook to mqtt server and returns the bridge
+func addBridge(server *mqtt.Server, cfg *config.Bridge, rules []bridgemq.Rule, logs *config.Log) (*bridgemq.Bridge, error) {
+	var pipeTLS *tls.Config
+	if cfg.PipeTLS.Cert != "" {
+		var err error
+		if pipeTLS, err = newPipeTlsConfig(&cfg.PipeTLS); err != nil {
+			return nil, err
+		}
+	}
+
+	hook := new(bridgemq.Hook)
+	err := server.AddHook(hook, []bridgemq.IOption{
+		bridgemq.OptName(cfg.Name),
+		bridgemq.OptAddr(cfg.Addr),
+		bridgemq.OptAgents(strings.Join(cfg.Agents, ",")),
+		bridgemq.OptBroker(server),
+		bridgemq.OptAdvertise(cfg.Advertise),
+		bridgemq.OptPipePort(cfg.PipePort),
+		bridgemq.OptEncryptKey(cfg.EncryptKey),
+		bridgemq.OptRules(rules),
+		bridgemq.OptSerfLogLevel(logs.SerfLevel),
+		bridgemq.OptSerfLogFile(logs.SerfFile),
+		bridgemq.OptLogClients(logs.Clients),
+		bridgemq.OptEndpoint(cfg.Endpoint),
+		bridgemq.OptZone(cfg.Zone),
+		bridgemq.OptPeerPolicy(cfg.PeerPolicy),
+		bridgemq.OptDrainRate(cfg.DrainRate),
+		bridgemq.OptJoinRetries(cfg.JoinRetries, time.Duration(cfg.JoinBackoff), time.Duration(cfg.JoinMaxBackoff)),
+		bridgemq.OptRejoin(cfg.ExpectedSize, time.Duration(cfg.RejoinInterval)),
+		bridgemq.OptSnapshotPath(cfg.SnapshotPath),
+		bridgemq.OptTransport(cfg.Transport),
+		bridgemq.OptPipeTLS(pipeTLS),
+		bridgemq.OptPipeToken(cfg.PipeToken),
+		bridgemq.OptAgentPolicies(cfg.AgentPolicies),
+		bridgemq.OptRateLimits(cfg.RateLimits, time.Duration(cfg.RateLimitMaxDelay)),
+		bridgemq.OptPriorities(cfg.Priorities, cfg.PriorityProperty),
+		bridgemq.OptPipeScheduling(cfg.PipeScheduling, cfg.PipeWeights),
+		bridgemq.OptWebhook(&webhook.Opt{
+			Endpoints:     cfg.Webhook.Endpoints,
+			BatchSize:     cfg.Webhook.BatchSize,
+			BatchLinger:   time.Duration(cfg.Webhook.BatchLinger),
+			Timeout:       time.Duration(cfg.Webhook.Timeout),
+			Retries:       cfg.Webhook.Retries,
+			Backoff:       time.Duration(cfg.Webhook.Backoff),
+			MaxBackoff:    time.Duration(cfg.Webhook.MaxBackoff),
+			QueueSize:     cfg.Webhook.QueueSize,
+			QueueDir:      cfg.Webhook.QueueDir,
+			QueueMaxBytes: cfg.Webhook.QueueMaxBytes,
+			RetryInterval: time.Duration(cfg.Webhook.RetryInterval),
+		}),
+		bridgemq.OptSysInterval(time.Duration(cfg.SysInterval)),
+		bridgemq.OptPipeKeepAlive(time.Duration(cfg.PipeKeepAlive), time.Duration(cfg.PipeKeepAliveTimeout)),
+		bridgemq.OptPipeBackoff(time.Duration(cfg.PipeBackoff), time.Duration(cfg.PipeMaxBackoff)),
+		bridgemq.OptPipeBatch(cfg.PipeBatchSize, cfg.PipeBatchBytes, time.Duration(cfg.PipeBatchLinger)),
+		bridgemq.OptPipeMaxMsgSize(cfg.PipeMaxMsgSize),
+		bridgemq.OptPipeMaxPayloadSize(cfg.PipeMaxPayloadSize),
+		bridgemq.OptPipeChunk(cfg.PipeChunkSize, time.Duration(cfg.PipeChunkTimeout)),
+		bridgemq.OptDiscovery(cfg.Discovery),
+		bridgemq.OptStatic(cfg.StaticAgents, cfg.StaticFile, time.Duration(cfg.StaticCheckInterval)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hook.Bridge(), nil
+}
+
+func main() {
+	if isCommand(os.Args[1:]) {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
+	path := parseFlags()
+	cfg, err := loadConfig(path)
+	if err != nil {
+		log.Fatalf("[ERROR] %s\n", err.Error())
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	logger := newLogger(&cfg.Log)
+	server := mqtt.New(&mqtt.Options{
+		Logger: &logger,
+	})
+
+	authHook, ledger, err := addAuth(server, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	storage, err := addStorage(server, &cfg.Storage)
+	if err != nil {
+		log.Fatal(err)
+	}
+	replayLog, err := addReplay(server, &cfg.Replay, authHook)
+	if err != nil {
+		log.Fatal(err)
+	}
+	certs, err := addListeners(server, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// if bridge mode on, add bridge hook to mqtt server
-	if *isBridge {
-		_ = server.AddHook(new(bridgemq.Hook), []bridgemq.IOption{
-			bridgemq.OptName(*agentName),
-			bridgemq.OptAddr(*agentAddr),
-			bridgemq.OptAgents(*agents),
-			bridgemq.OptBroker(server),
-			bridgemq.OptAdvertise(*agentAdvertise),
-			bridgemq.OptPipePort(*pipePort),
-		})
+	var bridge *bridgemq.Bridge
+	if cfg.Bridge.Enabled {
+		if bridge, err = addBridge(server, &cfg.Bridge, cfg.Rules, &cfg.Log); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	// if websocket port not set, do not open the ws service
-	if *wsPort != "" {
-		ws := listeners.NewWebsocket("ws1", ":"+*wsPort, nil)
-		err := server.AddListener(ws)
-		if err != nil {
+	reload := newReloader(path, cfg, server, bridge, ledger, certs, replayLog)
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go func() {
+		for range hups {
+			reload.Reload()
+		}
+	}()
+
+	// if admin rpc addr not set, the cli subcommands can not operate this agent
+	var adminServer *admin.Server
+	if cfg.Admin.RpcAddr != "" {
+		adminServer = admin.NewServer(cfg.Admin.RpcAddr, server, bridge)
+		adminServer.SetToken(cfg.Admin.RpcToken)
+		adminServer.SetReloader(reload)
+		adminServer.SetReplay(replayLog)
+		if err := adminServer.Start(); err != nil {
 			log.Fatal(err)
 		}
 	}
 
-	// if http port not set, do not open the http service
-	if *dashboard != "" {
-		stats := listeners.NewHTTPStats("stats", ":"+*dashboard, nil, server.Info)
-		err := server.AddListener(stats)
-		if err != nil {
+	// if health addr not set, the orchestrators can not probe this agent over http
+	var healthServer *health.Server
+	if cfg.Admin.HealthAddr != "" {
+		healthServer = health.NewServer(cfg.Admin.HealthAddr, server, bridge)
+		healthServer.SetStorageCheck(storage)
+		if err := healthServer.Start(); err != nil {
 			log.Fatal(err)
 		}
 	}
@@ -159,8 +396,21 @@ func main() {
 		}
 	}()
 
-	<-done
-	server.Log.Warn().Msg("caught signal, stopping...")
+	sig := <-sigs
+	server.Log.Warn().Str("signal", sig.String()).Msg("caught signal, stopping...")
+
+	// SIGTERM moves the clients to the other agents before stopping, unless the agent is drained already
+	if sig == syscall.SIGTERM && bridge != nil && !bridge.Draining() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Bridge.DrainTimeout))
+		bridge.Drain(ctx)
+		cancel()
+	}
+	if adminServer != nil {
+		adminServer.Stop()
+	}
+	if healthServer != nil {
+		healthServer.Stop()
+	}
 	server.Close()
 	server.Log.Info().Msg("main.go finished")
 }
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/hooks/auth"
+	"github.com/rs/zerolog"
+	"github.com/werbenhu/bridgemq"
+	"github.com/werbenhu/bridgemq/config"
+	"github.com/werbenhu/bridgemq/replay"
+)
+
+// reloader re-reads the config and applies the changes which can be applied without
+// dropping the client connections, it is triggered by SIGHUP or by the admin rpc.
+type reloader struct {
+	sync.Mutex
+	path   string
+	server *mqtt.Server
+	bridge *bridgemq.Bridge
+	ledger *auth.Ledger
+	certs  *certStore
+	replay *replay.Log
+
+	// started is the config the server started with, the keys which can not be applied
+	// live are compared with it so they are reported until the server is restarted
+	started *config.Config
+
+	// current is the last config applied
+	current *config.Config
+}
+
+func newReloader(path string, cfg *config.Config, server *mqtt.Server, bridge *bridgemq.Bridge, ledger *auth.Ledger, certs *certStore, log *replay.Log) *reloader {
+	return &reloader{
+		path:    path,
+		server:  server,
+		bridge:  bridge,
+		ledger:  ledger,
+		certs:   certs,
+		replay:  log,
+		started: cfg,
+		current: cfg,
+	}
+}
+
+// Reload re-reads the config file, the environment variables and the flags, the new config is
+// rejected as a whole if it is invalid. It returns the keys applied, the keys which need a restart
+// to take effect and the keys failed to apply.
+func (r *reloader) Reload() (applied []string, restart []string, failed []string, err error) {
+	r.Lock()
+	defer r.Unlock()
+
+	cfg, err := loadConfig(r.path)
+	if err != nil {
+		r.server.Log.Error().Err(err).Msg("reload config failed")
+		return nil, nil, nil, err
+	}
+
+	applied, restart, failed = make([]string, 0), make([]string, 0), make([]string, 0)
+	for _, key := range config.Diff(r.started, cfg) {
+		if !config.Reloadable(key) || !r.liveAt(key, cfg) {
+			restart = append(restart, key)
+		}
+	}
+
+	apply := func(key string, err error) bool {
+		if err != nil {
+			failed = append(failed, key+": "+err.Error())
+			r.server.Log.Error().Err(err).Str("key", key).Msg("reload config key failed")
+			return false
+		}
+		applied = append(applied, key)
+		return true
+	}
+
+	changed := make(map[string]bool)
+	for _, key := range config.Diff(r.current, cfg) {
+		changed[key] = config.Reloadable(key) && r.liveAt(key, cfg)
+	}
+
+	// next becomes the current config, the keys failed keep their last applied value
+	// so that they are seen as changed and retried by the next reload
+	next := *cfg
+
+	if changed["log.level"] {
+		level, _ := zerolog.ParseLevel(cfg.Log.Level)
+		zerolog.SetGlobalLevel(level)
+		apply("log.level", nil)
+	}
+
+	if changed["rules"] {
+		r.bridge.SetRules(cfg.Rules)
+		apply("rules", nil)
+	}
+
+	if changed["bridge.agent_policies"] {
+		r.bridge.SetAgentPolicies(cfg.Bridge.AgentPolicies)
+		apply("bridge.agent_policies", nil)
+	}
+
+	if changed["bridge.rate_limits"] || changed["bridge.rate_limit_max_delay"] {
+		r.bridge.SetRateLimits(cfg.Bridge.RateLimits, time.Duration(cfg.Bridge.RateLimitMaxDelay))
+		for _, key := range []string{"bridge.rate_limits", "bridge.rate_limit_max_delay"} {
+			if changed[key] {
+				apply(key, nil)
+			}
+		}
+	}
+
+	if changed["bridge.priorities"] {
+		r.bridge.SetPriorities(cfg.Bridge.Priorities)
+		apply("bridge.priorities", nil)
+	}
+
+	if changed["replay.filters"] {
+		r.replay.SetFilters(cfg.Replay.Filters)
+		apply("replay.filters", nil)
+	}
+
+	if changed["replay.max_age"] || changed["replay.max_bytes"] {
+		r.replay.SetRetention(time.Duration(cfg.Replay.MaxAge), cfg.Replay.MaxBytes)
+		for _, key := range []string{"replay.max_age", "replay.max_bytes"} {
+			if changed[key] {
+				apply(key, nil)
+			}
+		}
+	}
+
+	// the ledger file and the certificates are read again even if their paths are unchanged, so the
+	// files can be replaced in place before reloading, they are reported only if their content changed
+	if r.ledger != nil && (cfg.Auth.LedgerFile != "" || changed["auth.ledger"] || changed["auth.ledger_file"]) {
+		ledger, err := cfg.LoadLedger()
+		if err != nil {
+			apply("auth.ledger", err)
+			next.Auth = r.current.Auth
+		} else if ledgerChanged(r.ledger, ledger) {
+			r.ledger.Update(ledger)
+			apply("auth.ledger", nil)
+		}
+	}
+
+	if r.certs != nil {
+		updated, err := r.certs.load(&cfg.TLS)
+		if err != nil {
+			apply("tls", err)
+			next.TLS = r.current.TLS
+		} else if updated {
+			apply("tls", nil)
+		}
+	}
+
+	if changed["bridge.encrypt_key"] && !apply("bridge.encrypt_key", r.rotateKey(r.current.Bridge.EncryptKey, cfg.Bridge.EncryptKey)) {
+		next.Bridge.EncryptKey = r.current.Bridge.EncryptKey
+	}
+
+	if changed["bridge.agents"] && !apply("bridge.agents", r.joinSeeds(r.current.Bridge.Agents, cfg.Bridge.Agents)) {
+		next.Bridge.Agents = r.current.Bridge.Agents
+	}
+
+	r.current = &next
+	r.server.Log.Info().
+		Strs("applied", applied).
+		Strs("restart_required", restart).
+		Strs("failed", failed).
+		Msg("config reloaded")
+	return applied, restart, failed, nil
+}
+
+// liveAt reports whether the change of a reloadable key can be applied by the running server,
+// such as the gossip key which can be rotated but can not be enabled or disabled
+func (r *reloader) liveAt(key string, cfg *config.Config) bool {
+	switch key {
+	case "rules", "bridge.agents", "bridge.agent_policies", "bridge.rate_limits", "bridge.rate_limit_max_delay", "bridge.priorities":
+		return r.bridge != nil
+	case "bridge.encrypt_key":
+		return r.bridge != nil && r.started.Bridge.EncryptKey != "" && cfg.Bridge.EncryptKey != ""
+	case "auth.ledger", "auth.ledger_file":
+		return r.ledger != nil
+	case "replay.filters", "replay.max_age", "replay.max_bytes":
+		return r.replay != nil
+	case "tls.ca", "tls.cert", "tls.key", "tls.client_auth":
+		return r.certs != nil
+	}
+	return true
+}
+
+// ledgerChanged reports whether the rules of a ledger loaded differ from the rules in use
+func ledgerChanged(current *auth.Ledger, loaded *auth.Ledger) bool {
+	current.Lock()
+	defer current.Unlock()
+	return !reflect.DeepEqual(current.Auth, loaded.Auth) || !reflect.DeepEqual(current.ACL, loaded.ACL)
+}
+
+// rotateKey installs the new gossip key on every agent, makes it the primary key and
+// then removes the old key
+func (r *reloader) rotateKey(old string, new string) error {
+	keyring, err := r.bridge.Keyring()
+	if err != nil {
+		return err
+	}
+	if err = keyring.InstallKey(new); err != nil {
+		return err
+	}
+	if err = keyring.UseKey(new); err != nil {
+		return err
+	}
+	return keyring.RemoveKey(old)
+}
+
+// joinSeeds joins the seeds which are not in the old seeds list
+func (r *reloader) joinSeeds(old []string, new []string) error {
+	seeds := make([]string, 0)
+	for _, seed := range new {
+		found := false
+		for _, o := range old {
+			if seed == o {
+				found = true
+				break
+			}
+		}
+		if !found {
+			seeds = append(seeds, seed)
+		}
+	}
+	if len(seeds) == 0 {
+		return nil
+	}
+	_, err := r.bridge.Join(seeds)
+	return err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mochi-co/mqtt/v2"
+)
+
+func TestReloadLedger(t *testing.T) {
+	dir := t.TempDir()
+	ledgerFile := filepath.Join(dir, "ledger.yaml")
+	configFile := filepath.Join(dir, "config.yaml")
+	write := func(path string, data string) {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(ledgerFile, "auth:\n  - username: a\n    password: a\n    allow: true\n")
+	write(configFile, "auth:\n  allow_all: false\n  ledger_file: "+ledgerFile+"\n")
+
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledger, err := cfg.LoadLedger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newReloader(configFile, cfg, mqtt.New(nil), nil, ledger, nil, nil)
+
+	steps := []struct {
+		name    string
+		ledger  string
+		applied []string
+		failed  int
+	}{
+		{name: "unchanged", ledger: "auth:\n  - username: a\n    password: a\n    allow: true\n"},
+		{name: "changed", ledger: "auth:\n  - username: b\n    password: b\n    allow: true\n", applied: []string{"auth.ledger"}},
+		{name: "invalid", ledger: "auth: [", failed: 1},
+		{name: "fixed", ledger: "auth:\n  - username: c\n    password: c\n    allow: true\n", applied: []string{"auth.ledger"}},
+		{name: "unchanged again", ledger: "auth:\n  - username: c\n    password: c\n    allow: true\n"},
+	}
+	for _, step := range steps {
+		write(ledgerFile, step.ledger)
+		applied, _, failed, err := r.Reload()
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if len(applied) != len(step.applied) || (len(applied) > 0 && applied[0] != step.applied[0]) {
+			t.Errorf("%s: applied %v, want %v", step.name, applied, step.applied)
+		}
+		if len(failed) != step.failed {
+			t.Errorf("%s: failed %v, want %d keys", step.name, failed, step.failed)
+		}
+	}
+	if got := ledger.Auth[0].Username; got != "c" {
+		t.Errorf("ledger username %q, want c", got)
+	}
+}
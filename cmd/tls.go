@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/werbenhu/bridgemq/config"
+)
+
+// certStore holds the tls config of the tls listener, the certificates can be
+// replaced at runtime, the new handshakes use them while the established connections are kept
+type certStore struct {
+	config atomic.Value
+
+	// sum is the hash of the files and of the settings of the certificates in use
+	sum [sha256.Size]byte
+}
+
+func newTlsConfig(cfg *config.TLS) (*tls.Config, error) {
+	pem, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	if err != nil {
+		return nil, fmt.Errorf("tls serve LoadX509KeyPair cert file:%s err:%s", cfg.Cert, err.Error())
+	}
+
+	ca, err := os.ReadFile(cfg.CA)
+	if err != nil {
+		return nil, fmt.Errorf("tls serve read ca file failed. err:%s", err.Error())
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("tls serve append cert pool failed")
+	}
+
+	clientAuth := tls.NoClientCert
+	if cfg.ClientAuth {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &tls.Config{
+		Certificates:       []tls.Certificate{pem},
+		ClientCAs:          caPool,
+		InsecureSkipVerify: false,
+		ClientAuth:         clientAuth,
+	}, nil
+}
+
+// newPipeTlsConfig returns the mutual tls config of the pipe, it is used both by the listener and by
+// the connections to the other agents, which are all verified with the ca
+func newPipeTlsConfig(cfg *config.TLS) (*tls.Config, error) {
+	tlsConfig, err := newTlsConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.RootCAs = tlsConfig.ClientCAs
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return tlsConfig, nil
+}
+
+// load reads the certificates, the current ones are kept if they can not be read. It reports
+// whether the certificates were replaced, they are not if their files and settings are unchanged.
+func (s *certStore) load(cfg *config.TLS) (bool, error) {
+	sum, err := tlsSum(cfg)
+	if err != nil {
+		return false, err
+	}
+	if sum == s.sum && s.config.Load() != nil {
+		return false, nil
+	}
+	tlsConfig, err := newTlsConfig(cfg)
+	if err != nil {
+		return false, err
+	}
+	s.config.Store(tlsConfig)
+	s.sum = sum
+	return true, nil
+}
+
+// tlsSum hashes the files and the settings of the certificates
+func tlsSum(cfg *config.TLS) ([sha256.Size]byte, error) {
+	h := sha256.New()
+	for _, path := range []string{cfg.CA, cfg.Cert, cfg.Key} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return [sha256.Size]byte{}, fmt.Errorf("tls read file:%s err:%s", path, err.Error())
+		}
+		fmt.Fprintf(h, "%s:%d:", path, len(data))
+		h.Write(data)
+	}
+	fmt.Fprintf(h, "client_auth:%t", cfg.ClientAuth)
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// listenerConfig returns the tls config of the listener which always uses the current certificates
+func (s *certStore) listenerConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.config.Load().(*tls.Config), nil
+		},
+	}
+}
@@ -0,0 +1,438 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/mochi-co/mqtt/v2/hooks/auth"
+	"github.com/werbenhu/bridgemq"
+	"github.com/werbenhu/bridgemq/discovery"
+	"github.com/werbenhu/bridgemq/webhook"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// EnvPrefix is the prefix of the environment variables overriding the config keys,
+	// such as BRIDGEMQ_BRIDGE_PIPE_PORT for the key bridge.pipe_port
+	EnvPrefix = "BRIDGEMQ_"
+
+	// EnvConfig is the environment variable holding the config file path when -config is not set
+	EnvConfig = EnvPrefix + "CONFIG"
+
+	StorageBolt   = "bolt"
+	StorageMemory = "memory"
+)
+
+// Config is the configuration of a bridgemq server, it is loaded from a yaml, toml or json
+// file, then overridden by the environment variables and then by the command line flags.
+type Config struct {
+	Listeners Listeners       `json:"listeners"`
+	TLS       TLS             `json:"tls"`
+	Storage   Storage         `json:"storage"`
+	Replay    Replay          `json:"replay"`
+	Auth      Auth            `json:"auth"`
+	Bridge    Bridge          `json:"bridge"`
+	Rules     []bridgemq.Rule `json:"rules"`
+	Log       Log             `json:"log"`
+	Admin     Admin           `json:"admin"`
+}
+
+// Listeners are the listening addresses of the mqtt listeners, an empty address disables the listener.
+type Listeners struct {
+	TCP       string `json:"tcp"`
+	TLS       string `json:"tls"`
+	WS        string `json:"ws"`
+	Dashboard string `json:"dashboard"`
+}
+
+// TLS are the certificates used by the tls listener.
+type TLS struct {
+	CA   string `json:"ca"`
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+
+	// ClientAuth requires the clients to present a certificate signed by the ca
+	ClientAuth bool `json:"client_auth"`
+}
+
+// Webhook configures the http endpoints notified of the client, message and agent events
+type Webhook struct {
+	Endpoints []webhook.Endpoint `json:"endpoints"`
+
+	// BatchSize events are sent in a request, or less BatchLinger after the first of them
+	BatchSize   int      `json:"batch_size"`
+	BatchLinger Duration `json:"batch_linger"`
+	Timeout     Duration `json:"timeout"`
+
+	// Retries is the number of times a failed request is retried with a backoff doubled up to MaxBackoff,
+	// the failed requests are not retried if it is 0
+	Retries    int      `json:"retries"`
+	Backoff    Duration `json:"backoff"`
+	MaxBackoff Duration `json:"max_backoff"`
+
+	// QueueSize is the number of events waiting for an endpoint, the requests still failing are kept
+	// in QueueDir up to QueueMaxBytes per endpoint and sent again every RetryInterval
+	QueueSize     int      `json:"queue_size"`
+	QueueDir      string   `json:"queue_dir"`
+	QueueMaxBytes int      `json:"queue_max_bytes"`
+	RetryInterval Duration `json:"retry_interval"`
+}
+
+type Storage struct {
+	// Type is bolt or memory, the memory storage does not persist anything
+	Type    string   `json:"type"`
+	Path    string   `json:"path"`
+	Timeout Duration `json:"timeout"`
+}
+
+// Replay records the publishes matching Filters in a log, they are replayed by the admin rpc and by the
+// $replay/<since>/<filter> subscriptions. The log is disabled if Filters is empty.
+type Replay struct {
+	Filters []string `json:"filters"`
+
+	// Dir holds the segment files of the log, a new segment is started once the last one holds SegmentSize bytes
+	Dir         string `json:"dir"`
+	SegmentSize int    `json:"segment_size"`
+
+	// MaxAge and MaxBytes bound the log, the oldest segments are removed beyond, 0 does not bound it
+	MaxAge   Duration `json:"max_age"`
+	MaxBytes int      `json:"max_bytes"`
+}
+
+type Auth struct {
+	// AllowAll allows every client to connect and publish to any topic, the ledger is ignored
+	AllowAll bool `json:"allow_all"`
+
+	// LedgerFile is a yaml or json file holding the auth and acl rules, it takes precedence over Ledger
+	LedgerFile string       `json:"ledger_file"`
+	Ledger     *auth.Ledger `json:"ledger"`
+}
+
+// Bridge holds the bridgemq.Option fields.
+type Bridge struct {
+	Enabled    bool     `json:"enabled"`
+	Name       string   `json:"name"`
+	Addr       string   `json:"addr"`
+	Advertise  string   `json:"advertise"`
+	PipePort   string   `json:"pipe_port"`
+	Agents     []string `json:"agents"`
+	EncryptKey string   `json:"encrypt_key"`
+
+	// Endpoint is the mqtt address advertised to the other agents, the clients
+	// of a draining agent are redirected to the endpoints of the healthy agents
+	Endpoint string `json:"endpoint"`
+
+	// Zone is the zone of the agent advertised in the zone tag, such as an availability zone
+	Zone string `json:"zone"`
+
+	// PeerPolicy chooses the agent the clients of a draining agent are redirected to,
+	// round_robin, nearest by the estimated round trip time or zone for the agents of the same zone
+	PeerPolicy string `json:"peer_policy"`
+
+	// DrainRate is the number of clients disconnected per second while draining, 0 is unlimited
+	DrainRate int `json:"drain_rate"`
+
+	// DrainTimeout is how long SIGTERM drains the clients before disconnecting the rest at once
+	DrainTimeout Duration `json:"drain_timeout"`
+
+	// JoinRetries is the number of times joining the agents is retried at startup before the agent exits,
+	// the join is retried in the background until it succeeds if it is negative, the default
+	JoinRetries    int      `json:"join_retries"`
+	JoinBackoff    Duration `json:"join_backoff"`
+	JoinMaxBackoff Duration `json:"join_max_backoff"`
+
+	// ExpectedSize is the number of agents expected, the agents are joined again every
+	// RejoinInterval while less agents are alive, 0 disables the rejoin
+	ExpectedSize   int      `json:"expected_size"`
+	RejoinInterval Duration `json:"rejoin_interval"`
+
+	// Transport is grpc or tcp, the tcp transport uses a compact binary framing over plain tcp,
+	// it can not be used with the static discovery
+	Transport string `json:"transport"`
+
+	// PipeTLS enables mutual tls on the pipe when its cert is set, the other agents are verified
+	// with its ca and identified by the common name of their certificate, which must be their name
+	PipeTLS TLS `json:"pipe_tls"`
+
+	// PipeToken is a secret shared by the agents, the pushes without it are rejected when it is set
+	PipeToken string `json:"pipe_token"`
+
+	// AgentPolicies limit the topics the remote agents may publish into and whether their clients may
+	// take over the local clients, the policy of the agent * applies to the agents without their own policy
+	AgentPolicies []bridgemq.AgentPolicy `json:"agent_policies"`
+
+	// RateLimits are token bucket limits of the publishes received from and pushed to the remote
+	// agents, a publish delayed longer than RateLimitMaxDelay is dropped
+	RateLimits        []bridgemq.RateLimit `json:"rate_limits"`
+	RateLimitMaxDelay Duration             `json:"rate_limit_max_delay"`
+
+	// Priorities give the high, normal or low priority to the publishes by topic filter, the mqtt v5 user
+	// property PriorityProperty overrides them. The priorities are queued apart on the pipe and sent
+	// according to PipeScheduling, strict or weighted by PipeWeights, the weights of high, normal and low.
+	Priorities       []bridgemq.PriorityRule `json:"priorities"`
+	PriorityProperty string                  `json:"priority_property"`
+	PipeScheduling   string                  `json:"pipe_scheduling"`
+	PipeWeights      []int                   `json:"pipe_weights"`
+
+	// Webhook sends the events to http endpoints, it is disabled without endpoints
+	Webhook Webhook `json:"webhook"`
+
+	// SysInterval is the interval the cluster $SYS topics are published at, 0 disables them and the presence events
+	SysInterval Duration `json:"sys_interval"`
+
+	// PipeKeepAlive is the interval of the pings on an idle pipe connection, the connection is
+	// reconnected if a ping is not answered within PipeKeepAliveTimeout
+	PipeKeepAlive        Duration `json:"pipe_keepalive"`
+	PipeKeepAliveTimeout Duration `json:"pipe_keepalive_timeout"`
+
+	// PipeBackoff is the delay before reconnecting a lost pipe connection, doubled with a jitter up to PipeMaxBackoff
+	PipeBackoff    Duration `json:"pipe_backoff"`
+	PipeMaxBackoff Duration `json:"pipe_max_backoff"`
+
+	// PipeBatchSize is the maximum number of publishes combined in a batch sent to an agent, a batch is sent
+	// once it holds PipeBatchSize publishes or PipeBatchBytes bytes, or PipeBatchLinger after its first publish
+	PipeBatchSize   int      `json:"pipe_batch_size"`
+	PipeBatchBytes  int      `json:"pipe_batch_bytes"`
+	PipeBatchLinger Duration `json:"pipe_batch_linger"`
+
+	// PipeMaxMsgSize is the maximum size of a message on the pipe, the payloads larger than PipeChunkSize are sent
+	// in chunks reassembled by the receiver, which drops a transfer not completed within PipeChunkTimeout.
+	// The payloads larger than PipeMaxPayloadSize are neither forwarded nor reassembled.
+	PipeMaxMsgSize     int      `json:"pipe_max_msg_size"`
+	PipeMaxPayloadSize int      `json:"pipe_max_payload_size"`
+	PipeChunkSize      int      `json:"pipe_chunk_size"`
+	PipeChunkTimeout   Duration `json:"pipe_chunk_timeout"`
+
+	// SnapshotPath records the members so that a restarted agent rejoins its previous peers
+	SnapshotPath string `json:"snapshot_path"`
+
+	// Discovery is serf or static, the static discovery does not gossip, it uses the agents of
+	// StaticAgents and StaticFile which join and leave according to the health checks of their pipes
+	Discovery           string                  `json:"discovery"`
+	StaticAgents        []discovery.StaticAgent `json:"static_agents"`
+	StaticFile          string                  `json:"static_file"`
+	StaticCheckInterval Duration                `json:"static_check_interval"`
+}
+
+type Log struct {
+	Level      string `json:"level"`
+	File       string `json:"file"`
+	MaxSize    int    `json:"max_size"`
+	MaxBackups int    `json:"max_backups"`
+	MaxAge     int    `json:"max_age"`
+
+	// SerfLevel is the minimum level of the serf and memberlist logs
+	SerfLevel string `json:"serf_level"`
+
+	// SerfFile is a file the serf and memberlist logs are also written to
+	SerfFile string `json:"serf_file"`
+
+	// Clients logs every client connected and disconnected, which is noisy with many clients
+	Clients bool `json:"clients"`
+}
+
+type Admin struct {
+	RpcAddr string `json:"rpc_addr"`
+
+	// RpcToken is the token the cli sends with every admin rpc, it is required when RpcAddr is not a loopback address
+	RpcToken string `json:"rpc_token"`
+
+	// HealthAddr is the listening address of the http /healthz and /readyz endpoints
+	HealthAddr string `json:"health_addr"`
+}
+
+// Duration is a time.Duration which is decoded from a string such as 500ms or from nanoseconds
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch val := v.(type) {
+	case float64:
+		*d = Duration(val)
+	case string:
+		parsed, err := time.ParseDuration(val)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration: %s", string(b))
+	}
+	return nil
+}
+
+// Default returns the config used when nothing is configured
+func Default() *Config {
+	return &Config{
+		Listeners: Listeners{
+			Dashboard: ":8080",
+		},
+		TLS: TLS{
+			ClientAuth: true,
+		},
+		Storage: Storage{
+			Type:    StorageBolt,
+			Path:    "./data/bolt.db",
+			Timeout: Duration(500 * time.Millisecond),
+		},
+		Replay: Replay{
+			Dir:         "./data/replay",
+			SegmentSize: 16 * 1024 * 1024,
+			MaxAge:      Duration(24 * time.Hour),
+			MaxBytes:    1024 * 1024 * 1024,
+		},
+		Auth: Auth{
+			AllowAll: true,
+		},
+		Bridge: Bridge{
+			Addr:         ":7933",
+			PipePort:     "8933",
+			PeerPolicy:   bridgemq.PolicyRoundRobin,
+			Transport:    bridgemq.TransportGrpc,
+			DrainRate:    100,
+			DrainTimeout: Duration(30 * time.Second),
+
+			JoinRetries:    -1,
+			JoinBackoff:    Duration(time.Second),
+			JoinMaxBackoff: Duration(30 * time.Second),
+			RejoinInterval: Duration(30 * time.Second),
+			SnapshotPath:   "./data/serf.snapshot",
+
+			PipeKeepAlive:        Duration(10 * time.Second),
+			PipeKeepAliveTimeout: Duration(5 * time.Second),
+			PipeBackoff:          Duration(time.Second),
+			PipeMaxBackoff:       Duration(30 * time.Second),
+
+			PipeBatchSize:   128,
+			PipeBatchBytes:  256 * 1024,
+			PipeBatchLinger: Duration(2 * time.Millisecond),
+
+			PipeMaxMsgSize:     4 * 1024 * 1024,
+			PipeMaxPayloadSize: 64 * 1024 * 1024,
+			PipeChunkSize:      1024 * 1024,
+			PipeChunkTimeout:   Duration(30 * time.Second),
+
+			RateLimitMaxDelay: Duration(time.Second),
+
+			PriorityProperty: bridgemq.DefaultPriorityProperty,
+			PipeScheduling:   bridgemq.SchedulingStrict,
+			PipeWeights:      []int{8, 4, 1},
+
+			SysInterval: Duration(10 * time.Second),
+
+			Webhook: Webhook{
+				BatchSize:     100,
+				BatchLinger:   Duration(time.Second),
+				Timeout:       Duration(5 * time.Second),
+				Retries:       3,
+				Backoff:       Duration(time.Second),
+				MaxBackoff:    Duration(30 * time.Second),
+				QueueSize:     10000,
+				QueueDir:      "./data/webhook",
+				QueueMaxBytes: 64 * 1024 * 1024,
+				RetryInterval: Duration(30 * time.Second),
+			},
+
+			Discovery:           bridgemq.DiscoverySerf,
+			StaticCheckInterval: Duration(2 * time.Second),
+		},
+		Log: Log{
+			Level:      "info",
+			File:       "./log/bridgemq.log",
+			MaxSize:    10,
+			MaxBackups: 3,
+			MaxAge:     28,
+			SerfLevel:  "warn",
+		},
+		Admin: Admin{
+			RpcAddr:    "127.0.0.1:7373",
+			HealthAddr: ":8081",
+		},
+	}
+}
+
+// Load returns the default config overridden by the config file at path and then by the
+// environment variables, path can be empty to only use the environment variables.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		if err := cfg.decodeFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.applyEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// decodeFile decodes the file according to its extension, yaml and toml documents
+// are converted to json so that every format shares the json keys of the config.
+func (c *Config) decodeFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file:%s err:%s", path, err.Error())
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	doc := make(map[string]any)
+	switch ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	case ".toml":
+		err = toml.Unmarshal(data, &doc)
+	case ".json":
+		err = json.Unmarshal(data, &doc)
+	default:
+		return fmt.Errorf("unsupported config file format:%s, it must be .yaml, .yml, .toml or .json", ext)
+	}
+	if err != nil {
+		return fmt.Errorf("parse config file:%s err:%s", path, err.Error())
+	}
+
+	data, err = json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("parse config file:%s err:%s", path, err.Error())
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(c); err != nil {
+		return fmt.Errorf("decode config file:%s err:%s", path, err.Error())
+	}
+	return nil
+}
+
+// LoadLedger returns the auth ledger of the config, it is read from LedgerFile if set
+func (c *Config) LoadLedger() (*auth.Ledger, error) {
+	if c.Auth.LedgerFile == "" {
+		if c.Auth.Ledger == nil {
+			return new(auth.Ledger), nil
+		}
+		return c.Auth.Ledger, nil
+	}
+
+	data, err := os.ReadFile(c.Auth.LedgerFile)
+	if err != nil {
+		return nil, fmt.Errorf("read auth ledger file:%s err:%s", c.Auth.LedgerFile, err.Error())
+	}
+	ledger := new(auth.Ledger)
+	if err = ledger.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("parse auth ledger file:%s err:%s", c.Auth.LedgerFile, err.Error())
+	}
+	return ledger, nil
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"reflect"
+	"sort"
+)
+
+// reloadable are the config keys whose changes can be applied without restarting the server
+var reloadable = map[string]bool{
+	"rules":                       true,
+	"auth.ledger":                 true,
+	"auth.ledger_file":            true,
+	"tls.ca":                      true,
+	"tls.cert":                    true,
+	"tls.key":                     true,
+	"tls.client_auth":             true,
+	"log.level":                   true,
+	"bridge.agents":               true,
+	"bridge.encrypt_key":          true,
+	"bridge.agent_policies":       true,
+	"bridge.rate_limits":          true,
+	"bridge.rate_limit_max_delay": true,
+	"bridge.priorities":           true,
+	"replay.filters":              true,
+	"replay.max_age":              true,
+	"replay.max_bytes":            true,
+}
+
+// Reloadable reports whether the change of the config key can be applied without restarting the server
+func Reloadable(key string) bool {
+	return reloadable[key]
+}
+
+// Diff returns the sorted keys whose values differ between the two configs
+func Diff(old *Config, new *Config) []string {
+	keys := make([]string, 0)
+	oldFields, newFields := old.fields(), new.fields()
+	for key, field := range oldFields {
+		if !reflect.DeepEqual(field.Interface(), newFields[key].Interface()) {
+			keys = append(keys, key)
+		}
+	}
+
+	if !reflect.DeepEqual(old.Rules, new.Rules) {
+		keys = append(keys, "rules")
+	}
+	if !reflect.DeepEqual(old.Bridge.StaticAgents, new.Bridge.StaticAgents) {
+		keys = append(keys, "bridge.static_agents")
+	}
+	if !reflect.DeepEqual(old.Bridge.AgentPolicies, new.Bridge.AgentPolicies) {
+		keys = append(keys, "bridge.agent_policies")
+	}
+	if !reflect.DeepEqual(old.Bridge.RateLimits, new.Bridge.RateLimits) {
+		keys = append(keys, "bridge.rate_limits")
+	}
+	if !reflect.DeepEqual(old.Bridge.Priorities, new.Bridge.Priorities) {
+		keys = append(keys, "bridge.priorities")
+	}
+	if !reflect.DeepEqual(old.Bridge.PipeWeights, new.Bridge.PipeWeights) {
+		keys = append(keys, "bridge.pipe_weights")
+	}
+	if !reflect.DeepEqual(old.Bridge.Webhook.Endpoints, new.Bridge.Webhook.Endpoints) {
+		keys = append(keys, "bridge.webhook.endpoints")
+	}
+	if !reflect.DeepEqual(old.Auth.Ledger, new.Auth.Ledger) {
+		keys = append(keys, "auth.ledger")
+	}
+
+	sort.Strings(keys)
+	return keys
+}
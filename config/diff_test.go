@@ -0,0 +1,62 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mochi-co/mqtt/v2/hooks/auth"
+	"github.com/werbenhu/bridgemq"
+	"github.com/werbenhu/bridgemq/webhook"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		keys   []string
+		// reloadable is whether all the keys changed can be applied without a restart
+		reloadable bool
+	}{
+		{"unchanged", func(c *Config) {}, []string{}, true},
+		{"same list in a new slice", func(c *Config) { c.Replay.Filters = append([]string(nil), c.Replay.Filters...) }, []string{}, true},
+		{"scalar", func(c *Config) { c.Listeners.TCP = ":1884" }, []string{"listeners.tcp"}, false},
+		{"duration", func(c *Config) { c.Bridge.RateLimitMaxDelay = Duration(time.Minute) }, []string{"bridge.rate_limit_max_delay"}, true},
+		{"list", func(c *Config) { c.Replay.Filters = []string{"alarms/#"} }, []string{"replay.filters"}, true},
+		{"rules", func(c *Config) { c.Rules = []bridgemq.Rule{{Filter: "local/#", Action: "local"}} }, []string{"rules"}, true},
+		{"rate limits", func(c *Config) { c.Bridge.RateLimits = []bridgemq.RateLimit{{Messages: 1}} }, []string{"bridge.rate_limits"}, true},
+		{"webhook endpoints", func(c *Config) {
+			c.Bridge.Webhook.Endpoints = []webhook.Endpoint{{URL: "http://localhost/hook"}}
+		}, []string{"bridge.webhook.endpoints"}, false},
+		{"ledger", func(c *Config) {
+			c.Auth.Ledger = &auth.Ledger{Auth: auth.AuthRules{{Username: "user", Password: "pass", Allow: true}}}
+		}, []string{"auth.ledger"}, true},
+		{"sorted keys", func(c *Config) {
+			c.Log.Level = "debug"
+			c.Bridge.PipePort = "9000"
+			c.Admin.RpcAddr = ":8081"
+		}, []string{"admin.rpc_addr", "bridge.pipe_port", "log.level"}, false},
+		{"rate limits and max delay", func(c *Config) {
+			c.Bridge.RateLimits = []bridgemq.RateLimit{{Messages: 1, Action: bridgemq.LimitDelay}}
+			c.Bridge.RateLimitMaxDelay = Duration(time.Minute)
+		}, []string{"bridge.rate_limit_max_delay", "bridge.rate_limits"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old, new := Default(), Default()
+			tt.change(new)
+			keys := Diff(old, new)
+			if !reflect.DeepEqual(keys, tt.keys) {
+				t.Fatalf("expected %v, got %v", tt.keys, keys)
+			}
+			reloadable := true
+			for _, key := range keys {
+				reloadable = reloadable && Reloadable(key)
+			}
+			if reloadable != tt.reloadable {
+				t.Fatalf("expected reloadable %v, got %v", tt.reloadable, reloadable)
+			}
+		})
+	}
+}
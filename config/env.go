@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// Set sets the value of a config key such as bridge.pipe_port from its string representation,
+// lists are separated by commas. Only the scalar keys and the string lists can be set.
+func (c *Config) Set(key string, value string) error {
+	field, ok := c.fields()[key]
+	if !ok {
+		return fmt.Errorf("%s: unknown or unsettable config key", key)
+	}
+
+	switch {
+	case field.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s: invalid duration %q", key, value)
+		}
+		field.SetInt(int64(d))
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s: invalid bool %q", key, value)
+		}
+		field.SetBool(b)
+	case field.Kind() == reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s: invalid integer %q", key, value)
+		}
+		field.SetInt(int64(n))
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+		list := make([]string, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	}
+	return nil
+}
+
+// EnvName returns the environment variable overriding the config key
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// applyEnv overrides the config keys by the environment variables, such as
+// BRIDGEMQ_LISTENERS_TCP=:1883 for listeners.tcp
+func (c *Config) applyEnv(environ []string) error {
+	envs := make(map[string]string)
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, EnvPrefix) {
+			envs[k] = v
+		}
+	}
+
+	for key := range c.fields() {
+		if value, ok := envs[EnvName(key)]; ok {
+			if err := c.Set(key, value); err != nil {
+				return fmt.Errorf("environment variable %s: %s", EnvName(key), err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// fields returns the settable fields of the config by their dotted json keys
+func (c *Config) fields() map[string]reflect.Value {
+	fields := make(map[string]reflect.Value)
+	collectFields(reflect.ValueOf(c).Elem(), "", fields)
+	return fields
+}
+
+func collectFields(v reflect.Value, prefix string, fields map[string]reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		key := prefix + name
+		field := v.Field(i)
+		switch {
+		case field.Kind() == reflect.Struct:
+			collectFields(field, key+".", fields)
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() != reflect.String:
+		case field.Kind() == reflect.Pointer:
+		default:
+			fields[key] = field
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSet(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		// get returns the value set, err is contained in the error of an invalid value
+		get  func(c *Config) any
+		want any
+		err  string
+	}{
+		{"listeners.tcp", ":1884", func(c *Config) any { return c.Listeners.TCP }, ":1884", ""},
+		{"bridge.pipe_port", "9000", func(c *Config) any { return c.Bridge.PipePort }, "9000", ""},
+		{"bridge.enabled", "true", func(c *Config) any { return c.Bridge.Enabled }, true, ""},
+		{"bridge.drain_rate", "50", func(c *Config) any { return c.Bridge.DrainRate }, 50, ""},
+		{"bridge.drain_timeout", "1m30s", func(c *Config) any { return c.Bridge.DrainTimeout }, Duration(90 * time.Second), ""},
+		{"bridge.agents", " a:7933, b:7933 ,,", func(c *Config) any { return c.Bridge.Agents }, []string{"a:7933", "b:7933"}, ""},
+		{"bridge.agents", "", func(c *Config) any { return c.Bridge.Agents }, []string{}, ""},
+		{"replay.filters", "alarms/#", func(c *Config) any { return c.Replay.Filters }, []string{"alarms/#"}, ""},
+		{"bridge.enabled", "maybe", nil, nil, "invalid bool"},
+		{"bridge.drain_rate", "fast", nil, nil, "invalid integer"},
+		{"bridge.drain_timeout", "30", nil, nil, "invalid duration"},
+		{"bridge.unknown", "1", nil, nil, "unknown"},
+		{"bridge", "1", nil, nil, "unknown"},
+		{"rules", "a", nil, nil, "unknown"},
+		{"bridge.rate_limits", "a", nil, nil, "unknown"},
+		{"auth.ledger", "a", nil, nil, "unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key+"="+tt.value, func(t *testing.T) {
+			c := Default()
+			err := c.Set(tt.key, tt.value)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected an error with %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.get(c); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %#v, got %#v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"listeners.tcp":               "BRIDGEMQ_LISTENERS_TCP",
+		"bridge.pipe_port":            "BRIDGEMQ_BRIDGE_PIPE_PORT",
+		"bridge.webhook.batch_size":   "BRIDGEMQ_BRIDGE_WEBHOOK_BATCH_SIZE",
+		"bridge.rate_limit_max_delay": "BRIDGEMQ_BRIDGE_RATE_LIMIT_MAX_DELAY",
+	}
+	for key, want := range tests {
+		if got := EnvName(key); got != want {
+			t.Fatalf("%s expected %s, got %s", key, want, got)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		environ []string
+		check   func(c *Config) bool
+		err     string
+	}{
+		{"scalar", []string{"BRIDGEMQ_BRIDGE_PIPE_PORT=9000"}, func(c *Config) bool { return c.Bridge.PipePort == "9000" }, ""},
+		{"nested", []string{"BRIDGEMQ_BRIDGE_WEBHOOK_BATCH_SIZE=10"}, func(c *Config) bool { return c.Bridge.Webhook.BatchSize == 10 }, ""},
+		{"list", []string{"BRIDGEMQ_BRIDGE_AGENTS=a:7933,b:7933"}, func(c *Config) bool {
+			return reflect.DeepEqual(c.Bridge.Agents, []string{"a:7933", "b:7933"})
+		}, ""},
+		{"value with =", []string{"BRIDGEMQ_BRIDGE_ENCRYPT_KEY=a2V5=="}, func(c *Config) bool { return c.Bridge.EncryptKey == "a2V5==" }, ""},
+		{"other variables", []string{"PATH=/bin", "BRIDGEMQ_UNKNOWN=1", "BRIDGEMQ_CONFIG=bridgemq.yaml"}, func(c *Config) bool {
+			return reflect.DeepEqual(c, Default())
+		}, ""},
+		{"invalid", []string{"BRIDGEMQ_BRIDGE_ENABLED=maybe"}, nil, "BRIDGEMQ_BRIDGE_ENABLED"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			err := c.applyEnv(tt.environ)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected an error with %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(c) {
+				t.Fatalf("unexpected config %+v", c)
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/rs/zerolog"
+	"github.com/werbenhu/bridgemq"
+	"github.com/werbenhu/bridgemq/admin"
+	"github.com/werbenhu/bridgemq/discovery"
+	"github.com/werbenhu/bridgemq/webhook"
+)
+
+// FieldError is a validation error of a config key
+type FieldError struct {
+	Key string
+	Msg string
+}
+
+func (e FieldError) Error() string {
+	return e.Key + ": " + e.Msg
+}
+
+// ValidationError holds all the validation errors of a config
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, fe := range e {
+		msgs = append(msgs, fe.Error())
+	}
+	return "invalid config: " + strings.Join(msgs, "; ")
+}
+
+// Validate checks every key of the config and returns a ValidationError listing all the invalid keys
+func (c *Config) Validate() error {
+	var errs ValidationError
+	add := func(key string, format string, args ...any) {
+		errs = append(errs, FieldError{Key: key, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	checkAddr := func(key string, addr string) {
+		if addr == "" {
+			return
+		}
+		if err := validateAddr(addr); err != nil {
+			add(key, "invalid address %q, %s", addr, err.Error())
+		}
+	}
+	checkFile := func(key string, path string) {
+		if path == "" {
+			add(key, "is required")
+		} else if _, err := os.Stat(path); err != nil {
+			add(key, "file %q is not readable, %s", path, err.Error())
+		}
+	}
+
+	checkAddr("listeners.tcp", c.Listeners.TCP)
+	checkAddr("listeners.tls", c.Listeners.TLS)
+	checkAddr("listeners.ws", c.Listeners.WS)
+	checkAddr("listeners.dashboard", c.Listeners.Dashboard)
+	if c.Listeners.TLS != "" {
+		checkFile("tls.ca", c.TLS.CA)
+		checkFile("tls.cert", c.TLS.Cert)
+		checkFile("tls.key", c.TLS.Key)
+	}
+
+	switch c.Storage.Type {
+	case StorageBolt:
+		if c.Storage.Path == "" {
+			add("storage.path", "is required for the bolt storage")
+		}
+	case StorageMemory:
+	default:
+		add("storage.type", "unknown storage %q, it must be %s or %s", c.Storage.Type, StorageBolt, StorageMemory)
+	}
+	if c.Storage.Timeout < 0 {
+		add("storage.timeout", "must not be negative")
+	}
+
+	for i, filter := range c.Replay.Filters {
+		if !mqtt.IsValidFilter(filter, false) {
+			add(fmt.Sprintf("replay.filters[%d]", i), "invalid topic filter %q", filter)
+		}
+	}
+	if len(c.Replay.Filters) > 0 && c.Replay.Dir == "" {
+		add("replay.dir", "is required when replay.filters is set")
+	}
+	if c.Replay.SegmentSize < 0 || c.Replay.MaxAge < 0 || c.Replay.MaxBytes < 0 {
+		add("replay", "segment_size, max_age and max_bytes must not be negative")
+	}
+
+	if c.Auth.LedgerFile != "" {
+		checkFile("auth.ledger_file", c.Auth.LedgerFile)
+	}
+
+	if c.Bridge.Enabled {
+		if c.Bridge.Addr == "" {
+			add("bridge.addr", "is required in bridge mode")
+		}
+		checkAddr("bridge.addr", c.Bridge.Addr)
+		checkAddr("bridge.advertise", c.Bridge.Advertise)
+		if err := validatePort(c.Bridge.PipePort); err != nil {
+			add("bridge.pipe_port", "invalid port %q, %s", c.Bridge.PipePort, err.Error())
+		}
+		for i, a := range c.Bridge.Agents {
+			if discovery.IsSRV(a) {
+				continue
+			}
+			if err := validateAddr(a); err != nil {
+				add(fmt.Sprintf("bridge.agents[%d]", i), "invalid address %q, %s", a, err.Error())
+			}
+		}
+		checkAddr("bridge.endpoint", c.Bridge.Endpoint)
+		switch c.Bridge.Discovery {
+		case bridgemq.DiscoverySerf:
+		case bridgemq.DiscoveryStatic:
+			if len(c.Bridge.StaticAgents) == 0 && c.Bridge.StaticFile == "" {
+				add("bridge.static_agents", "static_agents or static_file is required by the static discovery")
+			}
+			for i, a := range c.Bridge.StaticAgents {
+				if a.Name == "" {
+					add(fmt.Sprintf("bridge.static_agents[%d].name", i), "is required")
+				}
+				if err := validatePort(a.PipePort); err != nil {
+					add(fmt.Sprintf("bridge.static_agents[%d].pipe_port", i), "invalid port %q, %s", a.PipePort, err.Error())
+				}
+			}
+		default:
+			add("bridge.discovery", "unknown discovery %q, it must be %s or %s", c.Bridge.Discovery, bridgemq.DiscoverySerf, bridgemq.DiscoveryStatic)
+		}
+		switch c.Bridge.Transport {
+		case bridgemq.TransportGrpc:
+		case bridgemq.TransportTcp:
+			if c.Bridge.Discovery == bridgemq.DiscoveryStatic {
+				add("bridge.transport", "the static discovery needs the %s transport", bridgemq.TransportGrpc)
+			}
+		default:
+			add("bridge.transport", "unknown transport %q, it must be %s or %s", c.Bridge.Transport, bridgemq.TransportGrpc, bridgemq.TransportTcp)
+		}
+		if c.Bridge.PipeTLS.Cert != "" && (c.Bridge.PipeTLS.Key == "" || c.Bridge.PipeTLS.CA == "") {
+			add("bridge.pipe_tls", "ca, cert and key are required to enable tls on the pipe")
+		}
+		agents := make(map[string]bool)
+		for i, p := range c.Bridge.AgentPolicies {
+			key := fmt.Sprintf("bridge.agent_policies[%d]", i)
+			if p.Agent == "" {
+				add(key+".agent", "must not be empty, * applies to every agent")
+			} else if agents[p.Agent] {
+				add(key+".agent", "agent %q has more than one policy", p.Agent)
+			}
+			agents[p.Agent] = true
+			for j, filter := range p.Topics {
+				if !mqtt.IsValidFilter(filter, false) {
+					add(fmt.Sprintf("%s.topics[%d]", key, j), "invalid topic filter %q", filter)
+				}
+			}
+		}
+		for i, r := range c.Bridge.RateLimits {
+			key := fmt.Sprintf("bridge.rate_limits[%d]", i)
+			switch r.Direction {
+			case "", bridgemq.LimitIn, bridgemq.LimitOut, bridgemq.LimitBoth:
+			default:
+				add(key+".direction", "unknown direction %q, it must be %s, %s or %s", r.Direction, bridgemq.LimitIn, bridgemq.LimitOut, bridgemq.LimitBoth)
+			}
+			switch r.Action {
+			case "", bridgemq.LimitDrop, bridgemq.LimitDelay, bridgemq.LimitShedQos0:
+			default:
+				add(key+".action", "unknown action %q, it must be %s, %s or %s", r.Action, bridgemq.LimitDrop, bridgemq.LimitDelay, bridgemq.LimitShedQos0)
+			}
+			if r.Filter != "" && !mqtt.IsValidFilter(r.Filter, false) {
+				add(key+".filter", "invalid topic filter %q", r.Filter)
+			}
+			if r.Messages < 0 || r.Bytes < 0 || (r.Messages == 0 && r.Bytes == 0) {
+				add(key+".messages", "messages or bytes must be positive and none of them negative")
+			}
+		}
+		if c.Bridge.RateLimitMaxDelay < 0 {
+			add("bridge.rate_limit_max_delay", "must not be negative")
+		}
+		for i, r := range c.Bridge.Priorities {
+			key := fmt.Sprintf("bridge.priorities[%d]", i)
+			if !mqtt.IsValidFilter(r.Filter, false) {
+				add(key+".filter", "invalid topic filter %q", r.Filter)
+			}
+			switch r.Priority {
+			case bridgemq.PriorityHigh, bridgemq.PriorityNormal, bridgemq.PriorityLow:
+			default:
+				add(key+".priority", "unknown priority %q, it must be %s, %s or %s", r.Priority, bridgemq.PriorityHigh, bridgemq.PriorityNormal, bridgemq.PriorityLow)
+			}
+		}
+		for i, e := range c.Bridge.Webhook.Endpoints {
+			key := fmt.Sprintf("bridge.webhook.endpoints[%d]", i)
+			if u, err := url.Parse(e.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				add(key+".url", "invalid url %q, it must be an http or https url", e.URL)
+			}
+			for j, ev := range e.Events {
+				known := false
+				for _, name := range webhook.Events {
+					known = known || ev == name
+				}
+				if !known {
+					add(fmt.Sprintf("%s.events[%d]", key, j), "unknown event %q, it must be one of %s", ev, strings.Join(webhook.Events, ", "))
+				}
+			}
+			for j, filter := range e.Topics {
+				if !mqtt.IsValidFilter(filter, false) {
+					add(fmt.Sprintf("%s.topics[%d]", key, j), "invalid topic filter %q", filter)
+				}
+			}
+		}
+		w := &c.Bridge.Webhook
+		if w.BatchSize < 0 || w.Retries < 0 || w.QueueSize < 0 || w.QueueMaxBytes < 0 {
+			add("bridge.webhook.batch_size", "batch_size, retries, queue_size and queue_max_bytes must not be negative")
+		}
+		if w.BatchLinger < 0 || w.Timeout < 0 || w.Backoff < 0 || w.MaxBackoff < 0 || w.RetryInterval < 0 {
+			add("bridge.webhook.batch_linger", "batch_linger, timeout, backoff, max_backoff and retry_interval must not be negative")
+		}
+		switch c.Bridge.PipeScheduling {
+		case bridgemq.SchedulingStrict:
+		case bridgemq.SchedulingWeighted:
+			if len(c.Bridge.PipeWeights) != 3 {
+				add("bridge.pipe_weights", "must be the 3 weights of the high, normal and low priorities")
+			}
+			for _, w := range c.Bridge.PipeWeights {
+				if w <= 0 {
+					add("bridge.pipe_weights", "must be positive")
+					break
+				}
+			}
+		default:
+			add("bridge.pipe_scheduling", "unknown scheduling %q, it must be %s or %s", c.Bridge.PipeScheduling, bridgemq.SchedulingStrict, bridgemq.SchedulingWeighted)
+		}
+		switch c.Bridge.PeerPolicy {
+		case bridgemq.PolicyRoundRobin, bridgemq.PolicyNearest, bridgemq.PolicyZone:
+		default:
+			add("bridge.peer_policy", "unknown policy %q, it must be %s, %s or %s", c.Bridge.PeerPolicy, bridgemq.PolicyRoundRobin, bridgemq.PolicyNearest, bridgemq.PolicyZone)
+		}
+		if c.Bridge.DrainRate < 0 {
+			add("bridge.drain_rate", "must not be negative")
+		}
+		if c.Bridge.DrainTimeout < 0 {
+			add("bridge.drain_timeout", "must not be negative")
+		}
+		if c.Bridge.JoinBackoff < 0 || c.Bridge.JoinMaxBackoff < 0 {
+			add("bridge.join_backoff", "join_backoff and join_max_backoff must not be negative")
+		}
+		if c.Bridge.SysInterval < 0 {
+			add("bridge.sys_interval", "must not be negative")
+		}
+		if c.Bridge.PipeKeepAlive < 0 || c.Bridge.PipeKeepAliveTimeout < 0 {
+			add("bridge.pipe_keepalive", "pipe_keepalive and pipe_keepalive_timeout must not be negative")
+		}
+		if c.Bridge.PipeBackoff < 0 || c.Bridge.PipeMaxBackoff < 0 {
+			add("bridge.pipe_backoff", "pipe_backoff and pipe_max_backoff must not be negative")
+		}
+		if c.Bridge.PipeBatchSize < 0 || c.Bridge.PipeBatchBytes < 0 || c.Bridge.PipeBatchLinger < 0 {
+			add("bridge.pipe_batch_size", "pipe_batch_size, pipe_batch_bytes and pipe_batch_linger must not be negative")
+		}
+		if c.Bridge.PipeMaxMsgSize < 0 || c.Bridge.PipeMaxPayloadSize < 0 || c.Bridge.PipeChunkSize < 0 || c.Bridge.PipeChunkTimeout < 0 {
+			add("bridge.pipe_max_msg_size", "pipe_max_msg_size, pipe_max_payload_size, pipe_chunk_size and pipe_chunk_timeout must not be negative")
+		}
+		if c.Bridge.PipeMaxMsgSize > 0 {
+			if c.Bridge.PipeChunkSize >= c.Bridge.PipeMaxMsgSize {
+				add("bridge.pipe_chunk_size", "must be smaller than pipe_max_msg_size %d", c.Bridge.PipeMaxMsgSize)
+			}
+			if c.Bridge.PipeBatchBytes >= c.Bridge.PipeMaxMsgSize {
+				add("bridge.pipe_batch_bytes", "must be smaller than pipe_max_msg_size %d", c.Bridge.PipeMaxMsgSize)
+			}
+		}
+		if c.Bridge.ExpectedSize < 0 {
+			add("bridge.expected_size", "must not be negative")
+		}
+		if c.Bridge.RejoinInterval < 0 {
+			add("bridge.rejoin_interval", "must not be negative")
+		}
+		if c.Bridge.EncryptKey != "" {
+			key, err := base64.StdEncoding.DecodeString(c.Bridge.EncryptKey)
+			if err != nil {
+				add("bridge.encrypt_key", "must be base64 encoded, %s", err.Error())
+			} else if l := len(key); l != 16 && l != 24 && l != 32 {
+				add("bridge.encrypt_key", "must be 16, 24 or 32 bytes, got %d bytes", l)
+			}
+		}
+	}
+
+	for i, r := range c.Rules {
+		if !mqtt.IsValidFilter(r.Filter, false) {
+			add(fmt.Sprintf("rules[%d].filter", i), "invalid topic filter %q", r.Filter)
+		}
+		if r.Action != bridgemq.RuleForward && r.Action != bridgemq.RuleDrop {
+			add(fmt.Sprintf("rules[%d].action", i), "unknown action %q, it must be %s or %s", r.Action, bridgemq.RuleForward, bridgemq.RuleDrop)
+		}
+	}
+
+	if _, err := zerolog.ParseLevel(c.Log.Level); err != nil {
+		add("log.level", "unknown level %q", c.Log.Level)
+	}
+	if _, err := zerolog.ParseLevel(c.Log.SerfLevel); err != nil {
+		add("log.serf_level", "unknown level %q", c.Log.SerfLevel)
+	}
+	if c.Log.MaxSize < 0 || c.Log.MaxBackups < 0 || c.Log.MaxAge < 0 {
+		add("log", "max_size, max_backups and max_age must not be negative")
+	}
+
+	checkAddr("admin.rpc_addr", c.Admin.RpcAddr)
+	if c.Admin.RpcAddr != "" && c.Admin.RpcToken == "" && !admin.Loopback(c.Admin.RpcAddr) {
+		add("admin.rpc_token", "is required when admin.rpc_addr %s is not a loopback address", c.Admin.RpcAddr)
+	}
+	checkAddr("admin.health_addr", c.Admin.HealthAddr)
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	return validatePort(port)
+}
+
+func validatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("port must be a number between 1 and 65535")
+	}
+	return nil
+}
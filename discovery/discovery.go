@@ -1,6 +1,19 @@
 package discovery
 
-import "github.com/werbenhu/bridgemq/agent"
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/werbenhu/bridgemq/agent"
+)
+
+// The errors returned by Start are wrapping one of these errors
+var (
+	ErrInvalidAddr = errors.New("discovery invalid address")
+	ErrBind        = errors.New("discovery bind failed")
+	ErrJoin        = errors.New("discovery join failed")
+)
 
 type Handler interface {
 	OnAgentJoin(*agent.Agent)
@@ -12,6 +25,60 @@ type Discovery interface {
 	SetHandler(Handler)
 	Agents() []*agent.Agent
 	LocalAgent() *agent.Agent
+	// Start binds the listeners and joins the seeds, the discovery must be stopped if it fails
 	Start() error
 	Stop()
 }
+
+// Cluster is implemented by the discoveries which can operate the cluster membership at runtime.
+type Cluster interface {
+	// Members returns all the known members including the failed and left ones.
+	Members() []*agent.Agent
+	Join(members []string) (int, error)
+	Leave() error
+	ForceLeave(name string) error
+}
+
+// Keyring is implemented by the discoveries which encrypt the gossip traffic.
+type Keyring interface {
+	InstallKey(key string) error
+	UseKey(key string) error
+	RemoveKey(key string) error
+	// ListKeys returns the installed keys and the number of agents which have installed each key.
+	ListKeys() (map[string]int, int, error)
+}
+
+// Tagger is implemented by the discoveries which can change the tags of the local agent at runtime.
+type Tagger interface {
+	// SetTag sets a tag of the local agent and propagates it to the other agents.
+	SetTag(key string, value string) error
+}
+
+// Coordinates is implemented by the discoveries which estimate the network latency between the agents.
+type Coordinates interface {
+	// RTT returns the estimated round trip time to an agent, false if it is not known yet.
+	RTT(name string) (time.Duration, bool)
+}
+
+// Messenger is implemented by the discoveries which can send small control messages to
+// all the agents through the gossip, they are delivered even if the pipe to an agent is down.
+type Messenger interface {
+	// Broadcast sends a user event to all the agents including the local agent.
+	Broadcast(name string, payload []byte) error
+	// Query sends a query to all the agents including the local agent and returns the
+	// responses received before ctx is done or the query times out.
+	Query(ctx context.Context, name string, payload []byte) ([]Response, error)
+}
+
+// Response is the response of an agent to a query.
+type Response struct {
+	From    string
+	Payload []byte
+}
+
+// MessageHandler is implemented by the handlers receiving the user events and the queries of a Messenger.
+type MessageHandler interface {
+	OnEvent(name string, payload []byte)
+	// OnQuery answers a query sent by the agent from, the query is not answered if ok is false.
+	OnQuery(from string, name string, payload []byte) (resp []byte, ok bool)
+}
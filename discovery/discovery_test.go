@@ -0,0 +1,49 @@
+package discovery
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/werbenhu/bridgemq/agent"
+)
+
+// testHandler records the agents joined and left
+type testHandler struct {
+	sync.Mutex
+	joined []string
+	left   []string
+}
+
+func (h *testHandler) OnAgentJoin(a *agent.Agent) {
+	h.Lock()
+	defer h.Unlock()
+	h.joined = append(h.joined, a.Id)
+}
+
+func (h *testHandler) OnAgentLeave(a *agent.Agent) {
+	h.Lock()
+	defer h.Unlock()
+	h.left = append(h.left, a.Id)
+}
+
+func (h *testHandler) OnAgentUpdate(a *agent.Agent) {}
+
+// events returns the number of agents joined and left
+func (h *testHandler) events() (int, int) {
+	h.Lock()
+	defer h.Unlock()
+	return len(h.joined), len(h.left)
+}
+
+// waitFor waits until cond is true, the test fails after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
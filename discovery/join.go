@@ -0,0 +1,95 @@
+package discovery
+
+import (
+	"errors"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	defaultJoinBackoff    = time.Second
+	defaultJoinMaxBackoff = 30 * time.Second
+	defaultRejoinInterval = 30 * time.Second
+)
+
+// errNoneJoined is the error of a join which contacted no member without failing, such as
+// a join whose seeds resolve to no address
+var errNoneJoined = errors.New("no member contacted")
+
+// retryJoin joins the members, the join is retried with an exponential backoff until one member
+// is contacted, until it has been retried the given times or until the discovery is stopped.
+// It is retried until it succeeds if retries is negative.
+func (s *Serf) retryJoin(members []string, retries int) error {
+	backoff, maxBackoff := s.opts.JoinBackoff, s.opts.JoinMaxBackoff
+	if backoff <= 0 {
+		backoff = defaultJoinBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = defaultJoinMaxBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		n, err := s.Join(members)
+		if n > 0 {
+			s.logger.Info().Strs("seeds", members).Int("joined", n).Int("attempt", attempt+1).Msg("serf discovery joined the cluster")
+			return nil
+		}
+		if err == nil {
+			err = errNoneJoined
+		}
+		if retries >= 0 && attempt >= retries {
+			return err
+		}
+
+		s.logger.Warn().Err(err).Strs("seeds", members).Int("attempt", attempt+1).Dur("backoff", backoff).Msg("serf discovery join failed, retrying")
+		select {
+		case <-time.After(backoff):
+		case <-s.stopped:
+			return err
+		}
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// rejoin joins the members every RejoinInterval while less than ExpectedSize agents are alive,
+// so that the partitions are merged once the other agents are reachable again
+func (s *Serf) rejoin(members []string) {
+	interval := s.opts.RejoinInterval
+	if interval <= 0 {
+		interval = defaultRejoinInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stopped:
+			return
+		}
+
+		alive := 0
+		for _, member := range s.serf.Members() {
+			if member.Status == serf.StatusAlive {
+				alive++
+			}
+		}
+		if alive >= s.opts.ExpectedSize {
+			continue
+		}
+
+		n, err := s.Join(members)
+		if err == nil && n == 0 {
+			err = errNoneJoined
+		}
+		if n > 0 {
+			s.logger.Info().Strs("seeds", members).Int("alive", alive).Int("expected", s.opts.ExpectedSize).Msg("serf discovery rejoined the cluster")
+		} else {
+			s.logger.Warn().Err(err).Strs("seeds", members).Int("alive", alive).Int("expected", s.opts.ExpectedSize).Msg("serf discovery rejoin failed")
+		}
+	}
+}
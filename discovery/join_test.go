@@ -0,0 +1,84 @@
+package discovery
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func newTestSerf(t *testing.T, name string) *Serf {
+	t.Helper()
+	logger := zerolog.Nop()
+	s := NewSerf(&Opt{
+		Addr:        "127.0.0.1:0",
+		Advertise:   "127.0.0.1:0",
+		Name:        name,
+		PipePort:    "0",
+		JoinBackoff: 10 * time.Millisecond,
+		Logger:      &logger,
+	})
+	s.SetHandler(new(testHandler))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	return s
+}
+
+func TestRetryJoinNoneJoined(t *testing.T) {
+	s := newTestSerf(t, "a")
+	if err := s.retryJoin(nil, 1); !errors.Is(err, errNoneJoined) {
+		t.Fatalf("retryJoin without address returned %v, want %v", err, errNoneJoined)
+	}
+}
+
+func TestRetryJoin(t *testing.T) {
+	a := newTestSerf(t, "a")
+	b := newTestSerf(t, "b")
+	addr := a.serf.Memberlist().LocalNode().Address()
+	if err := b.retryJoin([]string{addr}, 1); err != nil {
+		t.Fatalf("retryJoin %s failed: %v", addr, err)
+	}
+}
+
+func TestStartJoinInBackground(t *testing.T) {
+	// the seed is started after the agent on a port free for now
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed := l.Addr().String()
+	l.Close()
+
+	logger := zerolog.Nop()
+	a := NewSerf(&Opt{
+		Addr:        "127.0.0.1:0",
+		Advertise:   "127.0.0.1:0",
+		Name:        "a",
+		PipePort:    "0",
+		Members:     seed,
+		JoinRetries: -1,
+		JoinBackoff: 10 * time.Millisecond,
+		Logger:      &logger,
+	})
+	a.SetHandler(new(testHandler))
+	start := time.Now()
+	if err := a.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(a.Stop)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("start blocked %s while the seed is down", elapsed)
+	}
+
+	b := NewSerf(&Opt{Addr: seed, Advertise: seed, Name: "b", PipePort: "0", Logger: &logger})
+	b.SetHandler(new(testHandler))
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(b.Stop)
+	waitFor(t, "the agent joined the seed started later", func() bool { return len(b.Members()) == 2 })
+}
@@ -0,0 +1,409 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/werbenhu/bridgemq/agent"
+)
+
+const (
+	DefaultKVPrefix = "/bridgemq/agents/"
+	defaultKVTTL    = 10 * time.Second
+
+	// kvTimeout bounds a request to the kv store
+	kvTimeout = 5 * time.Second
+
+	// kvWatchBackoff is the wait before watching again when the kv store closed the watch
+	kvWatchBackoff = time.Second
+)
+
+// LeaseID identifies a lease of the kv store, the keys attached to a lease are deleted when it expires
+type LeaseID int64
+
+type KVEventType int
+
+const (
+	KVPut KVEventType = iota
+	KVDelete
+)
+
+// KVEvent is a change of a key watched
+type KVEvent struct {
+	Type  KVEventType
+	Key   string
+	Value []byte
+}
+
+// KVStore is the key value store of the KV discovery, it can be implemented for etcd or consul.
+type KVStore interface {
+	// Grant creates a lease which expires after ttl unless it is kept alive
+	Grant(ctx context.Context, ttl time.Duration) (LeaseID, error)
+	// KeepAlive renews the lease once, it fails if the lease has expired
+	KeepAlive(ctx context.Context, lease LeaseID) error
+	// Revoke deletes the lease and the keys attached to it
+	Revoke(ctx context.Context, lease LeaseID) error
+	// Put sets the value of the key attached to the lease
+	Put(ctx context.Context, key string, value []byte, lease LeaseID) error
+	Delete(ctx context.Context, key string) error
+	// Watch sends a put event for every key under the prefix and then the changes of
+	// the keys under the prefix, the channel is closed when ctx is done
+	Watch(ctx context.Context, prefix string) (<-chan KVEvent, error)
+}
+
+type KVOpt struct {
+	Store KVStore
+
+	// Prefix is the prefix of the keys of the agents, DefaultKVPrefix if it is empty
+	Prefix string
+
+	// TTL is the ttl of the lease of the local agent, which is kept alive every third of the ttl
+	TTL time.Duration
+
+	Name     string
+	Addr     string
+	PipePort string
+	Endpoint string
+	Zone     string
+
+	Logger *zerolog.Logger
+}
+
+// kvAgent is the value of the key of an agent
+type kvAgent struct {
+	Name     string            `json:"name"`
+	Addr     string            `json:"addr"`
+	PipePort string            `json:"pipe_port"`
+	Tags     map[string]string `json:"tags"`
+}
+
+// KV is a discovery registering the local agent in a kv store with a lease and watching the
+// keys of the other agents, the agents whose lease expires leave the cluster.
+type KV struct {
+	opts    *KVOpt
+	handler Handler
+	logger  *zerolog.Logger
+	prefix  string
+	ttl     time.Duration
+
+	local  atomic.Pointer[agent.Agent]
+	agents sync.Map
+
+	sync.Mutex
+	lease LeaseID
+
+	// deleted is set when the key of the local agent is deleted while its lease is alive, such as
+	// by a force leave, the agent is registered again when the lease is renewed
+	deleted atomic.Bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewKV(opts *KVOpt) *KV {
+	k := &KV{
+		opts:   opts,
+		logger: opts.Logger,
+		prefix: opts.Prefix,
+		ttl:    opts.TTL,
+	}
+	if k.logger == nil {
+		logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
+		k.logger = &logger
+	}
+	if k.prefix == "" {
+		k.prefix = DefaultKVPrefix
+	}
+	if k.ttl <= 0 {
+		k.ttl = defaultKVTTL
+	}
+
+	local := agent.New(opts.Name, opts.Addr, 0, opts.PipePort)
+	local.Tags[PortKey] = opts.PipePort
+	if opts.Endpoint != "" {
+		local.Tags[EndpointKey] = opts.Endpoint
+	}
+	if opts.Zone != "" {
+		local.Tags[ZoneKey] = opts.Zone
+	}
+	k.local.Store(local)
+	return k
+}
+
+func (k *KV) SetHandler(h Handler) {
+	k.handler = h
+}
+
+func (k *KV) LocalAgent() *agent.Agent {
+	return k.local.Load()
+}
+
+func (k *KV) Agents() []*agent.Agent {
+	nodes := []*agent.Agent{k.local.Load()}
+	k.agents.Range(func(key any, val any) bool {
+		nodes = append(nodes, val.(*agent.Agent))
+		return true
+	})
+	return nodes
+}
+
+// Members returns the agents registered in the kv store
+func (k *KV) Members() []*agent.Agent {
+	return k.Agents()
+}
+
+// Join is not supported, the agents are discovered from the kv store
+func (k *KV) Join(members []string) (int, error) {
+	return 0, fmt.Errorf("%w, the kv discovery discovers the agents from the kv store", ErrJoin)
+}
+
+// Leave revokes the lease of the local agent, the other agents see its key deleted
+func (k *KV) Leave() error {
+	k.Lock()
+	defer k.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), kvTimeout)
+	defer cancel()
+	if err := k.opts.Store.Revoke(ctx, k.lease); err != nil {
+		return err
+	}
+	k.local.Store(clone(k.local.Load(), agent.StatusLeft))
+	return nil
+}
+
+// ForceLeave deletes the key of an agent, the agent registers again when it renews its lease if it is running
+func (k *KV) ForceLeave(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), kvTimeout)
+	defer cancel()
+	return k.opts.Store.Delete(ctx, k.prefix+name)
+}
+
+// SetTag sets a tag of the local agent and writes it to the kv store
+func (k *KV) SetTag(key string, value string) error {
+	local := k.local.Load()
+	local = clone(local, local.Status)
+	local.Tags[key] = value
+	k.local.Store(local)
+
+	k.Lock()
+	defer k.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), kvTimeout)
+	defer cancel()
+	return k.put(ctx)
+}
+
+func (k *KV) Start() error {
+	if k.opts.Store == nil {
+		return fmt.Errorf("kv discovery store can not be nil")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), kvTimeout)
+	defer cancel()
+	if err := k.register(ctx); err != nil {
+		return fmt.Errorf("%w, kv discovery register agent err:%s", ErrJoin, err.Error())
+	}
+
+	k.ctx, k.cancel = context.WithCancel(context.Background())
+	events, err := k.opts.Store.Watch(k.ctx, k.prefix)
+	if err != nil {
+		k.cancel()
+		k.revoke()
+		return fmt.Errorf("%w, kv discovery watch prefix:%s err:%s", ErrJoin, k.prefix, err.Error())
+	}
+
+	k.wg.Add(2)
+	go k.watch(events)
+	go k.keepAlive(k.ctx)
+	k.logger.Info().Str("prefix", k.prefix).Dur("ttl", k.ttl).Msg("kv discovery started")
+	return nil
+}
+
+// Stop stops watching and revokes the lease of the local agent, so that the other agents see it leave at once
+func (k *KV) Stop() {
+	if k.cancel == nil {
+		return
+	}
+	k.cancel()
+	k.wg.Wait()
+	if k.local.Load().Status != agent.StatusLeft {
+		k.revoke()
+	}
+}
+
+// revoke revokes the lease of the local agent, its key is deleted
+func (k *KV) revoke() {
+	k.Lock()
+	defer k.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), kvTimeout)
+	defer cancel()
+	if err := k.opts.Store.Revoke(ctx, k.lease); err != nil {
+		k.logger.Warn().Err(err).Msg("kv discovery revoke lease failed, the agent leaves when it expires")
+	}
+}
+
+// register grants a new lease and writes the local agent attached to it
+func (k *KV) register(ctx context.Context) error {
+	k.Lock()
+	defer k.Unlock()
+	lease, err := k.opts.Store.Grant(ctx, k.ttl)
+	if err != nil {
+		return err
+	}
+	k.lease = lease
+	return k.put(ctx)
+}
+
+// put writes the local agent, the lock must be held
+func (k *KV) put(ctx context.Context) error {
+	local := k.local.Load()
+	value, err := json.Marshal(&kvAgent{
+		Name:     local.Id,
+		Addr:     local.Addr,
+		PipePort: local.PipePort,
+		Tags:     local.Tags,
+	})
+	if err != nil {
+		return err
+	}
+	return k.opts.Store.Put(ctx, k.prefix+local.Id, value, k.lease)
+}
+
+// keepAlive renews the lease every third of the ttl, the agent is registered again if the lease has expired
+func (k *KV) keepAlive(ctx context.Context) {
+	defer k.wg.Done()
+	ticker := time.NewTicker(k.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if k.local.Load().Status == agent.StatusLeft {
+			continue
+		}
+
+		reqCtx, cancel := context.WithTimeout(ctx, kvTimeout)
+		k.Lock()
+		err := k.opts.Store.KeepAlive(reqCtx, k.lease)
+		if err == nil && k.deleted.Swap(false) {
+			k.logger.Warn().Msg("kv discovery key of the agent was deleted, registering again")
+			err = k.put(reqCtx)
+		}
+		k.Unlock()
+		if err != nil {
+			k.logger.Warn().Err(err).Msg("kv discovery keep alive lease failed, registering again")
+			if err = k.register(reqCtx); err != nil {
+				k.deleted.Store(true)
+				k.logger.Error().Err(err).Msg("kv discovery register agent failed")
+			}
+		}
+		cancel()
+	}
+}
+
+// watch turns the changes of the keys of the other agents into joins, updates and leaves. When the
+// kv store closes the watch, the prefix is watched again, the agents whose key is not put again
+// within the ttl are deleted meanwhile and leave.
+func (k *KV) watch(events <-chan KVEvent) {
+	defer k.wg.Done()
+	for {
+		k.handle(events, nil)
+		if k.ctx.Err() != nil {
+			return
+		}
+		k.logger.Warn().Str("prefix", k.prefix).Msg("kv discovery watch closed by the store, watching again")
+
+		for {
+			select {
+			case <-time.After(kvWatchBackoff):
+			case <-k.ctx.Done():
+				return
+			}
+			var err error
+			if events, err = k.opts.Store.Watch(k.ctx, k.prefix); err == nil {
+				break
+			}
+			k.logger.Error().Err(err).Str("prefix", k.prefix).Msg("kv discovery watch prefix failed")
+		}
+
+		stale := make(map[string]bool)
+		k.agents.Range(func(key any, val any) bool {
+			stale[key.(string)] = true
+			return true
+		})
+		k.handle(events, stale)
+	}
+}
+
+// handle handles the events until the channel is closed. The agents of stale which are not put within
+// the ttl leave, stale is nil unless the prefix is watched again.
+func (k *KV) handle(events <-chan KVEvent, stale map[string]bool) {
+	var sweep <-chan time.Time
+	if len(stale) > 0 {
+		timer := time.NewTimer(k.ttl)
+		defer timer.Stop()
+		sweep = timer.C
+	}
+
+	for {
+		var e KVEvent
+		var ok bool
+		select {
+		case e, ok = <-events:
+			if !ok {
+				return
+			}
+		case <-sweep:
+			for name := range stale {
+				if val, ok := k.agents.LoadAndDelete(name); ok {
+					k.handler.OnAgentLeave(clone(val.(*agent.Agent), agent.StatusLeft))
+				}
+			}
+			stale, sweep = nil, nil
+			continue
+		}
+
+		name := strings.TrimPrefix(e.Key, k.prefix)
+		delete(stale, name)
+		if name == k.opts.Name {
+			if e.Type == KVDelete && k.local.Load().Status != agent.StatusLeft {
+				k.deleted.Store(true)
+			}
+			continue
+		}
+
+		switch e.Type {
+		case KVPut:
+			var value kvAgent
+			if err := json.Unmarshal(e.Value, &value); err != nil {
+				k.logger.Error().Err(err).Str("key", e.Key).Msg("kv discovery decode agent failed")
+				continue
+			}
+			node := agent.New(name, value.Addr, 0, value.PipePort)
+			for key, v := range value.Tags {
+				node.Tags[key] = v
+			}
+
+			if _, ok := k.agents.Load(name); ok {
+				k.agents.Store(name, node)
+				k.handler.OnAgentUpdate(node)
+			} else {
+				k.agents.Store(name, node)
+				k.handler.OnAgentJoin(node)
+			}
+
+		case KVDelete:
+			if val, ok := k.agents.LoadAndDelete(name); ok {
+				k.handler.OnAgentLeave(clone(val.(*agent.Agent), agent.StatusLeft))
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// closingKV is a MemoryKV whose watches can be closed as if the store dropped them
+type closingKV struct {
+	*MemoryKV
+	sync.Mutex
+	cancels   []context.CancelFunc
+	watchFail bool
+}
+
+func (c *closingKV) Watch(ctx context.Context, prefix string) (<-chan KVEvent, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.watchFail {
+		return nil, errors.New("watch failed")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	c.cancels = append(c.cancels, cancel)
+	return c.MemoryKV.Watch(ctx, prefix)
+}
+
+// closeWatches closes the watches made so far
+func (c *closingKV) closeWatches() {
+	c.Lock()
+	defer c.Unlock()
+	for _, cancel := range c.cancels {
+		cancel()
+	}
+	c.cancels = nil
+}
+
+func newTestKV(t *testing.T, store KVStore, name string, ttl time.Duration) (*KV, *testHandler) {
+	t.Helper()
+	logger := zerolog.Nop()
+	k := NewKV(&KVOpt{Store: store, TTL: ttl, Name: name, Addr: "127.0.0.1", PipePort: "8933", Logger: &logger})
+	h := new(testHandler)
+	k.SetHandler(h)
+	if err := k.Start(); err != nil {
+		t.Fatalf("start kv discovery %s err:%s", name, err)
+	}
+	t.Cleanup(k.Stop)
+	return k, h
+}
+
+func TestKVJoinStop(t *testing.T) {
+	store := NewMemoryKV()
+	_, h := newTestKV(t, store, "a", time.Minute)
+	b, hb := newTestKV(t, store, "b", time.Minute)
+
+	waitFor(t, "a sees b", func() bool { j, _ := h.events(); return j == 1 })
+	waitFor(t, "b sees a", func() bool { j, _ := hb.events(); return j == 1 })
+
+	// the lease is revoked by Stop, a sees b leave long before the ttl
+	b.Stop()
+	waitFor(t, "a sees b leave", func() bool { _, l := h.events(); return l == 1 })
+	store.Lock()
+	defer store.Unlock()
+	if len(store.values) != 1 {
+		t.Fatalf("expected the key of a only, got %d keys", len(store.values))
+	}
+}
+
+func TestKVForceLeave(t *testing.T) {
+	store := NewMemoryKV()
+	a, h := newTestKV(t, store, "a", 300*time.Millisecond)
+	newTestKV(t, store, "b", 300*time.Millisecond)
+	waitFor(t, "a sees b", func() bool { j, _ := h.events(); return j == 1 })
+
+	if err := a.ForceLeave("b"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a sees b leave", func() bool { _, l := h.events(); return l == 1 })
+
+	// b is still running, it registers again when it renews its lease
+	waitFor(t, "b registers again", func() bool { j, _ := h.events(); return j == 2 })
+}
+
+func TestKVLeaseExpired(t *testing.T) {
+	store := NewMemoryKV()
+	_, h := newTestKV(t, store, "a", time.Minute)
+
+	lease, _ := store.Grant(context.Background(), 100*time.Millisecond)
+	store.Put(context.Background(), DefaultKVPrefix+"b", []byte(`{"name":"b","addr":"127.0.0.1"}`), lease)
+	waitFor(t, "a sees b", func() bool { j, _ := h.events(); return j == 1 })
+	waitFor(t, "b expires", func() bool { _, l := h.events(); return l == 1 })
+}
+
+func TestKVRewatch(t *testing.T) {
+	store := &closingKV{MemoryKV: NewMemoryKV()}
+	_, h := newTestKV(t, store, "a", 500*time.Millisecond)
+	b, _ := newTestKV(t, store, "b", 500*time.Millisecond)
+	waitFor(t, "a sees b", func() bool { j, _ := h.events(); return j == 1 })
+
+	// b stops and c starts while the watch of a is closed, a sees them when it watches again
+	store.closeWatches()
+	b.Stop()
+	newTestKV(t, store, "c", 500*time.Millisecond)
+
+	waitFor(t, "a sees c", func() bool { j, _ := h.events(); return j == 2 })
+	waitFor(t, "a sees b leave", func() bool { _, l := h.events(); return l == 1 })
+}
+
+func TestKVStartFailed(t *testing.T) {
+	store := &closingKV{MemoryKV: NewMemoryKV(), watchFail: true}
+	logger := zerolog.Nop()
+	k := NewKV(&KVOpt{Store: store, Name: "a", Logger: &logger})
+	k.SetHandler(new(testHandler))
+	if err := k.Start(); !errors.Is(err, ErrJoin) {
+		t.Fatalf("expected ErrJoin, got %v", err)
+	}
+	if len(store.values) != 0 || len(store.leases) != 0 {
+		t.Fatalf("expected the lease revoked, got %d keys and %d leases", len(store.values), len(store.leases))
+	}
+}
+
+func TestMemoryKVWatch(t *testing.T) {
+	store := NewMemoryKV()
+	ctx := context.Background()
+	store.Put(ctx, "/p/b", []byte("b"), 0)
+	store.Put(ctx, "/p/a", []byte("a"), 0)
+	store.Put(ctx, "/q/c", []byte("c"), 0)
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	events, err := store.Watch(watchCtx, "/p/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Delete(ctx, "/p/a")
+
+	expected := []KVEvent{
+		{Type: KVPut, Key: "/p/a", Value: []byte("a")},
+		{Type: KVPut, Key: "/p/b", Value: []byte("b")},
+		{Type: KVDelete, Key: "/p/a"},
+	}
+	for i, want := range expected {
+		got := <-events
+		if got.Type != want.Type || got.Key != want.Key || string(got.Value) != string(want.Value) {
+			t.Fatalf("event %d expected %+v, got %+v", i, want, got)
+		}
+	}
+
+	cancel()
+	for range events {
+	}
+}
@@ -0,0 +1,49 @@
+package discovery
+
+import (
+	"io"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// serfLevels maps the level prefixes used by serf and memberlist to the zerolog levels
+var serfLevels = map[string]zerolog.Level{
+	"TRACE": zerolog.TraceLevel,
+	"DEBUG": zerolog.DebugLevel,
+	"INFO":  zerolog.InfoLevel,
+	"WARN":  zerolog.WarnLevel,
+	"ERR":   zerolog.ErrorLevel,
+	"ERROR": zerolog.ErrorLevel,
+}
+
+// serfWriter receives the lines written by the serf and memberlist loggers, such as
+// "2023/01/02 15:04:05 [WARN] memberlist: Refuting a suspect message", and writes the
+// lines at or above the minimum level to the zerolog logger and to the optional file.
+type serfWriter struct {
+	logger *zerolog.Logger
+	level  zerolog.Level
+	file   io.Writer
+}
+
+func (w *serfWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+	level, msg := zerolog.InfoLevel, line
+	if start := strings.Index(line, "["); start >= 0 {
+		if end := strings.Index(line[start:], "]"); end > 0 {
+			if l, ok := serfLevels[line[start+1:start+end]]; ok {
+				level, msg = l, strings.TrimSpace(line[start+end+1:])
+			}
+		}
+	}
+
+	if level < w.level {
+		return len(p), nil
+	}
+
+	w.logger.WithLevel(level).Str("component", "serf").Msg(msg)
+	if w.file != nil {
+		w.file.Write(p)
+	}
+	return len(p), nil
+}
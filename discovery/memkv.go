@@ -0,0 +1,207 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchQueueSize is the number of events buffered for a watcher of the MemoryKV
+const watchQueueSize = 64
+
+// MemoryKV is a KVStore in memory, the agents of a process can discover each other with it,
+// such as in the tests. The keys of a lease are deleted when it expires.
+type MemoryKV struct {
+	sync.Mutex
+	values   map[string]memValue
+	leases   map[LeaseID]*memLease
+	watchers map[*memWatcher]bool
+	nextId   LeaseID
+}
+
+type memValue struct {
+	value []byte
+	lease LeaseID
+}
+
+type memLease struct {
+	ttl   time.Duration
+	timer *time.Timer
+}
+
+type memWatcher struct {
+	sync.Mutex
+	prefix string
+	events chan KVEvent
+	ctx    context.Context
+	closed bool
+}
+
+// send sends an event unless the watcher is closed, it blocks while the queue is full
+func (w *memWatcher) send(e KVEvent) {
+	w.Lock()
+	defer w.Unlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.events <- e:
+	case <-w.ctx.Done():
+	}
+}
+
+func (w *memWatcher) close() {
+	w.Lock()
+	defer w.Unlock()
+	w.closed = true
+	close(w.events)
+}
+
+func NewMemoryKV() *MemoryKV {
+	return &MemoryKV{
+		values:   make(map[string]memValue),
+		leases:   make(map[LeaseID]*memLease),
+		watchers: make(map[*memWatcher]bool),
+	}
+}
+
+func (m *MemoryKV) Grant(ctx context.Context, ttl time.Duration) (LeaseID, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.nextId++
+	id := m.nextId
+	m.leases[id] = &memLease{
+		ttl: ttl,
+		timer: time.AfterFunc(ttl, func() {
+			m.revoke(id)
+		}),
+	}
+	return id, nil
+}
+
+func (m *MemoryKV) KeepAlive(ctx context.Context, lease LeaseID) error {
+	m.Lock()
+	defer m.Unlock()
+	l, ok := m.leases[lease]
+	if !ok {
+		return fmt.Errorf("lease %d not found", lease)
+	}
+	l.timer.Reset(l.ttl)
+	return nil
+}
+
+func (m *MemoryKV) Revoke(ctx context.Context, lease LeaseID) error {
+	m.revoke(lease)
+	return nil
+}
+
+func (m *MemoryKV) Put(ctx context.Context, key string, value []byte, lease LeaseID) error {
+	m.Lock()
+	if _, ok := m.leases[lease]; !ok && lease != 0 {
+		m.Unlock()
+		return fmt.Errorf("lease %d not found", lease)
+	}
+	m.values[key] = memValue{value: value, lease: lease}
+	watchers := m.watching(key)
+	m.Unlock()
+
+	m.notify(watchers, KVEvent{Type: KVPut, Key: key, Value: value})
+	return nil
+}
+
+func (m *MemoryKV) Delete(ctx context.Context, key string) error {
+	m.Lock()
+	_, ok := m.values[key]
+	delete(m.values, key)
+	watchers := m.watching(key)
+	m.Unlock()
+
+	if ok {
+		m.notify(watchers, KVEvent{Type: KVDelete, Key: key})
+	}
+	return nil
+}
+
+func (m *MemoryKV) Watch(ctx context.Context, prefix string) (<-chan KVEvent, error) {
+	m.Lock()
+	keys := make([]string, 0)
+	for key := range m.values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	initial := make([]KVEvent, 0, len(keys))
+	for _, key := range keys {
+		initial = append(initial, KVEvent{Type: KVPut, Key: key, Value: m.values[key].value})
+	}
+	// the queue holds the initial events, they are queued with the lock held so that
+	// the changes made meanwhile follow them
+	w := &memWatcher{
+		prefix: prefix,
+		events: make(chan KVEvent, len(initial)+watchQueueSize),
+		ctx:    ctx,
+	}
+	for _, e := range initial {
+		w.events <- e
+	}
+	m.watchers[w] = true
+	m.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		m.Lock()
+		delete(m.watchers, w)
+		m.Unlock()
+		w.close()
+	}()
+
+	return w.events, nil
+}
+
+// revoke deletes the lease and its keys
+func (m *MemoryKV) revoke(lease LeaseID) {
+	m.Lock()
+	l, ok := m.leases[lease]
+	if !ok {
+		m.Unlock()
+		return
+	}
+	l.timer.Stop()
+	delete(m.leases, lease)
+
+	keys := make([]string, 0)
+	for key, v := range m.values {
+		if v.lease == lease {
+			keys = append(keys, key)
+		}
+	}
+	m.Unlock()
+
+	for _, key := range keys {
+		m.Delete(context.Background(), key)
+	}
+}
+
+// watching returns the watchers of the key, the lock must be held
+func (m *MemoryKV) watching(key string) []*memWatcher {
+	watchers := make([]*memWatcher, 0)
+	for w := range m.watchers {
+		if strings.HasPrefix(key, w.prefix) {
+			watchers = append(watchers, w)
+		}
+	}
+	return watchers
+}
+
+// notify sends the events to the watchers
+func (m *MemoryKV) notify(watchers []*memWatcher, events ...KVEvent) {
+	for _, w := range watchers {
+		for _, e := range events {
+			w.send(e)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// resolveTimeout bounds the lookups of the seeds of a join attempt
+const resolveTimeout = 10 * time.Second
+
+// IsSRV reports whether the seed is an SRV name such as _bridgemq._tcp.example.com,
+// which has no port and whose first label starts with an underscore
+func IsSRV(seed string) bool {
+	return strings.HasPrefix(seed, "_") && !strings.Contains(seed, ":")
+}
+
+// ResolveSeeds resolves the seeds into ip:port addresses. A seed can be an ip:port address, a host:port
+// address whose host resolves to several A/AAAA records, or an SRV name providing the hosts and the ports.
+// The seeds and the SRV targets failing to resolve are skipped and logged if logger is not nil, an error
+// is only returned if no seed is resolved.
+func ResolveSeeds(ctx context.Context, resolver *net.Resolver, seeds []string, logger *zerolog.Logger) ([]string, error) {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	if logger == nil {
+		nop := zerolog.Nop()
+		logger = &nop
+	}
+
+	addrs := make([]string, 0, len(seeds))
+	seen := make(map[string]bool)
+	add := func(addr string) {
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+
+	var errs []string
+	for _, seed := range seeds {
+		resolved, err := resolveSeed(ctx, resolver, seed, logger)
+		if err != nil {
+			logger.Warn().Err(err).Str("seed", seed).Msg("resolve seed failed, it is skipped")
+			errs = append(errs, err.Error())
+			continue
+		}
+		for _, addr := range resolved {
+			add(addr)
+		}
+	}
+
+	if len(addrs) == 0 && len(errs) > 0 {
+		return nil, fmt.Errorf("resolve seeds failed, %s", strings.Join(errs, "; "))
+	}
+	return addrs, nil
+}
+
+// resolveSeed resolves a seed, the targets of an SRV name failing to resolve are skipped,
+// it fails if none of them is resolved
+func resolveSeed(ctx context.Context, resolver *net.Resolver, seed string, logger *zerolog.Logger) ([]string, error) {
+	if IsSRV(seed) {
+		_, records, err := resolver.LookupSRV(ctx, "", "", seed)
+		if err != nil {
+			return nil, fmt.Errorf("lookup srv:%s err:%s", seed, err.Error())
+		}
+
+		addrs := make([]string, 0, len(records))
+		var errs []string
+		for _, record := range records {
+			host := strings.TrimSuffix(record.Target, ".")
+			resolved, err := resolveHost(ctx, resolver, host, strconv.Itoa(int(record.Port)))
+			if err != nil {
+				logger.Warn().Err(err).Str("seed", seed).Str("target", host).Msg("resolve srv target failed, it is skipped")
+				errs = append(errs, err.Error())
+				continue
+			}
+			addrs = append(addrs, resolved...)
+		}
+		if len(addrs) == 0 && len(errs) > 0 {
+			return nil, fmt.Errorf("srv:%s no target resolved, %s", seed, strings.Join(errs, "; "))
+		}
+		return addrs, nil
+	}
+
+	host, port, err := net.SplitHostPort(seed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid seed:%s err:%s", seed, err.Error())
+	}
+	return resolveHost(ctx, resolver, host, port)
+}
+
+// resolveHost returns the addresses of all the A/AAAA records of host, host is returned as is if it is an ip
+func resolveHost(ctx context.Context, resolver *net.Resolver, host string, port string) ([]string, error) {
+	if host == "" || net.ParseIP(host) != nil {
+		return []string{net.JoinHostPort(host, port)}, nil
+	}
+
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("lookup host:%s err:%s", host, err.Error())
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	return addrs, nil
+}
@@ -0,0 +1,114 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startDNS serves the records on a local udp port and returns a resolver querying it
+func startDNS(t *testing.T, records map[string][]dns.RR) *net.Resolver {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		q := req.Question[0]
+		rrs, ok := records[q.Name]
+		if !ok {
+			resp.Rcode = dns.RcodeNameError
+		}
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == q.Qtype {
+				resp.Answer = append(resp.Answer, rr)
+			}
+		}
+		w.WriteMsg(resp)
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+}
+
+func rr(t *testing.T, s string) dns.RR {
+	t.Helper()
+	r, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestResolveSeeds(t *testing.T) {
+	resolver := startDNS(t, map[string][]dns.RR{
+		"_bridgemq._tcp.example.test.": {
+			rr(t, "_bridgemq._tcp.example.test. 60 IN SRV 10 10 7001 a.example.test."),
+			rr(t, "_bridgemq._tcp.example.test. 60 IN SRV 10 10 7002 b.example.test."),
+			rr(t, "_bridgemq._tcp.example.test. 60 IN SRV 10 10 7003 missing.example.test."),
+		},
+		"_broken._tcp.example.test.": {
+			rr(t, "_broken._tcp.example.test. 60 IN SRV 10 10 7003 missing.example.test."),
+		},
+		"a.example.test.": {rr(t, "a.example.test. 60 IN A 127.0.0.1")},
+		"b.example.test.": {
+			rr(t, "b.example.test. 60 IN A 127.0.0.2"),
+			rr(t, "b.example.test. 60 IN A 127.0.0.3"),
+		},
+	})
+
+	tests := []struct {
+		name  string
+		seeds []string
+		addrs []string
+		err   bool
+	}{
+		{name: "ip", seeds: []string{"10.0.0.1:7933"}, addrs: []string{"10.0.0.1:7933"}},
+		{name: "host with several records", seeds: []string{"b.example.test:7933"}, addrs: []string{"127.0.0.2:7933", "127.0.0.3:7933"}},
+		{name: "srv skips the target failing", seeds: []string{"_bridgemq._tcp.example.test"}, addrs: []string{"127.0.0.1:7001", "127.0.0.2:7002", "127.0.0.3:7002"}},
+		{name: "srv without target resolved", seeds: []string{"_broken._tcp.example.test"}, err: true},
+		{name: "seed failing is skipped", seeds: []string{"missing.example.test:7933", "a.example.test:7933"}, addrs: []string{"127.0.0.1:7933"}},
+		{name: "duplicates removed", seeds: []string{"a.example.test:7933", "127.0.0.1:7933"}, addrs: []string{"127.0.0.1:7933"}},
+		{name: "no seed resolved", seeds: []string{"missing.example.test:7933"}, err: true},
+		{name: "invalid seed", seeds: []string{"a.example.test"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrs, err := ResolveSeeds(context.Background(), resolver, tt.seeds, nil)
+			if (err != nil) != tt.err {
+				t.Fatalf("ResolveSeeds(%v) error %v, want error %v", tt.seeds, err, tt.err)
+			}
+			sort.Strings(addrs)
+			if !tt.err && !reflect.DeepEqual(addrs, tt.addrs) {
+				t.Fatalf("ResolveSeeds(%v) = %v, want %v", tt.seeds, addrs, tt.addrs)
+			}
+		})
+	}
+}
+
+func TestIsSRV(t *testing.T) {
+	tests := map[string]bool{
+		"_bridgemq._tcp.example.com": true,
+		"example.com:7933":           false,
+		"_host:7933":                 false,
+		"10.0.0.1:7933":              false,
+	}
+	for seed, want := range tests {
+		if got := IsSRV(seed); got != want {
+			t.Errorf("IsSRV(%q) = %v, want %v", seed, got, want)
+		}
+	}
+}
@@ -1,30 +1,46 @@
 package discovery
 
 import (
-	"io"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/fs"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/hashicorp/logutils"
 	"github.com/hashicorp/serf/serf"
 	"github.com/natefinch/lumberjack"
+	"github.com/rs/zerolog"
 	"github.com/werbenhu/bridgemq/agent"
 )
 
 const (
 	PortKey = "pipe_port"
+
+	// EndpointKey is the tag holding the mqtt address the clients can connect to
+	EndpointKey = "endpoint"
+
+	// DrainingKey is the tag set to "true" while the agent is draining its clients
+	DrainingKey = "draining"
+
+	// ZoneKey is the tag holding the zone of the agent, such as an availability zone or a region
+	ZoneKey = "zone"
 )
 
 type Serf struct {
 	events  chan serf.Event
+	stopped chan struct{}
 	opts    *Opt
 	serf    *serf.Serf
 	handler Handler
 	agents  sync.Map
+	logger  *zerolog.Logger
 }
 
 type Opt struct {
@@ -33,12 +49,60 @@ type Opt struct {
 	Name      string
 	Members   string
 	PipePort  string
+
+	// Endpoint is the mqtt address of the local broker advertised in the endpoint tag,
+	// the clients of a draining agent are redirected to the endpoints of the other agents.
+	Endpoint string
+
+	// Zone is advertised in the zone tag, the agents of the same zone are preferred by the zone policy.
+	Zone string
+
+	// EncryptKey is a base64 encoded 16, 24 or 32 bytes key to encrypt the gossip traffic,
+	// if it is empty the gossip traffic is not encrypted.
+	EncryptKey string
+
+	// Logger is the logger of the discovery, the serf and memberlist logs are written to it too.
+	Logger *zerolog.Logger
+
+	// SerfLogLevel is the minimum level of the serf and memberlist logs, warn by default.
+	SerfLogLevel string
+
+	// SerfLogFile is a file the serf and memberlist logs are also written to, it is rotated
+	// every 10 megabytes. The logs are only written to the Logger if it is empty.
+	SerfLogFile string
+
+	// JoinRetries is the number of times joining the members is retried by Start, the join
+	// is retried in the background until it succeeds if it is negative.
+	JoinRetries int
+
+	// JoinBackoff is the wait before the first retry, it doubles on every retry up to
+	// JoinMaxBackoff. They are 1 second and 30 seconds if not set.
+	JoinBackoff    time.Duration
+	JoinMaxBackoff time.Duration
+
+	// ExpectedSize is the number of agents expected in the cluster, the members are joined
+	// again every RejoinInterval while less agents are alive. 0 disables the rejoin.
+	ExpectedSize   int
+	RejoinInterval time.Duration
+
+	// Resolver resolves the dns and srv names of the members, net.DefaultResolver is used if it is nil.
+	Resolver *net.Resolver
+
+	// SnapshotPath is a file recording the members, a restarted agent rejoins the members
+	// recorded in it. No snapshot is recorded if it is empty.
+	SnapshotPath string
 }
 
 func NewSerf(opts *Opt) *Serf {
 	s := &Serf{
-		events: make(chan serf.Event),
-		opts:   opts,
+		events:  make(chan serf.Event),
+		stopped: make(chan struct{}),
+		opts:    opts,
+		logger:  opts.Logger,
+	}
+	if s.logger == nil {
+		logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
+		s.logger = &logger
 	}
 	return s
 }
@@ -65,83 +129,291 @@ func (s *Serf) SetHandler(h Handler) {
 }
 
 func (s *Serf) Stop() {
-	s.serf.Shutdown()
-	close(s.events)
+	if s.serf != nil {
+		s.serf.Shutdown()
+	}
+	// the events channel is not closed since serf may still send to it while shutting down
+	close(s.stopped)
 }
 
 func (s *Serf) Start() error {
 	var err error
 	cfg := serf.DefaultConfig()
-	cfg.MemberlistConfig.AdvertiseAddr, cfg.MemberlistConfig.AdvertisePort = s.splitHostPort(s.opts.Advertise)
-	cfg.MemberlistConfig.BindAddr, cfg.MemberlistConfig.BindPort = s.splitHostPort(s.opts.Addr)
+	if cfg.MemberlistConfig.AdvertiseAddr, cfg.MemberlistConfig.AdvertisePort, err = splitHostPort(s.opts.Advertise); err != nil {
+		return fmt.Errorf("%w, advertise:%s err:%s", ErrInvalidAddr, s.opts.Advertise, err.Error())
+	}
+	if cfg.MemberlistConfig.BindAddr, cfg.MemberlistConfig.BindPort, err = splitHostPort(s.opts.Addr); err != nil {
+		return fmt.Errorf("%w, addr:%s err:%s", ErrInvalidAddr, s.opts.Addr, err.Error())
+	}
 	cfg.EventCh = s.events
 
-	filter := &logutils.LevelFilter{
-		Levels:   []logutils.LogLevel{"DEBUG", "INFO", "WARN", "ERROR"},
-		MinLevel: logutils.LogLevel("WARN"),
-		Writer: io.MultiWriter(&lumberjack.Logger{
-			Filename:   "./log/serf.log",
+	writer := &serfWriter{
+		logger: s.logger,
+		level:  zerolog.WarnLevel,
+	}
+	if s.opts.SerfLogLevel != "" {
+		if writer.level, err = zerolog.ParseLevel(s.opts.SerfLogLevel); err != nil {
+			return fmt.Errorf("serf discovery parse log level:%s err:%s", s.opts.SerfLogLevel, err.Error())
+		}
+	}
+	if s.opts.SerfLogFile != "" {
+		writer.file = &lumberjack.Logger{
+			Filename:   s.opts.SerfLogFile,
 			MaxSize:    10, // megabytes
 			MaxBackups: 3,
 			MaxAge:     28, //days
-		}, os.Stderr),
+		}
 	}
 
-	cfg.Logger = log.New(os.Stderr, "", log.LstdFlags)
-	cfg.Logger.SetOutput(filter)
+	cfg.Logger = log.New(writer, "", log.LstdFlags)
 	cfg.MemberlistConfig.Logger = cfg.Logger
 	cfg.NodeName = s.opts.Name
 
+	if s.opts.SnapshotPath != "" {
+		if err = os.MkdirAll(filepath.Dir(s.opts.SnapshotPath), fs.ModePerm); err != nil {
+			return fmt.Errorf("serf discovery create snapshot dir err:%s", err.Error())
+		}
+		// a drained agent has left the cluster, it rejoins the members of the snapshot when restarted
+		cfg.SnapshotPath = s.opts.SnapshotPath
+		cfg.RejoinAfterLeave = true
+	}
+
+	if s.opts.EncryptKey != "" {
+		key, err := base64.StdEncoding.DecodeString(s.opts.EncryptKey)
+		if err != nil {
+			return fmt.Errorf("serf discovery decode encrypt key err:%s", err.Error())
+		}
+		cfg.MemberlistConfig.SecretKey = key
+	}
+
+	tags := map[string]string{
+		PortKey: s.opts.PipePort,
+	}
+	if s.opts.Endpoint != "" {
+		tags[EndpointKey] = s.opts.Endpoint
+	}
+	if s.opts.Zone != "" {
+		tags[ZoneKey] = s.opts.Zone
+	}
+	cfg.Tags = tags
+
 	s.serf, err = serf.Create(cfg)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w, addr:%s err:%s", ErrBind, s.opts.Addr, err.Error())
 	}
 
-	s.serf.SetTags(map[string]string{
-		PortKey: s.opts.PipePort,
-	})
 	go s.Loop()
-	log.Printf("[INFO] serf discovery started, current agent addr:%s, advertise addr:%s\n", s.opts.Addr, s.opts.Advertise)
-	if len(s.opts.Members) > 0 {
-		members := strings.Split(s.opts.Members, ",")
-		s.Join(members)
+	s.logger.Info().Str("addr", s.opts.Addr).Str("advertise", s.opts.Advertise).Msg("serf discovery started")
+	if len(s.opts.Members) == 0 {
+		return nil
+	}
+
+	members := strings.Split(s.opts.Members, ",")
+	if s.opts.ExpectedSize > 0 {
+		go s.rejoin(members)
+	}
+	if s.opts.JoinRetries < 0 {
+		go s.retryJoin(members, -1)
+		return nil
+	}
+	if err := s.retryJoin(members, s.opts.JoinRetries); err != nil {
+		return fmt.Errorf("%w, seeds:%s err:%s", ErrJoin, s.opts.Members, err.Error())
 	}
 	return nil
 }
 
-func (s *Serf) Join(members []string) error {
-	_, err := s.serf.Join(members, true)
+// Join joins the cluster by contacting the given members, it returns the number of members contacted successfully.
+// The dns names and the srv names of the members are resolved again on every join.
+func (s *Serf) Join(members []string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addrs, err := ResolveSeeds(ctx, s.opts.Resolver, members, s.logger)
+	if err != nil {
+		return 0, err
+	}
+	if len(addrs) > 0 {
+		s.logger.Debug().Strs("seeds", members).Strs("addrs", addrs).Msg("serf discovery resolved seeds")
+	}
+	return s.serf.Join(addrs, true)
+}
+
+// Members returns all the members known by serf, including the failed and left ones
+func (s *Serf) Members() []*agent.Agent {
+	members := s.serf.Members()
+	nodes := make([]*agent.Agent, 0, len(members))
+	for _, member := range members {
+		nodes = append(nodes, s.newAgent(member))
+	}
+	return nodes
+}
+
+// Leave gracefully leaves the cluster, the other agents will see this agent as left instead of failed
+func (s *Serf) Leave() error {
+	return s.serf.Leave()
+}
+
+// RTT returns the round trip time to an agent estimated from the vivaldi network coordinates,
+// the coordinate of an agent is known once serf has probed it
+func (s *Serf) RTT(name string) (time.Duration, bool) {
+	if s.serf == nil {
+		return 0, false
+	}
+	local, err := s.serf.GetCoordinate()
+	if err != nil {
+		return 0, false
+	}
+	other, ok := s.serf.GetCachedCoordinate(name)
+	if !ok || other == nil {
+		return 0, false
+	}
+	return local.DistanceTo(other), true
+}
+
+// Broadcast sends a user event to all the agents, the name and the payload are limited to 512 bytes
+func (s *Serf) Broadcast(name string, payload []byte) error {
+	return s.serf.UserEvent(name, payload, false)
+}
+
+// Query sends a query to all the agents and collects the responses until the query times out or ctx
+// is done, the query times out after the deadline of ctx or after a timeout growing with the cluster
+func (s *Serf) Query(ctx context.Context, name string, payload []byte) ([]Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	params := s.serf.DefaultQueryParams()
+	if deadline, ok := ctx.Deadline(); ok {
+		params.Timeout = time.Until(deadline)
+	}
+	resp, err := s.serf.Query(name, payload, params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+
+	responses := make([]Response, 0)
+	for {
+		select {
+		case r, ok := <-resp.ResponseCh():
+			if !ok {
+				return responses, nil
+			}
+			responses = append(responses, Response{From: r.From, Payload: r.Payload})
+		case <-ctx.Done():
+			return responses, nil
+		}
+	}
+}
+
+// SetTag sets a tag of the local agent, the other tags are kept
+func (s *Serf) SetTag(key string, value string) error {
+	tags := make(map[string]string)
+	for k, v := range s.serf.LocalMember().Tags {
+		tags[k] = v
+	}
+	tags[key] = value
+	return s.serf.SetTags(tags)
+}
+
+// ForceLeave forces a failed agent to transition into the left state
+func (s *Serf) ForceLeave(name string) error {
+	return s.serf.RemoveFailedNode(name)
+}
+
+// InstallKey installs a new encryption key on all the agents
+func (s *Serf) InstallKey(key string) error {
+	resp, err := s.serf.KeyManager().InstallKey(key)
+	return s.keyErr(resp, err)
+}
+
+// UseKey changes the primary encryption key on all the agents
+func (s *Serf) UseKey(key string) error {
+	resp, err := s.serf.KeyManager().UseKey(key)
+	return s.keyErr(resp, err)
+}
+
+// RemoveKey removes an encryption key from all the agents
+func (s *Serf) RemoveKey(key string) error {
+	resp, err := s.serf.KeyManager().RemoveKey(key)
+	return s.keyErr(resp, err)
+}
+
+// ListKeys returns the installed keys and the number of agents which have installed each key
+func (s *Serf) ListKeys() (map[string]int, int, error) {
+	resp, err := s.serf.KeyManager().ListKeys()
+	if err = s.keyErr(resp, err); err != nil {
+		return nil, 0, err
+	}
+	return resp.Keys, resp.NumNodes, nil
+}
+
+func (s *Serf) keyErr(resp *serf.KeyResponse, err error) error {
+	if err == nil {
+		return nil
+	}
+	if resp != nil {
+		for node, msg := range resp.Messages {
+			err = fmt.Errorf("%s, agent:%s %s", err.Error(), node, msg)
+		}
+	}
 	return err
 }
 
-func (s *Serf) splitHostPort(addr string) (string, int) {
+// answer responds to a query with the response of the handler
+func (s *Serf) answer(h MessageHandler, q *serf.Query) {
+	resp, ok := h.OnQuery(q.SourceNode(), q.Name, q.Payload)
+	if !ok {
+		return
+	}
+	if err := q.Respond(resp); err != nil {
+		s.logger.Warn().Err(err).Str("query", q.Name).Str("from", q.SourceNode()).Msg("serf discovery respond query failed")
+	}
+}
+
+func (s *Serf) newAgent(member serf.Member) *agent.Agent {
+	node := agent.New(member.Name, member.Addr.String(), member.Port, member.Tags[PortKey])
+	node.Status = member.Status.String()
+	for k, v := range member.Tags {
+		node.Tags[k] = v
+	}
+	return node
+}
+
+func splitHostPort(addr string) (string, int, error) {
 	h, p, err := net.SplitHostPort(addr)
 	if err != nil {
-		log.Fatalf("[ERROR] serf discovery parse addr:%s err:%s", addr, err.Error())
+		return "", 0, err
 	}
 
 	port, err := strconv.Atoi(p)
 	if err != nil {
-		log.Fatalf("[ERROR] serf discovery parse port:%s err:%s", p, err.Error())
+		return "", 0, fmt.Errorf("invalid port %q", p)
 	}
-	return h, port
+	return h, port, nil
 }
 
 func (s *Serf) Loop() {
-	for e := range s.events {
+	for {
+		var e serf.Event
+		select {
+		case e = <-s.events:
+		case <-s.stopped:
+			return
+		}
+
 		switch e.EventType() {
 		case serf.EventMemberJoin:
 			for _, member := range e.(serf.MemberEvent).Members {
-				node := agent.New(member.Name, member.Addr.String(), member.Port, member.Tags[PortKey])
+				// the agent is stored first so that it is a member when the handler connects to it
+				node := s.newAgent(member)
+				s.agents.Store(node.Id, node)
 				if s.opts.Name != member.Name {
 					s.handler.OnAgentJoin(node)
 				}
-				s.agents.Store(node.Id, node)
 			}
 
 		case serf.EventMemberUpdate:
 			for _, member := range e.(serf.MemberEvent).Members {
-				node := agent.New(member.Name, member.Addr.String(), member.Port, member.Tags[PortKey])
+				node := s.newAgent(member)
 				if s.serf.LocalMember().Name != member.Name {
 					s.handler.OnAgentUpdate(node)
 				}
@@ -150,12 +422,26 @@ func (s *Serf) Loop() {
 
 		case serf.EventMemberLeave, serf.EventMemberFailed:
 			for _, member := range e.(serf.MemberEvent).Members {
-				node := agent.New(member.Name, member.Addr.String(), member.Port, member.Tags[PortKey])
+				node := s.newAgent(member)
 				if s.serf.LocalMember().Name != member.Name {
-					s.handler.OnAgentLeave(node)
 					s.agents.Delete(node.Id)
+					s.handler.OnAgentLeave(node)
+				} else {
+					s.agents.Store(node.Id, node)
 				}
 			}
+
+		case serf.EventUser:
+			if h, ok := s.handler.(MessageHandler); ok {
+				event := e.(serf.UserEvent)
+				h.OnEvent(event.Name, event.Payload)
+			}
+
+		case serf.EventQuery:
+			// the queries are answered in the background so that a slow handler does not delay the member events
+			if h, ok := s.handler.(MessageHandler); ok {
+				go s.answer(h, e.(*serf.Query))
+			}
 		}
 	}
 }
@@ -0,0 +1,464 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/werbenhu/bridgemq/agent"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultCheckInterval    = 2 * time.Second
+	defaultFailureThreshold = 3
+
+	// pipeService is the grpc health service name of the pipe of an agent
+	pipeService = "Transport"
+)
+
+// StaticAgent is an agent of the static membership
+type StaticAgent struct {
+	Name     string `json:"name" yaml:"name"`
+	Addr     string `json:"addr" yaml:"addr"`
+	PipePort string `json:"pipe_port" yaml:"pipe_port"`
+
+	// Endpoint is the mqtt address of the agent, the clients of a draining agent are redirected to it
+	Endpoint string `json:"endpoint,omitempty" yaml:"endpoint"`
+
+	// Zone is the zone of the agent, the agents of the same zone are preferred by the zone policy
+	Zone string `json:"zone,omitempty" yaml:"zone"`
+}
+
+type StaticOpt struct {
+	// Name is the name of the local agent, the agent with this name in the list is the local agent
+	Name     string
+	Addr     string
+	PipePort string
+	Endpoint string
+	Zone     string
+
+	// Agents are the agents of the cluster, they are merged with the agents of File
+	Agents []StaticAgent
+
+	// File is a yaml or json file holding a list of agents, it is read again when it changes
+	File string
+
+	// CheckInterval is the interval of the health checks of the pipes of the other agents, an agent
+	// joins once its pipe is serving and leaves after FailureThreshold consecutive failed checks
+	CheckInterval    time.Duration
+	FailureThreshold int
+
+	// TLS is the tls config of the pipes, the health checks are insecure if it is nil
+	TLS *tls.Config
+
+	Logger *zerolog.Logger
+}
+
+// Static is a discovery without gossip, the agents are listed in the options or in a file,
+// they join and leave according to the grpc health checks of their pipes, so it works
+// where the udp traffic of serf is blocked.
+type Static struct {
+	opts    *StaticOpt
+	handler Handler
+	logger  *zerolog.Logger
+
+	// local is replaced by a copy when its status or its tags change, so it can be read without lock
+	local atomic.Pointer[agent.Agent]
+
+	sync.Mutex
+	members map[string]*staticMember
+	agents  sync.Map
+
+	// events are the joins and the leaves waiting to be reported to the handler, they are queued with the
+	// lock held and reported in order without it, by the caller which queued them or the one reporting already
+	events      []staticEvent
+	dispatching bool
+
+	// fileMod is the modification time of File when it was last read
+	fileMod time.Time
+	stopped chan struct{}
+	wg      sync.WaitGroup
+}
+
+// staticEvent is an agent joining or leaving
+type staticEvent struct {
+	agent *agent.Agent
+	join  bool
+}
+
+// staticMember is an agent of the list with the state of its health checks
+type staticMember struct {
+	config   StaticAgent
+	agent    *agent.Agent
+	conn     *grpc.ClientConn
+	health   grpc_health_v1.HealthClient
+	failures int
+}
+
+func NewStatic(opts *StaticOpt) *Static {
+	s := &Static{
+		opts:    opts,
+		logger:  opts.Logger,
+		members: make(map[string]*staticMember),
+		stopped: make(chan struct{}),
+	}
+	if s.logger == nil {
+		logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
+		s.logger = &logger
+	}
+
+	local := agent.New(opts.Name, opts.Addr, 0, opts.PipePort)
+	local.Tags[PortKey] = opts.PipePort
+	if opts.Endpoint != "" {
+		local.Tags[EndpointKey] = opts.Endpoint
+	}
+	if opts.Zone != "" {
+		local.Tags[ZoneKey] = opts.Zone
+	}
+	s.local.Store(local)
+	return s
+}
+
+func (s *Static) SetHandler(h Handler) {
+	s.handler = h
+}
+
+func (s *Static) LocalAgent() *agent.Agent {
+	return s.local.Load()
+}
+
+// Agents returns the local agent and the agents whose pipe is serving
+func (s *Static) Agents() []*agent.Agent {
+	nodes := []*agent.Agent{s.local.Load()}
+	s.agents.Range(func(key any, val any) bool {
+		nodes = append(nodes, val.(*agent.Agent))
+		return true
+	})
+	return nodes
+}
+
+// Members returns the local agent and all the listed agents including the failed ones
+func (s *Static) Members() []*agent.Agent {
+	s.Lock()
+	defer s.Unlock()
+	nodes := []*agent.Agent{s.local.Load()}
+	for _, m := range s.members {
+		nodes = append(nodes, m.agent)
+	}
+	return nodes
+}
+
+// Join is not supported, the agents are added to the list or to the file
+func (s *Static) Join(members []string) (int, error) {
+	return 0, fmt.Errorf("%w, the static discovery only joins the listed agents", ErrJoin)
+}
+
+// Leave marks the local agent as left, the other agents see it leave once its pipe stops serving
+func (s *Static) Leave() error {
+	s.local.Store(clone(s.local.Load(), agent.StatusLeft))
+	return nil
+}
+
+// ForceLeave makes a listed agent leave, it joins again once its pipe is serving
+func (s *Static) ForceLeave(name string) error {
+	defer s.dispatch()
+	s.Lock()
+	defer s.Unlock()
+	m, ok := s.members[name]
+	if !ok {
+		return fmt.Errorf("agent:%s is not listed", name)
+	}
+	s.leave(m, agent.StatusLeft)
+	return nil
+}
+
+// SetTag sets a tag of the local agent, the tag is only visible locally
+func (s *Static) SetTag(key string, value string) error {
+	local := s.local.Load()
+	local = clone(local, local.Status)
+	local.Tags[key] = value
+	s.local.Store(local)
+	return nil
+}
+
+func (s *Static) Start() error {
+	agents, err := s.list()
+	if err != nil {
+		return err
+	}
+	if err = s.update(agents); err != nil {
+		return err
+	}
+
+	s.wg.Add(1)
+	go s.loop()
+	s.logger.Info().Int("agents", len(agents)).Str("file", s.opts.File).Msg("static discovery started")
+	return nil
+}
+
+func (s *Static) Stop() {
+	close(s.stopped)
+	s.wg.Wait()
+
+	s.Lock()
+	defer s.Unlock()
+	for _, m := range s.members {
+		m.conn.Close()
+	}
+}
+
+// list returns the agents of the options merged with the agents of the file
+func (s *Static) list() ([]StaticAgent, error) {
+	agents := append([]StaticAgent{}, s.opts.Agents...)
+	if s.opts.File == "" {
+		return agents, nil
+	}
+
+	info, err := os.Stat(s.opts.File)
+	if err != nil {
+		return nil, fmt.Errorf("static discovery read file:%s err:%s", s.opts.File, err.Error())
+	}
+	data, err := os.ReadFile(s.opts.File)
+	if err != nil {
+		return nil, fmt.Errorf("static discovery read file:%s err:%s", s.opts.File, err.Error())
+	}
+
+	var fileAgents []StaticAgent
+	switch strings.ToLower(filepath.Ext(s.opts.File)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&fileAgents)
+	default:
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(&fileAgents)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("static discovery parse file:%s err:%s", s.opts.File, err.Error())
+	}
+
+	s.fileMod = info.ModTime()
+	return append(agents, fileAgents...), nil
+}
+
+// update applies a new list of agents, the removed agents leave and the added agents
+// join once their pipe is serving, an agent whose address changed is added again
+func (s *Static) update(agents []StaticAgent) error {
+	listed := make(map[string]StaticAgent)
+	for _, a := range agents {
+		if a.Name == "" {
+			return fmt.Errorf("static discovery agent name can not be empty")
+		}
+		if _, err := strconv.Atoi(a.PipePort); err != nil {
+			return fmt.Errorf("%w, agent:%s pipe port:%q", ErrInvalidAddr, a.Name, a.PipePort)
+		}
+		if a.Name != s.opts.Name {
+			listed[a.Name] = a
+		}
+	}
+
+	defer s.dispatch()
+	s.Lock()
+	defer s.Unlock()
+	for name, m := range s.members {
+		if a, ok := listed[name]; !ok || a != m.config {
+			s.leave(m, agent.StatusLeft)
+			m.conn.Close()
+			delete(s.members, name)
+		}
+	}
+
+	for name, a := range listed {
+		if _, ok := s.members[name]; ok {
+			continue
+		}
+		addr := net.JoinHostPort(a.Addr, a.PipePort)
+		creds := insecure.NewCredentials()
+		if s.opts.TLS != nil {
+			creds = credentials.NewTLS(s.opts.TLS)
+		}
+		conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			s.logger.Error().Err(err).Str("peer", name).Str("addr", addr).Msg("static discovery dial agent failed")
+			continue
+		}
+
+		node := agent.New(a.Name, a.Addr, 0, a.PipePort)
+		node.Status = agent.StatusFailed
+		node.Tags[PortKey] = a.PipePort
+		if a.Endpoint != "" {
+			node.Tags[EndpointKey] = a.Endpoint
+		}
+		if a.Zone != "" {
+			node.Tags[ZoneKey] = a.Zone
+		}
+		s.members[name] = &staticMember{
+			config: a,
+			agent:  node,
+			conn:   conn,
+			health: grpc_health_v1.NewHealthClient(conn),
+		}
+	}
+	return nil
+}
+
+func (s *Static) loop() {
+	defer s.wg.Done()
+	interval := s.opts.CheckInterval
+	if interval <= 0 {
+		interval = defaultCheckInterval
+	}
+
+	s.check()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stopped:
+			return
+		}
+		s.reload()
+		s.check()
+	}
+}
+
+// reload reads the file again if it was modified
+func (s *Static) reload() {
+	if s.opts.File == "" {
+		return
+	}
+	info, err := os.Stat(s.opts.File)
+	if err != nil || info.ModTime().Equal(s.fileMod) {
+		return
+	}
+
+	agents, err := s.list()
+	if err == nil {
+		err = s.update(agents)
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Str("file", s.opts.File).Msg("static discovery reload file failed")
+		return
+	}
+	s.logger.Info().Int("agents", len(agents)).Str("file", s.opts.File).Msg("static discovery reloaded file")
+}
+
+// check checks the pipes of all the agents concurrently, then the agents
+// whose pipe started serving join and the agents failing too often leave
+func (s *Static) check() {
+	s.Lock()
+	members := make([]*staticMember, 0, len(s.members))
+	for _, m := range s.members {
+		members = append(members, m)
+	}
+	s.Unlock()
+
+	serving := make([]bool, len(members))
+	var wg sync.WaitGroup
+	for i, m := range members {
+		wg.Add(1)
+		go func(i int, m *staticMember) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			resp, err := m.health.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: pipeService})
+			serving[i] = err == nil && resp.Status == grpc_health_v1.HealthCheckResponse_SERVING
+		}(i, m)
+	}
+	wg.Wait()
+
+	threshold := s.opts.FailureThreshold
+	if threshold <= 0 {
+		threshold = defaultFailureThreshold
+	}
+
+	defer s.dispatch()
+	s.Lock()
+	defer s.Unlock()
+	for i, m := range members {
+		if current, ok := s.members[m.config.Name]; !ok || current != m {
+			continue
+		}
+		if serving[i] {
+			m.failures = 0
+			if m.agent.Status != agent.StatusAlive {
+				m.agent = clone(m.agent, agent.StatusAlive)
+				s.agents.Store(m.agent.Id, m.agent)
+				s.logger.Info().Str("peer", m.agent.Id).Msg("static discovery agent is serving")
+				s.events = append(s.events, staticEvent{agent: m.agent, join: true})
+			}
+			continue
+		}
+
+		m.failures++
+		if m.failures >= threshold {
+			s.leave(m, agent.StatusFailed)
+		}
+	}
+}
+
+// leave makes an alive agent leave with the given status, the lock must be held and the leave
+// is reported once it is released
+func (s *Static) leave(m *staticMember, status string) {
+	alive := m.agent.Status == agent.StatusAlive
+	m.agent = clone(m.agent, status)
+	if !alive {
+		return
+	}
+	s.agents.Delete(m.agent.Id)
+	s.logger.Info().Str("peer", m.agent.Id).Str("status", status).Msg("static discovery agent left")
+	s.events = append(s.events, staticEvent{agent: m.agent})
+}
+
+// dispatch reports the events queued to the handler in order, the lock must not be held. The handler
+// may call the discovery, the events it queues are reported once it returns.
+func (s *Static) dispatch() {
+	s.Lock()
+	if s.dispatching {
+		s.Unlock()
+		return
+	}
+	s.dispatching = true
+	for len(s.events) > 0 {
+		e := s.events[0]
+		s.events = s.events[1:]
+		s.Unlock()
+		if e.join {
+			s.handler.OnAgentJoin(e.agent)
+		} else {
+			s.handler.OnAgentLeave(e.agent)
+		}
+		s.Lock()
+	}
+	s.dispatching = false
+	s.Unlock()
+}
+
+// clone returns a copy of the agent with the given status
+func clone(a *agent.Agent, status string) *agent.Agent {
+	node := *a
+	node.Status = status
+	node.Tags = make(map[string]string, len(a.Tags))
+	for k, v := range a.Tags {
+		node.Tags[k] = v
+	}
+	return &node
+}
@@ -0,0 +1,112 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/werbenhu/bridgemq/agent"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// startPipe serves the grpc health service of a pipe and returns its port
+func startPipe(t *testing.T) (string, *health.Server) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	h := health.NewServer()
+	h.SetServingStatus(pipeService, grpc_health_v1.HealthCheckResponse_SERVING)
+	grpc_health_v1.RegisterHealthServer(server, h)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	return port, h
+}
+
+// reentrantHandler calls the discovery back from its callbacks
+type reentrantHandler struct {
+	testHandler
+	s *Static
+}
+
+func (h *reentrantHandler) OnAgentJoin(a *agent.Agent) {
+	h.testHandler.OnAgentJoin(a)
+	h.s.Members()
+	h.s.ForceLeave(a.Id)
+}
+
+func (h *reentrantHandler) OnAgentLeave(a *agent.Agent) {
+	h.testHandler.OnAgentLeave(a)
+	h.s.Members()
+}
+
+func newTestStatic(t *testing.T, agents []StaticAgent) *Static {
+	t.Helper()
+	logger := zerolog.Nop()
+	s := NewStatic(&StaticOpt{
+		Name:             "local",
+		Addr:             "127.0.0.1",
+		PipePort:         "0",
+		Agents:           agents,
+		CheckInterval:    20 * time.Millisecond,
+		FailureThreshold: 2,
+		Logger:           &logger,
+	})
+	return s
+}
+
+func TestStaticJoinLeave(t *testing.T) {
+	port, h := startPipe(t)
+	s := newTestStatic(t, []StaticAgent{{Name: "peer", Addr: "127.0.0.1", PipePort: port}})
+	handler := new(testHandler)
+	s.SetHandler(handler)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	waitFor(t, "the peer to join", func() bool {
+		joined, _ := handler.events()
+		return joined == 1
+	})
+	if n := len(s.Agents()); n != 2 {
+		t.Fatalf("%d agents, want 2", n)
+	}
+
+	h.SetServingStatus(pipeService, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	waitFor(t, "the peer to leave", func() bool {
+		_, left := handler.events()
+		return left == 1
+	})
+	if n := len(s.Agents()); n != 1 {
+		t.Fatalf("%d agents, want 1", n)
+	}
+}
+
+func TestStaticReentrantHandler(t *testing.T) {
+	port, _ := startPipe(t)
+	s := newTestStatic(t, []StaticAgent{{Name: "peer", Addr: "127.0.0.1", PipePort: port}})
+	handler := &reentrantHandler{s: s}
+	s.SetHandler(handler)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// the peer joins, is forced to leave by the handler and joins again at the next check
+	waitFor(t, "the peer to join twice", func() bool {
+		joined, left := handler.events()
+		return joined >= 2 && left >= 1
+	})
+	handler.Lock()
+	defer handler.Unlock()
+	if handler.joined[0] != "peer" || handler.left[0] != "peer" {
+		t.Fatalf("events joined %v left %v", handler.joined, handler.left)
+	}
+}
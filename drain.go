@@ -0,0 +1,126 @@
+package bridgemq
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/werbenhu/bridgemq/discovery"
+	"github.com/werbenhu/bridgemq/transport"
+)
+
+// Draining reports whether the agent is draining or has drained its clients
+func (b *Bridge) Draining() bool {
+	return b.draining.Load()
+}
+
+// Drain moves the clients of the local broker to the other agents before a shutdown, it marks
+// the agent as draining, stops accepting new connections, disconnects the clients at DrainRate
+// per second with a server moved reason pointing to a healthy agent chosen by PeerPolicy, waits for the messages
+// being pushed to the other agents and then leaves the cluster. The remaining clients are
+// disconnected at once if ctx is done, the broker still has to be closed after draining.
+func (b *Bridge) Drain(ctx context.Context) error {
+	if !b.draining.CompareAndSwap(false, true) {
+		return ErrDraining
+	}
+	b.logger.Info().Msg("agent draining")
+
+	if tagger, ok := b.discovery.(discovery.Tagger); ok {
+		if err := tagger.SetTag(discovery.DrainingKey, "true"); err != nil {
+			b.logger.Warn().Err(err).Msg("set draining tag failed")
+		}
+	}
+
+	if status, ok := b.transport.(transport.Status); ok {
+		status.SetServing(false)
+	}
+
+	// the listeners are closed without closing their clients, they are disconnected below
+	b.option.Broker.Listeners.CloseAll(func(id string) {})
+
+	count := b.disconnectClients(ctx)
+	b.logger.Info().Int("clients", count).Msg("agent drained clients")
+
+	if err := b.transport.Flush(ctx); err != nil {
+		b.logger.Warn().Err(err).Msg("flush transport failed")
+	}
+
+	if cluster, ok := b.discovery.(discovery.Cluster); ok {
+		if err := cluster.Leave(); err != nil {
+			b.logger.Error().Err(err).Msg("leave cluster failed")
+			return err
+		}
+	}
+	b.logger.Info().Msg("agent drained")
+	return nil
+}
+
+// disconnectClients disconnects the local clients at DrainRate per second,
+// the rate is not limited any more once ctx is done
+func (b *Bridge) disconnectClients(ctx context.Context) int {
+	var interval time.Duration
+	if b.option.DrainRate > 0 {
+		interval = time.Second / time.Duration(b.option.DrainRate)
+	}
+
+	count := 0
+	for _, cl := range b.option.Broker.Clients.GetAll() {
+		if cl.Net.Inline || cl.Closed() {
+			continue
+		}
+		b.moveClient(cl)
+		count++
+
+		if interval > 0 && ctx.Err() == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(interval):
+			}
+		}
+	}
+	return count
+}
+
+// moveClient disconnects a client, the mqtt v5 clients are told to reconnect to a healthy agent.
+// The will message is not sent since the client is expected to reconnect to another agent.
+func (b *Bridge) moveClient(cl *mqtt.Client) {
+	atomic.StoreUint32(&cl.Properties.Will.Flag, 0)
+	if cl.Properties.ProtocolVersion < 5 {
+		cl.Stop(packets.ErrServerShuttingDown)
+		return
+	}
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Disconnect,
+		},
+		ReasonCode: packets.ErrServerShuttingDown.Code,
+		Properties: packets.Properties{
+			ReasonString: packets.ErrServerShuttingDown.Reason,
+		},
+	}
+	if endpoint := b.nextEndpoint(); endpoint != "" {
+		pk.ReasonCode = packets.ErrServerMoved.Code
+		pk.Properties.ReasonString = packets.ErrServerMoved.Reason
+		pk.Properties.ServerReference = endpoint
+	}
+
+	if err := cl.WritePacket(pk); err != nil {
+		b.logger.Debug().Err(err).Str("client_id", cl.ID).Msg("write disconnect packet failed")
+	}
+	cl.Stop(packets.ErrServerMoved)
+}
+
+// nextEndpoint returns the endpoint of a healthy agent chosen by the peer policy,
+// it is empty if no other agent advertises an endpoint
+func (b *Bridge) nextEndpoint() string {
+	peer, ok := b.SelectPeer(b.option.PeerPolicy, func(p Peer) bool {
+		return p.Agent.Tags[discovery.DrainingKey] != "true" && p.Agent.Tags[discovery.EndpointKey] != ""
+	})
+	if !ok {
+		return ""
+	}
+	return peer.Agent.Tags[discovery.EndpointKey]
+}
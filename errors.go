@@ -3,16 +3,53 @@ package bridgemq
 type Err struct {
 	Msg  string
 	Code int
+
+	// Err is the underlying error, it is nil for the predefined errors
+	Err error
 }
 
 func (e Err) String() string {
-	return e.Msg
+	return e.Error()
 }
 
 func (e Err) Error() string {
+	if e.Err != nil {
+		return e.Msg + ", " + e.Err.Error()
+	}
 	return e.Msg
 }
 
+// Unwrap returns the underlying error
+func (e Err) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is an Err with the same code, so that errors.Is(err, ErrBind)
+// matches the bind errors whatever their message and underlying error
+func (e Err) Is(target error) bool {
+	t, ok := target.(Err)
+	return ok && t.Code == e.Code
+}
+
+// Wrap returns a copy of the error wrapping err
+func (e Err) Wrap(err error) Err {
+	e.Err = err
+	return e
+}
+
 var (
-	ErrInvalidBroker = Err{Code: 10000, Msg: "invalid broker, borker can not be nil"}
+	ErrInvalidBroker  = Err{Code: 10000, Msg: "invalid broker, borker can not be nil"}
+	ErrNotSupported   = Err{Code: 10001, Msg: "operation not supported by the discovery"}
+	ErrClientNotFound = Err{Code: 10002, Msg: "client not found"}
+	ErrClientNotLocal = Err{Code: 10003, Msg: "client is not connected to the local agent"}
+	ErrDraining       = Err{Code: 10004, Msg: "agent is already draining"}
+	ErrInvalidAddr    = Err{Code: 10005, Msg: "invalid address"}
+	ErrInvalidOption  = Err{Code: 10006, Msg: "invalid option"}
+	ErrBind           = Err{Code: 10007, Msg: "bind listener failed"}
+	ErrJoin           = Err{Code: 10008, Msg: "join cluster failed"}
+	ErrStarted        = Err{Code: 10009, Msg: "bridge is already started"}
+
+	ErrInterceptorExists  = Err{Code: 10010, Msg: "interceptor already exists"}
+	ErrInvalidInterceptor = Err{Code: 10011, Msg: "invalid interceptor, it must intercept the inbound or the outbound messages"}
+	ErrMessageDropped     = Err{Code: 10012, Msg: "message dropped"}
 )
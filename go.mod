@@ -3,8 +3,9 @@ module github.com/werbenhu/bridgemq
 go 1.20
 
 require (
-	github.com/hashicorp/logutils v1.0.0
+	github.com/BurntSushi/toml v1.2.1
 	github.com/hashicorp/serf v0.10.1
+	github.com/miekg/dns v1.1.41
 	github.com/mochi-co/mqtt/v2 v2.2.8
 	github.com/natefinch/lumberjack v2.0.0+incompatible
 	github.com/rs/xid v1.4.0
@@ -13,10 +14,10 @@ require (
 	google.golang.org/grpc v1.54.0
 	google.golang.org/protobuf v1.28.1
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/BurntSushi/toml v1.2.1 // indirect
 	github.com/armon/go-metrics v0.0.0-20180917152333-f0300d1749da // indirect
 	github.com/asdine/storm v2.1.2+incompatible // indirect
 	github.com/asdine/storm/v3 v3.2.1 // indirect
@@ -32,11 +33,9 @@ require (
 	github.com/hashicorp/memberlist v0.5.0 // indirect
 	github.com/mattn/go-colorable v0.1.12 // indirect
 	github.com/mattn/go-isatty v0.0.14 // indirect
-	github.com/miekg/dns v1.1.41 // indirect
 	github.com/sean-/seed v0.0.0-20170313163322-e2103e2c3529 // indirect
 	golang.org/x/net v0.8.0 // indirect
 	golang.org/x/sys v0.6.0 // indirect
 	golang.org/x/text v0.8.0 // indirect
 	google.golang.org/genproto v0.0.0-20230110181048-76db0878b65f // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,59 @@
+package bridgemq
+
+import (
+	"github.com/werbenhu/bridgemq/agent"
+	"github.com/werbenhu/bridgemq/transport"
+)
+
+// Health is a snapshot of the state of the bridge reported by the health checks
+type Health struct {
+	// Status is the membership status of the local agent, empty before the discovery is started
+	Status string `json:"status"`
+
+	// Pipe reports whether the pipe listener is accepting the messages of the other agents
+	Pipe bool `json:"pipe"`
+
+	// Peers is the number of the other agents and Connected is the number of them whose pipe connection is ready
+	Peers     int `json:"peers"`
+	Connected int `json:"connected"`
+
+	// Ratio is the ratio of the other agents whose pipe connection is ready, 1 without other agents
+	Ratio float64 `json:"ratio"`
+
+	// Draining is set once the agent starts draining its clients
+	Draining bool `json:"draining"`
+
+	// Joining is set until the agent sees another agent when seeds are configured
+	Joining bool `json:"joining"`
+}
+
+// Healthy reports whether the agent is a member of the cluster and receives the messages of the other agents
+func (h Health) Healthy() bool {
+	return h.Status == agent.StatusAlive && h.Pipe
+}
+
+// Ready reports whether the agent is healthy and accepts clients
+func (h Health) Ready() bool {
+	return h.Healthy() && !h.Draining && !h.Joining
+}
+
+// Health returns the current health of the bridge
+func (b *Bridge) Health() Health {
+	h := Health{
+		Draining: b.Draining(),
+		Joining:  b.option.Agents != "" && !b.joined.Load(),
+	}
+	if local := b.LocalAgent(); local != nil {
+		h.Status = local.Status
+	}
+	if status, ok := b.transport.(transport.Status); ok {
+		h.Pipe = status.Serving()
+		h.Connected, h.Peers = status.Peers()
+	}
+
+	h.Ratio = 1
+	if h.Peers > 0 {
+		h.Ratio = float64(h.Connected) / float64(h.Peers)
+	}
+	return h
+}
@@ -0,0 +1,137 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/werbenhu/bridgemq"
+	"github.com/werbenhu/bridgemq/agent"
+)
+
+const (
+	StatusOk   = "ok"
+	StatusFail = "fail"
+)
+
+// Report is the json body of the /healthz and /readyz responses
+type Report struct {
+	Status string `json:"status"`
+
+	// Failures are the reasons the check failed
+	Failures []string `json:"failures,omitempty"`
+
+	// Bridge is the state of the bridge, it is nil if the broker is not running in bridge mode
+	Bridge *bridgemq.Health `json:"bridge,omitempty"`
+
+	// Storage is ok or the error of the storage check
+	Storage string `json:"storage"`
+}
+
+// Server serves the health checks for the orchestrators over http, /healthz fails if the
+// agent is not a member of the cluster, its pipe listener is down or its storage fails,
+// /readyz also fails while the agent is joining the cluster or draining its clients.
+type Server struct {
+	addr    string
+	broker  *mqtt.Server
+	bridge  *bridgemq.Bridge
+	storage func() error
+	server  *http.Server
+}
+
+// NewServer creates a health server listening on addr,
+// bridge can be nil if the broker is not running in bridge mode
+func NewServer(addr string, broker *mqtt.Server, bridge *bridgemq.Bridge) *Server {
+	return &Server{
+		addr:   addr,
+		broker: broker,
+		bridge: bridge,
+	}
+}
+
+// SetStorageCheck sets the function checking the storage, the storage is not checked if it is not set
+func (s *Server) SetStorageCheck(check func() error) {
+	s.storage = check
+}
+
+// Start binds the health listener and serves it in the background
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handle(false))
+	mux.HandleFunc("/readyz", s.handle(true))
+	s.server = &http.Server{
+		Handler:      mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.broker.Log.Error().Err(err).Str("addr", s.addr).Msg("health server serve failed")
+		}
+	}()
+	s.broker.Log.Info().Str("addr", s.addr).Msg("health server started")
+	return nil
+}
+
+func (s *Server) Stop() {
+	if s.server != nil {
+		s.server.Close()
+	}
+}
+
+// Check returns the health of the agent, ready adds the readiness checks
+func (s *Server) Check(ready bool) Report {
+	report := Report{
+		Status:  StatusOk,
+		Storage: StatusOk,
+	}
+	fail := func(reason string) {
+		report.Status = StatusFail
+		report.Failures = append(report.Failures, reason)
+	}
+
+	if s.storage != nil {
+		if err := s.storage(); err != nil {
+			report.Storage = err.Error()
+			fail("storage failed")
+		}
+	}
+
+	if s.bridge != nil {
+		h := s.bridge.Health()
+		report.Bridge = &h
+		if h.Status != agent.StatusAlive {
+			fail("agent is not an alive member of the cluster, status:" + h.Status)
+		}
+		if !h.Pipe {
+			fail("pipe listener is not serving")
+		}
+		if ready && h.Joining {
+			fail("agent is joining the cluster")
+		}
+		if ready && h.Draining {
+			fail("agent is draining")
+		}
+	}
+	return report
+}
+
+func (s *Server) handle(ready bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := s.Check(ready)
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status != StatusOk {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
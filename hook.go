@@ -2,10 +2,11 @@ package bridgemq
 
 import (
 	"bytes"
-	"log"
+	"context"
 
 	"github.com/mochi-co/mqtt/v2"
 	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/werbenhu/bridgemq/webhook"
 )
 
 const (
@@ -22,6 +23,11 @@ func (h *Hook) ID() string {
 	return HookId
 }
 
+// Bridge returns the bridge created by the hook, it is nil before the hook is initialized.
+func (h *Hook) Bridge() *Bridge {
+	return h.bridge
+}
+
 // Provides indicates which hook methods this hook provides.
 func (h *Hook) Provides(b byte) bool {
 	return bytes.Contains([]byte{
@@ -44,14 +50,22 @@ func (h *Hook) Init(config any) error {
 	}
 
 	h.bridge = NewBridge(option)
-	go h.bridge.Serve()
-	return nil
+	return h.bridge.Start(context.Background())
 }
 
 // OnSessionEstablished is called when a new client establishes a session (after OnConnect).
 func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
-	log.Printf("[INFO] local client id:%s connected \n", cl.ID)
+	if h.bridge.option.LogClients {
+		h.bridge.logger.Info().Str("client_id", cl.ID).Msg("local client connected")
+	}
 	h.bridge.PushConnect(pk.Connect.ClientIdentifier)
+	h.bridge.publishPresence(cl.ID, h.bridge.option.Name, true)
+	h.bridge.emit(&webhook.Event{
+		Type:     webhook.EventClientConnected,
+		ClientId: cl.ID,
+		Username: string(cl.Properties.Username),
+		Remote:   cl.Net.Remote,
+	})
 }
 
 // OnPublish is called when a client publishes a message.
@@ -61,27 +75,71 @@ func (h *Hook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, er
 		return pk, nil
 	}
 	h.pushPublish(cl, pk)
+	h.emitPublish(cl, pk)
 	return pk, nil
 }
 
 // OnWillSent is called when an LWT message has been issued from a disconnecting client.
 func (h *Hook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
 	h.pushPublish(cl, pk)
+	h.emitPublish(cl, pk)
 }
 
 // OnDisconnect is called when a client is disconnected for any reason.
 func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
-	log.Printf("[INFO] local client id:%s disconnected \n", cl.ID)
+	if h.bridge.option.LogClients {
+		h.bridge.logger.Info().Str("client_id", cl.ID).Msg("local client disconnected")
+	}
 	h.bridge.PushDisconnect(cl.ID)
+	if !h.takenOver(cl) {
+		h.bridge.publishPresence(cl.ID, h.bridge.option.Name, false)
+	}
+	e := &webhook.Event{
+		Type:     webhook.EventClientDisconnected,
+		ClientId: cl.ID,
+		Username: string(cl.Properties.Username),
+		Remote:   cl.Net.Remote,
+	}
+	if err != nil {
+		e.Reason = err.Error()
+	}
+	h.bridge.emit(e)
+}
+
+// takenOver reports whether the session of a disconnected client was taken over by a client
+// connected to the local broker or to a remote agent, the client is still present in the cluster
+func (h *Hook) takenOver(cl *mqtt.Client) bool {
+	if _, ok := h.bridge.clients.Load(cl.ID); ok {
+		return true
+	}
+	existing, ok := h.bridge.option.Broker.Clients.Get(cl.ID)
+	return ok && existing != cl && !existing.Closed()
+}
+
+// emitPublish sends a publish of a local client to the webhook endpoints whose topics match
+func (h *Hook) emitPublish(cl *mqtt.Client, pk packets.Packet) {
+	if h.bridge.webhook == nil || !h.bridge.webhook.Messages() {
+		return
+	}
+	h.bridge.emit(&webhook.Event{
+		Type:     webhook.EventMessagePublished,
+		ClientId: cl.ID,
+		Topic:    pk.TopicName,
+		Payload:  pk.Payload,
+		Qos:      pk.FixedHeader.Qos,
+		Retain:   pk.FixedHeader.Retain,
+	})
 }
 
 // PushPublish transmit a publish package to the remote agent via grpc
 func (h *Hook) pushPublish(cl *mqtt.Client, pk packets.Packet) {
-	h.bridge.PushPublish(
+	h.bridge.pushPublish(
 		pk.TopicName,
 		pk.Payload,
 		pk.FixedHeader.Qos,
 		pk.FixedHeader.Retain,
+		pk.Properties.User,
+		h.bridge.priority(pk.TopicName, pk.Properties.User),
 	)
 }
 
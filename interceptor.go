@@ -0,0 +1,180 @@
+package bridgemq
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/werbenhu/bridgemq/transport"
+)
+
+// Message is a publish crossing the pipe as seen by the interceptors, which may modify it
+type Message struct {
+	Topic      string
+	Payload    []byte
+	Qos        byte
+	Retain     bool
+	Properties []packets.UserProperty
+
+	// Origin is the agent the message was published on and Target the agent it is pushed to,
+	// Target is the local agent for the inbound messages
+	Origin string
+	Target string
+}
+
+// Interceptor is a step of the interceptor chain of the bridge, it must implement
+// OutboundInterceptor, InboundInterceptor or both of them
+type Interceptor interface {
+	ID() string
+}
+
+// OutboundInterceptor intercepts the publishes pushed to the remote agents, it is called once for every
+// agent a publish is pushed to with Target set to that agent. It may modify the message, re-route it by
+// changing its Topic or its Target, or drop it by returning an error. ErrMessageDropped drops it silently.
+type OutboundInterceptor interface {
+	Interceptor
+	InterceptOutbound(msg *Message) error
+}
+
+// InboundInterceptor intercepts the publishes received from the remote agents before they are published
+// to the local broker. It may modify the message, re-route it by changing its Topic, or drop it by returning
+// an error. ErrMessageDropped drops it silently.
+type InboundInterceptor interface {
+	Interceptor
+	InterceptInbound(msg *Message) error
+}
+
+// interceptor is an interceptor with its order, the interceptors of the same order run in the order they were added
+type interceptor struct {
+	Interceptor
+	order int
+}
+
+// chain is an immutable list of interceptors sorted by order, it is replaced when an interceptor is added or removed
+type chain struct {
+	all      []interceptor
+	outbound []OutboundInterceptor
+	inbound  []InboundInterceptor
+}
+
+func newChain(all []interceptor) *chain {
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].order < all[j].order
+	})
+	c := &chain{all: all}
+	for _, i := range all {
+		if o, ok := i.Interceptor.(OutboundInterceptor); ok {
+			c.outbound = append(c.outbound, o)
+		}
+		if in, ok := i.Interceptor.(InboundInterceptor); ok {
+			c.inbound = append(c.inbound, in)
+		}
+	}
+	return c
+}
+
+// AddInterceptor adds an interceptor to the chain, the interceptors run by increasing order. It returns
+// ErrInvalidInterceptor if it intercepts nothing and ErrInterceptorExists if its ID is already used.
+func (b *Bridge) AddInterceptor(i Interceptor, order int) error {
+	_, out := i.(OutboundInterceptor)
+	_, in := i.(InboundInterceptor)
+	if !out && !in {
+		return ErrInvalidInterceptor.Wrap(fmt.Errorf("interceptor %q", i.ID()))
+	}
+
+	b.interceptLock.Lock()
+	defer b.interceptLock.Unlock()
+	old := b.interceptors.Load()
+	for _, e := range old.all {
+		if e.ID() == i.ID() {
+			return ErrInterceptorExists.Wrap(fmt.Errorf("interceptor %q", i.ID()))
+		}
+	}
+	all := append(make([]interceptor, 0, len(old.all)+1), old.all...)
+	b.interceptors.Store(newChain(append(all, interceptor{Interceptor: i, order: order})))
+	return nil
+}
+
+// RemoveInterceptor removes the interceptor with the id, it is false if there is none
+func (b *Bridge) RemoveInterceptor(id string) bool {
+	b.interceptLock.Lock()
+	defer b.interceptLock.Unlock()
+	old := b.interceptors.Load()
+	all := make([]interceptor, 0, len(old.all))
+	for _, e := range old.all {
+		if e.ID() != id {
+			all = append(all, e)
+		}
+	}
+	if len(all) == len(old.all) {
+		return false
+	}
+	b.interceptors.Store(newChain(all))
+	return true
+}
+
+// Interceptors returns the ids of the interceptors in the order they run
+func (b *Bridge) Interceptors() []string {
+	all := b.interceptors.Load().all
+	ids := make([]string, 0, len(all))
+	for _, i := range all {
+		ids = append(ids, i.ID())
+	}
+	return ids
+}
+
+// interceptOutbound runs the outbound interceptors, it is false if the message is dropped
+func (b *Bridge) interceptOutbound(interceptors []OutboundInterceptor, msg *Message) bool {
+	for _, i := range interceptors {
+		if err := i.InterceptOutbound(msg); err != nil {
+			b.dropped(i.ID(), "outbound", msg, err)
+			return false
+		}
+	}
+	return true
+}
+
+// interceptInbound runs the inbound interceptors, it is false if the message is dropped
+func (b *Bridge) interceptInbound(interceptors []InboundInterceptor, msg *Message) bool {
+	for _, i := range interceptors {
+		if err := i.InterceptInbound(msg); err != nil {
+			b.dropped(i.ID(), "inbound", msg, err)
+			return false
+		}
+	}
+	return true
+}
+
+func (b *Bridge) dropped(id string, direction string, msg *Message, err error) {
+	event := b.logger.Warn().Err(err)
+	if errors.Is(err, ErrMessageDropped) {
+		event = b.logger.Debug()
+	}
+	event.Str("interceptor", id).Str("direction", direction).Str("topic", msg.Topic).
+		Str("origin", msg.Origin).Str("target", msg.Target).Msg("message dropped by an interceptor")
+}
+
+// toProperties converts the user properties of a packet to the properties carried by the pipe
+func toProperties(user []packets.UserProperty) []*transport.Property {
+	if len(user) == 0 {
+		return nil
+	}
+	properties := make([]*transport.Property, 0, len(user))
+	for _, u := range user {
+		properties = append(properties, &transport.Property{Key: u.Key, Val: u.Val})
+	}
+	return properties
+}
+
+// fromProperties converts the properties carried by the pipe to the user properties of a packet
+func fromProperties(properties []*transport.Property) []packets.UserProperty {
+	if len(properties) == 0 {
+		return nil
+	}
+	user := make([]packets.UserProperty, 0, len(properties))
+	for _, p := range properties {
+		user = append(user, packets.UserProperty{Key: p.Key, Val: p.Val})
+	}
+	return user
+}
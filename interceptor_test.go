@@ -0,0 +1,143 @@
+package bridgemq
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// the test interceptors append their id to the topic of the messages and return err
+type outboundStep struct {
+	id  string
+	err error
+}
+
+func (s *outboundStep) ID() string { return s.id }
+func (s *outboundStep) InterceptOutbound(msg *Message) error {
+	msg.Topic += "/" + s.id
+	return s.err
+}
+
+type inboundStep struct {
+	id  string
+	err error
+}
+
+func (s *inboundStep) ID() string { return s.id }
+func (s *inboundStep) InterceptInbound(msg *Message) error {
+	msg.Topic += "/" + s.id
+	return s.err
+}
+
+type bothStep struct {
+	outboundStep
+}
+
+func (s *bothStep) InterceptInbound(msg *Message) error {
+	return s.InterceptOutbound(msg)
+}
+
+type noStep string
+
+func (s noStep) ID() string { return string(s) }
+
+func newInterceptBridge() *Bridge {
+	logger := zerolog.Nop()
+	b := &Bridge{logger: &logger}
+	b.interceptors.Store(newChain(nil))
+	return b
+}
+
+func TestInterceptorChain(t *testing.T) {
+	type added struct {
+		i     Interceptor
+		order int
+	}
+	dropped := fmt.Errorf("filtered: %w", ErrMessageDropped)
+	tests := []struct {
+		name  string
+		added []added
+		ids   []string
+		// outbound and inbound are the topics of the messages after the chain, out and in whether they pass
+		outbound string
+		out      bool
+		inbound  string
+		in       bool
+	}{
+		{"empty", nil, []string{}, "t", true, "t", true},
+		{"by order", []added{
+			{&outboundStep{id: "a"}, 2},
+			{&outboundStep{id: "b"}, 1},
+			{&outboundStep{id: "c"}, 1},
+		}, []string{"b", "c", "a"}, "t/b/c/a", true, "t", true},
+		{"directions", []added{
+			{&outboundStep{id: "out"}, 0},
+			{&inboundStep{id: "in"}, 0},
+			{&bothStep{outboundStep{id: "both"}}, -1},
+		}, []string{"both", "out", "in"}, "t/both/out", true, "t/both/in", true},
+		{"dropped", []added{
+			{&outboundStep{id: "a", err: dropped}, 1},
+			{&outboundStep{id: "b"}, 2},
+			{&inboundStep{id: "c", err: errors.New("rejected")}, 1},
+			{&inboundStep{id: "d"}, 2},
+		}, []string{"a", "c", "b", "d"}, "t/a", false, "t/c", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newInterceptBridge()
+			for _, a := range tt.added {
+				if err := b.AddInterceptor(a.i, a.order); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if ids := b.Interceptors(); !reflect.DeepEqual(ids, tt.ids) {
+				t.Fatalf("expected interceptors %v, got %v", tt.ids, ids)
+			}
+
+			c := b.interceptors.Load()
+			msg := &Message{Topic: "t"}
+			if ok := b.interceptOutbound(c.outbound, msg); ok != tt.out || msg.Topic != tt.outbound {
+				t.Fatalf("expected outbound %s passed:%v, got %s passed:%v", tt.outbound, tt.out, msg.Topic, ok)
+			}
+			msg = &Message{Topic: "t"}
+			if ok := b.interceptInbound(c.inbound, msg); ok != tt.in || msg.Topic != tt.inbound {
+				t.Fatalf("expected inbound %s passed:%v, got %s passed:%v", tt.inbound, tt.in, msg.Topic, ok)
+			}
+		})
+	}
+}
+
+func TestAddRemoveInterceptor(t *testing.T) {
+	b := newInterceptBridge()
+	if err := b.AddInterceptor(noStep("none"), 0); !errors.Is(err, ErrInvalidInterceptor) {
+		t.Fatalf("expected ErrInvalidInterceptor, got %v", err)
+	}
+	if err := b.AddInterceptor(&outboundStep{id: "a"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddInterceptor(&inboundStep{id: "a"}, 1); !errors.Is(err, ErrInterceptorExists) {
+		t.Fatalf("expected ErrInterceptorExists, got %v", err)
+	}
+	if err := b.AddInterceptor(&inboundStep{id: "b"}, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the chain loaded before a removal is not modified by it
+	before := b.interceptors.Load()
+	if !b.RemoveInterceptor("a") || b.RemoveInterceptor("a") {
+		t.Fatal("expected the interceptor removed once")
+	}
+	if ids := b.Interceptors(); !reflect.DeepEqual(ids, []string{"b"}) {
+		t.Fatalf("expected interceptors [b], got %v", ids)
+	}
+	if len(before.all) != 2 || len(before.outbound) != 1 {
+		t.Fatalf("expected the previous chain unchanged, got %d interceptors", len(before.all))
+	}
+	if err := b.AddInterceptor(&outboundStep{id: "a"}, 0); err != nil {
+		t.Fatalf("expected the id free after the removal, got %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package bridgemq
+
+import (
+	"context"
+	"sync"
+
+	"github.com/werbenhu/bridgemq/discovery"
+)
+
+// QueryOwner asks the agents which of them the client whose id is the payload is connected to,
+// the agents the client is connected to answer with their name
+const QueryOwner = "bridgemq-owner"
+
+// EventHandler handles a user event broadcast by an agent
+type EventHandler func(payload []byte)
+
+// QueryHandler answers a query sent by the agent from, the query is not answered if ok is false
+type QueryHandler func(from string, payload []byte) (resp []byte, ok bool)
+
+// handlers are the handlers of the user events and the queries by name
+type handlers struct {
+	sync.RWMutex
+	events  map[string]EventHandler
+	queries map[string]QueryHandler
+}
+
+// HandleEvent sets the handler of the user events with the given name, the handlers are called
+// one at a time in the order of the events and must not block
+func (b *Bridge) HandleEvent(name string, h EventHandler) {
+	b.handlers.Lock()
+	defer b.handlers.Unlock()
+	b.handlers.events[name] = h
+}
+
+// HandleQuery sets the handler of the queries with the given name
+func (b *Bridge) HandleQuery(name string, h QueryHandler) {
+	b.handlers.Lock()
+	defer b.handlers.Unlock()
+	b.handlers.queries[name] = h
+}
+
+// Broadcast sends a user event to all the agents through the gossip, even to the agents whose
+// pipe is down. The event is also delivered to the local agent, it is ErrNotSupported if the
+// discovery does not gossip, such as the static and the kv discoveries.
+func (b *Bridge) Broadcast(name string, payload []byte) error {
+	messenger, ok := b.discovery.(discovery.Messenger)
+	if !ok {
+		return ErrNotSupported
+	}
+	return messenger.Broadcast(name, payload)
+}
+
+// Query sends a query to all the agents through the gossip and returns the responses received
+// before ctx is done or the query times out, the local agent answers it too
+func (b *Bridge) Query(ctx context.Context, name string, payload []byte) ([]discovery.Response, error) {
+	messenger, ok := b.discovery.(discovery.Messenger)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return messenger.Query(ctx, name, payload)
+}
+
+// Owner returns the agent the client is connected to, the agents are asked through the
+// gossip so that it is answered even if the client is connected to an agent whose pipe is down
+func (b *Bridge) Owner(ctx context.Context, clientId string) (string, error) {
+	if cl, ok := b.option.Broker.Clients.Get(clientId); ok && !cl.Closed() && !cl.Net.Inline {
+		return b.option.Name, nil
+	}
+	responses, err := b.Query(ctx, QueryOwner, []byte(clientId))
+	if err != nil {
+		return "", err
+	}
+	for _, r := range responses {
+		if len(r.Payload) > 0 {
+			return string(r.Payload), nil
+		}
+	}
+	return "", ErrClientNotFound
+}
+
+func (b *Bridge) OnEvent(name string, payload []byte) {
+	b.handlers.RLock()
+	h, ok := b.handlers.events[name]
+	b.handlers.RUnlock()
+	if !ok {
+		b.logger.Debug().Str("event", name).Msg("no handler for user event")
+		return
+	}
+	h(payload)
+}
+
+func (b *Bridge) OnQuery(from string, name string, payload []byte) ([]byte, bool) {
+	b.handlers.RLock()
+	h, ok := b.handlers.queries[name]
+	b.handlers.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return h(from, payload)
+}
+
+// answerOwner answers the owner query if the client is connected to the local broker
+func (b *Bridge) answerOwner(from string, payload []byte) ([]byte, bool) {
+	cl, ok := b.option.Broker.Clients.Get(string(payload))
+	if !ok || cl.Closed() || cl.Net.Inline {
+		return nil, false
+	}
+	return []byte(b.option.Name), true
+}
@@ -1,10 +1,30 @@
 package bridgemq
 
 import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/mochi-co/mqtt/v2"
 	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"github.com/werbenhu/bridgemq/discovery"
+	"github.com/werbenhu/bridgemq/transport"
+	"github.com/werbenhu/bridgemq/webhook"
+)
+
+const (
+	DiscoverySerf   = "serf"
+	DiscoveryStatic = "static"
+	DiscoveryKV     = "kv"
+
+	TransportGrpc = "grpc"
+	TransportTcp  = "tcp"
 )
 
 type Option struct {
@@ -14,6 +34,141 @@ type Option struct {
 	PipePort  string
 	Agents    string
 	Broker    *mqtt.Server
+
+	// EncryptKey is a base64 encoded key to encrypt the gossip traffic between agents
+	EncryptKey string
+
+	// Rules decide which published messages are forwarded to the other agents,
+	// all the messages are forwarded if there is no rule
+	Rules []Rule
+
+	// Logger is shared by the bridge, the discovery and the transport, the logger of the broker is used if it is nil
+	Logger *zerolog.Logger
+
+	// SerfLogLevel is the minimum level of the serf and memberlist logs, warn by default
+	SerfLogLevel string
+
+	// SerfLogFile is a file the serf and memberlist logs are also written to, no file is written if it is empty
+	SerfLogFile string
+
+	// Endpoint is the mqtt address the clients can connect to, such as 192.168.0.1:1883,
+	// the clients of a draining agent are redirected to the endpoints of the other agents
+	Endpoint string
+
+	// Zone is the zone of the agent advertised to the other agents, such as an availability zone
+	Zone string
+
+	// PeerPolicy chooses the agent the clients of a draining agent are redirected to, it is
+	// PolicyRoundRobin, PolicyNearest or PolicyZone, the latter two use the estimated round trip times
+	PeerPolicy string
+
+	// DrainRate is the number of clients disconnected per second while draining, 0 is unlimited
+	DrainRate int
+
+	// JoinRetries is the number of times joining the agents is retried with an exponential backoff
+	// starting at JoinBackoff up to JoinMaxBackoff before Start fails, it is retried in the background
+	// until it succeeds if it is negative, the default
+	JoinRetries    int
+	JoinBackoff    time.Duration
+	JoinMaxBackoff time.Duration
+
+	// ExpectedSize is the number of agents expected in the cluster, the agents are joined again
+	// every RejoinInterval while less agents are alive, 0 disables the rejoin
+	ExpectedSize   int
+	RejoinInterval time.Duration
+
+	// Resolver resolves the dns names and the srv names of the agents, such as _bridgemq._tcp.example.com,
+	// the names are resolved again on every join, net.DefaultResolver is used if it is nil
+	Resolver *net.Resolver
+
+	// Discovery is serf, static or kv, the static discovery uses the agents listed in StaticAgents
+	// and in StaticFile without gossip, they join and leave according to the health checks
+	// of their pipes done every StaticCheckInterval
+	Discovery           string
+	StaticAgents        []discovery.StaticAgent
+	StaticFile          string
+	StaticCheckInterval time.Duration
+
+	// KVStore is the store of the kv discovery, the agents register their key under KVPrefix
+	// with a lease of KVTTL and discover the other agents by watching the prefix
+	KVStore  discovery.KVStore
+	KVPrefix string
+	KVTTL    time.Duration
+
+	// SnapshotPath is a file recording the members, so that a restarted agent rejoins its previous peers
+	SnapshotPath string
+
+	// Transport is grpc or tcp, the tcp transport uses a compact binary framing over plain tcp which
+	// costs less memory and cpu per message, it can not be used with the static discovery whose
+	// health checks use the grpc health service of the pipe
+	Transport string
+
+	// PipeTLS enables tls on the pipe, it is the config of the listener and of the connections to the
+	// other agents, so it holds the certificate of the agent and the RootCAs and ClientCAs verifying
+	// the other agents. When it verifies the client certificates, an agent pushing to the local agent
+	// is identified by the common name of its certificate, which must be its name.
+	PipeTLS *tls.Config
+
+	// PipeToken is a secret shared by the agents, the pushes without it are rejected when it is set.
+	// With PipeToken or mutual PipeTLS, the agents pushing must be members of the cluster.
+	PipeToken string
+
+	// AgentPolicies limit the topics the remote agents may publish into and whether their
+	// clients may take over the local clients
+	AgentPolicies []AgentPolicy
+
+	// RateLimits limit the publishes received from and pushed to the remote agents, a publish
+	// delayed by a limit longer than RateLimitMaxDelay is dropped
+	RateLimits        []RateLimit
+	RateLimitMaxDelay time.Duration
+
+	// Priorities give a priority to the publishes by topic filter, the mqtt v5 user property PriorityProperty
+	// overrides them. The messages of each priority are queued apart on the pipe and sent according to
+	// PipeScheduling, strict or weighted by PipeWeights, the weights of the high, normal and low priorities.
+	Priorities       []PriorityRule
+	PriorityProperty string
+	PipeScheduling   string
+	PipeWeights      []int
+
+	// PipeKeepAlive is the interval of the pings on an idle pipe connection, the connection is
+	// reconnected if a ping is not answered within PipeKeepAliveTimeout
+	PipeKeepAlive        time.Duration
+	PipeKeepAliveTimeout time.Duration
+
+	// PipeBackoff is the delay before reconnecting a lost pipe connection, it is doubled with
+	// a jitter on every failed attempt up to PipeMaxBackoff
+	PipeBackoff    time.Duration
+	PipeMaxBackoff time.Duration
+
+	// PipeBatchSize is the maximum number of publishes combined in a batch sent to an agent, a batch is
+	// sent once it holds PipeBatchSize publishes or PipeBatchBytes bytes, or PipeBatchLinger after its
+	// first publish. The publishes are sent one by one if it is 1.
+	PipeBatchSize   int
+	PipeBatchBytes  int
+	PipeBatchLinger time.Duration
+
+	// PipeMaxMsgSize is the maximum size of a message sent or received on the pipe, the payloads larger
+	// than PipeChunkSize are split into chunks which are reassembled and verified by the receiver,
+	// a transfer whose next chunk is not received within PipeChunkTimeout is dropped. The payloads larger
+	// than PipeMaxPayloadSize are neither forwarded nor reassembled.
+	PipeMaxMsgSize     int
+	PipeMaxPayloadSize int
+	PipeChunkSize      int
+	PipeChunkTimeout   time.Duration
+
+	// Webhook sends the client connects and disconnects, the publishes of the local clients matching
+	// the topics of an endpoint and the agents joining and leaving to http endpoints, it is disabled if nil
+	Webhook *webhook.Opt
+
+	// SysInterval is the interval the cluster $SYS topics are published at and the stats of the agent are
+	// pushed to the other agents, 0 disables the cluster $SYS topics and the presence events of the clients
+	SysInterval time.Duration
+
+	// OnPeerState is called when the state of the pipe connection to an agent changes, it must not block
+	OnPeerState func(agentId string, state transport.PeerState)
+
+	// LogClients logs every client connected to or disconnected from the local broker and the remote agents
+	LogClients bool
 }
 
 type IOption func(o *Option)
@@ -62,6 +217,235 @@ func OptAgents(agents string) IOption {
 	}
 }
 
+func OptEncryptKey(key string) IOption {
+	return func(o *Option) {
+		if key != "" {
+			o.EncryptKey = key
+		}
+	}
+}
+
+func OptRules(rules []Rule) IOption {
+	return func(o *Option) {
+		o.Rules = rules
+	}
+}
+
+func OptLogger(logger *zerolog.Logger) IOption {
+	return func(o *Option) {
+		o.Logger = logger
+	}
+}
+
+func OptSerfLogLevel(level string) IOption {
+	return func(o *Option) {
+		if level != "" {
+			o.SerfLogLevel = level
+		}
+	}
+}
+
+func OptSerfLogFile(file string) IOption {
+	return func(o *Option) {
+		o.SerfLogFile = file
+	}
+}
+
+func OptLogClients(enabled bool) IOption {
+	return func(o *Option) {
+		o.LogClients = enabled
+	}
+}
+
+func OptEndpoint(endpoint string) IOption {
+	return func(o *Option) {
+		o.Endpoint = endpoint
+	}
+}
+
+func OptZone(zone string) IOption {
+	return func(o *Option) {
+		o.Zone = zone
+	}
+}
+
+func OptPeerPolicy(policy string) IOption {
+	return func(o *Option) {
+		if policy != "" {
+			o.PeerPolicy = policy
+		}
+	}
+}
+
+func OptTransport(name string) IOption {
+	return func(o *Option) {
+		if name != "" {
+			o.Transport = name
+		}
+	}
+}
+
+func OptPipeTLS(config *tls.Config) IOption {
+	return func(o *Option) {
+		o.PipeTLS = config
+	}
+}
+
+func OptPipeToken(token string) IOption {
+	return func(o *Option) {
+		o.PipeToken = token
+	}
+}
+
+func OptAgentPolicies(policies []AgentPolicy) IOption {
+	return func(o *Option) {
+		o.AgentPolicies = policies
+	}
+}
+
+func OptRateLimits(limits []RateLimit, maxDelay time.Duration) IOption {
+	return func(o *Option) {
+		o.RateLimits = limits
+		o.RateLimitMaxDelay = maxDelay
+	}
+}
+
+func OptPriorities(rules []PriorityRule, property string) IOption {
+	return func(o *Option) {
+		o.Priorities = rules
+		if property != "" {
+			o.PriorityProperty = property
+		}
+	}
+}
+
+func OptPipeScheduling(scheduling string, weights []int) IOption {
+	return func(o *Option) {
+		if scheduling != "" {
+			o.PipeScheduling = scheduling
+		}
+		if len(weights) > 0 {
+			o.PipeWeights = weights
+		}
+	}
+}
+
+func OptPipeKeepAlive(interval time.Duration, timeout time.Duration) IOption {
+	return func(o *Option) {
+		o.PipeKeepAlive = interval
+		o.PipeKeepAliveTimeout = timeout
+	}
+}
+
+func OptPipeBackoff(backoff time.Duration, maxBackoff time.Duration) IOption {
+	return func(o *Option) {
+		o.PipeBackoff = backoff
+		o.PipeMaxBackoff = maxBackoff
+	}
+}
+
+func OptPipeBatch(size int, bytes int, linger time.Duration) IOption {
+	return func(o *Option) {
+		o.PipeBatchSize = size
+		o.PipeBatchBytes = bytes
+		o.PipeBatchLinger = linger
+	}
+}
+
+func OptPipeMaxMsgSize(size int) IOption {
+	return func(o *Option) {
+		o.PipeMaxMsgSize = size
+	}
+}
+
+func OptPipeMaxPayloadSize(size int) IOption {
+	return func(o *Option) {
+		o.PipeMaxPayloadSize = size
+	}
+}
+
+func OptPipeChunk(size int, timeout time.Duration) IOption {
+	return func(o *Option) {
+		o.PipeChunkSize = size
+		o.PipeChunkTimeout = timeout
+	}
+}
+
+func OptWebhook(opt *webhook.Opt) IOption {
+	return func(o *Option) {
+		o.Webhook = opt
+	}
+}
+
+func OptSysInterval(interval time.Duration) IOption {
+	return func(o *Option) {
+		o.SysInterval = interval
+	}
+}
+
+func OptOnPeerState(fn func(agentId string, state transport.PeerState)) IOption {
+	return func(o *Option) {
+		o.OnPeerState = fn
+	}
+}
+
+func OptDrainRate(rate int) IOption {
+	return func(o *Option) {
+		o.DrainRate = rate
+	}
+}
+
+func OptJoinRetries(retries int, backoff time.Duration, maxBackoff time.Duration) IOption {
+	return func(o *Option) {
+		o.JoinRetries = retries
+		o.JoinBackoff = backoff
+		o.JoinMaxBackoff = maxBackoff
+	}
+}
+
+func OptRejoin(expectedSize int, interval time.Duration) IOption {
+	return func(o *Option) {
+		o.ExpectedSize = expectedSize
+		o.RejoinInterval = interval
+	}
+}
+
+func OptResolver(resolver *net.Resolver) IOption {
+	return func(o *Option) {
+		o.Resolver = resolver
+	}
+}
+
+func OptDiscovery(name string) IOption {
+	return func(o *Option) {
+		if name != "" {
+			o.Discovery = name
+		}
+	}
+}
+
+func OptStatic(agents []discovery.StaticAgent, file string, checkInterval time.Duration) IOption {
+	return func(o *Option) {
+		o.StaticAgents = agents
+		o.StaticFile = file
+		o.StaticCheckInterval = checkInterval
+	}
+}
+
+func OptKV(store discovery.KVStore, prefix string, ttl time.Duration) IOption {
+	return func(o *Option) {
+		o.KVStore = store
+		o.KVPrefix = prefix
+		o.KVTTL = ttl
+	}
+}
+
+func OptSnapshotPath(path string) IOption {
+	return func(o *Option) {
+		o.SnapshotPath = path
+	}
+}
+
 func DefaultOption() *Option {
 	hostname, _ := os.Hostname()
 	return &Option{
@@ -69,5 +453,198 @@ func DefaultOption() *Option {
 		Addr:      ":7933",
 		Advertise: ":7933",
 		PipePort:  "8933",
+
+		SerfLogLevel: "warn",
+		DrainRate:    100,
+		Discovery:    DiscoverySerf,
+		PeerPolicy:   PolicyRoundRobin,
+		Transport:    TransportGrpc,
+
+		JoinRetries:    -1,
+		JoinBackoff:    time.Second,
+		JoinMaxBackoff: 30 * time.Second,
+		RejoinInterval: 30 * time.Second,
+
+		PipeKeepAlive:        10 * time.Second,
+		PipeKeepAliveTimeout: 5 * time.Second,
+		PipeBackoff:          time.Second,
+		PipeMaxBackoff:       30 * time.Second,
+
+		PipeBatchSize:   128,
+		PipeBatchBytes:  256 * 1024,
+		PipeBatchLinger: 2 * time.Millisecond,
+
+		PipeMaxMsgSize:     4 * 1024 * 1024,
+		PipeMaxPayloadSize: 64 * 1024 * 1024,
+		PipeChunkSize:      1024 * 1024,
+		PipeChunkTimeout:   30 * time.Second,
+
+		RateLimitMaxDelay: time.Second,
+
+		PriorityProperty: DefaultPriorityProperty,
+		PipeScheduling:   SchedulingStrict,
+		PipeWeights:      []int{8, 4, 1},
+
+		SysInterval: 10 * time.Second,
+	}
+}
+
+// Validate checks the options before the bridge is started
+func (o *Option) Validate() error {
+	if o.Broker == nil {
+		return ErrInvalidBroker
+	}
+	if o.Name == "" {
+		return ErrInvalidOption.Wrap(fmt.Errorf("name can not be empty"))
+	}
+
+	switch o.Discovery {
+	case DiscoverySerf, DiscoveryStatic:
+	case DiscoveryKV:
+		if o.KVStore == nil {
+			return ErrInvalidOption.Wrap(fmt.Errorf("kv store can not be nil with the kv discovery"))
+		}
+	default:
+		return ErrInvalidOption.Wrap(fmt.Errorf("unknown discovery %q, it must be %s, %s or %s", o.Discovery, DiscoverySerf, DiscoveryStatic, DiscoveryKV))
+	}
+	switch o.Transport {
+	case TransportGrpc:
+	case TransportTcp:
+		if o.Discovery == DiscoveryStatic {
+			return ErrInvalidOption.Wrap(fmt.Errorf("the static discovery needs the %s transport", TransportGrpc))
+		}
+	default:
+		return ErrInvalidOption.Wrap(fmt.Errorf("unknown transport %q, it must be %s or %s", o.Transport, TransportGrpc, TransportTcp))
+	}
+	switch o.PeerPolicy {
+	case PolicyRoundRobin, PolicyNearest, PolicyZone:
+	default:
+		return ErrInvalidOption.Wrap(fmt.Errorf("unknown peer policy %q, it must be %s, %s or %s", o.PeerPolicy, PolicyRoundRobin, PolicyNearest, PolicyZone))
+	}
+	if err := validateAddr(o.Addr); err != nil {
+		return ErrInvalidAddr.Wrap(fmt.Errorf("addr %q %s", o.Addr, err.Error()))
+	}
+	if err := validateAddr(o.Advertise); err != nil {
+		return ErrInvalidAddr.Wrap(fmt.Errorf("advertise %q %s", o.Advertise, err.Error()))
+	}
+	if port, err := strconv.Atoi(o.PipePort); err != nil || port < 0 || port > 65535 {
+		return ErrInvalidAddr.Wrap(fmt.Errorf("pipe port %q is not a valid port", o.PipePort))
+	}
+	if o.Agents != "" {
+		for _, a := range strings.Split(o.Agents, ",") {
+			if discovery.IsSRV(a) {
+				continue
+			}
+			if err := validateAddr(a); err != nil {
+				return ErrInvalidAddr.Wrap(fmt.Errorf("agent %q %s", a, err.Error()))
+			}
+		}
+	}
+	if o.Endpoint != "" {
+		if err := validateAddr(o.Endpoint); err != nil {
+			return ErrInvalidAddr.Wrap(fmt.Errorf("endpoint %q %s", o.Endpoint, err.Error()))
+		}
+	}
+
+	if o.EncryptKey != "" {
+		key, err := base64.StdEncoding.DecodeString(o.EncryptKey)
+		if err != nil {
+			return ErrInvalidOption.Wrap(fmt.Errorf("encrypt key must be base64 encoded, %s", err.Error()))
+		}
+		if l := len(key); l != 16 && l != 24 && l != 32 {
+			return ErrInvalidOption.Wrap(fmt.Errorf("encrypt key must be 16, 24 or 32 bytes, got %d bytes", l))
+		}
+	}
+	if o.JoinBackoff < 0 || o.JoinMaxBackoff < 0 || o.RejoinInterval < 0 {
+		return ErrInvalidOption.Wrap(fmt.Errorf("join backoff and rejoin interval can not be negative"))
+	}
+	if o.PipeKeepAlive < 0 || o.PipeKeepAliveTimeout < 0 || o.PipeBackoff < 0 || o.PipeMaxBackoff < 0 {
+		return ErrInvalidOption.Wrap(fmt.Errorf("pipe keepalive and backoff can not be negative"))
+	}
+	if o.PipeBatchSize < 0 || o.PipeBatchBytes < 0 || o.PipeBatchLinger < 0 {
+		return ErrInvalidOption.Wrap(fmt.Errorf("pipe batch size, bytes and linger can not be negative"))
+	}
+	if o.PipeMaxMsgSize < 0 || o.PipeMaxPayloadSize < 0 || o.PipeChunkSize < 0 || o.PipeChunkTimeout < 0 {
+		return ErrInvalidOption.Wrap(fmt.Errorf("pipe max message size, max payload size, chunk size and chunk timeout can not be negative"))
+	}
+	if o.PipeMaxMsgSize > 0 {
+		if o.PipeChunkSize >= o.PipeMaxMsgSize {
+			return ErrInvalidOption.Wrap(fmt.Errorf("pipe chunk size %d must be smaller than the pipe max message size %d", o.PipeChunkSize, o.PipeMaxMsgSize))
+		}
+		if o.PipeBatchBytes >= o.PipeMaxMsgSize {
+			return ErrInvalidOption.Wrap(fmt.Errorf("pipe batch bytes %d must be smaller than the pipe max message size %d", o.PipeBatchBytes, o.PipeMaxMsgSize))
+		}
+	}
+	agents := make(map[string]bool)
+	for _, p := range o.AgentPolicies {
+		if p.Agent == "" {
+			return ErrInvalidOption.Wrap(fmt.Errorf("the agent of an agent policy can not be empty"))
+		}
+		if agents[p.Agent] {
+			return ErrInvalidOption.Wrap(fmt.Errorf("agent %q has more than one policy", p.Agent))
+		}
+		agents[p.Agent] = true
+	}
+	for i, r := range o.RateLimits {
+		if err := r.validate(); err != nil {
+			return ErrInvalidOption.Wrap(fmt.Errorf("rate limit %d %s", i, err.Error()))
+		}
+	}
+	if o.RateLimitMaxDelay < 0 {
+		return ErrInvalidOption.Wrap(fmt.Errorf("rate limit max delay can not be negative"))
+	}
+	for i, r := range o.Priorities {
+		if _, err := parsePriority(r.Priority); err != nil {
+			return ErrInvalidOption.Wrap(fmt.Errorf("priority rule %d %s", i, err.Error()))
+		}
+	}
+	switch o.PipeScheduling {
+	case SchedulingStrict:
+	case SchedulingWeighted:
+		if len(o.PipeWeights) != 3 {
+			return ErrInvalidOption.Wrap(fmt.Errorf("pipe weights must be the 3 weights of the high, normal and low priorities"))
+		}
+		for _, w := range o.PipeWeights {
+			if w <= 0 {
+				return ErrInvalidOption.Wrap(fmt.Errorf("pipe weights must be positive"))
+			}
+		}
+	default:
+		return ErrInvalidOption.Wrap(fmt.Errorf("unknown pipe scheduling %q, it must be %s or %s", o.PipeScheduling, SchedulingStrict, SchedulingWeighted))
+	}
+	if o.Webhook != nil {
+		if err := o.Webhook.Validate(); err != nil {
+			return ErrInvalidOption.Wrap(fmt.Errorf("webhook %s", err.Error()))
+		}
+	}
+	if o.SysInterval < 0 {
+		return ErrInvalidOption.Wrap(fmt.Errorf("sys interval can not be negative"))
+	}
+	if o.ExpectedSize < 0 {
+		return ErrInvalidOption.Wrap(fmt.Errorf("expected size can not be negative"))
+	}
+	if o.DrainRate < 0 {
+		return ErrInvalidOption.Wrap(fmt.Errorf("drain rate can not be negative"))
+	}
+	return nil
+}
+
+// weights returns the weights of the priorities given to the transport, they are empty with the strict scheduling
+func (o *Option) weights() []int {
+	if o.PipeScheduling != SchedulingWeighted {
+		return nil
+	}
+	return o.PipeWeights
+}
+
+// validateAddr checks that addr is a host:port address, the host can be empty
+func validateAddr(addr string) error {
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if port, err := strconv.Atoi(p); err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("invalid port %q", p)
 	}
+	return nil
 }
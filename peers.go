@@ -0,0 +1,144 @@
+package bridgemq
+
+import (
+	"sort"
+	"time"
+
+	"github.com/werbenhu/bridgemq/agent"
+	"github.com/werbenhu/bridgemq/discovery"
+	"github.com/werbenhu/bridgemq/transport"
+)
+
+// The policies choosing a peer among the healthy agents
+const (
+	// PolicyRoundRobin picks the agents in turn
+	PolicyRoundRobin = "round_robin"
+
+	// PolicyNearest picks the agent with the lowest estimated round trip time
+	PolicyNearest = "nearest"
+
+	// PolicyZone picks the agents of the local zone in turn, the nearest agent if none is in the local zone
+	PolicyZone = "zone"
+)
+
+// Peer is an alive remote agent with its zone and its estimated round trip time
+type Peer struct {
+	Agent *agent.Agent
+	Zone  string
+
+	// RTT is the round trip time estimated from the network coordinates, it is only valid if HasRTT is set
+	RTT    time.Duration
+	HasRTT bool
+
+	// State is the state of the pipe connection to the agent, empty if it is not connected
+	State transport.PeerState
+}
+
+// Zone returns the zone of the local agent
+func (b *Bridge) Zone() string {
+	return b.option.Zone
+}
+
+// RTT returns the estimated round trip time to an agent, false if the discovery does not
+// estimate the latency, such as the static discovery, if the agent has not been probed yet
+// or if it is the local agent
+func (b *Bridge) RTT(agentId string) (time.Duration, bool) {
+	coordinates, ok := b.discovery.(discovery.Coordinates)
+	if !ok || agentId == b.option.Name {
+		return 0, false
+	}
+	return coordinates.RTT(agentId)
+}
+
+// PeerStates returns the state of the pipe connection to every remote agent
+func (b *Bridge) PeerStates() map[string]transport.PeerState {
+	if status, ok := b.transport.(transport.Status); ok {
+		return status.PeerStates()
+	}
+	return map[string]transport.PeerState{}
+}
+
+// OnPeerState is called when the state of the pipe connection to an agent changes
+func (b *Bridge) OnPeerState(agentId string, state transport.PeerState) {
+	if b.option.OnPeerState != nil {
+		b.option.OnPeerState(agentId, state)
+	}
+}
+
+// Peers returns the alive remote agents, the agents of the local zone first, then by
+// increasing round trip time, the agents whose round trip time is unknown are last
+func (b *Bridge) Peers() []Peer {
+	peers := make([]Peer, 0)
+	states := b.PeerStates()
+	for _, a := range b.discovery.Agents() {
+		if a.Id == b.option.Name || a.Status != agent.StatusAlive {
+			continue
+		}
+		rtt, ok := b.RTT(a.Id)
+		peers = append(peers, Peer{
+			Agent:  a,
+			Zone:   a.Tags[discovery.ZoneKey],
+			RTT:    rtt,
+			HasRTT: ok,
+			State:  states[a.Id],
+		})
+	}
+
+	zone := b.option.Zone
+	sort.SliceStable(peers, func(i, j int) bool {
+		pi, pj := peers[i], peers[j]
+		if local := zone != "" && pi.Zone == zone; local != (zone != "" && pj.Zone == zone) {
+			return local
+		}
+		if pi.HasRTT != pj.HasRTT {
+			return pi.HasRTT
+		}
+		if pi.RTT != pj.RTT {
+			return pi.RTT < pj.RTT
+		}
+		return pi.Agent.Id < pj.Agent.Id
+	})
+	return peers
+}
+
+// SelectPeer picks one of the peers accepted by filter according to the policy, the filter
+// can be nil. It is false if no peer is accepted, an unknown policy is round robin.
+func (b *Bridge) SelectPeer(policy string, filter func(Peer) bool) (Peer, bool) {
+	candidates := make([]Peer, 0)
+	for _, p := range b.Peers() {
+		if filter == nil || filter(p) {
+			candidates = append(candidates, p)
+		}
+	}
+	if len(candidates) == 0 {
+		return Peer{}, false
+	}
+
+	switch policy {
+	case PolicyNearest:
+		return nearest(candidates), true
+	case PolicyZone:
+		local := make([]Peer, 0)
+		for _, p := range candidates {
+			if b.option.Zone != "" && p.Zone == b.option.Zone {
+				local = append(local, p)
+			}
+		}
+		if len(local) == 0 {
+			return nearest(candidates), true
+		}
+		candidates = local
+	}
+	return candidates[int(b.picks.Add(1)-1)%len(candidates)], true
+}
+
+// nearest returns the peer with the lowest known round trip time, the first peer if none is known
+func nearest(peers []Peer) Peer {
+	best := peers[0]
+	for _, p := range peers[1:] {
+		if p.HasRTT && (!best.HasRTT || p.RTT < best.RTT) {
+			best = p
+		}
+	}
+	return best
+}
@@ -0,0 +1,55 @@
+package bridgemq
+
+import "github.com/werbenhu/bridgemq/topics"
+
+// AnyAgent is the agent of the policy applied to the agents without their own policy
+const AnyAgent = "*"
+
+// AgentPolicy limits what a remote agent may push to the local agent, the agents
+// without a policy and without an AnyAgent policy are not limited
+type AgentPolicy struct {
+	// Agent is the name of the agent, AnyAgent applies to the agents without their own policy
+	Agent string `json:"agent"`
+
+	// Topics are the topic filters the agent may publish into, it may publish into every topic if it is empty
+	Topics []string `json:"topics"`
+
+	// DenyTakeover keeps a local client connected when a client with the same id connects to the agent
+	DenyTakeover bool `json:"deny_takeover"`
+}
+
+// SetAgentPolicies replaces the agent policies, they apply to the next messages received
+func (b *Bridge) SetAgentPolicies(policies []AgentPolicy) {
+	byAgent := make(map[string]*AgentPolicy, len(policies))
+	for i := range policies {
+		byAgent[policies[i].Agent] = &policies[i]
+	}
+	b.policies.Store(byAgent)
+}
+
+// AgentPolicy returns the policy applied to the agent, it is nil if the agent is not limited
+func (b *Bridge) AgentPolicy(id string) *AgentPolicy {
+	byAgent := b.policies.Load().(map[string]*AgentPolicy)
+	if p, ok := byAgent[id]; ok {
+		return p
+	}
+	return byAgent[AnyAgent]
+}
+
+// mayPublish reports whether the policy lets its agent publish into the topic
+func (p *AgentPolicy) mayPublish(topic string) bool {
+	if p == nil || len(p.Topics) == 0 {
+		return true
+	}
+	for _, filter := range p.Topics {
+		if topics.Match(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayTakeover reports whether the policy lets the clients of its agent take over the local clients
+func (p *AgentPolicy) mayTakeover() bool {
+	return p == nil || !p.DenyTakeover
+}
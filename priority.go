@@ -0,0 +1,74 @@
+package bridgemq
+
+import (
+	"fmt"
+
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/werbenhu/bridgemq/topics"
+	"github.com/werbenhu/bridgemq/transport"
+)
+
+const (
+	// PriorityHigh, PriorityNormal and PriorityLow are the priorities of the publishes on the pipe,
+	// the connects and the disconnects always have the high priority
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+
+	// SchedulingStrict always sends the messages of the highest priority first, SchedulingWeighted
+	// sends up to the weight of each priority in turn so that the low priorities are not starved
+	SchedulingStrict   = "strict"
+	SchedulingWeighted = "weighted"
+
+	// DefaultPriorityProperty is the mqtt v5 user property setting the priority of a publish
+	DefaultPriorityProperty = "priority"
+)
+
+// PriorityRule gives a priority to the publishes matching the topic filter
+type PriorityRule struct {
+	Filter   string `json:"filter"`
+	Priority string `json:"priority"`
+}
+
+// parsePriority returns the transport priority of a priority name
+func parsePriority(name string) (transport.Priority, error) {
+	switch name {
+	case PriorityHigh:
+		return transport.PriorityHigh, nil
+	case PriorityNormal:
+		return transport.PriorityNormal, nil
+	case PriorityLow:
+		return transport.PriorityLow, nil
+	}
+	return transport.PriorityNormal, fmt.Errorf("unknown priority %q, it must be %s, %s or %s", name, PriorityHigh, PriorityNormal, PriorityLow)
+}
+
+// SetPriorities replaces the priority rules, they apply to the next publishes pushed
+func (b *Bridge) SetPriorities(rules []PriorityRule) {
+	b.priorities.Store(rules)
+}
+
+// Priorities returns the current priority rules
+func (b *Bridge) Priorities() []PriorityRule {
+	return b.priorities.Load().([]PriorityRule)
+}
+
+// priority returns the priority of a publish. A valid PriorityProperty user property wins, otherwise
+// the first rule matching the topic decides, the publishes matching no rule have the normal priority.
+func (b *Bridge) priority(topic string, props []packets.UserProperty) transport.Priority {
+	for _, prop := range props {
+		if prop.Key != b.option.PriorityProperty {
+			continue
+		}
+		if p, err := parsePriority(prop.Val); err == nil {
+			return p
+		}
+	}
+	for _, r := range b.Priorities() {
+		if topics.Match(r.Filter, topic) {
+			p, _ := parsePriority(r.Priority)
+			return p
+		}
+	}
+	return transport.PriorityNormal
+}
@@ -0,0 +1,376 @@
+package bridgemq
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/werbenhu/bridgemq/topics"
+)
+
+const (
+	// LimitIn limits the publishes received from the remote agents, LimitOut the publishes
+	// pushed to them and LimitBoth both of them
+	LimitIn   = "in"
+	LimitOut  = "out"
+	LimitBoth = "both"
+
+	// LimitDrop drops the publishes over the limit, LimitDelay delays them until the limit
+	// allows them and LimitShedQos0 drops the publishes of qos 0 and delays the others
+	LimitDrop     = "drop"
+	LimitDelay    = "delay"
+	LimitShedQos0 = "shed_qos0"
+)
+
+// RateLimit is a token bucket limit of the publishes crossing the pipe, a bucket holds one second of traffic
+type RateLimit struct {
+	// Direction is in, out or both, both by default
+	Direction string `json:"direction"`
+
+	// Agent is the remote agent limited, * gives every agent its own bucket,
+	// all the agents share a single bucket if it is empty
+	Agent string `json:"agent"`
+
+	// Filter is the topic filter of the publishes limited, every publish is limited if it is empty
+	Filter string `json:"filter"`
+
+	// Messages and Bytes are the rates in messages and in bytes of topic and payload per second, 0 is unlimited
+	Messages float64 `json:"messages"`
+	Bytes    float64 `json:"bytes"`
+
+	// Action is drop, delay or shed_qos0, drop by default
+	Action string `json:"action"`
+}
+
+// validate checks the direction, the action and the rates of the limit
+func (r *RateLimit) validate() error {
+	switch r.Direction {
+	case "", LimitIn, LimitOut, LimitBoth:
+	default:
+		return fmt.Errorf("unknown direction %q, it must be %s, %s or %s", r.Direction, LimitIn, LimitOut, LimitBoth)
+	}
+	switch r.Action {
+	case "", LimitDrop, LimitDelay, LimitShedQos0:
+	default:
+		return fmt.Errorf("unknown action %q, it must be %s, %s or %s", r.Action, LimitDrop, LimitDelay, LimitShedQos0)
+	}
+	if r.Messages < 0 || r.Bytes < 0 {
+		return fmt.Errorf("messages and bytes can not be negative")
+	}
+	if r.Messages == 0 && r.Bytes == 0 {
+		return fmt.Errorf("needs messages or bytes")
+	}
+	return nil
+}
+
+// RateLimitStats counts the publishes checked by a rate limit, a publish over several limits
+// is counted as delayed or dropped by each of them
+type RateLimitStats struct {
+	Limit   RateLimit
+	Passed  uint64
+	Delayed uint64
+	Dropped uint64
+}
+
+// tokenBucket is filled at rate tokens per second up to rate tokens
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// wait returns the time until n tokens are available, a request larger than the bucket
+// waits until the bucket is full and leaves it in debt once taken
+func (t *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	if t.rate <= 0 {
+		return 0
+	}
+	if t.last.IsZero() {
+		t.tokens = t.rate
+	} else if t.tokens += now.Sub(t.last).Seconds() * t.rate; t.tokens > t.rate {
+		t.tokens = t.rate
+	}
+	t.last = now
+	if n > t.rate {
+		n = t.rate
+	}
+	if t.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - t.tokens) / t.rate * float64(time.Second))
+}
+
+func (t *tokenBucket) take(n float64) {
+	if t.rate > 0 {
+		t.tokens -= n
+	}
+}
+
+type bucketKey struct {
+	limit int
+	agent string
+}
+
+type bucket struct {
+	messages tokenBucket
+	bytes    tokenBucket
+}
+
+type limitCounters struct {
+	passed  atomic.Uint64
+	delayed atomic.Uint64
+	dropped atomic.Uint64
+}
+
+// limiter applies the rate limits, a publish must be allowed by all the limits it matches.
+// A publish delayed longer than maxDelay is dropped.
+type limiter struct {
+	limits   []RateLimit
+	counters []limitCounters
+	maxDelay time.Duration
+
+	sync.Mutex
+	buckets map[bucketKey]*bucket
+}
+
+func newLimiter(limits []RateLimit, maxDelay time.Duration) *limiter {
+	return &limiter{
+		limits:   limits,
+		counters: make([]limitCounters, len(limits)),
+		maxDelay: maxDelay,
+		buckets:  make(map[bucketKey]*bucket),
+	}
+}
+
+// match returns the indexes of the limits of the publish
+func (l *limiter) match(direction string, agent string, topic string) []int {
+	var matched []int
+	for i, r := range l.limits {
+		if r.Direction != "" && r.Direction != LimitBoth && r.Direction != direction {
+			continue
+		}
+		if r.Agent != "" && r.Agent != AnyAgent && r.Agent != agent {
+			continue
+		}
+		if r.Filter != "" && !topics.Match(r.Filter, topic) {
+			continue
+		}
+		matched = append(matched, i)
+	}
+	return matched
+}
+
+// bucket returns the bucket of the limit for the agent, it must be called with the lock held
+func (l *limiter) bucket(i int, agent string) *bucket {
+	key := bucketKey{limit: i}
+	if l.limits[i].Agent == AnyAgent {
+		key.agent = agent
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{
+			messages: tokenBucket{rate: l.limits[i].Messages},
+			bytes:    tokenBucket{rate: l.limits[i].Bytes},
+		}
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// reserve takes a publish to or from the agent from the buckets of the limits it matches. It returns the
+// delay before the publish passes, the publish is dropped if it is false. A delayed publish takes its tokens
+// at once so that the next publishes are delayed behind it.
+func (l *limiter) reserve(direction string, agent string, topic string, size int, qos byte) (time.Duration, bool) {
+	matched := l.match(direction, agent, topic)
+	if len(matched) == 0 {
+		return 0, true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	var longest time.Duration
+	var over []int
+	for _, i := range matched {
+		b := l.bucket(i, agent)
+		wait := b.messages.wait(1, now)
+		if w := b.bytes.wait(float64(size), now); w > wait {
+			wait = w
+		}
+		if wait > 0 {
+			over = append(over, i)
+			if wait > longest {
+				longest = wait
+			}
+		}
+	}
+
+	drop := longest > l.maxDelay
+	for _, i := range over {
+		switch l.limits[i].Action {
+		case LimitDelay:
+		case LimitShedQos0:
+			drop = drop || qos == 0
+		default:
+			drop = true
+		}
+	}
+	if drop {
+		for _, i := range over {
+			l.counters[i].dropped.Add(1)
+		}
+		return 0, false
+	}
+
+	for _, i := range over {
+		l.counters[i].delayed.Add(1)
+	}
+	for _, i := range matched {
+		b := l.bucket(i, agent)
+		b.messages.take(1)
+		b.bytes.take(float64(size))
+		l.counters[i].passed.Add(1)
+	}
+	return longest, true
+}
+
+// forget removes the buckets of an agent which left
+func (l *limiter) forget(agent string) {
+	l.Lock()
+	defer l.Unlock()
+	for key := range l.buckets {
+		if key.agent == agent {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *limiter) stats() []RateLimitStats {
+	stats := make([]RateLimitStats, 0, len(l.limits))
+	for i, r := range l.limits {
+		stats = append(stats, RateLimitStats{
+			Limit:   r,
+			Passed:  l.counters[i].passed.Load(),
+			Delayed: l.counters[i].delayed.Load(),
+			Dropped: l.counters[i].dropped.Load(),
+		})
+	}
+	return stats
+}
+
+// SetRateLimits replaces the rate limits and the longest delay of a publish, the buckets and the counters start again
+func (b *Bridge) SetRateLimits(limits []RateLimit, maxDelay time.Duration) {
+	b.limiter.Store(newLimiter(limits, maxDelay))
+}
+
+// RateLimitStats returns the counters of the rate limits
+func (b *Bridge) RateLimitStats() []RateLimitStats {
+	return b.limiter.Load().stats()
+}
+
+// OnPushPublish applies the outbound rate limits to a publish pushed to a remote agent and counts it, a delayed
+// publish waits in the queue of the agent
+func (b *Bridge) OnPushPublish(id string, topic string, payload []byte, qos byte, retain bool) (time.Duration, bool) {
+	if isSysTopic(topic) {
+		return 0, true
+	}
+	delay, ok := b.limiter.Load().reserve(LimitOut, id, topic, len(topic)+len(payload), qos)
+	if ok {
+		b.countOut(id)
+	}
+	return delay, ok
+}
+
+// delayQueue holds the publishes received from an agent which are delayed by the inbound rate limits, they
+// are published in order by a goroutine of the queue so that the pipe of the agent is not blocked. The
+// next publishes of the agent wait behind them. The publishes waiting are dropped once done is closed.
+type delayQueue struct {
+	done <-chan struct{}
+
+	sync.Mutex
+	pending []delayedPublish
+	running bool
+}
+
+type delayedPublish struct {
+	at      time.Time
+	publish func()
+}
+
+// run runs publish at the time at, it runs it at once if it is due and no publish is waiting
+func (q *delayQueue) run(at time.Time, publish func()) {
+	q.Lock()
+	if q.stopped() {
+		q.Unlock()
+		return
+	}
+	if !q.running && !at.After(time.Now()) {
+		q.Unlock()
+		publish()
+		return
+	}
+	q.pending = append(q.pending, delayedPublish{at: at, publish: publish})
+	if !q.running {
+		q.running = true
+		go q.drain()
+	}
+	q.Unlock()
+}
+
+// drain runs the publishes waiting in order until the queue is empty or done is closed
+func (q *delayQueue) drain() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		q.Lock()
+		if len(q.pending) == 0 || q.stopped() {
+			q.pending = nil
+			q.running = false
+			q.Unlock()
+			return
+		}
+		next := q.pending[0]
+		q.pending[0] = delayedPublish{}
+		q.pending = q.pending[1:]
+		q.Unlock()
+
+		if wait := time.Until(next.at); wait > 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case <-q.done:
+				continue
+			}
+		}
+		next.publish()
+	}
+}
+
+func (q *delayQueue) stopped() bool {
+	select {
+	case <-q.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// delayInbound publishes a publish received from an agent once the delay of the inbound rate limits has elapsed
+func (b *Bridge) delayInbound(id string, delay time.Duration, publish func()) {
+	q, ok := b.delays.Load(id)
+	if !ok {
+		if delay <= 0 {
+			publish()
+			return
+		}
+		q, _ = b.delays.LoadOrStore(id, &delayQueue{done: b.done})
+	}
+	q.(*delayQueue).run(time.Now().Add(delay), publish)
+}
@@ -0,0 +1,169 @@
+package bridgemq
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimiterReserve(t *testing.T) {
+	// every publish is 10 bytes and the limits allow 2 of them at once
+	type publish struct {
+		direction string
+		agent     string
+		topic     string
+		qos       byte
+		// ok is whether the publish passes and delayed whether it waits
+		ok      bool
+		delayed bool
+	}
+	tests := []struct {
+		name      string
+		limits    []RateLimit
+		publishes []publish
+	}{
+		{"drop", []RateLimit{{Messages: 2}}, []publish{
+			{LimitOut, "a", "t", 0, true, false},
+			{LimitOut, "a", "t", 0, true, false},
+			{LimitOut, "a", "t", 1, false, false},
+		}},
+		{"delay", []RateLimit{{Messages: 2, Action: LimitDelay}}, []publish{
+			{LimitOut, "a", "t", 0, true, false},
+			{LimitOut, "a", "t", 0, true, false},
+			{LimitOut, "a", "t", 0, true, true},
+			{LimitOut, "a", "t", 0, true, true},
+			{LimitOut, "a", "t", 0, false, false},
+		}},
+		{"shed qos 0", []RateLimit{{Messages: 2, Action: LimitShedQos0}}, []publish{
+			{LimitIn, "a", "t", 0, true, false},
+			{LimitIn, "a", "t", 0, true, false},
+			{LimitIn, "a", "t", 0, false, false},
+			{LimitIn, "a", "t", 1, true, true},
+		}},
+		{"bytes", []RateLimit{{Bytes: 20}}, []publish{
+			{LimitOut, "a", "t", 0, true, false},
+			{LimitOut, "a", "t", 0, true, false},
+			{LimitOut, "a", "t", 0, false, false},
+		}},
+		{"direction", []RateLimit{{Direction: LimitIn, Messages: 1}}, []publish{
+			{LimitIn, "a", "t", 0, true, false},
+			{LimitOut, "a", "t", 0, true, false},
+			{LimitIn, "a", "t", 0, false, false},
+		}},
+		{"filter", []RateLimit{{Filter: "sensors/#", Messages: 1}}, []publish{
+			{LimitOut, "a", "sensors/1", 0, true, false},
+			{LimitOut, "a", "alarms/1", 0, true, false},
+			{LimitOut, "a", "sensors/2", 0, false, false},
+		}},
+		{"shared bucket", []RateLimit{{Messages: 1}}, []publish{
+			{LimitOut, "a", "t", 0, true, false},
+			{LimitOut, "b", "t", 0, false, false},
+		}},
+		{"bucket per agent", []RateLimit{{Agent: AnyAgent, Messages: 1}}, []publish{
+			{LimitOut, "a", "t", 0, true, false},
+			{LimitOut, "b", "t", 0, true, false},
+			{LimitOut, "a", "t", 0, false, false},
+		}},
+		{"single agent", []RateLimit{{Agent: "a", Messages: 1}}, []publish{
+			{LimitOut, "a", "t", 0, true, false},
+			{LimitOut, "b", "t", 0, true, false},
+			{LimitOut, "b", "t", 0, true, false},
+			{LimitOut, "a", "t", 0, false, false},
+		}},
+		{"every limit", []RateLimit{{Messages: 10}, {Filter: "t", Messages: 1}}, []publish{
+			{LimitOut, "a", "t", 0, true, false},
+			{LimitOut, "a", "t", 0, false, false},
+			{LimitOut, "a", "u", 0, true, false},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the max delay lets two publishes wait for a rate of 2 per second
+			l := newLimiter(tt.limits, 1100*time.Millisecond)
+			var last time.Duration
+			for i, p := range tt.publishes {
+				delay, ok := l.reserve(p.direction, p.agent, p.topic, 10, p.qos)
+				if ok != p.ok || (delay > 0) != p.delayed {
+					t.Fatalf("publish %d expected ok:%v delayed:%v, got ok:%v delay:%s", i, p.ok, p.delayed, ok, delay)
+				}
+				if p.delayed {
+					if delay <= last {
+						t.Fatalf("publish %d delayed %s, not after the previous %s", i, delay, last)
+					}
+					last = delay
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterStats(t *testing.T) {
+	l := newLimiter([]RateLimit{{Messages: 1, Action: LimitShedQos0}}, time.Second)
+	l.reserve(LimitOut, "a", "t", 1, 1)
+	l.reserve(LimitOut, "a", "t", 1, 1)
+	l.reserve(LimitOut, "a", "t", 1, 0)
+
+	stats := l.stats()
+	if len(stats) != 1 || stats[0].Passed != 2 || stats[0].Delayed != 1 || stats[0].Dropped != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestDelayQueue(t *testing.T) {
+	var q delayQueue
+	var lock sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	run := func(i int, delay time.Duration) {
+		wg.Add(1)
+		q.run(time.Now().Add(delay), func() {
+			lock.Lock()
+			order = append(order, i)
+			lock.Unlock()
+			wg.Done()
+		})
+	}
+
+	// a publish due runs at once, the publishes behind a delayed one wait even if they are due
+	run(0, 0)
+	if len(order) != 1 {
+		t.Fatal("expected the publish due run at once")
+	}
+	start := time.Now()
+	run(1, 50*time.Millisecond)
+	run(2, 0)
+	run(3, 20*time.Millisecond)
+	wg.Wait()
+
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("expected the publishes delayed")
+	}
+	for i, v := range order {
+		if v != i {
+			t.Fatalf("expected the publishes in order, got %v", order)
+		}
+	}
+}
+
+func TestDelayQueueStopped(t *testing.T) {
+	done := make(chan struct{})
+	q := &delayQueue{done: done}
+	var published atomic.Int32
+	q.run(time.Now().Add(50*time.Millisecond), func() { published.Add(1) })
+	q.run(time.Now(), func() { published.Add(1) })
+
+	// the publishes waiting are dropped when the bridge stops, and the next ones are not run
+	close(done)
+	q.run(time.Now(), func() { published.Add(1) })
+	time.Sleep(100 * time.Millisecond)
+	if n := published.Load(); n != 0 {
+		t.Fatalf("expected no publish after the stop, got %d", n)
+	}
+	q.Lock()
+	defer q.Unlock()
+	if q.running || len(q.pending) != 0 {
+		t.Fatalf("expected the queue drained, running:%v pending:%d", q.running, len(q.pending))
+	}
+}
@@ -0,0 +1,353 @@
+package replay
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/werbenhu/bridgemq/topics"
+)
+
+const (
+	HookId = "replay"
+
+	// Prefix starts the replay subscriptions $replay/<since>/<filter>
+	Prefix = "$replay/"
+
+	// liveQueueSize is the number of live messages buffered for a replay subscription while
+	// it sends the stored messages, the live messages are dropped beyond
+	liveQueueSize = 1024
+)
+
+// Hook records the publishes of the broker in a log and serves the replay subscriptions. A replay
+// subscription $replay/<since>/<filter> receives the stored messages matching the filter published
+// since <since>, then the live messages matching the filter, all of them with qos 0. It ends when
+// the client unsubscribes or disconnects.
+type Hook struct {
+	mqtt.HookBase
+	log *Log
+	acl func(cl *mqtt.Client, topic string, write bool) bool
+
+	// the publishes hold the read lock while they are appended and dispatched, a replay subscription
+	// takes the write lock to start at the end of the log so that it misses no message and receives
+	// none twice
+	subsLock sync.RWMutex
+	subs     map[string]map[string]*replayer
+}
+
+func (h *Hook) ID() string {
+	return HookId
+}
+
+// ReplayLog returns the log of the hook, it is nil before the hook is initialized
+func (h *Hook) ReplayLog() *Log {
+	return h.log
+}
+
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSubscribe,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+		mqtt.OnDisconnect,
+		mqtt.OnPublished,
+		mqtt.OnWillSent,
+	}, []byte{b})
+}
+
+// Init opens the log, the config must be an *Opt
+func (h *Hook) Init(config any) error {
+	opts, ok := config.(*Opt)
+	if !ok || opts == nil {
+		return mqtt.ErrInvalidConfigType
+	}
+	if opts.Logger == nil {
+		opts.Logger = h.Log
+	}
+
+	log, err := Open(opts)
+	if err != nil {
+		return err
+	}
+	h.log = log
+	h.acl = opts.ACL
+	h.subs = make(map[string]map[string]*replayer)
+	return nil
+}
+
+// Stop ends the replay subscriptions and closes the log
+func (h *Hook) Stop() error {
+	h.subsLock.Lock()
+	for id, subs := range h.subs {
+		for _, r := range subs {
+			r.stop()
+		}
+		delete(h.subs, id)
+	}
+	h.subsLock.Unlock()
+	return h.log.Close()
+}
+
+// OnSubscribe makes the broker reject the replay subscriptions whose since or filter is invalid, or
+// whose filter the client may not read
+func (h *Hook) OnSubscribe(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	var filters packets.Subscriptions
+	for i, sub := range pk.Filters {
+		if !strings.HasPrefix(sub.Filter, Prefix) {
+			continue
+		}
+		_, filter, err := ParseSubscription(sub.Filter, time.Now())
+		if err == nil && !h.allowed(cl, filter) {
+			err = fmt.Errorf("filter %q not authorized", filter)
+		}
+		if err != nil {
+			h.Log.Warn().Err(err).Str("client", cl.ID).Str("filter", sub.Filter).Msg("replay subscription rejected")
+			if filters == nil {
+				filters = append(packets.Subscriptions(nil), pk.Filters...)
+			}
+			// an empty filter is rejected with the topic filter invalid reason code
+			filters[i].Filter = ""
+		}
+	}
+	if filters != nil {
+		pk.Filters = filters
+	}
+	return pk
+}
+
+// OnSubscribed starts the replay subscriptions granted
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	for i, sub := range pk.Filters {
+		if !strings.HasPrefix(sub.Filter, Prefix) || i >= len(reasonCodes) || reasonCodes[i] >= packets.ErrUnspecifiedError.Code {
+			continue
+		}
+		since, filter, err := ParseSubscription(sub.Filter, time.Now())
+		if err != nil {
+			continue
+		}
+		h.start(&replayer{
+			cl:     cl,
+			filter: filter,
+			since:  since,
+			live:   make(chan *Record, liveQueueSize),
+			done:   make(chan struct{}),
+		}, sub.Filter)
+	}
+}
+
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	h.subsLock.Lock()
+	defer h.subsLock.Unlock()
+	subs := h.subs[cl.ID]
+	for _, sub := range pk.Filters {
+		if r, ok := subs[sub.Filter]; ok {
+			r.stop()
+			delete(subs, sub.Filter)
+		}
+	}
+	if len(subs) == 0 {
+		delete(h.subs, cl.ID)
+	}
+}
+
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.subsLock.Lock()
+	defer h.subsLock.Unlock()
+	subs := h.subs[cl.ID]
+	for filter, r := range subs {
+		// a client taking over the session may have started its own replays already
+		if r.cl == cl {
+			r.stop()
+			delete(subs, filter)
+		}
+	}
+	if len(subs) == 0 {
+		delete(h.subs, cl.ID)
+	}
+}
+
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	h.record(cl, pk)
+}
+
+func (h *Hook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	h.record(cl, pk)
+}
+
+// record appends a publish to the log and sends it to the replay subscriptions matching it
+func (h *Hook) record(cl *mqtt.Client, pk packets.Packet) {
+	rec := &Record{
+		Time:     time.Now(),
+		Topic:    pk.TopicName,
+		Payload:  pk.Payload,
+		Qos:      pk.FixedHeader.Qos,
+		Retain:   pk.FixedHeader.Retain,
+		ClientId: cl.ID,
+	}
+
+	h.subsLock.RLock()
+	defer h.subsLock.RUnlock()
+	if !h.log.Append(rec) {
+		return
+	}
+	for _, subs := range h.subs {
+		for _, r := range subs {
+			if topics.Match(r.filter, rec.Topic) {
+				h.push(r, rec)
+			}
+		}
+	}
+}
+
+// allowed reports whether the client of a replay subscription may read a topic
+func (h *Hook) allowed(cl *mqtt.Client, topic string) bool {
+	return h.acl == nil || h.acl(cl, topic, false)
+}
+
+func (h *Hook) push(r *replayer, rec *Record) {
+	select {
+	case r.live <- rec:
+	default:
+		if r.dropping.CompareAndSwap(false, true) {
+			h.Log.Warn().Str("client", r.cl.ID).Str("filter", r.filter).Msg("replay subscription too slow, live messages dropped")
+		}
+	}
+}
+
+// start registers a replay subscription at the end of the log and sends its messages in the background,
+// it replaces the replay subscription of the client with the same filter
+func (h *Hook) start(r *replayer, filter string) {
+	h.subsLock.Lock()
+	subs, ok := h.subs[r.cl.ID]
+	if !ok {
+		subs = make(map[string]*replayer)
+		h.subs[r.cl.ID] = subs
+	}
+	if old, ok := subs[filter]; ok {
+		old.stop()
+	}
+	subs[filter] = r
+	r.end = h.log.Next()
+	h.subsLock.Unlock()
+
+	go h.run(r)
+}
+
+// run sends the stored messages of a replay subscription, then its live messages until it ends. The
+// messages the client may not read are skipped.
+func (h *Hook) run(r *replayer) {
+	var err error
+	sent := 0
+	rerr := h.log.Read(&Query{Filter: r.filter, Since: r.since, End: r.end}, func(rec *Record) bool {
+		if r.stopped() {
+			return false
+		}
+		if !h.allowed(r.cl, rec.Topic) {
+			return true
+		}
+		if err = r.send(rec); err != nil {
+			return false
+		}
+		sent++
+		return true
+	})
+	if rerr != nil {
+		h.Log.Error().Err(rerr).Str("client", r.cl.ID).Str("filter", r.filter).Msg("replay read log failed")
+	}
+	if err != nil {
+		return
+	}
+	h.Log.Debug().Str("client", r.cl.ID).Str("filter", r.filter).Time("since", r.since).Int("messages", sent).Msg("replay stored messages sent")
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case rec := <-r.live:
+			if !h.allowed(r.cl, rec.Topic) {
+				continue
+			}
+			if err := r.send(rec); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// replayer is a replay subscription of a client, it sends the records before end from the
+// log and then the live records
+type replayer struct {
+	cl     *mqtt.Client
+	filter string
+	since  time.Time
+	end    uint64
+
+	live     chan *Record
+	dropping atomic.Bool
+
+	done chan struct{}
+	once sync.Once
+}
+
+func (r *replayer) send(rec *Record) error {
+	return r.cl.WritePacket(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: rec.Topic,
+		Payload:   rec.Payload,
+		Created:   rec.Time.Unix(),
+	})
+}
+
+func (r *replayer) stop() {
+	r.once.Do(func() {
+		close(r.done)
+	})
+}
+
+func (r *replayer) stopped() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// ParseSubscription returns the time and the filter of a replay subscription $replay/<since>/<filter>
+func ParseSubscription(sub string, now time.Time) (time.Time, string, error) {
+	since, filter, ok := strings.Cut(strings.TrimPrefix(sub, Prefix), "/")
+	if !ok || filter == "" {
+		return time.Time{}, "", fmt.Errorf("replay subscription %q must be %s<since>/<filter>", sub, Prefix)
+	}
+	t, err := ParseSince(since, now)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	if !mqtt.IsValidFilter(filter, false) || strings.HasPrefix(filter, topics.SharePrefix+"/") {
+		return time.Time{}, "", fmt.Errorf("invalid topic filter %q", filter)
+	}
+	return t, filter, nil
+}
+
+// ParseSince parses the start of a replay, a duration before now such as 1h, a unix time in seconds
+// or an rfc3339 time
+func ParseSince(since string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(since); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	if sec, err := strconv.ParseInt(since, 10, 64); err == nil && sec >= 0 {
+		return time.Unix(sec, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, since); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid since %q, it must be a duration such as 1h, a unix time or an rfc3339 time", since)
+}
@@ -0,0 +1,180 @@
+package replay
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/rs/zerolog"
+)
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		since string
+		want  time.Time
+		err   bool
+	}{
+		{"1h", now.Add(-time.Hour), false},
+		{"90s", now.Add(-90 * time.Second), false},
+		{"0", now, false},
+		{"1700000000", time.Unix(1700000000, 0), false},
+		{"2024-04-30T10:00:00Z", time.Date(2024, 4, 30, 10, 0, 0, 0, time.UTC), false},
+		{"2024-04-30T10:00:00+02:00", time.Date(2024, 4, 30, 8, 0, 0, 0, time.UTC), false},
+		{"-1h", time.Time{}, true},
+		{"-5", time.Time{}, true},
+		{"2024-04-30", time.Time{}, true},
+		{"yesterday", time.Time{}, true},
+		{"", time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.since, func(t *testing.T) {
+			got, err := ParseSince(tt.since, now)
+			if (err != nil) != tt.err {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if !got.Equal(tt.want) {
+				t.Fatalf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseSubscription(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		sub    string
+		since  time.Time
+		filter string
+		err    bool
+	}{
+		{"$replay/1h/alarms/#", now.Add(-time.Hour), "alarms/#", false},
+		{"$replay/1700000000/a/+/c", time.Unix(1700000000, 0), "a/+/c", false},
+		{"$replay/2024-04-30T10:00:00Z/#", time.Date(2024, 4, 30, 10, 0, 0, 0, time.UTC), "#", false},
+		{"$replay/1h", time.Time{}, "", true},
+		{"$replay/1h/", time.Time{}, "", true},
+		{"$replay/soon/a", time.Time{}, "", true},
+		{"$replay/1h/a/#/b", time.Time{}, "", true},
+		{"$replay/1h/$share/group/a", time.Time{}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sub, func(t *testing.T) {
+			since, filter, err := ParseSubscription(tt.sub, now)
+			if (err != nil) != tt.err {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if !since.Equal(tt.since) || filter != tt.filter {
+				t.Fatalf("expected %s %q, got %s %q", tt.since, tt.filter, since, filter)
+			}
+		})
+	}
+}
+
+// newClient returns a client of the server and the topics of the publishes written to it
+func newClient(t *testing.T, server *mqtt.Server, id string) (*mqtt.Client, chan string) {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	cl := server.NewClient(a, "test", id, false)
+	reader := server.NewClient(b, "test", id+"-reader", false)
+	received := make(chan string, 100)
+	go func() {
+		for {
+			var fh packets.FixedHeader
+			if err := reader.ReadFixedHeader(&fh); err != nil {
+				return
+			}
+			pk, err := reader.ReadPacket(&fh)
+			if err != nil {
+				return
+			}
+			received <- pk.TopicName
+		}
+	}()
+	return cl, received
+}
+
+// expect checks the topics received in order and that no other publish follows
+func expect(t *testing.T, received chan string, topics ...string) {
+	t.Helper()
+	for _, want := range topics {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("expected %s, got %s", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %s, got nothing", want)
+		}
+	}
+	select {
+	case got := <-received:
+		t.Fatalf("expected nothing more, got %s", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func publish(h *Hook, cl *mqtt.Client, topic string) {
+	h.OnPublished(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish},
+		TopicName:   topic,
+		Payload:     []byte(topic),
+	})
+}
+
+func TestSubscription(t *testing.T) {
+	logger := zerolog.Nop()
+	server := mqtt.New(&mqtt.Options{Logger: &logger})
+	h := new(Hook)
+	err := server.AddHook(h, &Opt{
+		Filters: []string{"a/#", "secret/#"},
+		Dir:     t.TempDir(),
+		// the clients may not read secret/#
+		ACL: func(cl *mqtt.Client, topic string, write bool) bool {
+			return !strings.HasPrefix(topic, "secret")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+
+	publisher, _ := newClient(t, server, "publisher")
+	cl, received := newClient(t, server, "subscriber")
+	for _, topic := range []string{"a/1", "secret/1", "b/1"} {
+		publish(h, publisher, topic)
+	}
+
+	// the filters the client may not read and the invalid ones are rejected
+	pk := h.OnSubscribe(cl, packets.Packet{Filters: packets.Subscriptions{
+		{Filter: "$replay/1h/#"},
+		{Filter: "$replay/1h/secret/#"},
+		{Filter: "$replay/never/#"},
+		{Filter: "plain/#"},
+	}})
+	for i, want := range []string{"$replay/1h/#", "", "", "plain/#"} {
+		if pk.Filters[i].Filter != want {
+			t.Fatalf("filter %d expected %q, got %q", i, want, pk.Filters[i].Filter)
+		}
+	}
+
+	// the stored messages then the live ones, the messages not recorded and those the client may not read are skipped
+	sub := packets.Packet{Filters: packets.Subscriptions{{Filter: "$replay/1h/#"}}}
+	h.OnSubscribed(cl, sub, []byte{0})
+	for _, topic := range []string{"secret/2", "b/2", "a/2"} {
+		publish(h, publisher, topic)
+	}
+	expect(t, received, "a/1", "a/2")
+
+	// the subscription ends when the client unsubscribes
+	h.OnUnsubscribed(cl, sub)
+	publish(h, publisher, "a/3")
+	expect(t, received)
+}
@@ -0,0 +1,441 @@
+package replay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/rs/zerolog"
+	"github.com/werbenhu/bridgemq/topics"
+)
+
+const (
+	defaultSegmentSize = 16 * 1024 * 1024
+
+	// retentionInterval is how often the segments older than MaxAge are removed
+	retentionInterval = 10 * time.Second
+)
+
+// ErrClosed is returned by the reads of a closed log
+var ErrClosed = errors.New("replay log is closed")
+
+// Record is a publish recorded in the log, Seq increases with every record
+type Record struct {
+	Seq      uint64
+	Time     time.Time
+	Topic    string
+	Payload  []byte
+	Qos      byte
+	Retain   bool
+	ClientId string
+}
+
+// Query selects the records read from the log
+type Query struct {
+	// Filter is the topic filter of the records, every record matches an empty filter
+	Filter string
+
+	// Since and Until bound the time of the records, they are not bounded if they are zero
+	Since time.Time
+	Until time.Time
+
+	// Limit is the maximum number of records read, 0 reads them all
+	Limit int
+
+	// End is the sequence the read stops at, the records appended after the read started are not read if it is 0
+	End uint64
+}
+
+type Opt struct {
+	// Filters are the topic filters of the publishes recorded
+	Filters []string
+
+	// Dir holds the segment files, a new segment is started once the last one holds SegmentSize bytes
+	Dir         string
+	SegmentSize int
+
+	// MaxAge and MaxBytes bound the log, the oldest segments are removed once all their records are older
+	// than MaxAge or the log is larger than MaxBytes. The log is not bounded by a zero MaxAge or MaxBytes.
+	MaxAge   time.Duration
+	MaxBytes int
+
+	// ACL checks the reads of the replay subscriptions as the acl of the server, the filter of a subscription
+	// and the topic of every message replayed, every read is allowed if it is nil
+	ACL func(cl *mqtt.Client, topic string, write bool) bool
+
+	Logger *zerolog.Logger
+}
+
+// Validate checks the filters and the bounds
+func (o *Opt) Validate() error {
+	if o.Dir == "" {
+		return fmt.Errorf("dir is required")
+	}
+	for _, f := range o.Filters {
+		if !mqtt.IsValidFilter(f, false) {
+			return fmt.Errorf("invalid topic filter %q", f)
+		}
+	}
+	if o.SegmentSize < 0 || o.MaxAge < 0 || o.MaxBytes < 0 {
+		return fmt.Errorf("segment size, max age and max bytes can not be negative")
+	}
+	return nil
+}
+
+// Log is an append-only log of the publishes matching its filters, it is split in segment files so
+// that the oldest records are removed a segment at a time
+type Log struct {
+	opts   *Opt
+	logger *zerolog.Logger
+
+	sync.Mutex
+	filters  []string
+	maxAge   time.Duration
+	maxBytes int64
+
+	// segments are sorted by base, the last one is written to file
+	segments []*segment
+	file     *os.File
+	size     int64
+	next     uint64
+	buf      []byte
+	closed   bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Open opens the log in Dir, the records of the segment files already there are kept
+func Open(opts *Opt) (*Log, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.SegmentSize == 0 {
+		opts.SegmentSize = defaultSegmentSize
+	}
+	l := &Log{
+		opts:     opts,
+		logger:   opts.Logger,
+		filters:  opts.Filters,
+		maxAge:   opts.MaxAge,
+		maxBytes: int64(opts.MaxBytes),
+		next:     1,
+		done:     make(chan struct{}),
+	}
+	if l.logger == nil {
+		logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
+		l.logger = &logger
+	}
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+
+	l.Lock()
+	err := l.openLast()
+	if err == nil {
+		l.removeOld()
+	}
+	l.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	l.wg.Add(1)
+	go l.retain()
+	return l, nil
+}
+
+// load reads the segment files, the last one is scanned to find the sequence of the next record
+func (l *Log) load() error {
+	entries, err := os.ReadDir(l.opts.Dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		l.segments = append(l.segments, &segment{path: segmentPath(l.opts.Dir, base), base: base})
+	}
+	sort.Slice(l.segments, func(i, j int) bool {
+		return l.segments[i].base < l.segments[j].base
+	})
+
+	for i, s := range l.segments {
+		if i < len(l.segments)-1 {
+			info, err := os.Stat(s.path)
+			if err != nil {
+				return err
+			}
+			s.size = info.Size()
+			if s.first, err = firstTime(s.path); err != nil && err != io.EOF {
+				l.logger.Warn().Err(err).Str("segment", s.path).Msg("replay read segment failed")
+			}
+			continue
+		}
+		next, cut, err := scan(s)
+		if err != nil {
+			return fmt.Errorf("replay scan segment %s: %w", s.path, err)
+		}
+		if cut > 0 {
+			l.logger.Warn().Str("segment", s.path).Int64("bytes", cut).Msg("replay segment truncated after its last valid record")
+		}
+		l.next = next
+	}
+
+	// the last record of a segment is older than the first record of the next one
+	for i := 0; i < len(l.segments)-1; i++ {
+		l.segments[i].last = l.segments[i+1].first
+		l.size += l.segments[i].size
+	}
+	if n := len(l.segments); n > 0 {
+		l.size += l.segments[n-1].size
+	}
+	return nil
+}
+
+// openLast opens the last segment for writing, a segment is created if there is none
+func (l *Log) openLast() error {
+	if len(l.segments) == 0 {
+		l.segments = append(l.segments, &segment{path: segmentPath(l.opts.Dir, l.next), base: l.next})
+	}
+	f, err := openSegment(l.segments[len(l.segments)-1].path)
+	if err != nil {
+		return err
+	}
+	l.file = f
+	return nil
+}
+
+// roll starts a new segment and closes the last one, the last one is still written if it fails
+func (l *Log) roll() error {
+	s := &segment{path: segmentPath(l.opts.Dir, l.next), base: l.next}
+	f, err := openSegment(s.path)
+	if err != nil {
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		l.logger.Warn().Err(err).Msg("replay close segment failed")
+	}
+	l.segments = append(l.segments, s)
+	l.file = f
+	return nil
+}
+
+func openSegment(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+}
+
+// Append records the publish if its topic matches a filter of the log, it sets the sequence of
+// the record and its time if it is zero. It is false if the record is not recorded.
+func (l *Log) Append(r *Record) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.closed || !topics.MatchAny(l.filters, r.Topic) {
+		return false
+	}
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	r.Seq = l.next
+	l.buf = encode(l.buf[:0], r)
+
+	last := l.segments[len(l.segments)-1]
+	if last.size > 0 && last.size+int64(len(l.buf)) > int64(l.opts.SegmentSize) {
+		if err := l.roll(); err != nil {
+			l.logger.Error().Err(err).Msg("replay start segment failed")
+			return false
+		}
+		l.removeOld()
+		last = l.segments[len(l.segments)-1]
+	}
+
+	if n, err := l.file.Write(l.buf); err != nil {
+		// a record partly written is cut off so that the next records follow the last valid one
+		if n > 0 {
+			l.file.Truncate(last.size)
+		}
+		l.logger.Error().Err(err).Str("topic", r.Topic).Msg("replay append record failed")
+		return false
+	}
+	if last.size == 0 {
+		last.first = r.Time
+	}
+	last.last = r.Time
+	last.size += int64(len(l.buf))
+	l.size += int64(len(l.buf))
+	l.next++
+	return true
+}
+
+// Read calls fn with the records matching the query in the order they were appended, until fn returns false
+func (l *Log) Read(q *Query, fn func(*Record) bool) error {
+	l.Lock()
+	if l.closed {
+		l.Unlock()
+		return ErrClosed
+	}
+	end := q.End
+	if end == 0 || end > l.next {
+		end = l.next
+	}
+	segments := make([]segment, 0, len(l.segments))
+	for _, s := range l.segments {
+		segments = append(segments, *s)
+	}
+	l.Unlock()
+
+	read := 0
+	for _, s := range segments {
+		if s.base >= end || (!q.Until.IsZero() && s.first.After(q.Until)) {
+			break
+		}
+		if s.size == 0 || (!q.Since.IsZero() && s.last.Before(q.Since)) {
+			continue
+		}
+		done, err := l.readSegment(&s, q, end, func(r *Record) bool {
+			read++
+			return fn(r) && (q.Limit <= 0 || read < q.Limit)
+		})
+		if err != nil || done {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSegment reads the records of a segment matching the query, done is true if fn returned
+// false or the end was reached. The segments removed meanwhile are skipped.
+func (l *Log) readSegment(s *segment, q *Query, end uint64, fn func(*Record) bool) (bool, error) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	r := newReader(f, s.size)
+	for {
+		rec, _, err := r.next()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("replay read segment %s: %w", s.path, err)
+		}
+		if rec.Seq >= end {
+			return true, nil
+		}
+		if rec.Time.Before(q.Since) || (!q.Until.IsZero() && rec.Time.After(q.Until)) {
+			continue
+		}
+		if q.Filter != "" && !topics.Match(q.Filter, rec.Topic) {
+			continue
+		}
+		if !fn(rec) {
+			return true, nil
+		}
+	}
+}
+
+// Next returns the sequence of the next record, a read with End set to it does not read the records appended after
+func (l *Log) Next() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	return l.next
+}
+
+// SetFilters replaces the topic filters, they apply to the next publishes
+func (l *Log) SetFilters(filters []string) {
+	l.Lock()
+	defer l.Unlock()
+	l.filters = filters
+}
+
+// SetRetention replaces the bounds of the log, the segments out of them are removed at once
+func (l *Log) SetRetention(maxAge time.Duration, maxBytes int) {
+	l.Lock()
+	defer l.Unlock()
+	l.maxAge, l.maxBytes = maxAge, int64(maxBytes)
+	if !l.closed {
+		l.removeOld()
+	}
+}
+
+// retain removes the segments older than MaxAge every retentionInterval
+func (l *Log) retain() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			l.Lock()
+			if !l.closed {
+				l.removeOld()
+			}
+			l.Unlock()
+		}
+	}
+}
+
+// removeOld removes the oldest segments out of the bounds, the last segment is started again
+// once all its records are older than MaxAge
+func (l *Log) removeOld() {
+	now := time.Now()
+	last := l.segments[len(l.segments)-1]
+	if l.maxAge > 0 && last.size > 0 && now.Sub(last.last) > l.maxAge {
+		if err := l.roll(); err != nil {
+			l.logger.Error().Err(err).Msg("replay start segment failed")
+		}
+	}
+
+	for len(l.segments) > 1 {
+		s := l.segments[0]
+		if !(l.maxBytes > 0 && l.size > l.maxBytes) && !(l.maxAge > 0 && now.Sub(s.last) > l.maxAge) {
+			return
+		}
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			l.logger.Error().Err(err).Str("segment", s.path).Msg("replay remove segment failed")
+			return
+		}
+		l.logger.Debug().Str("segment", s.path).Int64("bytes", s.size).Msg("replay segment removed")
+		l.size -= s.size
+		l.segments = l.segments[1:]
+	}
+}
+
+// Close stops the retention and closes the last segment
+func (l *Log) Close() error {
+	l.Lock()
+	if l.closed {
+		l.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	err := l.file.Close()
+	l.Unlock()
+
+	l.wg.Wait()
+	return err
+}
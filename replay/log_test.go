@@ -0,0 +1,118 @@
+package replay
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// appendRecords appends n records of about 100 bytes published age ago
+func appendRecords(t *testing.T, l *Log, n int, age time.Duration) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if !l.Append(&Record{Time: time.Now().Add(-age), Topic: "a/1", Payload: bytes.Repeat([]byte("x"), 80)}) {
+			t.Fatalf("record %d not appended", i)
+		}
+	}
+}
+
+// readSeqs returns the sequences of the records of the log
+func readSeqs(t *testing.T, l *Log) []uint64 {
+	t.Helper()
+	var seqs []uint64
+	if err := l.Read(&Query{}, func(r *Record) bool {
+		seqs = append(seqs, r.Seq)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return seqs
+}
+
+func TestLogRetention(t *testing.T) {
+	// the records of about 100 bytes fill segments of 500 bytes
+	tests := []struct {
+		name     string
+		maxAge   time.Duration
+		maxBytes int
+		// age is the age of the records, reload sets the retention after they are appended
+		age    time.Duration
+		reload bool
+		// removed is whether the oldest records are removed and all whether every record is
+		removed bool
+		all     bool
+	}{
+		{"unbounded", 0, 0, 0, false, false, false},
+		{"max bytes", 0, 1000, 0, false, true, false},
+		{"max bytes reloaded", 0, 1000, 0, true, true, false},
+		{"max age", time.Hour, 0, 0, false, false, false},
+		{"max age expired", time.Hour, 0, 2 * time.Hour, true, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := zerolog.Nop()
+			opts := &Opt{Filters: []string{"#"}, Dir: t.TempDir(), SegmentSize: 500, Logger: &logger}
+			if !tt.reload {
+				opts.MaxAge, opts.MaxBytes = tt.maxAge, tt.maxBytes
+			}
+			l, err := Open(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			appendRecords(t, l, 50, tt.age)
+			if tt.reload {
+				l.SetRetention(tt.maxAge, tt.maxBytes)
+			}
+
+			seqs := readSeqs(t, l)
+			switch {
+			case tt.all:
+				if len(seqs) != 0 {
+					t.Fatalf("expected every record removed, got %v", seqs)
+				}
+			case !tt.removed:
+				if len(seqs) != 50 {
+					t.Fatalf("expected the 50 records kept, got %d", len(seqs))
+				}
+			default:
+				// the records are removed a segment at a time, the last ones are kept
+				if len(seqs) == 0 || seqs[0] == 1 || seqs[len(seqs)-1] != 50 || len(seqs)*100 > tt.maxBytes {
+					t.Fatalf("expected the last records up to %d bytes kept, got %v", tt.maxBytes, seqs)
+				}
+			}
+
+			// the sequences go on after the records removed
+			appendRecords(t, l, 1, 0)
+			if seqs := readSeqs(t, l); seqs[len(seqs)-1] != 51 {
+				t.Fatalf("expected the next record 51, got %v", seqs)
+			}
+		})
+	}
+}
+
+func TestLogReopen(t *testing.T) {
+	logger := zerolog.Nop()
+	opts := &Opt{Filters: []string{"a/#"}, Dir: t.TempDir(), SegmentSize: 500, Logger: &logger}
+	l, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, l, 20, 0)
+	if l.Append(&Record{Topic: "b/1"}) {
+		t.Fatal("expected a record not matching the filters not appended")
+	}
+	l.Close()
+
+	l, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if seqs := readSeqs(t, l); len(seqs) != 20 || l.Next() != 21 {
+		t.Fatalf("expected the 20 records kept, got %v and next %d", seqs, l.Next())
+	}
+}
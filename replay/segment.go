@@ -0,0 +1,216 @@
+package replay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// segmentExt is the extension of the segment files, they are named by the sequence of their first record
+	segmentExt = ".log"
+
+	// headerSize is the size of the header of a record, the length and the crc32 of its body
+	headerSize = 8
+
+	// bodyMinSize is the size of the body of a record with an empty topic, client id and payload
+	bodyMinSize = 8 + 8 + 1 + 1 + 1
+)
+
+var errCorrupt = errors.New("corrupt record")
+
+// segment is a file of the log holding the records from base, only the last segment is written
+type segment struct {
+	path string
+	base uint64
+	size int64
+
+	// first and last are the times of the first and of the last record, last is an upper bound for
+	// the segments read when the log is opened, it is the time of the first record of the next segment
+	first time.Time
+	last  time.Time
+}
+
+func segmentName(base uint64) string {
+	return fmt.Sprintf("%020d%s", base, segmentExt)
+}
+
+// encode appends a record to buf, the body of a record is its sequence, its time, its flags and its
+// topic, client id and payload, it is preceded by its length and its crc32
+func encode(buf []byte, r *Record) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, headerSize)...)
+	buf = binary.BigEndian.AppendUint64(buf, r.Seq)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(r.Time.UnixNano()))
+	flags := r.Qos & 0x03
+	if r.Retain {
+		flags |= 0x04
+	}
+	buf = append(buf, flags)
+	buf = binary.AppendUvarint(buf, uint64(len(r.Topic)))
+	buf = append(buf, r.Topic...)
+	buf = binary.AppendUvarint(buf, uint64(len(r.ClientId)))
+	buf = append(buf, r.ClientId...)
+	buf = append(buf, r.Payload...)
+
+	body := buf[start+headerSize:]
+	binary.BigEndian.PutUint32(buf[start:], uint32(len(body)))
+	binary.BigEndian.PutUint32(buf[start+4:], crc32.ChecksumIEEE(body))
+	return buf
+}
+
+// decode decodes the body of a record
+func decode(body []byte) (*Record, error) {
+	if len(body) < bodyMinSize {
+		return nil, errCorrupt
+	}
+	r := &Record{
+		Seq:  binary.BigEndian.Uint64(body),
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(body[8:]))),
+	}
+	flags := body[16]
+	r.Qos, r.Retain = flags&0x03, flags&0x04 != 0
+
+	rest := body[17:]
+	str := func() (string, bool) {
+		n, size := binary.Uvarint(rest)
+		if size <= 0 || uint64(len(rest)-size) < n {
+			return "", false
+		}
+		s := string(rest[size : size+int(n)])
+		rest = rest[size+int(n):]
+		return s, true
+	}
+	var ok bool
+	if r.Topic, ok = str(); !ok {
+		return nil, errCorrupt
+	}
+	if r.ClientId, ok = str(); !ok {
+		return nil, errCorrupt
+	}
+	r.Payload = append([]byte(nil), rest...)
+	return r, nil
+}
+
+// reader reads the records of a segment up to a size
+type reader struct {
+	r      *bufio.Reader
+	remain int64
+	body   []byte
+}
+
+func newReader(f io.Reader, size int64) *reader {
+	return &reader{r: bufio.NewReaderSize(f, 64*1024), remain: size}
+}
+
+// next returns the next record, it is io.EOF at the end of the segment and errCorrupt
+// if a record is truncated or does not match its crc32
+func (r *reader) next() (*Record, int64, error) {
+	if r.remain == 0 {
+		return nil, 0, io.EOF
+	}
+	var header [headerSize]byte
+	if r.remain < headerSize {
+		return nil, 0, errCorrupt
+	}
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		return nil, 0, truncated(err)
+	}
+	n := int64(binary.BigEndian.Uint32(header[:]))
+	if n < bodyMinSize || n > r.remain-headerSize {
+		return nil, 0, errCorrupt
+	}
+	if int64(cap(r.body)) < n {
+		r.body = make([]byte, n)
+	}
+	body := r.body[:n]
+	if _, err := io.ReadFull(r.r, body); err != nil {
+		return nil, 0, truncated(err)
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, errCorrupt
+	}
+	rec, err := decode(body)
+	if err != nil {
+		return nil, 0, err
+	}
+	r.remain -= headerSize + n
+	return rec, headerSize + n, nil
+}
+
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errCorrupt
+	}
+	return err
+}
+
+// scan reads the records of a segment file to recover its size and the times of its first and of its
+// last record, the records after a truncated or corrupt record are cut off, such as a record partly
+// written when the process stopped. It returns the sequence of the record following the last one
+// and the number of bytes cut off.
+func scan(s *segment) (uint64, int64, error) {
+	f, err := os.OpenFile(s.path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	next, valid := s.base, int64(0)
+	r := newReader(f, info.Size())
+	for {
+		rec, n, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		if err == errCorrupt || (err == nil && rec.Seq != next) {
+			if err := f.Truncate(valid); err != nil {
+				return 0, 0, err
+			}
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if valid == 0 {
+			s.first = rec.Time
+		}
+		s.last = rec.Time
+		valid += n
+		next = rec.Seq + 1
+	}
+	s.size = valid
+	return next, info.Size() - valid, nil
+}
+
+// firstTime reads the time of the first record of a segment file
+func firstTime(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+	rec, _, err := newReader(f, info.Size()).next()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return rec.Time, nil
+}
+
+func segmentPath(dir string, base uint64) string {
+	return filepath.Join(dir, segmentName(base))
+}
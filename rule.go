@@ -0,0 +1,25 @@
+package bridgemq
+
+import "github.com/werbenhu/bridgemq/topics"
+
+const (
+	RuleForward = "forward"
+	RuleDrop    = "drop"
+)
+
+// Rule decides whether the messages matching the topic filter are forwarded to the other agents
+type Rule struct {
+	Filter string `json:"filter"`
+	Action string `json:"action"`
+}
+
+// forwardable reports whether a message of the topic is forwarded to the other agents,
+// the first rule matching the topic wins, the topics matching no rule are forwarded.
+func forwardable(rules []Rule, topic string) bool {
+	for _, r := range rules {
+		if topics.Match(r.Filter, topic) {
+			return r.Action != RuleDrop
+		}
+	}
+	return true
+}
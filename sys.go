@@ -0,0 +1,313 @@
+package bridgemq
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/werbenhu/bridgemq/agent"
+	"github.com/werbenhu/bridgemq/discovery"
+	"github.com/werbenhu/bridgemq/transport"
+)
+
+// The cluster $SYS topics published by every agent to its local clients, the stats are retained
+const (
+	// SysPrefix starts the cluster $SYS topics
+	SysPrefix = "$SYS/cluster/"
+
+	// SysMembers is the list of the agents with their status
+	SysMembers = SysPrefix + "members"
+
+	// SysNodes is followed by the name of an agent, it holds the NodeStats of the agent. The agents push
+	// their own stats to the other agents through the pipe so that every agent publishes them all.
+	SysNodes = SysPrefix + "nodes/"
+
+	// SysClientsCount is the number of clients connected to the cluster
+	SysClientsCount = SysPrefix + "clients/count"
+
+	// SysBridgedIn and SysBridgedOut are the publishes received from and pushed to the remote agents by
+	// all the agents since they started
+	SysBridgedIn  = SysPrefix + "messages/bridged_in"
+	SysBridgedOut = SysPrefix + "messages/bridged_out"
+
+	// SysClients is followed by <client id>/connected or <client id>/disconnected, the presence events of
+	// the clients of the cluster. The connected event is retained until the client disconnects.
+	SysClients = SysPrefix + "clients/"
+)
+
+// NodeStats are the stats of an agent published in $SYS/cluster/nodes/<name>
+type NodeStats struct {
+	Name     string `json:"name"`
+	Zone     string `json:"zone,omitempty"`
+	Time     int64  `json:"time"`
+	Draining bool   `json:"draining"`
+
+	// Clients is the number of clients connected to the agent
+	Clients int `json:"clients"`
+
+	// BridgedIn and BridgedOut are the publishes received from and pushed to the remote agents
+	BridgedIn  uint64 `json:"bridged_in"`
+	BridgedOut uint64 `json:"bridged_out"`
+
+	Pipes []PipeStats `json:"pipes"`
+}
+
+// PipeStats are the stats of the pipe connection of an agent to a remote agent
+type PipeStats struct {
+	Peer  string              `json:"peer"`
+	State transport.PeerState `json:"state"`
+
+	// RTT is the estimated round trip time in milliseconds, 0 if it is unknown
+	RTT float64 `json:"rtt_ms,omitempty"`
+
+	// Sent and Received are the publishes pushed to and received from the remote agent
+	Sent     uint64 `json:"sent"`
+	Received uint64 `json:"received"`
+}
+
+// MemberInfo is an agent of the list published in $SYS/cluster/members
+type MemberInfo struct {
+	Name   string `json:"name"`
+	Addr   string `json:"addr"`
+	Status string `json:"status"`
+	Zone   string `json:"zone,omitempty"`
+}
+
+// Presence is the payload of the presence events of a client
+type Presence struct {
+	ClientId string `json:"client_id"`
+	Agent    string `json:"agent"`
+	Time     int64  `json:"time"`
+}
+
+// pipeCounters count the publishes pushed to and received from a remote agent
+type pipeCounters struct {
+	sent     atomic.Uint64
+	received atomic.Uint64
+}
+
+// sysStats holds the counters of the local agent and the last stats pushed by the remote agents
+type sysStats struct {
+	in    atomic.Uint64
+	out   atomic.Uint64
+	pipes sync.Map
+
+	sync.Mutex
+	nodes map[string]*NodeStats
+}
+
+func (s *sysStats) pipe(id string) *pipeCounters {
+	if c, ok := s.pipes.Load(id); ok {
+		return c.(*pipeCounters)
+	}
+	c, _ := s.pipes.LoadOrStore(id, &pipeCounters{})
+	return c.(*pipeCounters)
+}
+
+// isSysTopic reports whether the topic is a cluster $SYS topic, they are neither limited nor counted as bridged
+func isSysTopic(topic string) bool {
+	return strings.HasPrefix(topic, SysPrefix)
+}
+
+// sysLevel reports whether a name can be a level of a topic
+func sysLevel(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "/+#")
+}
+
+// countOut counts a publish pushed to a remote agent
+func (b *Bridge) countOut(id string) {
+	b.sys.out.Add(1)
+	b.sys.pipe(id).sent.Add(1)
+}
+
+// countIn counts a publish received from a remote agent
+func (b *Bridge) countIn(id string) {
+	b.sys.in.Add(1)
+	b.sys.pipe(id).received.Add(1)
+}
+
+// sysEnabled reports whether the cluster $SYS topics are published
+func (b *Bridge) sysEnabled() bool {
+	return b.option.SysInterval > 0 && b.option.Broker != nil
+}
+
+// NodeStats returns the stats of the local agent
+func (b *Bridge) NodeStats() NodeStats {
+	s := NodeStats{
+		Name:       b.option.Name,
+		Zone:       b.option.Zone,
+		Time:       time.Now().Unix(),
+		Draining:   b.Draining(),
+		BridgedIn:  b.sys.in.Load(),
+		BridgedOut: b.sys.out.Load(),
+		Pipes:      make([]PipeStats, 0),
+	}
+	if b.option.Broker != nil {
+		for _, cl := range b.option.Broker.Clients.GetAll() {
+			if !cl.Net.Inline && !cl.Closed() {
+				s.Clients++
+			}
+		}
+	}
+	for id, state := range b.PeerStates() {
+		p := PipeStats{Peer: id, State: state}
+		if rtt, ok := b.RTT(id); ok {
+			p.RTT = float64(rtt) / float64(time.Millisecond)
+		}
+		c := b.sys.pipe(id)
+		p.Sent, p.Received = c.sent.Load(), c.received.Load()
+		s.Pipes = append(s.Pipes, p)
+	}
+	sort.Slice(s.Pipes, func(i, j int) bool {
+		return s.Pipes[i].Peer < s.Pipes[j].Peer
+	})
+	return s
+}
+
+// ClusterStats returns the stats of the local agent and the last stats pushed by the alive remote agents
+func (b *Bridge) ClusterStats() []NodeStats {
+	stats := []NodeStats{b.NodeStats()}
+	alive := make(map[string]bool)
+	for _, a := range b.discovery.Agents() {
+		if a.Status == agent.StatusAlive {
+			alive[a.Id] = true
+		}
+	}
+	b.sys.Lock()
+	for name, s := range b.sys.nodes {
+		if alive[name] && name != b.option.Name {
+			stats = append(stats, *s)
+		}
+	}
+	b.sys.Unlock()
+	sort.Slice(stats[1:], func(i, j int) bool {
+		return stats[i+1].Name < stats[j+1].Name
+	})
+	return stats
+}
+
+// publishSysLoop publishes the cluster $SYS topics and pushes the stats of the local agent to the
+// remote agents every SysInterval until the bridge is stopped
+func (b *Bridge) publishSysLoop() {
+	ticker := time.NewTicker(b.option.SysInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			b.publishSysStats()
+		}
+	}
+}
+
+// publishSysStats publishes the cluster $SYS topics and pushes the stats of the local agent
+func (b *Bridge) publishSysStats() {
+	nodes := b.ClusterStats()
+	if payload, err := json.Marshal(nodes[0]); err == nil && b.transport != nil {
+		b.transport.PushPublish(b.discovery.LocalAgent(), SysNodes+nodes[0].Name, payload, 0, false)
+	}
+
+	var in, out uint64
+	for _, s := range nodes {
+		in += s.BridgedIn
+		out += s.BridgedOut
+		if !sysLevel(s.Name) {
+			continue
+		}
+		if payload, err := json.Marshal(s); err == nil {
+			b.publishSys(SysNodes+s.Name, payload, true)
+		}
+	}
+
+	members := make([]MemberInfo, 0)
+	if agents, err := b.Members(); err == nil {
+		for _, a := range agents {
+			members = append(members, MemberInfo{Name: a.Id, Addr: a.Addr, Status: a.Status, Zone: a.Tags[discovery.ZoneKey]})
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+	if payload, err := json.Marshal(members); err == nil {
+		b.publishSys(SysMembers, payload, true)
+	}
+
+	clients := nodes[0].Clients
+	b.clients.Range(func(key any, val any) bool {
+		clients++
+		return true
+	})
+	b.publishSys(SysClientsCount, []byte(strconv.Itoa(clients)), true)
+	b.publishSys(SysBridgedIn, []byte(strconv.FormatUint(in, 10)), true)
+	b.publishSys(SysBridgedOut, []byte(strconv.FormatUint(out, 10)), true)
+}
+
+// onNodeStats keeps the stats pushed by a remote agent, the stats of another agent are ignored
+func (b *Bridge) onNodeStats(id string, p *transport.Publish) {
+	if !b.sysEnabled() {
+		return
+	}
+	var s NodeStats
+	if err := json.Unmarshal(p.Payload, &s); err != nil || s.Name != id || p.Topic != SysNodes+id {
+		b.logger.Warn().Str("peer", id).Str("topic", p.Topic).Msg("invalid cluster stats received")
+		return
+	}
+	b.sys.Lock()
+	defer b.sys.Unlock()
+	if b.sys.nodes == nil {
+		b.sys.nodes = make(map[string]*NodeStats)
+	}
+	b.sys.nodes[id] = &s
+}
+
+// forgetNode removes the stats and the counters of an agent which left
+func (b *Bridge) forgetNode(id string) {
+	b.sys.pipes.Delete(id)
+	b.sys.Lock()
+	delete(b.sys.nodes, id)
+	b.sys.Unlock()
+	if b.sysEnabled() && sysLevel(id) {
+		b.publishSys(SysNodes+id, nil, true)
+	}
+}
+
+// publishPresence publishes the presence event of a client connected to or disconnected from an agent,
+// the retained connected event is cleared when the client disconnects
+func (b *Bridge) publishPresence(clientId string, agentId string, connected bool) {
+	if !b.sysEnabled() || !sysLevel(clientId) {
+		return
+	}
+	payload, err := json.Marshal(Presence{ClientId: clientId, Agent: agentId, Time: time.Now().Unix()})
+	if err != nil {
+		return
+	}
+	if connected {
+		b.publishSys(SysClients+clientId+"/connected", payload, true)
+		return
+	}
+	b.publishSys(SysClients+clientId+"/connected", nil, true)
+	b.publishSys(SysClients+clientId+"/disconnected", payload, false)
+}
+
+// publishSys publishes a message to the local clients, it is not pushed to the remote agents.
+// A retained message with an empty payload clears the retained message of the topic.
+func (b *Bridge) publishSys(topic string, payload []byte, retain bool) {
+	cl := b.option.Broker.NewClient(nil, "local", HookId, true)
+	err := b.option.Broker.InjectPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Retain: retain,
+		},
+		TopicName: topic,
+		Payload:   payload,
+	})
+	if err != nil {
+		b.logger.Debug().Err(err).Str("topic", topic).Msg("publish cluster $SYS topic failed")
+	}
+}
@@ -0,0 +1,51 @@
+package topics
+
+import "strings"
+
+const (
+	// SharePrefix is the prefix of mqtt v5 shared subscription filters.
+	SharePrefix = "$share"
+)
+
+// Match reports whether the topic name matches the topic filter,
+// the filter can contain the single-level (+) and multi-level (#) wildcards.
+// Shared subscription filters ($share/<group>/<filter>) are matched by their filter part.
+func Match(filter string, topic string) bool {
+	if strings.HasPrefix(filter, SharePrefix+"/") {
+		parts := strings.SplitN(filter, "/", 3)
+		if len(parts) < 3 {
+			return false
+		}
+		filter = parts[2]
+	}
+
+	// [MQTT-4.7.2-1] topics beginning with $ are not matched by filters starting with a wildcard
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return i == len(fs)-1
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+// MatchAny reports whether the topic name matches any of the topic filters.
+func MatchAny(filters []string, topic string) bool {
+	for _, f := range filters {
+		if Match(f, topic) {
+			return true
+		}
+	}
+	return false
+}
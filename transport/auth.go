@@ -0,0 +1,113 @@
+package transport
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// TokenKey is the metadata key of the shared token sent by the agents with their agent-id
+const TokenKey = "agent-token"
+
+// authenticator identifies the agents pushing to this agent. With mutual tls, an agent is identified by the
+// common name of its verified certificate, otherwise by its agent-id, and the token must match when it is set.
+// The agent must be a current member of the cluster. It is disabled if neither a token nor mutual tls is used.
+type authenticator struct {
+	token   string
+	mutual  bool
+	members func(id string) bool
+	logger  *zerolog.Logger
+}
+
+func newAuthenticator(token string, config *tls.Config, members func(id string) bool, logger *zerolog.Logger) *authenticator {
+	return &authenticator{
+		token:   token,
+		mutual:  config != nil && config.ClientAuth == tls.RequireAndVerifyClientCert,
+		members: members,
+		logger:  logger,
+	}
+}
+
+// enabled reports whether the agents are authenticated
+func (a *authenticator) enabled() bool {
+	return a.token != "" || a.mutual
+}
+
+// identify returns the id of the agent claiming to be id with the token, certs are its verified certificate chains
+func (a *authenticator) identify(id string, token string, certs [][]*x509.Certificate) (string, error) {
+	if a.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		return "", fmt.Errorf("invalid token of agent %q", id)
+	}
+	if a.mutual {
+		if len(certs) == 0 || len(certs[0]) == 0 {
+			return "", fmt.Errorf("agent %q has no verified certificate", id)
+		}
+		name := certs[0][0].Subject.CommonName
+		if id != "" && id != name {
+			return "", fmt.Errorf("agent %q does not match its certificate %q", id, name)
+		}
+		id = name
+	}
+	if id == "" {
+		return "", fmt.Errorf("missing %s", AgentIdKey)
+	}
+	if !a.members(id) {
+		return "", fmt.Errorf("agent %q is not a member of the cluster", id)
+	}
+	return id, nil
+}
+
+// unaryInterceptor authenticates the calls of the Transport service, the AgentId of a request must be the
+// id of the agent calling. The other services, such as the health service, are not authenticated.
+func (a *authenticator) unaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if !a.enabled() || !strings.HasPrefix(info.FullMethod, "/"+_Transport_serviceDesc.ServiceName+"/") {
+		return handler(ctx, req)
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	var certs [][]*x509.Certificate
+	if p, ok := peer.FromContext(ctx); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			certs = tlsInfo.State.VerifiedChains
+		}
+	}
+	id, err := a.identify(first(md, AgentIdKey), first(md, TokenKey), certs)
+	if err != nil {
+		a.logger.Warn().Err(err).Str("method", info.FullMethod).Msg("pipe call of an unauthenticated agent rejected")
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if r, ok := req.(interface{ GetAgentId() string }); ok && r.GetAgentId() != id {
+		a.logger.Warn().Str("peer", id).Str("agent_id", r.GetAgentId()).Str("method", info.FullMethod).Msg("pipe call pushing as another agent rejected")
+		return nil, status.Errorf(codes.PermissionDenied, "agent %q can not push as agent %q", id, r.GetAgentId())
+	}
+	return handler(ctx, req)
+}
+
+// clientInterceptor sends the id of the local agent and the token with every call
+func clientInterceptor(id string, token string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx = metadata.AppendToOutgoingContext(ctx, AgentIdKey, id)
+		if token != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, TokenKey, token)
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+func first(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
@@ -0,0 +1,96 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/werbenhu/bridgemq/agent"
+)
+
+func TestAuthenticatorIdentify(t *testing.T) {
+	members := func(id string) bool { return id == "a" || id == "b" }
+	cert := func(name string) [][]*x509.Certificate {
+		return [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: name}}}}
+	}
+	mutual := &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert}
+
+	tests := []struct {
+		name   string
+		token  string
+		config *tls.Config
+		id     string
+		sent   string
+		certs  [][]*x509.Certificate
+		want   string
+		err    string
+	}{
+		{"token", "secret", nil, "a", "secret", nil, "a", ""},
+		{"invalid token", "secret", nil, "a", "wrong", nil, "", "invalid token"},
+		{"missing id", "secret", nil, "", "secret", nil, "", "missing"},
+		{"not a member", "secret", nil, "c", "secret", nil, "", "not a member"},
+		{"certificate", "", mutual, "", "", cert("b"), "b", ""},
+		{"certificate matching the id", "", mutual, "b", "", cert("b"), "b", ""},
+		{"certificate of another agent", "", mutual, "a", "", cert("b"), "", "does not match"},
+		{"no certificate", "", mutual, "a", "", nil, "", "no verified certificate"},
+		{"certificate of a non member", "", mutual, "", "", cert("c"), "", "not a member"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAuthenticator(tt.token, tt.config, members, nopLogger())
+			if !a.enabled() {
+				t.Fatal("expected the authenticator enabled")
+			}
+			id, err := a.identify(tt.id, tt.sent, tt.certs)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected an error with %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil || id != tt.want {
+				t.Fatalf("expected %q, got %q err:%v", tt.want, id, err)
+			}
+		})
+	}
+}
+
+func TestTcpTransportMemberLeft(t *testing.T) {
+	var members sync.Map
+	members.Store("a", true)
+	isMember := func(id string) bool {
+		_, ok := members.Load(id)
+		return ok
+	}
+
+	portA, portB := freePort(t), freePort(t)
+	a := NewTcpTransport(&TcpOpt{Port: portA, Name: "a", Token: "secret", Backoff: 10 * time.Millisecond, Logger: nopLogger()})
+	b := NewTcpTransport(&TcpOpt{Port: portB, Name: "b", Token: "secret", Members: isMember, Logger: nopLogger()})
+	startPair(t, a, nil, b, portA, portB)
+
+	state := func() PeerState { return a.PeerStates()["b"] }
+	deadline := time.Now().Add(time.Second)
+	for state() != StateReady && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if state() != StateReady {
+		t.Fatalf("expected the connection of a ready, got %s", state())
+	}
+
+	// b sees a leave, the connection of a is closed and a is not accepted again
+	members.Delete("a")
+	b.Leave(agent.New("a", "127.0.0.1", 0, portA))
+	deadline = time.Now().Add(time.Second)
+	for state() == StateReady && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if state() == StateReady {
+		t.Fatal("expected the connection of a closed")
+	}
+}
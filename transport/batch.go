@@ -0,0 +1,162 @@
+package transport
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultBatchSize   = 128
+	defaultBatchBytes  = 256 * 1024
+	defaultBatchLinger = 2 * time.Millisecond
+
+	// batchQueueSize is the number of publishes queued for a remote agent, the publisher
+	// waits while the queue is full
+	batchQueueSize = 4096
+)
+
+// outgoing is a publish queued for the remote agents, chunks is set if its payload is sent in chunks
+// and at is set if it is delayed until then
+type outgoing struct {
+	publish *Publish
+	chunks  []*Chunk
+	at      time.Time
+}
+
+// batcher combines the publishes to a remote agent into batches, it outlives the
+// connections to the agent so that the order is kept when a connection is replaced
+type batcher struct {
+	id    string
+	lanes *lanes[*outgoing]
+	done  chan struct{}
+}
+
+func newBatcher(id string, weights []int) *batcher {
+	return &batcher{
+		id:    id,
+		lanes: newLanes[*outgoing](batchQueueSize, weights, func(out *outgoing) time.Time { return out.at }),
+		done:  make(chan struct{}),
+	}
+}
+
+// enqueue queues a publish in the lane of its priority, it is false if the batcher is stopped
+func (b *batcher) enqueue(p Priority, out *outgoing) bool {
+	return b.lanes.enqueue(p, out)
+}
+
+// stop closes the lanes, the publishes queued are still sent
+func (b *batcher) stop() {
+	b.lanes.stop()
+}
+
+// batch sends the publishes queued for an agent in batches of at most BatchSize publishes and
+// BatchBytes bytes, a batch is sent BatchLinger after its first publish if it is not full before.
+// A batch holds the publishes of a single priority, the high priority publishes are sent without
+// lingering. A chunked publish is sent on its own once the publishes queued before it are sent. A
+// delayed publish is held by the lanes until its time, the other priorities are sent meanwhile.
+func (g *RpcTransport) batch(b *batcher) {
+	defer close(b.done)
+	pending := make([]*Publish, 0, g.opts.BatchSize)
+	priority := PriorityNormal
+	size := 0
+
+	linger := time.NewTimer(g.opts.BatchLinger)
+	linger.Stop()
+	defer linger.Stop()
+
+	flush := func() {
+		linger.Stop()
+		if len(pending) == 0 {
+			return
+		}
+		g.sendBatch(b.id, pending)
+		g.pushing.Add(-int64(len(pending)))
+		pending = make([]*Publish, 0, g.opts.BatchSize)
+		size = 0
+	}
+
+	for {
+		out, p, state := b.lanes.next(linger.C, nil)
+		switch state {
+		case laneStopped:
+			flush()
+			return
+		case laneTimeout:
+			flush()
+			continue
+		}
+
+		if p != priority {
+			flush()
+			priority = p
+		}
+		if out.chunks != nil {
+			flush()
+			if val, ok := g.clients.Load(b.id); ok {
+				g.sendChunks(b.id, val.(*RpcClient), out.publish, out.chunks)
+			}
+			g.pushing.Add(-1)
+			continue
+		}
+
+		n := len(out.publish.Topic) + len(out.publish.Payload)
+		if len(pending) > 0 && size+n > g.opts.BatchBytes {
+			flush()
+		}
+		if len(pending) == 0 {
+			linger.Reset(g.opts.BatchLinger)
+		}
+		pending = append(pending, out.publish)
+		size += n
+		if len(pending) >= g.opts.BatchSize || size >= g.opts.BatchBytes || (p == PriorityHigh && b.lanes.queued(p) == 0) {
+			flush()
+		}
+	}
+}
+
+// sendBatch sends a batch to an agent, the publishes are sent one by one if BatchSize is 1
+// or to the agents which do not support the batches
+func (g *RpcTransport) sendBatch(id string, publishes []*Publish) {
+	val, ok := g.clients.Load(id)
+	if !ok {
+		g.logger.Warn().Str("peer", id).Int("publishes", len(publishes)).Msg("bridge push publish batch dropped, agent has left")
+		return
+	}
+	client := val.(*RpcClient)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if g.opts.BatchSize > 1 && !client.noBatch.Load() {
+		in := &PublishBatch{
+			AgentId:   publishes[0].AgentId,
+			Publishes: publishes,
+		}
+		err := g.invoke(id, client, func(c *RpcClient) error {
+			_, err := c.PushPublishBatch(ctx, in)
+			if status.Code(err) == codes.Unimplemented {
+				c.noBatch.Store(true)
+			}
+			return err
+		})
+		if status.Code(err) != codes.Unimplemented {
+			if err != nil {
+				g.logger.Error().Err(err).Str("peer", id).Int("publishes", len(publishes)).Msg("bridge push publish batch failed")
+			}
+			return
+		}
+		g.logger.Info().Str("peer", id).Msg("agent does not support publish batches, sending publishes one by one")
+	}
+
+	for _, p := range publishes {
+		if err := g.invoke(id, client, func(c *RpcClient) error {
+			_, err := c.PushPublish(ctx, p)
+			return err
+		}); err != nil {
+			g.logger.Error().Err(err).Str("peer", id).Str("topic", p.Topic).Msg("bridge push publish failed")
+		}
+	}
+}
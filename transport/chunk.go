@@ -0,0 +1,224 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// defaultMaxMsgSize is the default maximum size of a message received or sent on the pipe, it is the grpc default
+	defaultMaxMsgSize = 4 * 1024 * 1024
+
+	// defaultChunkSize is the default size above which a payload is split into chunks
+	defaultChunkSize = 1024 * 1024
+
+	// defaultChunkTimeout is the default time a transfer waits for its next chunk before it is dropped
+	defaultChunkTimeout = 30 * time.Second
+
+	// defaultMaxPayloadSize is the default maximum size of a payload sent in chunks
+	defaultMaxPayloadSize = 64 * 1024 * 1024
+
+	// maxAgentTransfers is the maximum number of transfers of an agent reassembled at once, an agent
+	// sends its chunked publishes one after the other so it has a single transfer unless it restarted
+	maxAgentTransfers = 4
+)
+
+// chunkDefaults sets the default message size, payload size, chunk size and chunk timeout of a transport
+func chunkDefaults(maxMsgSize *int, maxPayloadSize *int, chunkSize *int, chunkTimeout *time.Duration) {
+	if *maxMsgSize <= 0 {
+		*maxMsgSize = defaultMaxMsgSize
+	}
+	if *maxPayloadSize <= 0 {
+		*maxPayloadSize = defaultMaxPayloadSize
+	}
+	if *chunkSize <= 0 {
+		*chunkSize = defaultChunkSize
+		if *chunkSize > *maxMsgSize/2 {
+			*chunkSize = *maxMsgSize / 2
+		}
+	}
+	if *chunkTimeout <= 0 {
+		*chunkTimeout = defaultChunkTimeout
+	}
+}
+
+// split splits the payload of a publish into chunks of at most size bytes, every chunk carries
+// the size and the sha256 of the whole payload, the first one carries the user properties
+func split(id uint64, p *Publish, size int) []*Chunk {
+	payload := p.Payload
+	sum := sha256.Sum256(payload)
+	total := (len(payload) + size - 1) / size
+	chunks := make([]*Chunk, 0, total)
+	for i := 0; i < total; i++ {
+		end := (i + 1) * size
+		if end > len(payload) {
+			end = len(payload)
+		}
+		chunks = append(chunks, &Chunk{
+			AgentId: p.AgentId,
+			Id:      id,
+			Index:   uint32(i),
+			Total:   uint32(total),
+			Topic:   p.Topic,
+			Qos:     p.Qos,
+			Retain:  p.Retain,
+			Size:    uint64(len(payload)),
+			Sum:     sum[:],
+			Data:    payload[i*size : end],
+		})
+	}
+	chunks[0].Properties = p.Properties
+	return chunks
+}
+
+type transferKey struct {
+	agentId string
+	id      uint64
+}
+
+// transfer is a payload being reassembled, next is the index of the chunk expected
+type transfer struct {
+	next       uint32
+	size       uint64
+	data       []byte
+	properties []*Property
+	timer      *time.Timer
+}
+
+// assembler reassembles the payloads of the chunks received, the chunks of a transfer must arrive in
+// order and a transfer which does not receive its next chunk within the timeout is dropped. A payload
+// is limited to maxSize bytes and an agent to maxAgentTransfers transfers at once, the buffer of a
+// transfer grows with the chunks received.
+type assembler struct {
+	timeout time.Duration
+	maxSize uint64
+	logger  *zerolog.Logger
+
+	sync.Mutex
+	transfers map[transferKey]*transfer
+
+	// agents are the numbers of transfers by agent id
+	agents map[string]int
+}
+
+func newAssembler(timeout time.Duration, maxSize int, logger *zerolog.Logger) *assembler {
+	return &assembler{
+		timeout:   timeout,
+		maxSize:   uint64(maxSize),
+		logger:    logger,
+		transfers: make(map[transferKey]*transfer),
+		agents:    make(map[string]int),
+	}
+}
+
+// add adds a chunk to its transfer, it returns the publish once its last chunk is added and
+// its payload is verified. The transfer is dropped if the chunk does not follow the previous one
+// or the payload does not match its size or its sha256.
+func (a *assembler) add(c *Chunk) (*Publish, error) {
+	if c.Total == 0 || c.Index >= c.Total {
+		return nil, fmt.Errorf("chunk index:%d out of total:%d", c.Index, c.Total)
+	}
+	key := transferKey{agentId: c.AgentId, id: c.Id}
+
+	a.Lock()
+	defer a.Unlock()
+	t, ok := a.transfers[key]
+	if c.Index == 0 {
+		if ok {
+			a.drop(key, t)
+			a.logger.Warn().Str("peer", c.AgentId).Uint64("transfer", c.Id).Msg("chunked transfer restarted, the incomplete one is dropped")
+		}
+		if c.Size > a.maxSize {
+			return nil, fmt.Errorf("chunked payload size:%d larger than the max payload size:%d", c.Size, a.maxSize)
+		}
+		if a.agents[c.AgentId] >= maxAgentTransfers {
+			return nil, fmt.Errorf("agent has %d chunked transfers in progress", a.agents[c.AgentId])
+		}
+		t = &transfer{size: c.Size, properties: c.Properties}
+		t.timer = time.AfterFunc(a.timeout, func() {
+			a.expire(key, t)
+		})
+		a.transfers[key] = t
+		a.agents[c.AgentId]++
+	} else if !ok {
+		return nil, fmt.Errorf("chunk index:%d of an unknown transfer:%d", c.Index, c.Id)
+	}
+
+	if c.Index != t.next {
+		a.drop(key, t)
+		return nil, fmt.Errorf("chunk index:%d received, expected:%d", c.Index, t.next)
+	}
+	if c.Size != t.size {
+		a.drop(key, t)
+		return nil, fmt.Errorf("chunk size:%d of a payload of size:%d", c.Size, t.size)
+	}
+	if uint64(len(t.data)+len(c.Data)) > t.size {
+		a.drop(key, t)
+		return nil, fmt.Errorf("chunked payload larger than its size:%d", t.size)
+	}
+	t.data = append(t.data, c.Data...)
+	t.next++
+
+	if t.next < c.Total {
+		t.timer.Reset(a.timeout)
+		return nil, nil
+	}
+	a.drop(key, t)
+	if uint64(len(t.data)) != c.Size {
+		return nil, fmt.Errorf("chunked payload size:%d, expected:%d", len(t.data), c.Size)
+	}
+	if sum := sha256.Sum256(t.data); !bytes.Equal(sum[:], c.Sum) {
+		return nil, fmt.Errorf("chunked payload sha256 mismatch")
+	}
+	return &Publish{
+		AgentId:    c.AgentId,
+		Topic:      c.Topic,
+		Payload:    t.data,
+		Qos:        c.Qos,
+		Retain:     c.Retain,
+		Properties: t.properties,
+	}, nil
+}
+
+// drop removes a transfer, it must be called with the lock held
+func (a *assembler) drop(key transferKey, t *transfer) {
+	t.timer.Stop()
+	if a.transfers[key] == t {
+		a.remove(key)
+	}
+}
+
+// remove deletes a transfer and counts it out of its agent, it must be called with the lock held
+func (a *assembler) remove(key transferKey) {
+	delete(a.transfers, key)
+	if a.agents[key.agentId]--; a.agents[key.agentId] <= 0 {
+		delete(a.agents, key.agentId)
+	}
+}
+
+// expire drops a transfer which did not receive its next chunk in time
+func (a *assembler) expire(key transferKey, t *transfer) {
+	a.Lock()
+	defer a.Unlock()
+	if a.transfers[key] != t {
+		return
+	}
+	a.remove(key)
+	a.logger.Warn().Str("peer", key.agentId).Uint64("transfer", key.id).Uint32("chunks", t.next).
+		Dur("timeout", a.timeout).Msg("chunked transfer timed out, it is dropped")
+}
+
+// close drops all the transfers
+func (a *assembler) close() {
+	a.Lock()
+	defer a.Unlock()
+	for key, t := range a.transfers {
+		t.timer.Stop()
+		a.remove(key)
+	}
+}
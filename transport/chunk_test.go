@@ -0,0 +1,126 @@
+package transport
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAssembler(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 100)
+	publish := func(id uint64, agentId string) []*Chunk {
+		return split(id, &Publish{AgentId: agentId, Topic: "big", Payload: payload, Qos: 1, Properties: []*Property{{Key: "k", Val: "v"}}}, 300)
+	}
+
+	// the chunks are added in order, the last one returns the publish or an error containing err
+	tests := []struct {
+		name    string
+		maxSize int
+		chunks  func() []*Chunk
+		err     string
+	}{
+		{"in order", 1024, func() []*Chunk { return publish(1, "a") }, ""},
+		{"restarted", 1024, func() []*Chunk {
+			c := publish(1, "a")
+			return append(c[:2:2], c...)
+		}, ""},
+		{"out of order", 1024, func() []*Chunk {
+			c := publish(1, "a")
+			return []*Chunk{c[0], c[2]}
+		}, "expected:1"},
+		{"unknown transfer", 1024, func() []*Chunk { return publish(1, "a")[1:2] }, "unknown transfer"},
+		{"index out of total", 1024, func() []*Chunk {
+			c := publish(1, "a")[0]
+			c.Index = c.Total
+			return []*Chunk{c}
+		}, "out of total"},
+		{"larger than the max payload size", 999, func() []*Chunk { return publish(1, "a")[:1] }, "max payload size"},
+		{"too many transfers", 1024, func() []*Chunk {
+			chunks := make([]*Chunk, 0)
+			for i := 0; i <= maxAgentTransfers; i++ {
+				chunks = append(chunks, publish(uint64(i), "a")[0])
+			}
+			return chunks
+		}, "in progress"},
+		{"size changed", 1024, func() []*Chunk {
+			c := publish(1, "a")
+			c[1].Size = 2000
+			return c[:2]
+		}, "payload of size"},
+		{"larger than its size", 1024, func() []*Chunk {
+			c := publish(1, "a")
+			c[3].Data = append(c[3].Data, 'x')
+			return c
+		}, "larger than its size"},
+		{"smaller than its size", 1024, func() []*Chunk {
+			c := publish(1, "a")
+			c[3].Data = c[3].Data[:10]
+			return c
+		}, "expected:1000"},
+		{"sha256 mismatch", 1024, func() []*Chunk {
+			c := publish(1, "a")
+			c[3].Data = bytes.Repeat([]byte("x"), len(c[3].Data))
+			return c
+		}, "sha256"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAssembler(time.Minute, tt.maxSize, nopLogger())
+			defer a.close()
+			chunks := tt.chunks()
+			var p *Publish
+			var err error
+			for i, c := range chunks {
+				p, err = a.add(c)
+				if i < len(chunks)-1 && (err != nil || p != nil) {
+					t.Fatalf("chunk %d returned publish:%v err:%v", i, p, err)
+				}
+			}
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected an error with %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p == nil || !bytes.Equal(p.Payload, payload) || p.Topic != "big" || p.Qos != 1 || len(p.Properties) != 1 {
+				t.Fatalf("unexpected publish %v", p)
+			}
+			if len(a.transfers) != 0 || len(a.agents) != 0 {
+				t.Fatalf("expected no transfer left, got %d transfers of %d agents", len(a.transfers), len(a.agents))
+			}
+		})
+	}
+}
+
+func TestAssemblerTransfersByAgent(t *testing.T) {
+	a := newAssembler(50*time.Millisecond, 1024, nopLogger())
+	defer a.close()
+	payload := bytes.Repeat([]byte("x"), 600)
+	first := func(id uint64, agentId string) *Chunk {
+		return split(id, &Publish{AgentId: agentId, Topic: "big", Payload: payload}, 300)[0]
+	}
+
+	for i := 0; i < maxAgentTransfers; i++ {
+		if _, err := a.add(first(uint64(i), "a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.add(first(100, "a")); err == nil {
+		t.Fatal("expected the transfers of agent a limited")
+	}
+	if _, err := a.add(first(100, "b")); err != nil {
+		t.Fatalf("the transfers of agent b are not limited by agent a, got %v", err)
+	}
+
+	// the expired transfers make room for new ones
+	time.Sleep(100 * time.Millisecond)
+	if _, err := a.add(first(100, "a")); err != nil {
+		t.Fatalf("expected a transfer after the others expired, got %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The frames of the tcp transport are a 4 bytes big endian length followed by the frame type
+// and the body, the strings and the bytes of a body are prefixed by their uvarint length.
+//
+//	hello:      agent id, token, the first frame of a connection
+//	connect:    client id
+//	disconnect: client id
+//	publish:    flags (qos in bits 0-1, retain in bit 2, properties in bit 3), topic, payload, properties
+//	ack:        uvarint number of frames handled since the hello, the hello is acknowledged by an ack of 0
+//	chunk:      uvarint transfer id, index, total and payload size, sha256, flags, topic, data, properties
+//
+// The properties follow only when the bit 3 of the flags is set, they are a uvarint count followed by
+// the key and the value of every property.
+const (
+	FrameHello byte = iota + 1
+	FrameConnect
+	FrameDisconnect
+	FramePublish
+	FrameAck
+	FrameChunk
+)
+
+var errFrameTooLarge = errors.New("frame too large")
+
+// frame is a decoded frame, the fields used depend on the type
+type frame struct {
+	Type     byte
+	AgentId  string
+	Token    string
+	ClientId string
+	Topic    string
+	Payload  []byte
+	Qos      byte
+	Retain   bool
+	Ack      uint64
+	Chunk    *Chunk
+
+	Properties []*Property
+}
+
+// encode returns the frame with its length prefix
+func (f *frame) encode() []byte {
+	size := 5 + len(f.Topic) + len(f.Payload) + len(f.ClientId) + len(f.AgentId) + len(f.Token) + 16 + propertiesSize(f.Properties)
+	if f.Chunk != nil {
+		size += len(f.Chunk.Topic) + len(f.Chunk.Data) + len(f.Chunk.Sum) + 32 + propertiesSize(f.Chunk.Properties)
+	}
+	buf := make([]byte, 5, size)
+	buf[4] = f.Type
+	switch f.Type {
+	case FrameHello:
+		buf = appendString(buf, f.AgentId)
+		buf = appendString(buf, f.Token)
+	case FrameConnect, FrameDisconnect:
+		buf = appendString(buf, f.ClientId)
+	case FramePublish:
+		buf = append(buf, packFlags(f.Qos, f.Retain, f.Properties))
+		buf = appendString(buf, f.Topic)
+		buf = binary.AppendUvarint(buf, uint64(len(f.Payload)))
+		buf = append(buf, f.Payload...)
+		buf = appendProperties(buf, f.Properties)
+	case FrameAck:
+		buf = binary.AppendUvarint(buf, f.Ack)
+	case FrameChunk:
+		c := f.Chunk
+		buf = binary.AppendUvarint(buf, c.Id)
+		buf = binary.AppendUvarint(buf, uint64(c.Index))
+		buf = binary.AppendUvarint(buf, uint64(c.Total))
+		buf = binary.AppendUvarint(buf, c.Size)
+		buf = binary.AppendUvarint(buf, uint64(len(c.Sum)))
+		buf = append(buf, c.Sum...)
+		buf = append(buf, packFlags(byte(c.Qos), c.Retain, c.Properties))
+		buf = appendString(buf, c.Topic)
+		buf = binary.AppendUvarint(buf, uint64(len(c.Data)))
+		buf = append(buf, c.Data...)
+		buf = appendProperties(buf, c.Properties)
+	}
+	binary.BigEndian.PutUint32(buf, uint32(len(buf)-4))
+	return buf
+}
+
+// readFrame reads and decodes the next frame, a frame longer than max bytes is an error
+func readFrame(r *bufio.Reader, max int) (*frame, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(head[:])
+	if size == 0 {
+		return nil, fmt.Errorf("empty frame")
+	}
+	if size > uint32(max) {
+		return nil, errFrameTooLarge
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	f := &frame{Type: body[0]}
+	d := decoder{buf: body[1:]}
+	switch f.Type {
+	case FrameHello:
+		f.AgentId = d.string()
+		f.Token = d.string()
+	case FrameConnect, FrameDisconnect:
+		f.ClientId = d.string()
+	case FramePublish:
+		flags := d.byte()
+		f.Qos = flags & 0x03
+		f.Retain = flags&0x04 != 0
+		f.Topic = d.string()
+		f.Payload = d.bytes()
+		if flags&0x08 != 0 {
+			f.Properties = d.properties()
+		}
+	case FrameAck:
+		f.Ack = d.uvarint()
+	case FrameChunk:
+		c := &Chunk{
+			Id:    d.uvarint(),
+			Index: uint32(d.uvarint()),
+			Total: uint32(d.uvarint()),
+			Size:  d.uvarint(),
+			Sum:   d.bytes(),
+		}
+		flags := d.byte()
+		c.Qos = int32(flags & 0x03)
+		c.Retain = flags&0x04 != 0
+		c.Topic = d.string()
+		c.Data = d.bytes()
+		if flags&0x08 != 0 {
+			c.Properties = d.properties()
+		}
+		f.Chunk = c
+	default:
+		return nil, fmt.Errorf("unknown frame type:%d", f.Type)
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("decode frame type:%d err:%s", f.Type, d.err.Error())
+	}
+	return f, nil
+}
+
+// packFlags packs the qos in bits 0-1, the retain flag in bit 2 and whether properties follow in bit 3
+func packFlags(qos byte, retain bool, properties []*Property) byte {
+	b := qos & 0x03
+	if retain {
+		b |= 0x04
+	}
+	if len(properties) > 0 {
+		b |= 0x08
+	}
+	return b
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// propertiesSize estimates the encoded size of the properties
+func propertiesSize(properties []*Property) int {
+	size := 0
+	for _, p := range properties {
+		size += len(p.Key) + len(p.Val) + 4
+	}
+	return size
+}
+
+func appendProperties(buf []byte, properties []*Property) []byte {
+	if len(properties) == 0 {
+		return buf
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(properties)))
+	for _, p := range properties {
+		buf = appendString(buf, p.Key)
+		buf = appendString(buf, p.Val)
+	}
+	return buf
+}
+
+// decoder reads the fields of a frame body, the first error is kept and the next reads return zero values
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.buf) == 0 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if uint64(len(d.buf)) < n {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) properties() []*Property {
+	n := d.uvarint()
+	// every property takes at least two bytes
+	if d.err == nil && n > uint64(len(d.buf)/2) {
+		d.err = io.ErrUnexpectedEOF
+	}
+	if d.err != nil {
+		return nil
+	}
+	properties := make([]*Property, 0, n)
+	for i := uint64(0); i < n; i++ {
+		properties = append(properties, &Property{Key: d.string(), Val: d.string()})
+	}
+	return properties
+}
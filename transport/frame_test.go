@@ -0,0 +1,94 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestFrameCodec(t *testing.T) {
+	properties := []*Property{{Key: "priority", Val: "high"}, {Key: "k", Val: ""}}
+	tests := []struct {
+		name  string
+		frame *frame
+	}{
+		{"hello", &frame{Type: FrameHello, AgentId: "agent-1", Token: "secret"}},
+		{"hello without token", &frame{Type: FrameHello, AgentId: "agent-1"}},
+		{"connect", &frame{Type: FrameConnect, ClientId: "client-1"}},
+		{"disconnect", &frame{Type: FrameDisconnect, ClientId: "client-1"}},
+		{"publish", &frame{Type: FramePublish, Topic: "a/b", Payload: []byte("payload"), Qos: 1}},
+		{"publish retained qos 2", &frame{Type: FramePublish, Topic: "a/b", Payload: []byte{0, 1, 2}, Qos: 2, Retain: true}},
+		{"publish with properties", &frame{Type: FramePublish, Topic: "a", Payload: []byte("p"), Properties: properties}},
+		{"ack of the hello", &frame{Type: FrameAck}},
+		{"ack", &frame{Type: FrameAck, Ack: 1 << 40}},
+		{"chunk", &frame{Type: FrameChunk, Chunk: &Chunk{
+			Id: 7, Index: 1, Total: 3, Size: 300, Sum: bytes.Repeat([]byte{0xab}, 32),
+			Qos: 1, Retain: true, Topic: "big", Data: bytes.Repeat([]byte("x"), 100), Properties: properties,
+		}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := tt.frame.encode()
+			if size := binary.BigEndian.Uint32(buf); int(size) != len(buf)-4 {
+				t.Fatalf("length prefix %d, expected %d", size, len(buf)-4)
+			}
+			f, err := readFrame(bufio.NewReader(bytes.NewReader(buf)), len(buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(f.Chunk, tt.frame.Chunk) {
+				t.Fatalf("chunk %v, expected %v", f.Chunk, tt.frame.Chunk)
+			}
+			got, want := *f, *tt.frame
+			got.Chunk, want.Chunk = nil, nil
+			if len(got.Payload) == 0 && len(want.Payload) == 0 {
+				got.Payload, want.Payload = nil, nil
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("decoded %+v, expected %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	publish := (&frame{Type: FramePublish, Topic: "a/b", Payload: []byte("payload")}).encode()
+	raw := func(body ...byte) []byte {
+		return append(binary.BigEndian.AppendUint32(nil, uint32(len(body))), body...)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		max  int
+		err  error
+	}{
+		{"eof", nil, 1024, io.EOF},
+		{"truncated length", []byte{0, 0}, 1024, io.ErrUnexpectedEOF},
+		{"truncated body", publish[:len(publish)-2], 1024, io.ErrUnexpectedEOF},
+		{"too large", publish, len(publish) - 5, errFrameTooLarge},
+		{"empty", []byte{0, 0, 0, 0}, 1024, nil},
+		{"unknown type", raw(99), 1024, nil},
+		{"truncated field", raw(FrameConnect, 10, 'a'), 1024, nil},
+		{"too many properties", raw(FramePublish, 0x08, 0, 0, 100), 1024, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readFrame(bufio.NewReader(bytes.NewReader(tt.data)), tt.max)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
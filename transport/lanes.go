@@ -0,0 +1,246 @@
+package transport
+
+import (
+	"sync"
+	"time"
+)
+
+// Priority is the class of a message on the pipe, the order of the messages is kept within a class
+type Priority int
+
+const (
+	// PriorityHigh is the class of the connects, the disconnects and the critical publishes
+	PriorityHigh Priority = iota
+	PriorityNormal
+	PriorityLow
+
+	numPriorities
+)
+
+// String returns the name of the priority
+func (p Priority) String() string {
+	switch p {
+	case PriorityHigh:
+		return "high"
+	case PriorityLow:
+		return "low"
+	}
+	return "normal"
+}
+
+// the results of lanes.next
+const (
+	laneItem = iota
+	laneStopped
+	laneTimeout
+	laneAborted
+)
+
+// lanes queue the messages of every priority on their own channel. The messages are scheduled strictly by
+// priority, or in a weighted round robin taking up to weights[p] messages of the priority p in a round.
+// A delayed message is held out of its lane until its time, the messages behind it in the lane wait while
+// the other lanes keep being scheduled. The producers hold the read lock while queuing, stop closes the
+// queues with the lock held. next must be called by a single consumer.
+type lanes[T any] struct {
+	queues  [numPriorities]chan T
+	weights []int
+	// at returns the time a message is delayed until, zero if it is not delayed
+	at func(T) time.Time
+
+	sync.RWMutex
+	stopped bool
+
+	// recv are the queues not closed yet, credits the messages left in the round and held the delayed
+	// messages taken from their queue, owned by the consumer
+	recv    [numPriorities]chan T
+	credits [numPriorities]int
+	held    [numPriorities]T
+	holding [numPriorities]bool
+}
+
+// newLanes creates the lanes, at may be nil if the messages are never delayed
+func newLanes[T any](size int, weights []int, at func(T) time.Time) *lanes[T] {
+	l := &lanes[T]{weights: weights, at: at}
+	for p := range l.queues {
+		l.queues[p] = make(chan T, size)
+		l.recv[p] = l.queues[p]
+	}
+	l.refill()
+	return l
+}
+
+// enqueue queues a message in the lane of its priority, it waits while the lane is full. It is false if the lanes are stopped.
+func (l *lanes[T]) enqueue(p Priority, v T) bool {
+	l.RLock()
+	defer l.RUnlock()
+	if l.stopped {
+		return false
+	}
+	l.queues[p] <- v
+	return true
+}
+
+// stop closes the lanes, the messages queued are still returned by next
+func (l *lanes[T]) stop() {
+	l.Lock()
+	defer l.Unlock()
+	if l.stopped {
+		return
+	}
+	l.stopped = true
+	for _, q := range l.queues {
+		close(q)
+	}
+}
+
+// len returns the number of messages queued
+func (l *lanes[T]) len() int {
+	n := 0
+	for _, q := range l.queues {
+		n += len(q)
+	}
+	return n
+}
+
+// queued returns the number of messages queued with the priority
+func (l *lanes[T]) queued(p Priority) int {
+	return len(l.queues[p])
+}
+
+func (l *lanes[T]) refill() {
+	for p := range l.credits {
+		l.credits[p] = 1
+		if len(l.weights) > p {
+			l.credits[p] = l.weights[p]
+		}
+	}
+}
+
+// hold holds a message taken from the lane of the priority p if it is delayed, it is false if it is due
+func (l *lanes[T]) hold(p Priority, v T) bool {
+	if l.at == nil || !time.Now().Before(l.at(v)) {
+		return false
+	}
+	l.held[p] = v
+	l.holding[p] = true
+	return true
+}
+
+// take returns the message held in the lane of the priority p if its time has come
+func (l *lanes[T]) take(p Priority) (T, bool) {
+	var zero T
+	if !l.holding[p] || time.Now().Before(l.at(l.held[p])) {
+		return zero, false
+	}
+	v := l.held[p]
+	l.held[p] = zero
+	l.holding[p] = false
+	return v, true
+}
+
+// due returns the time until the earliest message held is due, it is false if none is held
+func (l *lanes[T]) due() (time.Duration, bool) {
+	var at time.Time
+	for p := range l.held {
+		if l.holding[p] && (at.IsZero() || l.at(l.held[p]).Before(at)) {
+			at = l.at(l.held[p])
+		}
+	}
+	return time.Until(at), !at.IsZero()
+}
+
+// ready returns the next message scheduled without waiting, the lanes holding a message not due are skipped
+func (l *lanes[T]) ready() (T, Priority, bool) {
+	for round := 0; round < 2; round++ {
+		for p := range l.recv {
+			if len(l.weights) > 0 && l.credits[p] <= 0 {
+				continue
+			}
+			if l.holding[p] {
+				if v, ok := l.take(Priority(p)); ok {
+					l.credits[p]--
+					return v, Priority(p), true
+				}
+				continue
+			}
+			if l.recv[p] == nil {
+				continue
+			}
+			select {
+			case v, ok := <-l.recv[p]:
+				if !ok {
+					l.recv[p] = nil
+				} else if !l.hold(Priority(p), v) {
+					l.credits[p]--
+					return v, Priority(p), true
+				}
+			default:
+			}
+		}
+		// the lanes with credits are empty or held, a new round starts
+		l.refill()
+	}
+	var zero T
+	return zero, 0, false
+}
+
+// next returns the next message scheduled and its priority, it waits until a message is queued or a message
+// held is due, the lanes are stopped and drained, timeout fires or abort is closed. A nil timeout or abort is
+// never ready.
+func (l *lanes[T]) next(timeout <-chan time.Time, abort <-chan struct{}) (T, Priority, int) {
+	for {
+		if v, p, ok := l.ready(); ok {
+			return v, p, laneItem
+		}
+
+		// the lanes holding a message are not received from until it is due
+		recv := l.recv
+		for p := range recv {
+			if l.holding[p] {
+				recv[p] = nil
+			}
+		}
+		var timer *time.Timer
+		var due <-chan time.Time
+		if wait, ok := l.due(); ok {
+			timer = time.NewTimer(wait)
+			due = timer.C
+		}
+		if recv[PriorityHigh] == nil && recv[PriorityNormal] == nil && recv[PriorityLow] == nil && due == nil {
+			var zero T
+			return zero, 0, laneStopped
+		}
+
+		var v T
+		var ok bool
+		p := Priority(-1)
+		state := laneItem
+		select {
+		case v, ok = <-recv[PriorityHigh]:
+			p = PriorityHigh
+		case v, ok = <-recv[PriorityNormal]:
+			p = PriorityNormal
+		case v, ok = <-recv[PriorityLow]:
+			p = PriorityLow
+		case <-due:
+		case <-timeout:
+			state = laneTimeout
+		case <-abort:
+			state = laneAborted
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		switch {
+		case state != laneItem:
+			return v, 0, state
+		case p < 0:
+			// a message held is due, it is scheduled with the others
+		case !ok:
+			l.recv[p] = nil
+		case !l.hold(p, v):
+			l.credits[p]--
+			return v, p, laneItem
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package transport
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// laneMsg is a message of the lanes tests, named after its priority and its position in the lane
+type laneMsg struct {
+	name string
+	at   time.Time
+}
+
+func newTestLanes(weights []int) *lanes[laneMsg] {
+	return newLanes[laneMsg](16, weights, func(m laneMsg) time.Time { return m.at })
+}
+
+// drain returns the names of the messages in the order scheduled until the lanes are stopped and drained
+func drain(t *testing.T, l *lanes[laneMsg]) []string {
+	var names []string
+	for {
+		m, _, state := l.next(time.After(time.Second), nil)
+		switch state {
+		case laneStopped:
+			return names
+		case laneTimeout:
+			t.Fatalf("timed out after %v", names)
+		}
+		names = append(names, m.name)
+	}
+}
+
+func TestLanesScheduling(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		want    []string
+	}{
+		{"strict", nil, []string{"h0", "h1", "h2", "n0", "n1", "n2", "l0", "l1", "l2"}},
+		{"weighted", []int{2, 1, 1}, []string{"h0", "h1", "n0", "l0", "h2", "n1", "l1", "n2", "l2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLanes(tt.weights)
+			for i := 0; i < 3; i++ {
+				for p, prefix := range []string{"h", "n", "l"} {
+					l.enqueue(Priority(p), laneMsg{name: prefix + string(rune('0'+i))})
+				}
+			}
+			l.stop()
+			if got := drain(t, l); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLanesDelayed(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	tests := []struct {
+		name    string
+		weights []int
+	}{
+		{"strict", nil},
+		{"weighted", []int{8, 4, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLanes(tt.weights)
+			start := time.Now()
+			l.enqueue(PriorityLow, laneMsg{name: "l0", at: start.Add(delay)})
+			l.enqueue(PriorityLow, laneMsg{name: "l1"})
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				l.enqueue(PriorityHigh, laneMsg{name: "h0"})
+				l.enqueue(PriorityNormal, laneMsg{name: "n0"})
+				l.stop()
+			}()
+
+			// the high and normal publishes overtake the delayed low one, which still holds the low lane
+			for _, want := range []string{"h0", "n0"} {
+				m, _, state := l.next(time.After(time.Second), nil)
+				if state != laneItem || m.name != want {
+					t.Fatalf("expected %s, got %s state:%d", want, m.name, state)
+				}
+				if elapsed := time.Since(start); elapsed >= delay {
+					t.Fatalf("%s waited behind the delayed message for %s", want, elapsed)
+				}
+			}
+			if got := drain(t, l); !reflect.DeepEqual(got, []string{"l0", "l1"}) {
+				t.Fatalf("expected [l0 l1], got %v", got)
+			}
+			if elapsed := time.Since(start); elapsed < delay {
+				t.Fatalf("the delayed message was returned after %s, before its delay", elapsed)
+			}
+		})
+	}
+}
+
+func TestLanesDelayedAbort(t *testing.T) {
+	l := newTestLanes(nil)
+	l.enqueue(PriorityNormal, laneMsg{name: "n0", at: time.Now().Add(time.Hour)})
+	if _, _, state := l.next(time.After(20*time.Millisecond), nil); state != laneTimeout {
+		t.Fatalf("expected timeout while the message is held, got state:%d", state)
+	}
+	abort := make(chan struct{})
+	close(abort)
+	if _, _, state := l.next(nil, abort); state != laneAborted {
+		t.Fatalf("expected aborted while the message is held, got state:%d", state)
+	}
+	// the held message is not lost, it is still due before the lanes are drained
+	l.stop()
+	if _, _, state := l.next(time.After(20*time.Millisecond), nil); state != laneTimeout {
+		t.Fatalf("expected the stopped lanes to wait for the held message, got state:%d", state)
+	}
+}
@@ -2,30 +2,225 @@ package transport
 
 import (
 	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
 
+	"github.com/werbenhu/bridgemq/agent"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 )
 
+// PeerState is the state of the pipe connection to a remote agent
+type PeerState string
+
+const (
+	// StateConnecting is the state of a connection which has never been ready
+	StateConnecting PeerState = "connecting"
+
+	// StateReady is the state of a ready connection whose pushes succeed
+	StateReady PeerState = "ready"
+
+	// StateDegraded is the state of a ready connection whose last pushes failed
+	StateDegraded PeerState = "degraded"
+
+	// StateDown is the state of a lost connection, it is reconnected with a backoff
+	StateDown PeerState = "down"
+)
+
+// degradedThreshold is the number of consecutive failed pushes degrading a ready connection
+const degradedThreshold = 3
+
+// errClientClosed is returned by the calls of a client closed after it was loaded,
+// such as a client replaced because the address of its agent changed
+var errClientClosed = errors.New("rpc client closed")
+
 type RpcClient struct {
 	conn *grpc.ClientConn
 	pipe TransportClient
+
+	// addr is the pipe address dialed, the client is replaced when the address of the agent changes
+	addr string
+
+	// agent is the last known state of the remote agent, it is replaced when its tags change
+	agent atomic.Pointer[agent.Agent]
+
+	// state is driven by the connectivity state of conn and the results of the pushes,
+	// onState is called on every change, failures counts the consecutive failed pushes
+	stateLock sync.Mutex
+	state     PeerState
+	failures  int
+	onState   func(old PeerState, new PeerState)
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	// noBatch is set if the agent does not support the publish batches
+	noBatch atomic.Bool
+
+	// noChunk is set if the agent does not support the chunked publishes
+	noChunk atomic.Bool
+
+	// the calls in progress hold the read lock, Close waits for them before closing the connection
+	sync.RWMutex
+	closed bool
+}
+
+func newRpcClient(node *agent.Agent, addr string, conn *grpc.ClientConn, onState func(old PeerState, new PeerState)) *RpcClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &RpcClient{
+		conn:    conn,
+		pipe:    NewTransportClient(conn),
+		addr:    addr,
+		state:   StateConnecting,
+		onState: onState,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	c.agent.Store(node)
+	return c
+}
+
+// start connects and follows the state of the connection in the background
+func (c *RpcClient) start() {
+	go c.watch(c.ctx)
+}
+
+// State returns the state of the connection
+func (c *RpcClient) State() PeerState {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.state
+}
+
+// watch follows the connectivity state of the connection until it is closed, an idle connection is
+// connected again at once, grpc retries a failed connection with a jittered exponential backoff
+func (c *RpcClient) watch(ctx context.Context) {
+	c.conn.Connect()
+	for {
+		s := c.conn.GetState()
+		switch s {
+		case connectivity.Idle:
+			c.conn.Connect()
+		case connectivity.Ready:
+			c.setState(func() PeerState {
+				if c.state == StateDegraded {
+					return StateDegraded
+				}
+				c.failures = 0
+				return StateReady
+			})
+		case connectivity.TransientFailure:
+			c.setState(func() PeerState { return StateDown })
+		case connectivity.Shutdown:
+			return
+		}
+		if !c.conn.WaitForStateChange(ctx, s) {
+			return
+		}
+	}
+}
+
+// report records the result of a push, a ready connection is degraded after
+// degradedThreshold consecutive failures and ready again after a success
+func (c *RpcClient) report(err error) {
+	c.setState(func() PeerState {
+		if err != nil {
+			c.failures++
+		} else {
+			c.failures = 0
+		}
+		switch {
+		case c.state == StateReady && c.failures >= degradedThreshold:
+			return StateDegraded
+		case c.state == StateDegraded && c.failures == 0:
+			return StateReady
+		}
+		return c.state
+	})
+}
+
+// setState changes the state to the one returned by next, which is called with the state lock held,
+// onState is called with the lock held too so that the changes are reported in order
+func (c *RpcClient) setState(next func() PeerState) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	old := c.state
+	c.state = next()
+	if c.state != old && c.onState != nil {
+		c.onState(old, c.state)
+	}
 }
 
+// Agent returns the last known state of the remote agent
+func (c *RpcClient) Agent() *agent.Agent {
+	return c.agent.Load()
+}
+
+// Close waits for the calls in progress and closes the connection
 func (c *RpcClient) Close() {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.cancel()
 	c.conn.Close()
 }
 
+// do runs the call unless the client is closed, the client is not closed before the call returns
+func (c *RpcClient) do(call func() error) error {
+	c.RLock()
+	defer c.RUnlock()
+	if c.closed {
+		return errClientClosed
+	}
+	err := call()
+	c.report(err)
+	return err
+}
+
 // PushConnect send a connect package to the remote agent via grpc
-func (c *RpcClient) PushConnect(ctx context.Context, in *Connect, opts ...grpc.CallOption) (*Response, error) {
-	return c.pipe.PushConnect(ctx, in, opts...)
+func (c *RpcClient) PushConnect(ctx context.Context, in *Connect, opts ...grpc.CallOption) (resp *Response, err error) {
+	err = c.do(func() error {
+		resp, err = c.pipe.PushConnect(ctx, in, opts...)
+		return err
+	})
+	return resp, err
 }
 
 // PushDisconnect send a disconnect package to the remote agent via grpc
-func (c *RpcClient) PushDisconnect(ctx context.Context, in *Disconnect, opts ...grpc.CallOption) (*Response, error) {
-	return c.pipe.PushDisconnect(ctx, in, opts...)
+func (c *RpcClient) PushDisconnect(ctx context.Context, in *Disconnect, opts ...grpc.CallOption) (resp *Response, err error) {
+	err = c.do(func() error {
+		resp, err = c.pipe.PushDisconnect(ctx, in, opts...)
+		return err
+	})
+	return resp, err
+}
+
+// PushChunk send a chunk of a large publish to the remote agent via grpc
+func (c *RpcClient) PushChunk(ctx context.Context, in *Chunk, opts ...grpc.CallOption) (resp *Response, err error) {
+	err = c.do(func() error {
+		resp, err = c.pipe.PushChunk(ctx, in, opts...)
+		return err
+	})
+	return resp, err
+}
+
+// PushPublishBatch send a batch of publish packages to the remote agent via grpc
+func (c *RpcClient) PushPublishBatch(ctx context.Context, in *PublishBatch, opts ...grpc.CallOption) (resp *Response, err error) {
+	err = c.do(func() error {
+		resp, err = c.pipe.PushPublishBatch(ctx, in, opts...)
+		return err
+	})
+	return resp, err
 }
 
 // PushPublish send a publish package to the remote agent via grpc
-func (c *RpcClient) PushPublish(ctx context.Context, in *Publish, opts ...grpc.CallOption) (*Response, error) {
-	return c.pipe.PushPublish(ctx, in, opts...)
+func (c *RpcClient) PushPublish(ctx context.Context, in *Publish, opts ...grpc.CallOption) (resp *Response, err error) {
+	err = c.do(func() error {
+		resp, err = c.pipe.PushPublish(ctx, in, opts...)
+		return err
+	})
+	return resp, err
 }
@@ -2,11 +2,17 @@ package transport
 
 import (
 	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // RpcServer is a grpc server recive connet, disconnect and publish package from other agent
 type RpcServer struct {
 	handler Handler
+
+	// chunks reassembles the payloads of the chunked publishes
+	chunks *assembler
 }
 
 func NewRpcServer(h Handler) *RpcServer {
@@ -37,10 +43,42 @@ func (s *RpcServer) PushDisconnect(ctx context.Context, req *Disconnect) (*Respo
 	}, nil
 }
 
+// PushPublishBatch handle a batch of publish packages from other agents via grpc, they are handled in order
+func (s *RpcServer) PushPublishBatch(ctx context.Context, req *PublishBatch) (*Response, error) {
+	if s.handler != nil {
+		for _, p := range req.Publishes {
+			deliver(s.handler, req.AgentId, p)
+		}
+	}
+	return &Response{
+		Code: 0,
+		Msg:  "success",
+	}, nil
+}
+
+// PushChunk handle a chunk of a large publish from other agents via grpc, the publish is
+// handled once its last chunk is received
+func (s *RpcServer) PushChunk(ctx context.Context, req *Chunk) (*Response, error) {
+	if s.chunks == nil {
+		return nil, status.Errorf(codes.Unimplemented, "method PushChunk not implemented")
+	}
+	p, err := s.chunks.add(req)
+	if err != nil {
+		return nil, status.Errorf(codes.DataLoss, "push chunk err:%s", err.Error())
+	}
+	if p != nil && s.handler != nil {
+		deliver(s.handler, p.AgentId, p)
+	}
+	return &Response{
+		Code: 0,
+		Msg:  "success",
+	}, nil
+}
+
 // PushPublish handle publich package from other agents via grpc
 func (s *RpcServer) PushPublish(ctx context.Context, req *Publish) (*Response, error) {
 	if s.handler != nil {
-		s.handler.OnPublish(req.AgentId, req.Topic, req.Payload, byte(req.Qos), req.Retain)
+		deliver(s.handler, req.AgentId, req)
 	}
 	return &Response{
 		Code: 0,
@@ -2,21 +2,88 @@ package transport
 
 import (
 	"context"
-	"log"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
+	"os"
+	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/rs/zerolog"
 	"github.com/werbenhu/bridgemq/agent"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 )
 
 const (
 	AgentIdKey = "agent-id"
+
+	defaultKeepAlive        = 10 * time.Second
+	defaultKeepAliveTimeout = 5 * time.Second
+	defaultBackoff          = time.Second
+	defaultMaxBackoff       = 30 * time.Second
 )
 
 type Opt struct {
 	Port string
+
+	// Name is the name of the local agent, it is sent to the other agents with every call
+	Name string
+
+	// TLS enables tls on the pipe when it is not nil, it is the config of the listener and of the
+	// connections to the other agents. When it requires and verifies the client certificates, an
+	// agent calling is identified by the common name of its certificate.
+	TLS *tls.Config
+
+	// Token is a secret shared by the agents, the calls without it are rejected when it is set
+	Token string
+
+	// Members reports whether an agent is a member of the cluster, the calls of the other agents are rejected
+	// when a token or mutual tls is used. The agents joined to the transport are the members if it is nil.
+	Members func(id string) bool
+
+	// KeepAlive is the interval of the pings sent on an idle pipe connection, the connection
+	// is closed and reconnected if a ping is not answered within KeepAliveTimeout
+	KeepAlive        time.Duration
+	KeepAliveTimeout time.Duration
+
+	// Backoff is the delay before reconnecting a lost pipe connection, it is doubled with a jitter
+	// on every failed attempt up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// BatchSize is the maximum number of publishes combined in a batch sent to an agent, a batch is
+	// sent once it holds BatchSize publishes or BatchBytes bytes of topics and payloads, or BatchLinger
+	// after its first publish. The publishes are sent one by one, still queued in their lanes, if it is 1.
+	BatchSize   int
+	BatchBytes  int
+	BatchLinger time.Duration
+
+	// MaxMsgSize is the maximum size of a message sent or received on the pipe. The payloads larger than
+	// ChunkSize are split into chunks reassembled by the receiver, a transfer whose next chunk is not
+	// received within ChunkTimeout is dropped. The payloads larger than MaxPayloadSize are neither sent
+	// nor reassembled.
+	MaxMsgSize     int
+	MaxPayloadSize int
+	ChunkSize      int
+	ChunkTimeout   time.Duration
+
+	// Weights are the publishes of each priority sent in a round of the weighted scheduling of the
+	// batches, the priorities are scheduled strictly if it is empty
+	Weights []int
+
+	// Logger is the logger of the transport, the logs of a remote agent carry its id in the peer field
+	Logger *zerolog.Logger
 }
 
 type RpcTransport struct {
@@ -24,12 +91,73 @@ type RpcTransport struct {
 	opts    *Opt
 	handler Handler
 	clients sync.Map
+	logger  *zerolog.Logger
+
+	// pushing is the number of pushes in progress and of publishes queued, Flush waits for it to drop to zero
+	pushing atomic.Int64
+
+	// batchers are the batchers of the publishes by agent id
+	batchers sync.Map
+
+	// serving is set while the pipe listener is accepting connections
+	serving atomic.Bool
+
+	// health is the standard grpc health service served on the pipe port
+	health *health.Server
+
+	// chunks reassembles the chunked publishes received, transfers numbers the chunked publishes sent
+	chunks    *assembler
+	transfers atomic.Uint64
+
+	// auth authenticates the agents calling when a token or mutual tls is used
+	auth *authenticator
 }
 
 func NewRpcTransport(opts *Opt) *RpcTransport {
-	return &RpcTransport{
-		opts: opts,
+	g := &RpcTransport{
+		opts:   opts,
+		logger: opts.Logger,
+		health: health.NewServer(),
+	}
+	if g.logger == nil {
+		logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
+		g.logger = &logger
+	}
+	if opts.KeepAlive <= 0 {
+		opts.KeepAlive = defaultKeepAlive
+	}
+	if opts.KeepAliveTimeout <= 0 {
+		opts.KeepAliveTimeout = defaultKeepAliveTimeout
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = defaultBackoff
+	}
+	if opts.MaxBackoff < opts.Backoff {
+		opts.MaxBackoff = defaultMaxBackoff
+		if opts.MaxBackoff < opts.Backoff {
+			opts.MaxBackoff = opts.Backoff
+		}
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
 	}
+	if opts.BatchBytes <= 0 {
+		opts.BatchBytes = defaultBatchBytes
+	}
+	if opts.BatchLinger <= 0 {
+		opts.BatchLinger = defaultBatchLinger
+	}
+	chunkDefaults(&opts.MaxMsgSize, &opts.MaxPayloadSize, &opts.ChunkSize, &opts.ChunkTimeout)
+	g.chunks = newAssembler(opts.ChunkTimeout, opts.MaxPayloadSize, g.logger)
+	members := opts.Members
+	if members == nil {
+		members = func(id string) bool {
+			_, ok := g.clients.Load(id)
+			return ok
+		}
+	}
+	g.auth = newAuthenticator(opts.Token, opts.TLS, members, g.logger)
+	return g
 }
 
 func (g *RpcTransport) SetHandler(h Handler) {
@@ -38,56 +166,132 @@ func (g *RpcTransport) SetHandler(h Handler) {
 
 // Join() is called When a new agent is discovered by the discovery
 func (g *RpcTransport) Join(node *agent.Agent) {
-	if _, ok := g.clients.Load(node.Id); !ok {
-		addr := node.Addr + ":" + node.PipePort
-		log.Printf("[INFO] agent: %s has joined, addr:%s \n", node.Id, addr)
-		conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithUserAgent(node.Id))
-		if err != nil {
-			log.Printf("[ERROR] agent join failed. grpc dial addr:%s err:%s\n", addr, err.Error())
-			return
-		}
-
-		client := NewTransportClient(conn)
-		g.clients.Store(node.Id, &RpcClient{
-			conn: conn,
-			pipe: client,
-		})
-	}
+	g.connect(node, "agent has joined")
 }
 
-// Leave() is called When a agent is left
+// Leave() is called When a agent is left, the calls in progress are finished before the connection is closed
 func (g *RpcTransport) Leave(node *agent.Agent) {
-	if c, ok := g.clients.Load(node.Id); ok {
-		addr := node.Addr + ":" + node.PipePort
-		log.Printf("[INFO] agent: %s has left, addr:%s \n", node.Id, addr)
-		client := c.(*RpcClient)
-		g.clients.Delete(node.Id)
-		client.Close()
+	if c, ok := g.clients.LoadAndDelete(node.Id); ok {
+		addr := net.JoinHostPort(node.Addr, node.PipePort)
+		g.logger.Info().Str("peer", node.Id).Str("addr", addr).Msg("agent has left")
+		go c.(*RpcClient).Close()
+	}
+	if b, ok := g.batchers.LoadAndDelete(node.Id); ok {
+		b.(*batcher).stop()
 	}
 }
 
-// Join() is called When a agent updated
+// Update() is called When a agent updated, the connection is replaced if its address or its pipe port changed
 func (g *RpcTransport) Update(node *agent.Agent) {
-	if _, ok := g.clients.Load(node.Id); !ok {
-		addr := node.Addr + ":" + node.PipePort
-		log.Printf("[INFO] agent: %s was updated, addr: %s \n", node.Id, addr)
-		conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithUserAgent(node.Id))
-		if err != nil {
-			log.Printf("[ERROR] agent update failed. grpc dial addr:%s err:%s\n", addr, err.Error())
+	g.connect(node, "agent was updated")
+}
+
+// connect dials the agent unless it is connected to the same address. When the address changed,
+// the new client replaces the old one at once and the old one is closed once its calls are
+// finished, the calls failing because the old client was closed are retried with the new one.
+func (g *RpcTransport) connect(node *agent.Agent, msg string) {
+	addr := net.JoinHostPort(node.Addr, node.PipePort)
+	var old *RpcClient
+	if val, ok := g.clients.Load(node.Id); ok {
+		old = val.(*RpcClient)
+		if old.addr == addr {
+			if !reflect.DeepEqual(old.Agent().Tags, node.Tags) {
+				g.logger.Debug().Str("peer", node.Id).Interface("tags", node.Tags).Msg("agent tags changed")
+			}
+			old.agent.Store(node)
 			return
 		}
+	}
 
-		client := NewTransportClient(conn)
-		g.clients.Store(node.Id, &RpcClient{
-			conn: conn,
-			pipe: client,
-		})
+	creds := insecure.NewCredentials()
+	if g.opts.TLS != nil {
+		creds = credentials.NewTLS(g.opts.TLS)
+	}
+	conn, err := grpc.Dial(addr,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithUserAgent(node.Id),
+		grpc.WithUnaryInterceptor(clientInterceptor(g.opts.Name, g.opts.Token)),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  g.opts.Backoff,
+				Multiplier: 2,
+				Jitter:     0.2,
+				MaxDelay:   g.opts.MaxBackoff,
+			},
+			MinConnectTimeout: 5 * time.Second,
+		}),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                g.opts.KeepAlive,
+			Timeout:             g.opts.KeepAliveTimeout,
+			PermitWithoutStream: true,
+		}),
+		grpc.WithDefaultCallOptions(
+			grpc.MaxCallSendMsgSize(g.opts.MaxMsgSize),
+			grpc.MaxCallRecvMsgSize(g.opts.MaxMsgSize),
+		),
+	)
+	if err != nil {
+		g.logger.Error().Err(err).Str("peer", node.Id).Str("addr", addr).Msg("grpc dial agent failed")
+		return
+	}
+
+	var client *RpcClient
+	client = newRpcClient(node, addr, conn, func(old PeerState, state PeerState) {
+		g.onState(node.Id, client, old, state)
+	})
+	g.clients.Store(node.Id, client)
+	client.start()
+
+	b := newBatcher(node.Id, g.opts.Weights)
+	if _, loaded := g.batchers.LoadOrStore(node.Id, b); !loaded {
+		go g.batch(b)
+	}
+
+	if old == nil {
+		g.logger.Info().Str("peer", node.Id).Str("addr", addr).Msg(msg)
+		return
+	}
+	g.logger.Info().Str("peer", node.Id).Str("addr", addr).Str("old_addr", old.addr).Msg("agent address changed, connection replaced")
+	go old.Close()
+}
+
+// onState logs the state changes of the clients and reports them to the handler,
+// the changes of a client replaced meanwhile are not reported
+func (g *RpcTransport) onState(id string, client *RpcClient, old PeerState, state PeerState) {
+	if val, ok := g.clients.Load(id); !ok || val.(*RpcClient) != client {
+		return
+	}
+	event := g.logger.Info()
+	if state == StateDown || state == StateDegraded {
+		event = g.logger.Warn()
+	}
+	event.Str("peer", id).Str("addr", client.addr).Str("from", string(old)).Str("to", string(state)).Msg("pipe connection state changed")
+
+	if h, ok := g.handler.(StateHandler); ok {
+		h.OnPeerState(id, state)
 	}
 }
 
+// invoke runs the call with the client of the agent, the call is retried with the new
+// client if the client was replaced and closed since it was loaded
+func (g *RpcTransport) invoke(id string, client *RpcClient, call func(c *RpcClient) error) error {
+	err := call(client)
+	for errors.Is(err, errClientClosed) {
+		val, ok := g.clients.Load(id)
+		if !ok || val.(*RpcClient) == client {
+			return err
+		}
+		client = val.(*RpcClient)
+		err = call(client)
+	}
+	return err
+}
+
 // PushConnect transmit a connect package to the remote agent via grpc
 // clientId is the client id of the client that connected
 func (g *RpcTransport) PushConnect(local *agent.Agent, clientId string) {
+	g.pushing.Add(1)
+	defer g.pushing.Add(-1)
 	g.clients.Range(func(key any, val any) bool {
 		if local.IsSelf(key.(string)) {
 			return true
@@ -96,11 +300,15 @@ func (g *RpcTransport) PushConnect(local *agent.Agent, clientId string) {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
-		if _, err := client.PushConnect(ctx, &Connect{
+		in := &Connect{
 			AgentId:  local.Id,
 			ClientId: clientId,
+		}
+		if err := g.invoke(key.(string), client, func(c *RpcClient) error {
+			_, err := c.PushConnect(ctx, in)
+			return err
 		}); err != nil {
-			log.Printf("[ERROR] bridge push connect to agent:%s failed, err:%s\n", key.(string), err.Error())
+			g.logger.Error().Err(err).Str("peer", key.(string)).Str("client_id", clientId).Msg("bridge push connect failed")
 		}
 		return true
 	})
@@ -109,6 +317,8 @@ func (g *RpcTransport) PushConnect(local *agent.Agent, clientId string) {
 // PushDisconnect transmit a connect package to the remote agent via grpc
 // clientId is the client id of the client that connected
 func (g *RpcTransport) PushDisconnect(local *agent.Agent, clientId string) {
+	g.pushing.Add(1)
+	defer g.pushing.Add(-1)
 	g.clients.Range(func(key any, val any) bool {
 		if local.IsSelf(key.(string)) {
 			return true
@@ -117,60 +327,213 @@ func (g *RpcTransport) PushDisconnect(local *agent.Agent, clientId string) {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
-		if _, err := client.PushDisconnect(ctx, &Disconnect{
+		in := &Disconnect{
 			AgentId:  local.Id,
 			ClientId: clientId,
+		}
+		if err := g.invoke(key.(string), client, func(c *RpcClient) error {
+			_, err := c.PushDisconnect(ctx, in)
+			return err
 		}); err != nil {
-			log.Printf("[ERROR] bridge push disconnect to agent:%s failed, err:%s\n", key.(string), err.Error())
+			g.logger.Error().Err(err).Str("peer", key.(string)).Str("client_id", clientId).Msg("bridge push disconnect failed")
 		}
 		return true
 	})
 }
 
-// PushPublish transmit a publish package to the remote agent via grpc
+// PushPublish transmit a publish package to the remote agent via grpc with the normal priority
 func (g *RpcTransport) PushPublish(local *agent.Agent, topic string, payload []byte, qos byte, retain bool) {
-	g.clients.Range(func(key any, val any) bool {
-		if local.IsSelf(key.(string)) {
+	g.PushPublishPriority(local, topic, payload, qos, retain, PriorityNormal)
+}
+
+// PushPublishPriority transmit a publish package to the remote agent via grpc in the lane of its priority
+func (g *RpcTransport) PushPublishPriority(local *agent.Agent, topic string, payload []byte, qos byte, retain bool, priority Priority) {
+	g.PushPublishTo(local, "", &Publish{Topic: topic, Payload: payload, Qos: int32(qos), Retain: retain}, priority)
+}
+
+// PushPublishTo transmit a publish package with its user properties to the agent via grpc, or to every
+// remote agent if id is empty. The publishes are queued in the lane of their priority and sent in batches,
+// or one by one if BatchSize is 1, the payloads larger than ChunkSize are sent in chunks. The connects and
+// the disconnects are never queued.
+func (g *RpcTransport) PushPublishTo(local *agent.Agent, id string, p *Publish, priority Priority) {
+	p.AgentId = local.Id
+	if len(p.Payload) > g.opts.MaxPayloadSize {
+		g.logger.Warn().Str("topic", p.Topic).Int("size", len(p.Payload)).Int("max_size", g.opts.MaxPayloadSize).Msg("bridge push publish dropped, payload too large")
+		return
+	}
+	var chunks []*Chunk
+	if len(p.Payload) > g.opts.ChunkSize {
+		chunks = split(g.transfers.Add(1), p, g.opts.ChunkSize)
+	}
+
+	out := &outgoing{publish: p, chunks: chunks}
+	g.batchers.Range(func(key any, val any) bool {
+		if local.IsSelf(key.(string)) || (id != "" && key.(string) != id) {
 			return true
 		}
-		client := val.(*RpcClient)
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-
-		if _, err := client.PushPublish(ctx, &Publish{
-			AgentId: local.Id,
-			Topic:   topic,
-			Payload: payload,
-			Qos:     int32(qos),
-			Retain:  retain,
-		}); err != nil {
-			log.Printf("[ERROR] bridge push publish to agent:%s failed, err:%s\n", key.(string), err.Error())
+		delay, ok := g.outbound(key.(string), p.Topic, p.Payload, byte(p.Qos), p.Retain)
+		if !ok {
+			return true
+		}
+		queued := out
+		if delay > 0 {
+			queued = &outgoing{publish: p, chunks: chunks, at: time.Now().Add(delay)}
+		}
+		g.pushing.Add(1)
+		if !val.(*batcher).enqueue(priority, queued) {
+			g.pushing.Add(-1)
 		}
 		return true
 	})
 }
 
-func (g *RpcTransport) Start() error {
-	var err error
+// outbound reports whether the handler lets the publish be pushed to the agent and the delay before it is sent
+func (g *RpcTransport) outbound(id string, topic string, payload []byte, qos byte, retain bool) (time.Duration, bool) {
+	if h, ok := g.handler.(OutboundHandler); ok {
+		return h.OnPushPublish(id, topic, payload, qos, retain)
+	}
+	return 0, true
+}
+
+// sendChunks sends the chunks of a large publish to an agent in order, the publish
+// is sent whole to the agents which do not support the chunks
+func (g *RpcTransport) sendChunks(id string, client *RpcClient, p *Publish, chunks []*Chunk) {
+	if !client.noChunk.Load() {
+		err := g.pushChunks(id, client, chunks)
+		if status.Code(err) != codes.Unimplemented {
+			if err != nil {
+				g.logger.Error().Err(err).Str("peer", id).Str("topic", p.Topic).Int("size", len(p.Payload)).Msg("bridge push chunked publish failed")
+			}
+			return
+		}
+		g.logger.Info().Str("peer", id).Msg("agent does not support chunked publishes, sending them whole")
+	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := g.invoke(id, client, func(c *RpcClient) error {
+		_, err := c.PushPublish(ctx, p)
+		return err
+	}); err != nil {
+		g.logger.Error().Err(err).Str("peer", id).Str("topic", p.Topic).Int("size", len(p.Payload)).Msg("bridge push publish failed")
+	}
+}
+
+// pushChunks pushes the chunks one by one, it stops at the first failure
+func (g *RpcTransport) pushChunks(id string, client *RpcClient, chunks []*Chunk) error {
+	for _, chunk := range chunks {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := g.invoke(id, client, func(c *RpcClient) error {
+			_, err := c.PushChunk(ctx, chunk)
+			if status.Code(err) == codes.Unimplemented {
+				c.noChunk.Store(true)
+			}
+			return err
+		})
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush waits until the pushes in progress are finished or ctx is done
+func (g *RpcTransport) Flush(ctx context.Context) error {
+	return waitIdle(ctx, &g.pushing)
+}
+
+// Start binds the pipe listener and serves it in the background
+func (g *RpcTransport) Start() error {
 	listener, err := net.Listen("tcp", ":"+g.opts.Port)
 	if err != nil {
-		log.Fatalf("[ERROR] rpc transport listen to port:%s failed, err:%s", g.opts.Port, err.Error())
-		return err
+		return fmt.Errorf("rpc transport listen port:%s err:%s", g.opts.Port, err.Error())
 	}
 
-	g.server = grpc.NewServer()
-	RegisterTransportServer(g.server, NewRpcServer(g.handler))
-	if err = g.server.Serve(listener); err != nil {
-		log.Fatalf("[ERROR] rpc transport serve to port:%s failed, err:%s", g.opts.Port, err.Error())
+	options := []grpc.ServerOption{
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             time.Second,
+			PermitWithoutStream: true,
+		}),
+		grpc.MaxRecvMsgSize(g.opts.MaxMsgSize),
+		grpc.MaxSendMsgSize(g.opts.MaxMsgSize),
+		grpc.UnaryInterceptor(g.auth.unaryInterceptor),
 	}
-	return err
+	if g.opts.TLS != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(g.opts.TLS)))
+	}
+	g.server = grpc.NewServer(options...)
+	server := NewRpcServer(g.handler)
+	server.chunks = g.chunks
+	RegisterTransportServer(g.server, server)
+	grpc_health_v1.RegisterHealthServer(g.server, g.health)
+	g.SetServing(true)
+
+	g.serving.Store(true)
+	go func() {
+		defer g.serving.Store(false)
+		if err := g.server.Serve(listener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+			g.logger.Error().Err(err).Str("port", g.opts.Port).Msg("rpc transport serve failed")
+		}
+	}()
+	g.logger.Info().Str("port", g.opts.Port).Bool("tls", g.opts.TLS != nil).Bool("auth", g.auth.enabled()).Msg("rpc transport started")
+	return nil
+}
+
+// Serving reports whether the pipe listener is accepting connections
+func (g *RpcTransport) Serving() bool {
+	return g.serving.Load()
+}
+
+// Peers returns the number of remote agents whose pipe connection is ready and the number of remote agents
+func (g *RpcTransport) Peers() (int, int) {
+	ready, total := 0, 0
+	g.clients.Range(func(key any, val any) bool {
+		total++
+		if val.(*RpcClient).State() == StateReady {
+			ready++
+		}
+		return true
+	})
+	return ready, total
+}
+
+// PeerStates returns the state of the pipe connection to every remote agent
+func (g *RpcTransport) PeerStates() map[string]PeerState {
+	states := make(map[string]PeerState)
+	g.clients.Range(func(key any, val any) bool {
+		states[key.(string)] = val.(*RpcClient).State()
+		return true
+	})
+	return states
+}
+
+// SetServing changes the status reported by the grpc health service, for the whole
+// server and for the Transport service
+func (g *RpcTransport) SetServing(serving bool) {
+	status := grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	if serving {
+		status = grpc_health_v1.HealthCheckResponse_SERVING
+	}
+	g.health.SetServingStatus("", status)
+	g.health.SetServingStatus(_Transport_serviceDesc.ServiceName, status)
 }
 
 func (g *RpcTransport) Stop() {
+	g.health.Shutdown()
+	g.batchers.Range(func(k any, v any) bool {
+		b := v.(*batcher)
+		b.stop()
+		<-b.done
+		g.batchers.Delete(k)
+		return true
+	})
 	g.clients.Range(func(k any, v any) bool {
 		v.(*RpcClient).Close()
 		return true
 	})
-	g.server.Stop()
+	if g.server != nil {
+		g.server.Stop()
+	}
+	g.chunks.close()
 }
@@ -189,22 +189,78 @@ func (x *Disconnect) GetClientId() string {
 	return ""
 }
 
+type Property struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Key string `protobuf:"bytes,1,opt,name=Key,proto3" json:"Key,omitempty"`
+	Val string `protobuf:"bytes,2,opt,name=Val,proto3" json:"Val,omitempty"`
+}
+
+func (x *Property) Reset() {
+	*x = Property{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_rptransport_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Property) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Property) ProtoMessage() {}
+
+func (x *Property) ProtoReflect() protoreflect.Message {
+	mi := &file_rptransport_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Property.ProtoReflect.Descriptor instead.
+func (*Property) Descriptor() ([]byte, []int) {
+	return file_rptransport_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Property) GetKey() string {
+	if x != nil {
+		return x.Key
+	}
+	return ""
+}
+
+func (x *Property) GetVal() string {
+	if x != nil {
+		return x.Val
+	}
+	return ""
+}
+
 type Publish struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	AgentId string `protobuf:"bytes,1,opt,name=AgentId,proto3" json:"AgentId,omitempty"`
-	Topic   string `protobuf:"bytes,2,opt,name=Topic,proto3" json:"Topic,omitempty"`
-	Payload []byte `protobuf:"bytes,3,opt,name=Payload,proto3" json:"Payload,omitempty"`
-	Qos     int32  `protobuf:"varint,4,opt,name=Qos,proto3" json:"Qos,omitempty"`
-	Retain  bool   `protobuf:"varint,5,opt,name=Retain,proto3" json:"Retain,omitempty"`
+	AgentId    string      `protobuf:"bytes,1,opt,name=AgentId,proto3" json:"AgentId,omitempty"`
+	Topic      string      `protobuf:"bytes,2,opt,name=Topic,proto3" json:"Topic,omitempty"`
+	Payload    []byte      `protobuf:"bytes,3,opt,name=Payload,proto3" json:"Payload,omitempty"`
+	Qos        int32       `protobuf:"varint,4,opt,name=Qos,proto3" json:"Qos,omitempty"`
+	Retain     bool        `protobuf:"varint,5,opt,name=Retain,proto3" json:"Retain,omitempty"`
+	Properties []*Property `protobuf:"bytes,6,rep,name=Properties,proto3" json:"Properties,omitempty"`
 }
 
 func (x *Publish) Reset() {
 	*x = Publish{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_rptransport_proto_msgTypes[3]
+		mi := &file_rptransport_proto_msgTypes[4]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -217,7 +273,7 @@ func (x *Publish) String() string {
 func (*Publish) ProtoMessage() {}
 
 func (x *Publish) ProtoReflect() protoreflect.Message {
-	mi := &file_rptransport_proto_msgTypes[3]
+	mi := &file_rptransport_proto_msgTypes[4]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -230,7 +286,7 @@ func (x *Publish) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Publish.ProtoReflect.Descriptor instead.
 func (*Publish) Descriptor() ([]byte, []int) {
-	return file_rptransport_proto_rawDescGZIP(), []int{3}
+	return file_rptransport_proto_rawDescGZIP(), []int{4}
 }
 
 func (x *Publish) GetAgentId() string {
@@ -268,6 +324,195 @@ func (x *Publish) GetRetain() bool {
 	return false
 }
 
+func (x *Publish) GetProperties() []*Property {
+	if x != nil {
+		return x.Properties
+	}
+	return nil
+}
+
+type PublishBatch struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	AgentId   string     `protobuf:"bytes,1,opt,name=AgentId,proto3" json:"AgentId,omitempty"`
+	Publishes []*Publish `protobuf:"bytes,2,rep,name=Publishes,proto3" json:"Publishes,omitempty"`
+}
+
+func (x *PublishBatch) Reset() {
+	*x = PublishBatch{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_rptransport_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PublishBatch) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PublishBatch) ProtoMessage() {}
+
+func (x *PublishBatch) ProtoReflect() protoreflect.Message {
+	mi := &file_rptransport_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PublishBatch.ProtoReflect.Descriptor instead.
+func (*PublishBatch) Descriptor() ([]byte, []int) {
+	return file_rptransport_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *PublishBatch) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *PublishBatch) GetPublishes() []*Publish {
+	if x != nil {
+		return x.Publishes
+	}
+	return nil
+}
+
+type Chunk struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	AgentId    string      `protobuf:"bytes,1,opt,name=AgentId,proto3" json:"AgentId,omitempty"`
+	Id         uint64      `protobuf:"varint,2,opt,name=Id,proto3" json:"Id,omitempty"`
+	Index      uint32      `protobuf:"varint,3,opt,name=Index,proto3" json:"Index,omitempty"`
+	Total      uint32      `protobuf:"varint,4,opt,name=Total,proto3" json:"Total,omitempty"`
+	Topic      string      `protobuf:"bytes,5,opt,name=Topic,proto3" json:"Topic,omitempty"`
+	Qos        int32       `protobuf:"varint,6,opt,name=Qos,proto3" json:"Qos,omitempty"`
+	Retain     bool        `protobuf:"varint,7,opt,name=Retain,proto3" json:"Retain,omitempty"`
+	Size       uint64      `protobuf:"varint,8,opt,name=Size,proto3" json:"Size,omitempty"`
+	Sum        []byte      `protobuf:"bytes,9,opt,name=Sum,proto3" json:"Sum,omitempty"`
+	Data       []byte      `protobuf:"bytes,10,opt,name=Data,proto3" json:"Data,omitempty"`
+	Properties []*Property `protobuf:"bytes,11,rep,name=Properties,proto3" json:"Properties,omitempty"`
+}
+
+func (x *Chunk) Reset() {
+	*x = Chunk{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_rptransport_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Chunk) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Chunk) ProtoMessage() {}
+
+func (x *Chunk) ProtoReflect() protoreflect.Message {
+	mi := &file_rptransport_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Chunk.ProtoReflect.Descriptor instead.
+func (*Chunk) Descriptor() ([]byte, []int) {
+	return file_rptransport_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *Chunk) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *Chunk) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Chunk) GetIndex() uint32 {
+	if x != nil {
+		return x.Index
+	}
+	return 0
+}
+
+func (x *Chunk) GetTotal() uint32 {
+	if x != nil {
+		return x.Total
+	}
+	return 0
+}
+
+func (x *Chunk) GetTopic() string {
+	if x != nil {
+		return x.Topic
+	}
+	return ""
+}
+
+func (x *Chunk) GetQos() int32 {
+	if x != nil {
+		return x.Qos
+	}
+	return 0
+}
+
+func (x *Chunk) GetRetain() bool {
+	if x != nil {
+		return x.Retain
+	}
+	return false
+}
+
+func (x *Chunk) GetSize() uint64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *Chunk) GetSum() []byte {
+	if x != nil {
+		return x.Sum
+	}
+	return nil
+}
+
+func (x *Chunk) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *Chunk) GetProperties() []*Property {
+	if x != nil {
+		return x.Properties
+	}
+	return nil
+}
+
 var File_rptransport_proto protoreflect.FileDescriptor
 
 var file_rptransport_proto_rawDesc = []byte{
@@ -283,25 +528,57 @@ var file_rptransport_proto_rawDesc = []byte{
 	0x6e, 0x65, 0x63, 0x74, 0x12, 0x18, 0x0a, 0x07, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x49, 0x64, 0x18,
 	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x49, 0x64, 0x12, 0x1a,
 	0x0a, 0x08, 0x43, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x49, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09,
-	0x52, 0x08, 0x43, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x49, 0x64, 0x22, 0x7d, 0x0a, 0x07, 0x50, 0x75,
-	0x62, 0x6c, 0x69, 0x73, 0x68, 0x12, 0x18, 0x0a, 0x07, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x49, 0x64,
+	0x52, 0x08, 0x43, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x49, 0x64, 0x22, 0x2e, 0x0a, 0x08, 0x50, 0x72,
+	0x6f, 0x70, 0x65, 0x72, 0x74, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x4b, 0x65, 0x79, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x03, 0x4b, 0x65, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x56, 0x61, 0x6c, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x56, 0x61, 0x6c, 0x22, 0xa8, 0x01, 0x0a, 0x07, 0x50,
+	0x75, 0x62, 0x6c, 0x69, 0x73, 0x68, 0x12, 0x18, 0x0a, 0x07, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x49,
+	0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x49, 0x64,
+	0x12, 0x14, 0x0a, 0x05, 0x54, 0x6f, 0x70, 0x69, 0x63, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x05, 0x54, 0x6f, 0x70, 0x69, 0x63, 0x12, 0x18, 0x0a, 0x07, 0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61,
+	0x64, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x07, 0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64,
+	0x12, 0x10, 0x0a, 0x03, 0x51, 0x6f, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x05, 0x52, 0x03, 0x51,
+	0x6f, 0x73, 0x12, 0x16, 0x0a, 0x06, 0x52, 0x65, 0x74, 0x61, 0x69, 0x6e, 0x18, 0x05, 0x20, 0x01,
+	0x28, 0x08, 0x52, 0x06, 0x52, 0x65, 0x74, 0x61, 0x69, 0x6e, 0x12, 0x29, 0x0a, 0x0a, 0x50, 0x72,
+	0x6f, 0x70, 0x65, 0x72, 0x74, 0x69, 0x65, 0x73, 0x18, 0x06, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x09,
+	0x2e, 0x50, 0x72, 0x6f, 0x70, 0x65, 0x72, 0x74, 0x79, 0x52, 0x0a, 0x50, 0x72, 0x6f, 0x70, 0x65,
+	0x72, 0x74, 0x69, 0x65, 0x73, 0x22, 0x50, 0x0a, 0x0c, 0x50, 0x75, 0x62, 0x6c, 0x69, 0x73, 0x68,
+	0x42, 0x61, 0x74, 0x63, 0x68, 0x12, 0x18, 0x0a, 0x07, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x49, 0x64,
 	0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x49, 0x64, 0x12,
-	0x14, 0x0a, 0x05, 0x54, 0x6f, 0x70, 0x69, 0x63, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05,
-	0x54, 0x6f, 0x70, 0x69, 0x63, 0x12, 0x18, 0x0a, 0x07, 0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64,
-	0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x07, 0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x12,
-	0x10, 0x0a, 0x03, 0x51, 0x6f, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x05, 0x52, 0x03, 0x51, 0x6f,
-	0x73, 0x12, 0x16, 0x0a, 0x06, 0x52, 0x65, 0x74, 0x61, 0x69, 0x6e, 0x18, 0x05, 0x20, 0x01, 0x28,
-	0x08, 0x52, 0x06, 0x52, 0x65, 0x74, 0x61, 0x69, 0x6e, 0x32, 0x83, 0x01, 0x0a, 0x09, 0x54, 0x72,
-	0x61, 0x6e, 0x73, 0x70, 0x6f, 0x72, 0x74, 0x12, 0x24, 0x0a, 0x0b, 0x50, 0x75, 0x73, 0x68, 0x43,
-	0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x12, 0x08, 0x2e, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74,
-	0x1a, 0x09, 0x2e, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x2a, 0x0a,
-	0x0e, 0x50, 0x75, 0x73, 0x68, 0x44, 0x69, 0x73, 0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x12,
-	0x0b, 0x2e, 0x44, 0x69, 0x73, 0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x1a, 0x09, 0x2e, 0x52,
-	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x24, 0x0a, 0x0b, 0x50, 0x75, 0x73,
-	0x68, 0x50, 0x75, 0x62, 0x6c, 0x69, 0x73, 0x68, 0x12, 0x08, 0x2e, 0x50, 0x75, 0x62, 0x6c, 0x69,
-	0x73, 0x68, 0x1a, 0x09, 0x2e, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x42,
-	0x0c, 0x5a, 0x0a, 0x2f, 0x74, 0x72, 0x61, 0x6e, 0x73, 0x70, 0x6f, 0x72, 0x74, 0x62, 0x06, 0x70,
-	0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x26, 0x0a, 0x09, 0x50, 0x75, 0x62, 0x6c, 0x69, 0x73, 0x68, 0x65, 0x73, 0x18, 0x02, 0x20, 0x03,
+	0x28, 0x0b, 0x32, 0x08, 0x2e, 0x50, 0x75, 0x62, 0x6c, 0x69, 0x73, 0x68, 0x52, 0x09, 0x50, 0x75,
+	0x62, 0x6c, 0x69, 0x73, 0x68, 0x65, 0x73, 0x22, 0x82, 0x02, 0x0a, 0x05, 0x43, 0x68, 0x75, 0x6e,
+	0x6b, 0x12, 0x18, 0x0a, 0x07, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x49, 0x64, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x07, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x49, 0x64, 0x12, 0x0e, 0x0a, 0x02, 0x49,
+	0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04, 0x52, 0x02, 0x49, 0x64, 0x12, 0x14, 0x0a, 0x05, 0x49,
+	0x6e, 0x64, 0x65, 0x78, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x05, 0x49, 0x6e, 0x64, 0x65,
+	0x78, 0x12, 0x14, 0x0a, 0x05, 0x54, 0x6f, 0x74, 0x61, 0x6c, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0d,
+	0x52, 0x05, 0x54, 0x6f, 0x74, 0x61, 0x6c, 0x12, 0x14, 0x0a, 0x05, 0x54, 0x6f, 0x70, 0x69, 0x63,
+	0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x54, 0x6f, 0x70, 0x69, 0x63, 0x12, 0x10, 0x0a,
+	0x03, 0x51, 0x6f, 0x73, 0x18, 0x06, 0x20, 0x01, 0x28, 0x05, 0x52, 0x03, 0x51, 0x6f, 0x73, 0x12,
+	0x16, 0x0a, 0x06, 0x52, 0x65, 0x74, 0x61, 0x69, 0x6e, 0x18, 0x07, 0x20, 0x01, 0x28, 0x08, 0x52,
+	0x06, 0x52, 0x65, 0x74, 0x61, 0x69, 0x6e, 0x12, 0x12, 0x0a, 0x04, 0x53, 0x69, 0x7a, 0x65, 0x18,
+	0x08, 0x20, 0x01, 0x28, 0x04, 0x52, 0x04, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x10, 0x0a, 0x03, 0x53,
+	0x75, 0x6d, 0x18, 0x09, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x03, 0x53, 0x75, 0x6d, 0x12, 0x12, 0x0a,
+	0x04, 0x44, 0x61, 0x74, 0x61, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x44, 0x61, 0x74,
+	0x61, 0x12, 0x29, 0x0a, 0x0a, 0x50, 0x72, 0x6f, 0x70, 0x65, 0x72, 0x74, 0x69, 0x65, 0x73, 0x18,
+	0x0b, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x09, 0x2e, 0x50, 0x72, 0x6f, 0x70, 0x65, 0x72, 0x74, 0x79,
+	0x52, 0x0a, 0x50, 0x72, 0x6f, 0x70, 0x65, 0x72, 0x74, 0x69, 0x65, 0x73, 0x32, 0xd5, 0x01, 0x0a,
+	0x09, 0x54, 0x72, 0x61, 0x6e, 0x73, 0x70, 0x6f, 0x72, 0x74, 0x12, 0x24, 0x0a, 0x0b, 0x50, 0x75,
+	0x73, 0x68, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x12, 0x08, 0x2e, 0x43, 0x6f, 0x6e, 0x6e,
+	0x65, 0x63, 0x74, 0x1a, 0x09, 0x2e, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00,
+	0x12, 0x2a, 0x0a, 0x0e, 0x50, 0x75, 0x73, 0x68, 0x44, 0x69, 0x73, 0x63, 0x6f, 0x6e, 0x6e, 0x65,
+	0x63, 0x74, 0x12, 0x0b, 0x2e, 0x44, 0x69, 0x73, 0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x1a,
+	0x09, 0x2e, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x24, 0x0a, 0x0b,
+	0x50, 0x75, 0x73, 0x68, 0x50, 0x75, 0x62, 0x6c, 0x69, 0x73, 0x68, 0x12, 0x08, 0x2e, 0x50, 0x75,
+	0x62, 0x6c, 0x69, 0x73, 0x68, 0x1a, 0x09, 0x2e, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
+	0x22, 0x00, 0x12, 0x2e, 0x0a, 0x10, 0x50, 0x75, 0x73, 0x68, 0x50, 0x75, 0x62, 0x6c, 0x69, 0x73,
+	0x68, 0x42, 0x61, 0x74, 0x63, 0x68, 0x12, 0x0d, 0x2e, 0x50, 0x75, 0x62, 0x6c, 0x69, 0x73, 0x68,
+	0x42, 0x61, 0x74, 0x63, 0x68, 0x1a, 0x09, 0x2e, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
+	0x22, 0x00, 0x12, 0x20, 0x0a, 0x09, 0x50, 0x75, 0x73, 0x68, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x12,
+	0x06, 0x2e, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x1a, 0x09, 0x2e, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e,
+	0x73, 0x65, 0x22, 0x00, 0x42, 0x0c, 0x5a, 0x0a, 0x2f, 0x74, 0x72, 0x61, 0x6e, 0x73, 0x70, 0x6f,
+	0x72, 0x74, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -316,25 +593,35 @@ func file_rptransport_proto_rawDescGZIP() []byte {
 	return file_rptransport_proto_rawDescData
 }
 
-var file_rptransport_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_rptransport_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
 var file_rptransport_proto_goTypes = []interface{}{
-	(*Response)(nil),   // 0: Response
-	(*Connect)(nil),    // 1: Connect
-	(*Disconnect)(nil), // 2: Disconnect
-	(*Publish)(nil),    // 3: Publish
+	(*Response)(nil),     // 0: Response
+	(*Connect)(nil),      // 1: Connect
+	(*Disconnect)(nil),   // 2: Disconnect
+	(*Property)(nil),     // 3: Property
+	(*Publish)(nil),      // 4: Publish
+	(*PublishBatch)(nil), // 5: PublishBatch
+	(*Chunk)(nil),        // 6: Chunk
 }
 var file_rptransport_proto_depIdxs = []int32{
-	1, // 0: Transport.PushConnect:input_type -> Connect
-	2, // 1: Transport.PushDisconnect:input_type -> Disconnect
-	3, // 2: Transport.PushPublish:input_type -> Publish
-	0, // 3: Transport.PushConnect:output_type -> Response
-	0, // 4: Transport.PushDisconnect:output_type -> Response
-	0, // 5: Transport.PushPublish:output_type -> Response
-	3, // [3:6] is the sub-list for method output_type
-	0, // [0:3] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	3, // 0: Publish.Properties:type_name -> Property
+	4, // 1: PublishBatch.Publishes:type_name -> Publish
+	3, // 2: Chunk.Properties:type_name -> Property
+	1, // 3: Transport.PushConnect:input_type -> Connect
+	2, // 4: Transport.PushDisconnect:input_type -> Disconnect
+	4, // 5: Transport.PushPublish:input_type -> Publish
+	5, // 6: Transport.PushPublishBatch:input_type -> PublishBatch
+	6, // 7: Transport.PushChunk:input_type -> Chunk
+	0, // 8: Transport.PushConnect:output_type -> Response
+	0, // 9: Transport.PushDisconnect:output_type -> Response
+	0, // 10: Transport.PushPublish:output_type -> Response
+	0, // 11: Transport.PushPublishBatch:output_type -> Response
+	0, // 12: Transport.PushChunk:output_type -> Response
+	8, // [8:13] is the sub-list for method output_type
+	3, // [3:8] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
 }
 
 func init() { file_rptransport_proto_init() }
@@ -380,6 +667,18 @@ func file_rptransport_proto_init() {
 			}
 		}
 		file_rptransport_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Property); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_rptransport_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*Publish); i {
 			case 0:
 				return &v.state
@@ -391,6 +690,30 @@ func file_rptransport_proto_init() {
 				return nil
 			}
 		}
+		file_rptransport_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PublishBatch); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_rptransport_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Chunk); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -398,7 +721,7 @@ func file_rptransport_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_rptransport_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   4,
+			NumMessages:   7,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
@@ -427,6 +750,8 @@ type TransportClient interface {
 	PushConnect(ctx context.Context, in *Connect, opts ...grpc.CallOption) (*Response, error)
 	PushDisconnect(ctx context.Context, in *Disconnect, opts ...grpc.CallOption) (*Response, error)
 	PushPublish(ctx context.Context, in *Publish, opts ...grpc.CallOption) (*Response, error)
+	PushPublishBatch(ctx context.Context, in *PublishBatch, opts ...grpc.CallOption) (*Response, error)
+	PushChunk(ctx context.Context, in *Chunk, opts ...grpc.CallOption) (*Response, error)
 }
 
 type transportClient struct {
@@ -464,11 +789,31 @@ func (c *transportClient) PushPublish(ctx context.Context, in *Publish, opts ...
 	return out, nil
 }
 
+func (c *transportClient) PushPublishBatch(ctx context.Context, in *PublishBatch, opts ...grpc.CallOption) (*Response, error) {
+	out := new(Response)
+	err := c.cc.Invoke(ctx, "/Transport/PushPublishBatch", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *transportClient) PushChunk(ctx context.Context, in *Chunk, opts ...grpc.CallOption) (*Response, error) {
+	out := new(Response)
+	err := c.cc.Invoke(ctx, "/Transport/PushChunk", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // TransportServer is the server API for Transport service.
 type TransportServer interface {
 	PushConnect(context.Context, *Connect) (*Response, error)
 	PushDisconnect(context.Context, *Disconnect) (*Response, error)
 	PushPublish(context.Context, *Publish) (*Response, error)
+	PushPublishBatch(context.Context, *PublishBatch) (*Response, error)
+	PushChunk(context.Context, *Chunk) (*Response, error)
 }
 
 // UnimplementedTransportServer can be embedded to have forward compatible implementations.
@@ -484,6 +829,12 @@ func (*UnimplementedTransportServer) PushDisconnect(context.Context, *Disconnect
 func (*UnimplementedTransportServer) PushPublish(context.Context, *Publish) (*Response, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method PushPublish not implemented")
 }
+func (*UnimplementedTransportServer) PushPublishBatch(context.Context, *PublishBatch) (*Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PushPublishBatch not implemented")
+}
+func (*UnimplementedTransportServer) PushChunk(context.Context, *Chunk) (*Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PushChunk not implemented")
+}
 
 func RegisterTransportServer(s *grpc.Server, srv TransportServer) {
 	s.RegisterService(&_Transport_serviceDesc, srv)
@@ -543,6 +894,42 @@ func _Transport_PushPublish_Handler(srv interface{}, ctx context.Context, dec fu
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Transport_PushPublishBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PublishBatch)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TransportServer).PushPublishBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Transport/PushPublishBatch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TransportServer).PushPublishBatch(ctx, req.(*PublishBatch))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Transport_PushChunk_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Chunk)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TransportServer).PushChunk(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Transport/PushChunk",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TransportServer).PushChunk(ctx, req.(*Chunk))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _Transport_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "Transport",
 	HandlerType: (*TransportServer)(nil),
@@ -559,6 +946,14 @@ var _Transport_serviceDesc = grpc.ServiceDesc{
 			MethodName: "PushPublish",
 			Handler:    _Transport_PushPublish_Handler,
 		},
+		{
+			MethodName: "PushPublishBatch",
+			Handler:    _Transport_PushPublishBatch_Handler,
+		},
+		{
+			MethodName: "PushChunk",
+			Handler:    _Transport_PushChunk_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "rptransport.proto",
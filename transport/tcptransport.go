@@ -0,0 +1,693 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/werbenhu/bridgemq/agent"
+)
+
+const (
+	// tcpQueueSize is the number of frames queued for a remote agent in a lane, the pushes wait while the lane is full
+	tcpQueueSize = 4096
+
+	// tcpWindow is the number of frames written to a connection and not acknowledged yet, the writer waits
+	// while the window is full so that the frames wait in the lanes where the higher priorities overtake them
+	tcpWindow = 1024
+
+	// tcpAckEvery is the number of frames handled between two acks while more frames are buffered
+	tcpAckEvery = tcpWindow / 4
+
+	// tcpBufferSize is the size of the read and write buffers of a connection
+	tcpBufferSize = 64 * 1024
+
+	// tcpTimeout bounds a dial, a write and the wait for the acks of a peer stopped
+	tcpTimeout = 5 * time.Second
+)
+
+type TcpOpt struct {
+	Port string
+
+	// Name is the name of the local agent, it is sent to the other agents when connecting
+	Name string
+
+	// TLS enables tls on the pipe when it is not nil, it is the config of the listener and of the
+	// connections to the other agents, so it holds the certificate of the agent, the RootCAs verifying
+	// the other agents and the ClientCAs and ClientAuth verifying the agents connecting
+	TLS *tls.Config
+
+	// Token is a secret shared by the agents, it is sent in the hello frame and the connections
+	// without it are closed when it is set. With mutual tls, the common name of the certificate
+	// of an agent must be its name.
+	Token string
+
+	// Members reports whether an agent is a member of the cluster, the connections of the other agents are
+	// closed when a token or mutual tls is used. The agents joined to the transport are the members if it is nil.
+	Members func(id string) bool
+
+	// KeepAlive is the period of the tcp keepalives of the connections to the other agents
+	KeepAlive time.Duration
+
+	// Backoff is the delay before reconnecting a lost connection, doubled with a jitter on every failed attempt
+	// up to MaxBackoff. It is reset once a connection is acknowledged by the agent.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// MaxMsgSize is the maximum size of a frame, a larger frame read closes the connection. The payloads
+	// larger than ChunkSize are split into chunk frames reassembled by the receiver, a transfer whose
+	// next chunk is not received within ChunkTimeout is dropped. The payloads larger than MaxPayloadSize
+	// are neither sent nor reassembled.
+	MaxMsgSize     int
+	MaxPayloadSize int
+	ChunkSize      int
+	ChunkTimeout   time.Duration
+
+	// Weights are the frames of each priority written in a round of the weighted scheduling of a
+	// connection, the priorities are scheduled strictly if it is empty
+	Weights []int
+
+	Logger *zerolog.Logger
+}
+
+// TcpTransport is a transport over plain tcp with a compact binary framing, it needs less memory
+// and cpu per message than the grpc transport. The frames sent to an agent are pipelined on a single
+// connection and acknowledged in batches, the frames not acknowledged when the connection is lost are dropped.
+type TcpTransport struct {
+	opts    *TcpOpt
+	handler Handler
+	logger  *zerolog.Logger
+
+	listener net.Listener
+	peers    sync.Map
+
+	// inbound are the connections of the other agents with the id of the agent once it sent its hello,
+	// they are closed when the agent leaves and by Stop
+	inbound sync.Map
+
+	// pushing is the number of frames queued or not acknowledged yet, Flush waits for it to drop to zero
+	pushing atomic.Int64
+
+	// serving is set while the listener is accepting connections,
+	// the new connections are refused while accepting is not set
+	serving   atomic.Bool
+	accepting atomic.Bool
+
+	// chunks reassembles the chunked publishes received, transfers numbers the chunked publishes sent
+	chunks    *assembler
+	transfers atomic.Uint64
+
+	// auth authenticates the agents connecting when a token or mutual tls is used
+	auth *authenticator
+}
+
+// tcpFrame is an encoded frame queued for a remote agent, at is set if it is delayed until then
+type tcpFrame struct {
+	buf []byte
+	at  time.Time
+}
+
+// tcpPeer is the connection to a remote agent, it is reconnected with a backoff until it is stopped
+type tcpPeer struct {
+	id   string
+	addr string
+
+	agent atomic.Pointer[agent.Agent]
+	lanes *lanes[tcpFrame]
+	done  chan struct{}
+
+	// unacked is the number of frames written and not acknowledged on the current connection
+	unacked atomic.Int64
+
+	stateLock sync.Mutex
+	state     PeerState
+}
+
+func NewTcpTransport(opts *TcpOpt) *TcpTransport {
+	t := &TcpTransport{
+		opts:   opts,
+		logger: opts.Logger,
+	}
+	if t.logger == nil {
+		logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
+		t.logger = &logger
+	}
+	if opts.KeepAlive <= 0 {
+		opts.KeepAlive = defaultKeepAlive
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = defaultBackoff
+	}
+	if opts.MaxBackoff < opts.Backoff {
+		opts.MaxBackoff = defaultMaxBackoff
+		if opts.MaxBackoff < opts.Backoff {
+			opts.MaxBackoff = opts.Backoff
+		}
+	}
+	chunkDefaults(&opts.MaxMsgSize, &opts.MaxPayloadSize, &opts.ChunkSize, &opts.ChunkTimeout)
+	t.chunks = newAssembler(opts.ChunkTimeout, opts.MaxPayloadSize, t.logger)
+	members := opts.Members
+	if members == nil {
+		members = func(id string) bool {
+			_, ok := t.peers.Load(id)
+			return ok
+		}
+	}
+	t.auth = newAuthenticator(opts.Token, opts.TLS, members, t.logger)
+	t.accepting.Store(true)
+	return t
+}
+
+func (t *TcpTransport) SetHandler(h Handler) {
+	t.handler = h
+}
+
+// Join() is called When a new agent is discovered by the discovery
+func (t *TcpTransport) Join(node *agent.Agent) {
+	t.connect(node, "agent has joined")
+}
+
+// Leave() is called When a agent is left, the connections of the agent to this agent are closed
+func (t *TcpTransport) Leave(node *agent.Agent) {
+	if p, ok := t.peers.LoadAndDelete(node.Id); ok {
+		t.logger.Info().Str("peer", node.Id).Str("addr", p.(*tcpPeer).addr).Msg("agent has left")
+		p.(*tcpPeer).stop()
+	}
+	t.inbound.Range(func(key any, val any) bool {
+		if val.(string) == node.Id {
+			key.(net.Conn).Close()
+		}
+		return true
+	})
+}
+
+// Update() is called When a agent updated, the connection is replaced if its address or its pipe port changed
+func (t *TcpTransport) Update(node *agent.Agent) {
+	t.connect(node, "agent was updated")
+}
+
+// connect starts a peer for the agent unless it is connected to the same address, the old
+// peer of an agent whose address changed sends the frames it has queued before closing
+func (t *TcpTransport) connect(node *agent.Agent, msg string) {
+	addr := net.JoinHostPort(node.Addr, node.PipePort)
+	var old *tcpPeer
+	if val, ok := t.peers.Load(node.Id); ok {
+		old = val.(*tcpPeer)
+		if old.addr == addr {
+			old.agent.Store(node)
+			return
+		}
+	}
+
+	p := &tcpPeer{
+		id:    node.Id,
+		addr:  addr,
+		lanes: newLanes[tcpFrame](tcpQueueSize, t.opts.Weights, func(f tcpFrame) time.Time { return f.at }),
+		done:  make(chan struct{}),
+		state: StateConnecting,
+	}
+	p.agent.Store(node)
+	t.peers.Store(node.Id, p)
+	go t.run(p)
+
+	if old == nil {
+		t.logger.Info().Str("peer", node.Id).Str("addr", addr).Msg(msg)
+		return
+	}
+	t.logger.Info().Str("peer", node.Id).Str("addr", addr).Str("old_addr", old.addr).Msg("agent address changed, connection replaced")
+	old.stop()
+}
+
+// PushConnect transmit a connect frame to the remote agents with the high priority
+func (t *TcpTransport) PushConnect(local *agent.Agent, clientId string) {
+	t.push(local, PriorityHigh, nil, &frame{Type: FrameConnect, ClientId: clientId})
+}
+
+// PushDisconnect transmit a disconnect frame to the remote agents with the high priority
+func (t *TcpTransport) PushDisconnect(local *agent.Agent, clientId string) {
+	t.push(local, PriorityHigh, nil, &frame{Type: FrameDisconnect, ClientId: clientId})
+}
+
+// PushPublish transmit a publish frame to the remote agents with the normal priority
+func (t *TcpTransport) PushPublish(local *agent.Agent, topic string, payload []byte, qos byte, retain bool) {
+	t.PushPublishPriority(local, topic, payload, qos, retain, PriorityNormal)
+}
+
+// PushPublishPriority transmit a publish frame to the remote agents in the lane of its priority
+func (t *TcpTransport) PushPublishPriority(local *agent.Agent, topic string, payload []byte, qos byte, retain bool, priority Priority) {
+	t.PushPublishTo(local, "", &Publish{Topic: topic, Payload: payload, Qos: int32(qos), Retain: retain}, priority)
+}
+
+// PushPublishTo transmit a publish frame with its user properties to the agent, or to every remote agent
+// if id is empty, in the lane of its priority. The payloads larger than ChunkSize are sent in chunk frames.
+func (t *TcpTransport) PushPublishTo(local *agent.Agent, id string, p *Publish, priority Priority) {
+	p.AgentId = local.Id
+	if len(p.Payload) > t.opts.MaxPayloadSize {
+		t.logger.Warn().Str("topic", p.Topic).Int("size", len(p.Payload)).Int("max_size", t.opts.MaxPayloadSize).Msg("tcp transport publish dropped, payload too large")
+		return
+	}
+	allow := func(key string) (time.Duration, bool) {
+		if id != "" && key != id {
+			return 0, false
+		}
+		if h, ok := t.handler.(OutboundHandler); ok {
+			return h.OnPushPublish(key, p.Topic, p.Payload, byte(p.Qos), p.Retain)
+		}
+		return 0, true
+	}
+	if len(p.Payload) <= t.opts.ChunkSize {
+		t.push(local, priority, allow, &frame{Type: FramePublish, Topic: p.Topic, Payload: p.Payload, Qos: byte(p.Qos), Retain: p.Retain, Properties: p.Properties})
+		return
+	}
+	chunks := split(t.transfers.Add(1), p, t.opts.ChunkSize)
+	frames := make([]*frame, 0, len(chunks))
+	for _, c := range chunks {
+		frames = append(frames, &frame{Type: FrameChunk, Chunk: c})
+	}
+	t.push(local, priority, allow, frames...)
+}
+
+// push queues the frames in order in the lane of the priority for every remote agent allowed, they are encoded
+// once. allow returns whether the frames are pushed to an agent and the delay before they are written.
+func (t *TcpTransport) push(local *agent.Agent, priority Priority, allow func(id string) (time.Duration, bool), frames ...*frame) {
+	bufs := make([][]byte, 0, len(frames))
+	for _, f := range frames {
+		bufs = append(bufs, f.encode())
+	}
+	t.peers.Range(func(key any, val any) bool {
+		if local.IsSelf(key.(string)) {
+			return true
+		}
+		var at time.Time
+		if allow != nil {
+			delay, ok := allow(key.(string))
+			if !ok {
+				return true
+			}
+			if delay > 0 {
+				at = time.Now().Add(delay)
+			}
+		}
+		for _, buf := range bufs {
+			t.pushing.Add(1)
+			if !val.(*tcpPeer).lanes.enqueue(priority, tcpFrame{buf: buf, at: at}) {
+				t.pushing.Add(-1)
+				break
+			}
+		}
+		return true
+	})
+}
+
+// Flush waits until the frames queued are acknowledged or dropped, or ctx is done
+func (t *TcpTransport) Flush(ctx context.Context) error {
+	return waitIdle(ctx, &t.pushing)
+}
+
+// Start binds the pipe listener and serves it in the background
+func (t *TcpTransport) Start() error {
+	listener, err := net.Listen("tcp", ":"+t.opts.Port)
+	if err != nil {
+		return fmt.Errorf("tcp transport listen port:%s err:%s", t.opts.Port, err.Error())
+	}
+	if t.opts.TLS != nil {
+		listener = tls.NewListener(listener, t.opts.TLS)
+	}
+	t.listener = listener
+
+	t.serving.Store(true)
+	go t.accept()
+	t.logger.Info().Str("port", t.opts.Port).Bool("tls", t.opts.TLS != nil).Bool("auth", t.auth.enabled()).Msg("tcp transport started")
+	return nil
+}
+
+func (t *TcpTransport) Stop() {
+	t.accepting.Store(false)
+	if t.listener != nil {
+		t.listener.Close()
+	}
+	t.peers.Range(func(key any, val any) bool {
+		p := val.(*tcpPeer)
+		p.stop()
+		<-p.done
+		t.peers.Delete(key)
+		return true
+	})
+	t.inbound.Range(func(key any, val any) bool {
+		key.(net.Conn).Close()
+		return true
+	})
+	t.chunks.close()
+}
+
+// Serving reports whether the pipe listener is accepting connections
+func (t *TcpTransport) Serving() bool {
+	return t.serving.Load()
+}
+
+// Peers returns the number of remote agents whose connection is ready and the number of remote agents
+func (t *TcpTransport) Peers() (int, int) {
+	ready, total := 0, 0
+	t.peers.Range(func(key any, val any) bool {
+		total++
+		if val.(*tcpPeer).State() == StateReady {
+			ready++
+		}
+		return true
+	})
+	return ready, total
+}
+
+// PeerStates returns the state of the connection to every remote agent
+func (t *TcpTransport) PeerStates() map[string]PeerState {
+	states := make(map[string]PeerState)
+	t.peers.Range(func(key any, val any) bool {
+		states[key.(string)] = val.(*tcpPeer).State()
+		return true
+	})
+	return states
+}
+
+// SetServing makes the listener accept or refuse the new connections of the other agents,
+// the established connections are kept
+func (t *TcpTransport) SetServing(serving bool) {
+	t.accepting.Store(serving)
+}
+
+// accept serves the connections of the other agents until the listener is closed
+func (t *TcpTransport) accept() {
+	defer t.serving.Store(false)
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				t.logger.Error().Err(err).Str("port", t.opts.Port).Msg("tcp transport accept failed")
+			}
+			return
+		}
+		if !t.accepting.Load() {
+			conn.Close()
+			continue
+		}
+		go t.serve(conn)
+	}
+}
+
+// serve handles the frames of an agent in order, the frames handled are acknowledged
+// whenever no more frame is buffered so that a burst is acknowledged at once
+func (t *TcpTransport) serve(conn net.Conn) {
+	t.inbound.Store(conn, "")
+	defer t.inbound.Delete(conn)
+	defer conn.Close()
+
+	r := bufio.NewReaderSize(conn, tcpBufferSize)
+	w := bufio.NewWriter(conn)
+	hello, err := readFrame(r, t.opts.MaxMsgSize)
+	if err != nil || hello.Type != FrameHello {
+		t.logger.Warn().Err(err).Str("remote", conn.RemoteAddr().String()).Msg("tcp transport expected a hello frame")
+		return
+	}
+	id := hello.AgentId
+	if t.auth.enabled() {
+		var certs [][]*x509.Certificate
+		if c, ok := conn.(*tls.Conn); ok {
+			certs = c.ConnectionState().VerifiedChains
+		}
+		if id, err = t.auth.identify(hello.AgentId, hello.Token, certs); err != nil {
+			t.logger.Warn().Err(err).Str("remote", conn.RemoteAddr().String()).Msg("tcp transport connection of an unauthenticated agent closed")
+			return
+		}
+	}
+
+	// the connection is closed if the agent leaves after its hello is checked
+	t.inbound.Store(conn, id)
+	if t.auth.enabled() && !t.auth.members(id) {
+		return
+	}
+
+	// the hello is acknowledged with an ack of no frame
+	conn.SetWriteDeadline(time.Now().Add(tcpTimeout))
+	w.Write((&frame{Type: FrameAck, Ack: 0}).encode())
+	if err := w.Flush(); err != nil {
+		t.logger.Warn().Err(err).Str("peer", id).Msg("tcp transport write ack failed")
+		return
+	}
+
+	var handled uint64
+	for {
+		f, err := readFrame(r, t.opts.MaxMsgSize)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) {
+				t.logger.Warn().Err(err).Str("peer", id).Msg("tcp transport read frame failed")
+			}
+			return
+		}
+
+		if t.handler != nil {
+			switch f.Type {
+			case FrameConnect:
+				t.handler.OnConnect(id, f.ClientId)
+			case FrameDisconnect:
+				t.handler.OnDisConnect(id, f.ClientId)
+			case FramePublish:
+				deliver(t.handler, id, &Publish{AgentId: id, Topic: f.Topic, Payload: f.Payload, Qos: int32(f.Qos), Retain: f.Retain, Properties: f.Properties})
+			case FrameChunk:
+				f.Chunk.AgentId = id
+				p, err := t.chunks.add(f.Chunk)
+				if err != nil {
+					t.logger.Warn().Err(err).Str("peer", id).Str("topic", f.Chunk.Topic).Msg("tcp transport chunk dropped")
+				} else if p != nil {
+					deliver(t.handler, id, p)
+				}
+			}
+		}
+		handled++
+
+		if r.Buffered() == 0 || handled%tcpAckEvery == 0 {
+			conn.SetWriteDeadline(time.Now().Add(tcpTimeout))
+			w.Write((&frame{Type: FrameAck, Ack: handled}).encode())
+			if err := w.Flush(); err != nil {
+				t.logger.Warn().Err(err).Str("peer", id).Msg("tcp transport write ack failed")
+				return
+			}
+		}
+	}
+}
+
+// run connects to the agent and writes the frames queued until the peer is stopped, the frames
+// queued while the agent can not be reached are dropped so that the pushes do not block. The peer
+// is ready once the agent acknowledged the hello, the backoff is reset only then so that an agent
+// closing the connections at once is not dialed in a loop.
+func (t *TcpTransport) run(p *tcpPeer) {
+	defer close(p.done)
+	backoff := t.opts.Backoff
+	for {
+		conn, err := t.dial(p.addr)
+		if err != nil {
+			t.setState(p, StateDown)
+			t.logger.Debug().Err(err).Str("peer", p.id).Str("addr", p.addr).Dur("backoff", backoff).Msg("tcp transport dial agent failed")
+		} else {
+			var ready atomic.Bool
+			stopped, err := t.write(p, conn, func() {
+				ready.Store(true)
+				t.setState(p, StateReady)
+			})
+			if lost := p.unacked.Swap(0); lost > 0 {
+				t.pushing.Add(-lost)
+				t.logger.Warn().Str("peer", p.id).Int64("frames", lost).Msg("tcp transport frames not acknowledged were dropped")
+			}
+			if stopped {
+				return
+			}
+			if ready.Load() {
+				backoff = t.opts.Backoff
+			}
+			t.setState(p, StateDown)
+			t.logger.Warn().Err(err).Str("peer", p.id).Str("addr", p.addr).Dur("backoff", backoff).Msg("tcp transport connection lost")
+		}
+
+		if !t.dropWhile(p, backoff) {
+			return
+		}
+		if backoff *= 2; backoff > t.opts.MaxBackoff {
+			backoff = t.opts.MaxBackoff
+		}
+	}
+}
+
+func (t *TcpTransport) dial(addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   tcpTimeout,
+		KeepAlive: t.opts.KeepAlive,
+	}
+	if t.opts.TLS != nil {
+		return tls.DialWithDialer(dialer, "tcp", addr, t.opts.TLS)
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+// write writes the frames queued to the connection in the order scheduled by the lanes until it fails or
+// the peer is stopped, the writes are buffered and flushed whenever the lanes are empty. It returns true
+// once the peer is stopped and the frames written are acknowledged. A delayed frame is held by the lanes
+// until its time, the other priorities are written meanwhile. hello is called when the agent acknowledges
+// the hello.
+func (t *TcpTransport) write(p *tcpPeer, conn net.Conn, hello func()) (bool, error) {
+	defer conn.Close()
+	w := bufio.NewWriterSize(conn, tcpBufferSize)
+	conn.SetWriteDeadline(time.Now().Add(tcpTimeout))
+	w.Write((&frame{Type: FrameHello, AgentId: t.opts.Name, Token: t.opts.Token}).encode())
+	if err := w.Flush(); err != nil {
+		return false, err
+	}
+
+	// broken is closed with failed set once the connection fails
+	var failed error
+	broken := make(chan struct{})
+	window := make(chan struct{}, 1)
+	go func() {
+		failed = t.readAcks(p, conn, window, hello)
+		close(broken)
+	}()
+
+	for {
+		for p.unacked.Load() >= tcpWindow {
+			if err := w.Flush(); err != nil {
+				return false, err
+			}
+			select {
+			case <-window:
+			case <-broken:
+				return false, failed
+			}
+		}
+		f, _, state := p.lanes.next(nil, broken)
+		switch state {
+		case laneStopped:
+			if err := w.Flush(); err != nil {
+				return true, err
+			}
+			t.waitAcks(p, broken)
+			return true, nil
+		case laneAborted:
+			return false, failed
+		}
+		conn.SetWriteDeadline(time.Now().Add(tcpTimeout))
+		if _, err := w.Write(f.buf); err != nil {
+			t.pushing.Add(-1)
+			return false, err
+		}
+		p.unacked.Add(1)
+		if p.lanes.len() == 0 {
+			if err := w.Flush(); err != nil {
+				return false, err
+			}
+		}
+	}
+}
+
+// readAcks reads the acks of the agent until the connection fails, window is signaled on every ack. The
+// first ack acknowledges the hello, hello is called then.
+func (t *TcpTransport) readAcks(p *tcpPeer, conn net.Conn, window chan struct{}, hello func()) error {
+	r := bufio.NewReader(conn)
+	var acked uint64
+	for {
+		f, err := readFrame(r, t.opts.MaxMsgSize)
+		if err != nil {
+			return err
+		}
+		if f.Type != FrameAck || f.Ack < acked {
+			return fmt.Errorf("unexpected frame type:%d", f.Type)
+		}
+		if hello != nil {
+			hello()
+			hello = nil
+		}
+		n := int64(f.Ack - acked)
+		acked = f.Ack
+		p.unacked.Add(-n)
+		t.pushing.Add(-n)
+		select {
+		case window <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// waitAcks waits until the frames written are acknowledged, the connection fails or tcpTimeout
+func (t *TcpTransport) waitAcks(p *tcpPeer, broken chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), tcpTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-broken:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	waitIdle(ctx, &p.unacked)
+}
+
+// dropWhile drops the frames queued during the backoff with a jitter, it is false if the peer is stopped
+func (t *TcpTransport) dropWhile(p *tcpPeer, backoff time.Duration) bool {
+	timer := time.NewTimer(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+	defer timer.Stop()
+	dropped := 0
+	defer func() {
+		if dropped > 0 {
+			t.logger.Warn().Str("peer", p.id).Int("frames", dropped).Msg("tcp transport frames dropped, agent can not be reached")
+		}
+	}()
+	for {
+		if _, _, state := p.lanes.next(timer.C, nil); state != laneItem {
+			return state == laneTimeout
+		}
+		t.pushing.Add(-1)
+		dropped++
+	}
+}
+
+// setState changes the state of the peer and reports it to the handler
+func (t *TcpTransport) setState(p *tcpPeer, state PeerState) {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	old := p.state
+	if old == state {
+		return
+	}
+	p.state = state
+
+	event := t.logger.Info()
+	if state == StateDown {
+		event = t.logger.Warn()
+	}
+	event.Str("peer", p.id).Str("addr", p.addr).Str("from", string(old)).Str("to", string(state)).Msg("pipe connection state changed")
+	if val, ok := t.peers.Load(p.id); !ok || val.(*tcpPeer) != p {
+		return
+	}
+	if h, ok := t.handler.(StateHandler); ok {
+		h.OnPeerState(p.id, state)
+	}
+}
+
+// State returns the state of the connection
+func (p *tcpPeer) State() PeerState {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	return p.state
+}
+
+// stop closes the lanes, the frames queued are still sent if the agent is connected
+func (p *tcpPeer) stop() {
+	p.lanes.stop()
+}
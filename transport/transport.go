@@ -1,6 +1,12 @@
 package transport
 
-import "github.com/werbenhu/bridgemq/agent"
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/werbenhu/bridgemq/agent"
+)
 
 type Handler interface {
 	OnConnect(id string, clientId string)
@@ -8,6 +14,40 @@ type Handler interface {
 	OnPublish(id string, topic string, payload []byte, qos byte, retain bool)
 }
 
+// StateHandler is implemented by the handlers which follow the state of the pipe connections.
+type StateHandler interface {
+	// OnPeerState is called in order when the state of the connection to a remote agent changes, it must not block.
+	OnPeerState(id string, state PeerState)
+}
+
+// OutboundHandler is implemented by the handlers which control the publishes pushed to the remote agents.
+type OutboundHandler interface {
+	// OnPushPublish is called before a publish is queued for a remote agent, it must not block. The publish is
+	// not sent to the agent if it returns false, otherwise it is sent once the delay returned has elapsed. The
+	// delay holds the lane of its priority to the agent only, the next publishes of the lane wait behind the
+	// publish delayed while the other priorities are sent.
+	OnPushPublish(id string, topic string, payload []byte, qos byte, retain bool) (time.Duration, bool)
+}
+
+// MessageHandler is implemented by the handlers which receive the user properties of the publishes.
+type MessageHandler interface {
+	// OnPublishMessage is called instead of OnPublish with the publish received from the agent.
+	OnPublishMessage(id string, p *Publish)
+}
+
+// Prioritizer is implemented by the transports which queue the publishes by priority.
+type Prioritizer interface {
+	// PushPublishPriority transmit a publish in the lane of its priority, the order is kept within a lane.
+	PushPublishPriority(local *agent.Agent, topic string, payload []byte, qos byte, retain bool, priority Priority)
+}
+
+// Router is implemented by the transports which push a publish with its user properties to a chosen agent.
+type Router interface {
+	// PushPublishTo transmit a publish in the lane of its priority to the agent, or to every remote agent if
+	// id is empty. The AgentId of the publish is set to the local agent.
+	PushPublishTo(local *agent.Agent, id string, p *Publish, priority Priority)
+}
+
 type Transport interface {
 	Join(node *agent.Agent)
 	Leave(node *agent.Agent)
@@ -16,6 +56,43 @@ type Transport interface {
 	PushConnect(local *agent.Agent, clientId string)
 	PushDisconnect(local *agent.Agent, clientId string)
 	PushPublish(local *agent.Agent, topic string, payload []byte, qos byte, retain bool)
+	// Flush waits until the messages being pushed to the remote agents are sent or ctx is done
+	Flush(ctx context.Context) error
 	Start() error
 	Stop()
 }
+
+// Status is implemented by the transports which report their health.
+type Status interface {
+	// Serving reports whether the transport is accepting the messages of the remote agents.
+	Serving() bool
+	// Peers returns the number of remote agents whose connection is ready and the number of remote agents.
+	Peers() (ready int, total int)
+	// PeerStates returns the state of the connection to every remote agent.
+	PeerStates() map[string]PeerState
+	// SetServing changes the status reported to the health checks of the remote agents.
+	SetServing(serving bool)
+}
+
+// deliver hands a publish received from an agent to the handler, with its user properties if the handler takes them
+func deliver(h Handler, id string, p *Publish) {
+	if mh, ok := h.(MessageHandler); ok {
+		mh.OnPublishMessage(id, p)
+		return
+	}
+	h.OnPublish(id, p.Topic, p.Payload, byte(p.Qos), p.Retain)
+}
+
+// waitIdle waits until the counter drops to zero or ctx is done
+func waitIdle(ctx context.Context, counter *atomic.Int64) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for counter.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
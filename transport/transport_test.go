@@ -0,0 +1,185 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/werbenhu/bridgemq/agent"
+)
+
+// countHandler counts the publishes received
+type countHandler struct {
+	publishes atomic.Int64
+}
+
+func (h *countHandler) OnConnect(id string, clientId string)    {}
+func (h *countHandler) OnDisConnect(id string, clientId string) {}
+func (h *countHandler) OnPublish(id string, topic string, payload []byte, qos byte, retain bool) {
+	h.publishes.Add(1)
+}
+
+// freePort returns a tcp port free on the loopback
+func freePort(tb testing.TB) string {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+func nopLogger() *zerolog.Logger {
+	logger := zerolog.Nop()
+	return &logger
+}
+
+// startPair starts the transports of the agents a and b and joins them to each other, ha is the handler
+// of a, a countHandler if it is nil. It returns the local agent of a and the handler of b.
+func startPair(tb testing.TB, a Transport, ha Handler, b Transport, portA string, portB string) (*agent.Agent, *countHandler) {
+	tb.Helper()
+	if ha == nil {
+		ha = new(countHandler)
+	}
+	a.SetHandler(ha)
+	h := new(countHandler)
+	b.SetHandler(h)
+	for _, t := range []Transport{a, b} {
+		if err := t.Start(); err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(t.Stop)
+	}
+	a.Join(agent.New("b", "127.0.0.1", 0, portB))
+	b.Join(agent.New("a", "127.0.0.1", 0, portA))
+	return agent.New("a", "127.0.0.1", 0, ""), h
+}
+
+// waitCount waits until the handler has received n publishes
+func waitCount(tb testing.TB, h *countHandler, n int64) {
+	tb.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for h.publishes.Load() < n {
+		if time.Now().After(deadline) {
+			tb.Fatalf("received %d publishes of %d", h.publishes.Load(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// benchPush pushes b.N publishes of 32 bytes from a to b and waits until b received them
+func benchPush(b *testing.B, local *agent.Agent, a Transport, h *countHandler) {
+	payload := make([]byte, 32)
+	a.PushPublish(local, "warmup", payload, 0, false)
+	waitCount(b, h, 1)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		a.PushPublish(local, "bench/topic", payload, 0, false)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := a.Flush(ctx); err != nil {
+		b.Fatal(err)
+	}
+	waitCount(b, h, int64(b.N)+1)
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msg/s")
+}
+
+func BenchmarkRpcTransport(b *testing.B) {
+	for _, size := range []int{1, defaultBatchSize} {
+		b.Run("batch_size="+strconv.Itoa(size), func(b *testing.B) {
+			portA, portB := freePort(b), freePort(b)
+			a := NewRpcTransport(&Opt{Port: portA, Name: "a", BatchSize: size, Logger: nopLogger()})
+			local, h := startPair(b, a, nil, NewRpcTransport(&Opt{Port: portB, Name: "b", Logger: nopLogger()}), portA, portB)
+			benchPush(b, local, a, h)
+		})
+	}
+}
+
+func BenchmarkTcpTransport(b *testing.B) {
+	portA, portB := freePort(b), freePort(b)
+	a := NewTcpTransport(&TcpOpt{Port: portA, Name: "a", Logger: nopLogger()})
+	local, h := startPair(b, a, nil, NewTcpTransport(&TcpOpt{Port: portB, Name: "b", Logger: nopLogger()}), portA, portB)
+	benchPush(b, local, a, h)
+}
+
+func TestTcpTransportHello(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		ready bool
+	}{
+		{"acknowledged", "secret", true},
+		{"rejected", "wrong", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			portA, portB := freePort(t), freePort(t)
+			a := NewTcpTransport(&TcpOpt{Port: portA, Name: "a", Token: tt.token, Backoff: 10 * time.Millisecond, Logger: nopLogger()})
+			startPair(t, a, nil, NewTcpTransport(&TcpOpt{Port: portB, Name: "b", Token: "secret", Logger: nopLogger()}), portA, portB)
+
+			// the peer is ready once the hello is acknowledged, without any frame pushed
+			deadline := time.Now().Add(time.Second)
+			for a.PeerStates()["b"] != StateReady && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			if ready := a.PeerStates()["b"] == StateReady; ready != tt.ready {
+				t.Fatalf("expected ready %v, got state %s", tt.ready, a.PeerStates()["b"])
+			}
+		})
+	}
+}
+
+// delayHandler delays every publish pushed
+type delayHandler struct {
+	countHandler
+	delay time.Duration
+}
+
+func (h *delayHandler) OnPushPublish(id string, topic string, payload []byte, qos byte, retain bool) (time.Duration, bool) {
+	return h.delay, true
+}
+
+func TestOutboundDelay(t *testing.T) {
+	tests := []struct {
+		name string
+		new  func(port string, name string) Transport
+	}{
+		{"rpc", func(port string, name string) Transport {
+			return NewRpcTransport(&Opt{Port: port, Name: name, Logger: nopLogger()})
+		}},
+		{"tcp", func(port string, name string) Transport {
+			return NewTcpTransport(&TcpOpt{Port: port, Name: name, Logger: nopLogger()})
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			portA, portB := freePort(t), freePort(t)
+			a := tt.new(portA, "a")
+			local, h := startPair(t, a, &delayHandler{delay: 200 * time.Millisecond}, tt.new(portB, "b"), portA, portB)
+
+			// the publisher is not blocked by the delay, the publishes are received in order after it
+			start := time.Now()
+			for i := 0; i < 3; i++ {
+				a.PushPublish(local, "t", []byte{byte(i)}, 0, false)
+			}
+			if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+				t.Fatalf("the publisher was blocked for %s", elapsed)
+			}
+			waitCount(t, h, 3)
+			if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+				t.Fatalf("the publishes were received after %s, before their delay", elapsed)
+			}
+		})
+	}
+}
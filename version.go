@@ -0,0 +1,5 @@
+package bridgemq
+
+// Version is the version of bridgemq, it can be overridden at build time with
+// -ldflags "-X github.com/werbenhu/bridgemq.Version=x.y.z"
+var Version = "v0.2.0"
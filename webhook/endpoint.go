@@ -0,0 +1,323 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// endpoint batches the events of an endpoint and sends them, the requests which still fail after
+// their retries are kept in the spool and sent again by the retrier
+type endpoint struct {
+	*Endpoint
+	opts   *Opt
+	logger *zerolog.Logger
+
+	spool *spool
+	queue chan *Event
+	done  chan struct{}
+
+	// stopping aborts the backoffs and the retrier, workers counts the goroutines running
+	stopping chan struct{}
+	workers  sync.WaitGroup
+
+	// down is set while the requests are kept in the spool, the new requests are spooled without
+	// being sent until the retrier empties the spool. dropping is set while the events are dropped.
+	down     atomic.Bool
+	dropping atomic.Bool
+
+	sent    atomic.Uint64
+	dropped atomic.Uint64
+
+	// the emitters hold the read lock while queuing, stop closes the queue with the lock held
+	sync.RWMutex
+	stopped bool
+}
+
+func newEndpoint(e *Endpoint, opts *Opt, logger *zerolog.Logger) *endpoint {
+	l := logger.With().Str("webhook", e.URL).Logger()
+	return &endpoint{
+		Endpoint: e,
+		opts:     opts,
+		logger:   &l,
+		queue:    make(chan *Event, opts.QueueSize),
+		done:     make(chan struct{}),
+		stopping: make(chan struct{}),
+	}
+}
+
+// open opens the spool of the endpoint, in a directory of QueueDir named after the hash of the url
+func (e *endpoint) open() error {
+	if e.opts.QueueDir == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(e.URL))
+	s, err := openSpool(filepath.Join(e.opts.QueueDir, hex.EncodeToString(sum[:8])), int64(e.opts.QueueMaxBytes))
+	if err != nil {
+		return fmt.Errorf("webhook %s queue: %w", e.URL, err)
+	}
+	e.spool = s
+	e.down.Store(s.len() > 0)
+	return nil
+}
+
+func (e *endpoint) start() {
+	e.workers.Add(1)
+	go e.batch()
+	if e.spool != nil {
+		e.workers.Add(1)
+		go e.retry()
+	}
+}
+
+// stop sends the events queued and waits for the workers
+func (e *endpoint) stop() {
+	e.Lock()
+	if e.stopped {
+		e.Unlock()
+		return
+	}
+	e.stopped = true
+	close(e.queue)
+	e.Unlock()
+
+	close(e.stopping)
+	e.workers.Wait()
+}
+
+// enqueue queues an event, it is dropped if the queue is full or the endpoint is stopped
+func (e *endpoint) enqueue(ev *Event) {
+	e.RLock()
+	defer e.RUnlock()
+	if e.stopped {
+		return
+	}
+	select {
+	case e.queue <- ev:
+	default:
+		e.dropped.Add(1)
+		if e.dropping.CompareAndSwap(false, true) {
+			e.logger.Warn().Int("queue_size", e.opts.QueueSize).Msg("webhook queue is full, events are dropped")
+		}
+	}
+}
+
+// batch sends the events queued in batches of at most BatchSize events, a batch is sent
+// BatchLinger after its first event if it is not full before
+func (e *endpoint) batch() {
+	defer e.workers.Done()
+	pending := make([]*Event, 0, e.opts.BatchSize)
+
+	linger := time.NewTimer(e.opts.BatchLinger)
+	linger.Stop()
+	defer linger.Stop()
+
+	// flush drains the tick of a linger which fired while the batch was filled, it would flush the next batch early
+	flush := func() {
+		if !linger.Stop() {
+			select {
+			case <-linger.C:
+			default:
+			}
+		}
+		if len(pending) == 0 {
+			return
+		}
+		e.deliver(pending)
+		pending = make([]*Event, 0, e.opts.BatchSize)
+	}
+
+	for {
+		select {
+		case ev, ok := <-e.queue:
+			if !ok {
+				flush()
+				return
+			}
+			if len(pending) == 0 {
+				linger.Reset(e.opts.BatchLinger)
+			}
+			pending = append(pending, ev)
+			if len(pending) >= e.opts.BatchSize {
+				flush()
+			}
+		case <-linger.C:
+			flush()
+		}
+	}
+}
+
+// deliver sends a batch with its retries, the batch is spooled if it still fails or the endpoint is down
+func (e *endpoint) deliver(events []*Event) {
+	body, err := json.Marshal(events)
+	if err != nil {
+		e.drop(len(events), err)
+		return
+	}
+	if e.spool != nil && e.down.Load() {
+		e.keep(body, len(events))
+		return
+	}
+
+	backoff := e.opts.Backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := e.send(body)
+		if err == nil {
+			e.sent.Add(uint64(len(events)))
+			e.dropping.Store(false)
+			return
+		}
+		if !retry {
+			e.drop(len(events), err)
+			return
+		}
+		if attempt >= e.opts.Retries || !e.wait(backoff) {
+			if e.spool == nil {
+				e.drop(len(events), err)
+				return
+			}
+			e.logger.Warn().Err(err).Int("events", len(events)).Msg("webhook request failed, it is kept on disk")
+			e.down.Store(true)
+			e.keep(body, len(events))
+			return
+		}
+		e.logger.Debug().Err(err).Int("attempt", attempt+1).Dur("backoff", backoff).Msg("webhook request failed, retrying")
+		if backoff *= 2; backoff > e.opts.MaxBackoff {
+			backoff = e.opts.MaxBackoff
+		}
+	}
+}
+
+// wait waits for the backoff with a jitter, it is false if the endpoint is stopping
+func (e *endpoint) wait(backoff time.Duration) bool {
+	timer := time.NewTimer(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-e.stopping:
+		return false
+	}
+}
+
+// keep spools a request, the events of the oldest requests removed to make room for it are counted as dropped
+func (e *endpoint) keep(body []byte, events int) {
+	requests, evicted, err := e.spool.push(body, events)
+	e.dropped.Add(uint64(evicted))
+	if requests > 0 {
+		e.logger.Warn().Int("requests", requests).Int("events", evicted).Int("queue_max_bytes", e.opts.QueueMaxBytes).Msg("webhook queue on disk is full, the oldest requests are dropped")
+	}
+	if err != nil {
+		e.drop(events, err)
+	}
+}
+
+func (e *endpoint) drop(events int, err error) {
+	e.dropped.Add(uint64(events))
+	e.logger.Error().Err(err).Int("events", events).Msg("webhook request dropped")
+}
+
+// retry sends the spooled requests in order every RetryInterval, it stops at the first failure.
+// The endpoint is up again once the spool is empty.
+func (e *endpoint) retry() {
+	defer e.workers.Done()
+	ticker := time.NewTicker(e.opts.RetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stopping:
+			return
+		case <-ticker.C:
+		}
+		for {
+			f, body, err := e.spool.oldest()
+			if err != nil {
+				e.logger.Error().Err(err).Msg("webhook read queue on disk failed")
+				break
+			}
+			if f.name == "" {
+				if e.down.CompareAndSwap(true, false) {
+					e.logger.Info().Msg("webhook queue on disk sent, endpoint is up again")
+				}
+				break
+			}
+			retry, err := e.send(body)
+			if err != nil && retry {
+				e.logger.Debug().Err(err).Msg("webhook request on disk failed, retrying later")
+				break
+			}
+			if err != nil {
+				e.dropped.Add(uint64(f.events))
+				e.logger.Error().Err(err).Int("events", f.events).Msg("webhook request on disk rejected, it is dropped")
+			} else {
+				e.sent.Add(uint64(f.events))
+			}
+			e.spool.remove(f.name)
+		}
+	}
+}
+
+// send posts a request, retry reports whether a failed request may succeed later
+func (e *endpoint) send(body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+	if e.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(e.Secret, body))
+	}
+
+	resp, err := e.opts.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook response status %s", resp.Status)
+	}
+	return false, fmt.Errorf("webhook response status %s", resp.Status)
+}
+
+func (e *endpoint) stats() Stats {
+	s := Stats{
+		URL:     e.URL,
+		Sent:    e.sent.Load(),
+		Dropped: e.dropped.Load(),
+		Queued:  len(e.queue),
+	}
+	if e.spool != nil {
+		s.Spooled = e.spool.len()
+	}
+	return s
+}
+
+// Sign returns the signature of a body sent to an endpoint with the secret, the receivers
+// compare it to the SignatureHeader of the request with hmac.Equal
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,133 @@
+package webhook
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spool is a directory keeping the requests not sent, a file per request named by the time it was
+// kept, so that they are read in order, and by its number of events. It holds at most max bytes,
+// the oldest requests are removed to make room for a new one.
+type spool struct {
+	dir string
+	max int64
+
+	sync.Mutex
+	files []spoolFile
+	size  int64
+	seq   uint64
+}
+
+type spoolFile struct {
+	name   string
+	size   int64
+	events int
+}
+
+// openSpool creates the directory of a spool and reads the requests it already holds
+func openSpool(dir string, max int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &spool{dir: dir, max: max}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		f := spoolFile{name: entry.Name(), size: info.Size()}
+		var at, seq int64
+		fmt.Sscanf(f.name, "%d-%d-%d.json", &at, &seq, &f.events)
+		s.files = append(s.files, f)
+		s.size += info.Size()
+	}
+	sort.Slice(s.files, func(i, j int) bool {
+		return s.files[i].name < s.files[j].name
+	})
+	return s, nil
+}
+
+// push writes a request of events, it returns the number of requests and of events removed to make room for it
+func (s *spool) push(body []byte, events int) (int, int, error) {
+	size := int64(len(body))
+	if size > s.max {
+		return 0, 0, fmt.Errorf("request of %d bytes larger than the queue", size)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	requests, evicted := 0, 0
+	for s.size+size > s.max && len(s.files) > 0 {
+		requests++
+		evicted += s.files[0].events
+		s.removeLocked(s.files[0].name)
+	}
+
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d-%d.json", time.Now().UnixNano(), s.seq%1000000, events)
+	tmp := filepath.Join(s.dir, name+".tmp")
+	if err := os.WriteFile(tmp, body, 0o600); err != nil {
+		os.Remove(tmp)
+		return requests, evicted, err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		os.Remove(tmp)
+		return requests, evicted, err
+	}
+	s.files = append(s.files, spoolFile{name: name, size: size, events: events})
+	s.size += size
+	return requests, evicted, nil
+}
+
+// oldest returns the oldest request, its name is empty if the spool is empty
+func (s *spool) oldest() (spoolFile, []byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	for len(s.files) > 0 {
+		f := s.files[0]
+		body, err := os.ReadFile(filepath.Join(s.dir, f.name))
+		if os.IsNotExist(err) {
+			s.removeLocked(f.name)
+			continue
+		}
+		return f, body, err
+	}
+	return spoolFile{}, nil, nil
+}
+
+// remove removes a request, it does nothing if the request was already removed
+func (s *spool) remove(name string) {
+	s.Lock()
+	defer s.Unlock()
+	s.removeLocked(name)
+}
+
+func (s *spool) removeLocked(name string) {
+	for i, f := range s.files {
+		if f.name == name {
+			os.Remove(filepath.Join(s.dir, name))
+			s.files = append(s.files[:i], s.files[i+1:]...)
+			s.size -= f.size
+			return
+		}
+	}
+}
+
+// len returns the number of requests kept
+func (s *spool) len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.files)
+}
@@ -0,0 +1,273 @@
+package webhook
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/werbenhu/bridgemq/topics"
+)
+
+const (
+	EventClientConnected    = "client.connected"
+	EventClientDisconnected = "client.disconnected"
+	EventMessagePublished   = "message.published"
+	EventAgentJoined        = "agent.joined"
+	EventAgentLeft          = "agent.left"
+
+	// SignatureHeader carries the hex encoded hmac sha256 of the body, prefixed by sha256=,
+	// when the secret of the endpoint is set
+	SignatureHeader = "X-Bridgemq-Signature"
+
+	defaultBatchSize     = 100
+	defaultBatchLinger   = time.Second
+	defaultTimeout       = 5 * time.Second
+	defaultRetries       = 3
+	defaultBackoff       = time.Second
+	defaultMaxBackoff    = 30 * time.Second
+	defaultQueueSize     = 10000
+	defaultQueueMaxBytes = 64 * 1024 * 1024
+	defaultRetryInterval = 30 * time.Second
+)
+
+// Events are the types of the events sent to the endpoints
+var Events = []string{EventClientConnected, EventClientDisconnected, EventMessagePublished, EventAgentJoined, EventAgentLeft}
+
+// Endpoint is an http url receiving the events of the types in Events, every type if it is empty. The
+// message events are only sent for the topics matching Topics, so an endpoint without Topics receives none.
+type Endpoint struct {
+	URL     string            `json:"url"`
+	Events  []string          `json:"events"`
+	Topics  []string          `json:"topics"`
+	Secret  string            `json:"secret"`
+	Headers map[string]string `json:"headers"`
+}
+
+// wants reports whether the endpoint receives the event
+func (e *Endpoint) wants(ev *Event) bool {
+	if len(e.Events) > 0 && !contains(e.Events, ev.Type) {
+		return false
+	}
+	if ev.Type != EventMessagePublished {
+		return true
+	}
+	for _, filter := range e.Topics {
+		if topics.Match(filter, ev.Topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is an event of the broker or of the cluster, the endpoints receive a json array of events.
+// The payload of a message is base64 encoded.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+
+	// Agent is the agent reporting the event
+	Agent string `json:"agent"`
+
+	// ClientId, Username, Remote and Reason describe the client of a client event, ClientId is
+	// also the publisher of a message
+	ClientId string `json:"client_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	Remote   string `json:"remote,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+
+	// Peer and Addr describe the agent of an agent event
+	Peer string `json:"peer,omitempty"`
+	Addr string `json:"addr,omitempty"`
+
+	Topic   string `json:"topic,omitempty"`
+	Payload []byte `json:"payload,omitempty"`
+	Qos     byte   `json:"qos,omitempty"`
+	Retain  bool   `json:"retain,omitempty"`
+}
+
+type Opt struct {
+	Endpoints []Endpoint
+
+	// BatchSize is the maximum number of events sent in a request, a request is sent once it holds
+	// BatchSize events or BatchLinger after its first event
+	BatchSize   int
+	BatchLinger time.Duration
+
+	// Timeout bounds a request
+	Timeout time.Duration
+
+	// Retries is the number of times a failed request is retried with a backoff doubled from Backoff
+	// up to MaxBackoff, the requests rejected with a 4xx status other than 408 and 429 are not retried.
+	// The requests are not retried if it is 0, they are retried 3 times if it is negative.
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// QueueSize is the number of events waiting to be sent to an endpoint, the events are dropped while it is full
+	QueueSize int
+
+	// QueueDir keeps the requests which still fail after their retries on disk, they are sent again in
+	// order every RetryInterval. The requests of an endpoint use at most QueueMaxBytes, the oldest are
+	// dropped beyond. The failed requests are dropped if it is empty.
+	QueueDir      string
+	QueueMaxBytes int
+	RetryInterval time.Duration
+
+	// Client sends the requests, a client with Timeout is used if it is nil
+	Client *http.Client
+
+	Logger *zerolog.Logger
+}
+
+// Validate checks the endpoints and the durations
+func (o *Opt) Validate() error {
+	for i, e := range o.Endpoints {
+		u, err := url.Parse(e.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("endpoint %d url %q must be an http or https url", i, e.URL)
+		}
+		for _, ev := range e.Events {
+			if !contains(Events, ev) {
+				return fmt.Errorf("endpoint %d unknown event %q", i, ev)
+			}
+		}
+	}
+	if o.BatchSize < 0 || o.QueueSize < 0 || o.QueueMaxBytes < 0 {
+		return fmt.Errorf("batch size, queue size and queue max bytes can not be negative")
+	}
+	if o.BatchLinger < 0 || o.Timeout < 0 || o.Backoff < 0 || o.MaxBackoff < 0 || o.RetryInterval < 0 {
+		return fmt.Errorf("batch linger, timeout, backoff and retry interval can not be negative")
+	}
+	return nil
+}
+
+// Sink sends the events to the endpoints which want them, every endpoint has its own queue so
+// that a slow or failing endpoint does not delay the others
+type Sink struct {
+	opts      *Opt
+	logger    *zerolog.Logger
+	endpoints []*endpoint
+
+	// messages is set if an endpoint receives the message events
+	messages bool
+}
+
+// New creates a sink, the events emitted before Start are dropped
+func New(opts *Opt) *Sink {
+	s := &Sink{
+		opts:   opts,
+		logger: opts.Logger,
+	}
+	if s.logger == nil {
+		logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
+		s.logger = &logger
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	if opts.BatchLinger <= 0 {
+		opts.BatchLinger = defaultBatchLinger
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.Retries < 0 {
+		opts.Retries = defaultRetries
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = defaultBackoff
+	}
+	if opts.MaxBackoff < opts.Backoff {
+		opts.MaxBackoff = defaultMaxBackoff
+		if opts.MaxBackoff < opts.Backoff {
+			opts.MaxBackoff = opts.Backoff
+		}
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultQueueSize
+	}
+	if opts.QueueMaxBytes <= 0 {
+		opts.QueueMaxBytes = defaultQueueMaxBytes
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = defaultRetryInterval
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: opts.Timeout}
+	}
+
+	for i := range opts.Endpoints {
+		s.endpoints = append(s.endpoints, newEndpoint(&opts.Endpoints[i], opts, s.logger))
+		if len(opts.Endpoints[i].Topics) > 0 {
+			s.messages = true
+		}
+	}
+	return s
+}
+
+// Start opens the queues on disk and starts sending the events
+func (s *Sink) Start() error {
+	for _, e := range s.endpoints {
+		if err := e.open(); err != nil {
+			return err
+		}
+	}
+	for _, e := range s.endpoints {
+		e.start()
+	}
+	return nil
+}
+
+// Stop sends the events queued, the requests which fail are kept on disk
+func (s *Sink) Stop() {
+	for _, e := range s.endpoints {
+		e.stop()
+	}
+}
+
+// Messages reports whether an endpoint receives the message events
+func (s *Sink) Messages() bool {
+	return s.messages
+}
+
+// Emit queues the event for the endpoints which want it, it never blocks
+func (s *Sink) Emit(ev *Event) {
+	for _, e := range s.endpoints {
+		if e.Endpoint.wants(ev) {
+			e.enqueue(ev)
+		}
+	}
+}
+
+// Stats counts the events of an endpoint
+type Stats struct {
+	URL string
+
+	// Sent and Dropped are the events sent and dropped, Queued the events in memory
+	// and Spooled the requests kept on disk
+	Sent    uint64
+	Dropped uint64
+	Queued  int
+	Spooled int
+}
+
+// Stats returns the counters of every endpoint
+func (s *Sink) Stats() []Stats {
+	stats := make([]Stats, 0, len(s.endpoints))
+	for _, e := range s.endpoints {
+		stats = append(stats, e.stats())
+	}
+	return stats
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,299 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// receiver records the requests of an endpoint and answers them with the statuses in order,
+// the last one is repeated
+type receiver struct {
+	*httptest.Server
+
+	sync.Mutex
+	statuses []int
+	bodies   [][]byte
+	headers  []http.Header
+}
+
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	r := &receiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.Lock()
+		defer r.Unlock()
+		r.bodies = append(r.bodies, body)
+		r.headers = append(r.headers, req.Header.Clone())
+		status := r.statuses[0]
+		if len(r.statuses) > 1 {
+			r.statuses = r.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// set answers the next requests with status
+func (r *receiver) set(status int) {
+	r.Lock()
+	defer r.Unlock()
+	r.statuses = []int{status}
+}
+
+func (r *receiver) requests() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.bodies)
+}
+
+// batches returns the number of events of every request
+func (r *receiver) batches(t *testing.T) []int {
+	r.Lock()
+	defer r.Unlock()
+	sizes := make([]int, 0, len(r.bodies))
+	for _, body := range r.bodies {
+		var events []*Event
+		if err := json.Unmarshal(body, &events); err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, len(events))
+	}
+	return sizes
+}
+
+// waitStats waits until the stats of the first endpoint match done, stop aborts the backoffs
+func waitStats(t *testing.T, s *Sink, done func(Stats) bool) Stats {
+	deadline := time.Now().Add(2 * time.Second)
+	for !done(s.Stats()[0]) {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected stats %+v", s.Stats()[0])
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return s.Stats()[0]
+}
+
+func newSink(opts *Opt) *Sink {
+	logger := zerolog.Nop()
+	opts.Logger = &logger
+	if opts.Backoff == 0 {
+		opts.Backoff = time.Millisecond
+	}
+	return New(opts)
+}
+
+func event(i int) *Event {
+	return &Event{Type: EventClientConnected, Time: time.Unix(1700000000, 0).UTC(), Agent: "a", ClientId: string(rune('a' + i%26))}
+}
+
+func TestSign(t *testing.T) {
+	r := newReceiver(t, http.StatusOK)
+	s := newSink(&Opt{Endpoints: []Endpoint{
+		{URL: r.URL, Secret: "secret", Headers: map[string]string{"Authorization": "Bearer token"}},
+		{URL: r.URL},
+	}})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	s.Emit(event(0))
+	s.Stop()
+
+	if r.requests() != 2 {
+		t.Fatalf("expected 2 requests, got %d", r.requests())
+	}
+	signed := 0
+	for i, h := range r.headers {
+		signature := h.Get(SignatureHeader)
+		if signature == "" {
+			continue
+		}
+		signed++
+		if !hmac.Equal([]byte(signature), []byte(Sign("secret", r.bodies[i]))) {
+			t.Fatalf("signature %s does not match the body", signature)
+		}
+		if h.Get("Authorization") != "Bearer token" || h.Get("Content-Type") != "application/json" {
+			t.Fatalf("unexpected headers %v", h)
+		}
+	}
+	if signed != 1 {
+		t.Fatalf("expected only the request of the endpoint with a secret signed, got %d", signed)
+	}
+	if Sign("secret", []byte("body")) == Sign("other", []byte("body")) {
+		t.Fatal("expected the signature to depend on the secret")
+	}
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		retries  int
+		statuses []int
+		requests int
+		sent     uint64
+	}{
+		{"sent", 2, []int{http.StatusNoContent}, 1, 1},
+		{"server error retried", 2, []int{http.StatusBadGateway, http.StatusOK}, 2, 1},
+		{"request timeout retried", 2, []int{http.StatusRequestTimeout, http.StatusOK}, 2, 1},
+		{"too many requests retried", 2, []int{http.StatusTooManyRequests, http.StatusOK}, 2, 1},
+		{"bad request dropped", 2, []int{http.StatusBadRequest, http.StatusOK}, 1, 0},
+		{"unauthorized dropped", 2, []int{http.StatusUnauthorized, http.StatusOK}, 1, 0},
+		{"retries exhausted", 2, []int{http.StatusServiceUnavailable}, 3, 0},
+		{"no retries", 0, []int{http.StatusServiceUnavailable, http.StatusOK}, 1, 0},
+		{"default retries", -1, []int{http.StatusServiceUnavailable}, defaultRetries + 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newReceiver(t, tt.statuses...)
+			s := newSink(&Opt{Endpoints: []Endpoint{{URL: r.URL}}, BatchSize: 1, Retries: tt.retries})
+			if err := s.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop()
+			s.Emit(event(0))
+
+			stats := waitStats(t, s, func(s Stats) bool { return s.Sent+s.Dropped > 0 })
+			if r.requests() != tt.requests {
+				t.Fatalf("expected %d requests, got %d", tt.requests, r.requests())
+			}
+			if stats.Sent != tt.sent || stats.Dropped != 1-tt.sent {
+				t.Fatalf("unexpected stats %+v", stats)
+			}
+		})
+	}
+}
+
+func TestBatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		linger  time.Duration
+		events  int
+		batches []int
+	}{
+		{"full batches", 3, time.Hour, 7, []int{3, 3, 1}},
+		{"single events", 1, time.Hour, 3, []int{1, 1, 1}},
+		{"linger", 100, 20 * time.Millisecond, 5, []int{5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newReceiver(t, http.StatusOK)
+			s := newSink(&Opt{Endpoints: []Endpoint{{URL: r.URL}}, BatchSize: tt.size, BatchLinger: tt.linger})
+			if err := s.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop()
+			for i := 0; i < tt.events; i++ {
+				s.Emit(event(i))
+			}
+
+			// the last batch is sent by the linger, or by stop if the linger is too long
+			if tt.linger < time.Second {
+				deadline := time.Now().Add(time.Second)
+				for r.requests() < len(tt.batches) && time.Now().Before(deadline) {
+					time.Sleep(5 * time.Millisecond)
+				}
+			} else {
+				s.Stop()
+			}
+			got := r.batches(t)
+			if len(got) != len(tt.batches) {
+				t.Fatalf("expected batches %v, got %v", tt.batches, got)
+			}
+			for i := range got {
+				if got[i] != tt.batches[i] {
+					t.Fatalf("expected batches %v, got %v", tt.batches, got)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchLinger(t *testing.T) {
+	r := newReceiver(t, http.StatusOK)
+	s := newSink(&Opt{Endpoints: []Endpoint{{URL: r.URL}}, BatchSize: 2, BatchLinger: 50 * time.Millisecond})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// the batch sent by the linger and the full batch restart the linger of the next batch
+	s.Emit(event(0))
+	time.Sleep(60 * time.Millisecond)
+	for r.requests() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	s.Emit(event(1))
+	s.Emit(event(2))
+	s.Emit(event(3))
+	time.Sleep(20 * time.Millisecond)
+	if got := r.batches(t); len(got) != 2 || got[1] != 2 {
+		t.Fatalf("expected batches [1 2] before the linger, got %v", got)
+	}
+	time.Sleep(80 * time.Millisecond)
+	if got := r.batches(t); len(got) != 3 || got[2] != 1 {
+		t.Fatalf("expected batches [1 2 1] after the linger, got %v", got)
+	}
+}
+
+func TestSpool(t *testing.T) {
+	body, err := json.Marshal([]*Event{event(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	r := newReceiver(t, http.StatusServiceUnavailable)
+
+	// the spool holds 2 requests of a single event, the oldest are dropped to make room for the new ones
+	opts := func(url string) *Opt {
+		return &Opt{
+			Endpoints:     []Endpoint{{URL: url}},
+			BatchSize:     1,
+			Retries:       1,
+			QueueDir:      dir,
+			QueueMaxBytes: 2*len(body) + 1,
+			RetryInterval: 10 * time.Millisecond,
+		}
+	}
+	s := newSink(opts(r.URL))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		s.Emit(event(i))
+	}
+	waitStats(t, s, func(s Stats) bool { return s.Dropped == 3 })
+	s.Stop()
+	if stats := s.Stats()[0]; stats.Spooled != 2 || stats.Sent != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// the requests kept are sent again by the sink started on the same spool once the endpoint is up
+	r.set(http.StatusOK)
+	failed := r.requests()
+	s = newSink(opts(r.URL))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	deadline := time.Now().Add(time.Second)
+	for s.Stats()[0].Spooled > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := s.Stats()[0]; stats.Spooled != 0 || stats.Sent != 2 {
+		t.Fatalf("expected the spooled requests sent, got %+v", stats)
+	}
+	if sent := r.requests() - failed; sent != 2 {
+		t.Fatalf("expected the 2 spooled requests sent, got %d", sent)
+	}
+}